@@ -25,6 +25,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"math"
 	"sort"
 	"time"
@@ -64,9 +65,31 @@ type Aggregator interface {
 type State struct {
 	t          DataPointQueuer
 	m          map[string]*aggregation
+	free       []*aggregation // flushed aggregations, for reuse
 	lastFlush  time.Time
 	Thresholds []int // List of percentiles for CmdAppend
 	AppendAttr string
+	// How long the value of a node is summed by CmdNodeSum
+	// after it was received, 0 means until the next flush.
+	NodeSumWindow time.Duration
+	nodes         map[string]*nodeSum // kept across flushes
+	// If ZeroFillCounters is true, a CmdAdd counter which was
+	// once flushed is flushed as 0 in every period without any
+	// value for it, rather than not at all. Counters are then
+	// remembered for the life of the aggregator.
+	ZeroFillCounters bool
+	counters         map[string]serde.Ident // flushed counters, only with ZeroFillCounters
+}
+
+// nodeSum is the latest value of a CmdNodeSum from each node.
+type nodeSum struct {
+	ident  serde.Ident
+	values map[string]nodeValue
+}
+
+type nodeValue struct {
+	value float64
+	ts    time.Time
 }
 
 // Returns a new aggregator. The only argument needs to provide a
@@ -74,55 +97,124 @@ type State struct {
 // queue the aggregated points. The returned aggregator state has
 // Thresholds set to {90}.
 func NewAggregator(t DataPointQueuer) *State {
+	return NewAggregatorSize(t, 0)
+}
+
+// NewAggregatorSize is NewAggregator for about size distinct idents
+// aggregated per flush period, which it allocates for upfront rather
+// than growing as the idents arrive. Either way, the memory is
+// reused from one period to the next.
+func NewAggregatorSize(t DataPointQueuer, size int) *State {
+	if size < 0 {
+		size = 0
+	}
 	return &State{
 		t:          t,
-		m:          make(map[string]*aggregation),
+		m:          make(map[string]*aggregation, size),
+		free:       make([]*aggregation, 0, size),
 		lastFlush:  time.Now(),
 		Thresholds: []int{90},
 		AppendAttr: "value",
 	}
 }
 
+// get returns the aggregation at key ident, creating it as kind if
+// not existing, reusing a flushed one if there is any.
+func (a *State) get(ident serde.Ident, key string, kind aggKind) *aggregation {
+	if agg := a.m[key]; agg != nil {
+		return agg
+	}
+	var agg *aggregation
+	if n := len(a.free); n > 0 {
+		agg, a.free = a.free[n-1], a.free[:n-1]
+		*agg = aggregation{list: agg.list[:0]}
+	} else {
+		agg = &aggregation{}
+	}
+	agg.ident, agg.kind = ident, kind
+	if kind == aggKindList && agg.list == nil {
+		agg.list = make([]float64, 0, 2)
+	}
+	a.m[key] = agg
+	return agg
+}
+
+// reset clears all aggregations, keeping them (and the map) for
+// reuse.
+func (a *State) reset() {
+	for key, agg := range a.m {
+		agg.ident = nil
+		a.free = append(a.free, agg)
+		delete(a.m, key)
+	}
+}
+
 // Add to an already existing value at key ident, created as
 // 0.0/aggKindValue if not existing.
 func (a *State) add(ident serde.Ident, value float64) {
-	key := ident.String()
-	if a.m[key] == nil {
-		a.m[key] = &aggregation{ident: ident, kind: aggKindValue}
-	}
-	a.m[key].value += value
+	a.get(ident, ident.String(), aggKindValue).value += value
 }
 
 // Add to an already existing value at key ident, created as
 // 0.0/aggKindGauge if not existing.
 func (a *State) addGauge(ident serde.Ident, value float64) {
-	key := ident.String()
-	if a.m[key] == nil {
-		a.m[key] = &aggregation{ident: ident, kind: aggKindGauge}
-	}
-	a.m[key].value += value
+	a.get(ident, ident.String(), aggKindGauge).value += value
 }
 
 // Set the value at key ident overwriting any previous, created as
 // 0.0./aggKindGauge if not existing
 func (a *State) setGauge(ident serde.Ident, value float64) {
-	key := ident.String()
-	if a.m[key] == nil {
-		a.m[key] = &aggregation{ident: ident, kind: aggKindGauge, value: value}
-	} else {
-		a.m[key].value = value
-	}
+	a.get(ident, ident.String(), aggKindGauge).value = value
 }
 
 // Append to values at key ident, created as aggKindList if not
 // existing.
 func (a *State) append(ident serde.Ident, value float64) {
+	agg := a.get(ident, ident.String(), aggKindList)
+	if agg.kind == aggKindList {
+		agg.list = append(agg.list, value)
+	}
+}
+
+// Set the value of the node at key ident, overwriting the previous
+// value of that node.
+func (a *State) setNodeSum(ident serde.Ident, node string, value float64, ts time.Time) {
+	if a.nodes == nil {
+		a.nodes = make(map[string]*nodeSum)
+	}
 	key := ident.String()
-	if a.m[key] == nil {
-		a.m[key] = &aggregation{ident: ident, kind: aggKindList, list: make([]float64, 0, 2)}
+	ns := a.nodes[key]
+	if ns == nil {
+		ns = &nodeSum{ident: ident, values: make(map[string]nodeValue)}
+		a.nodes[key] = ns
 	}
-	if a.m[key].list != nil {
-		a.m[key].list = append(a.m[key].list, value)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	ns.values[node] = nodeValue{value: value, ts: ts}
+}
+
+// flushNodeSums queues the sum of the values of the nodes which
+// are recent enough, forgetting the rest.
+func (a *State) flushNodeSums(now time.Time) {
+	cutoff := a.lastFlush
+	if a.NodeSumWindow > 0 {
+		cutoff = now.Add(-a.NodeSumWindow)
+	}
+	for key, ns := range a.nodes {
+		var sum float64
+		for node, nv := range ns.values {
+			if nv.ts.Before(cutoff) {
+				delete(ns.values, node)
+				continue
+			}
+			sum += nv.value
+		}
+		if len(ns.values) == 0 {
+			delete(a.nodes, key)
+			continue
+		}
+		a.t.QueueDataPoint(ns.ident, now, sum)
 	}
 }
 
@@ -139,6 +231,8 @@ func (a *State) ProcessCmd(cmd *Command) {
 		a.setGauge(cmd.ident, cmd.value)
 	case CmdAppend:
 		a.append(cmd.ident, cmd.value)
+	case CmdNodeSum:
+		a.setNodeSum(cmd.ident, cmd.node, cmd.value, cmd.ts)
 	}
 }
 
@@ -165,6 +259,12 @@ func (a *State) Flush(now time.Time) {
 			if now.After(a.lastFlush) {
 				a.t.QueueDataPoint(agg.ident, now, agg.value/now.Sub(a.lastFlush).Seconds())
 			}
+			if a.ZeroFillCounters {
+				if a.counters == nil {
+					a.counters = make(map[string]serde.Ident)
+				}
+				a.counters[agg.ident.String()] = agg.ident
+			}
 
 		case aggKindGauge:
 			// store as is
@@ -206,8 +306,36 @@ func (a *State) Flush(now time.Time) {
 		}
 	}
 
-	// clear the map
-	a.m = make(map[string]*aggregation)
+	a.flushNodeSums(now)
+	if a.ZeroFillCounters {
+		a.zeroFillCounters(now)
+	}
+
+	a.reset()
+	a.lastFlush = now
+}
+
+// zeroFillCounters queues a 0 for every remembered counter without
+// an aggregation in this period.
+func (a *State) zeroFillCounters(now time.Time) {
+	if !now.After(a.lastFlush) {
+		return
+	}
+	for key, ident := range a.counters {
+		if agg := a.m[key]; agg == nil || agg.kind != aggKindValue {
+			a.t.QueueDataPoint(ident, now, 0)
+		}
+	}
+}
+
+// Discard clears all aggregations without queuing anything, as if
+// they were flushed at now. If now is zero, time.Now() is used. The
+// values of CmdNodeSum are kept, they are not per flush period.
+func (a *State) Discard(now time.Time) {
+	if now.IsZero() {
+		now = time.Now()
+	}
+	a.reset()
 	a.lastFlush = now
 }
 
@@ -218,6 +346,7 @@ const (
 	CmdAddGauge               // Add the value, the flushed value is the sum as is (e.g. total traffic for all routers).
 	CmdSetGauge               // Overwrite the value, the flushed value is the last value as is.
 	CmdAppend                 // Append the value to a slice. The flushed values will be upper/lower/sum/mean and Threshold percentiles.
+	CmdNodeSum                // Overwrite the value of the node, the flushed value is the sum of the latest value of every node, see NewNodeSumCommand.
 )
 
 // An aggregator command. Use NewCommand() to create one.
@@ -226,7 +355,8 @@ type Command struct {
 	ident serde.Ident
 	value float64
 	ts    time.Time
-	Hops  int // For cluster forwarding
+	node  string // CmdNodeSum only
+	Hops  int    // For cluster forwarding
 }
 
 func (ac *Command) GobEncode() ([]byte, error) {
@@ -243,6 +373,7 @@ func (ac *Command) GobEncode() ([]byte, error) {
 	check(enc.Encode(ac.value))
 	check(enc.Encode(ac.ts))
 	check(enc.Encode(ac.Hops))
+	check(enc.Encode(ac.node))
 	if err != nil {
 		return nil, err
 	}
@@ -262,6 +393,10 @@ func (ac *Command) GobDecode(b []byte) error {
 	check(dec.Decode(&ac.value))
 	check(dec.Decode(&ac.ts))
 	check(dec.Decode(&ac.Hops))
+	// A command from a node which predates CmdNodeSum ends here
+	if er := dec.Decode(&ac.node); er != io.EOF {
+		check(er)
+	}
 	return err
 }
 
@@ -270,3 +405,13 @@ func (ac *Command) GobDecode(b []byte) error {
 func NewCommand(cmd AggCmd, ident serde.Ident, value float64) *Command {
 	return &Command{cmd: cmd, ident: ident, value: value, ts: time.Now()}
 }
+
+// Create a CmdNodeSum command, which sets the value of the gauge as
+// measured by node (e.g. the number of connections to it) so that the
+// aggregator can flush the cluster-wide sum: the sum of the latest
+// value received from every node within State.NodeSumWindow. The
+// values are kept from one flush to the next, a node which stops
+// sending drops out of the sum once its value is too old.
+func NewNodeSumCommand(ident serde.Ident, node string, value float64) *Command {
+	return &Command{cmd: CmdNodeSum, ident: ident, value: value, ts: time.Now(), node: node}
+}
@@ -78,11 +78,20 @@ type Cluster struct {
 	meta      []byte
 	dds       map[string]*ddEntry
 	snd, rcv  chan *Msg // dds messages
+	relinq    chan *Msg // relinquish messages, see ddMessages
 	copies    int
 	rpcPort   int
 	rpc       net.Listener
 	joined    bool
 	ncache    map[*memberlist.Node]*Node
+
+	msgMu      sync.RWMutex    // guards msgComp and msgCompMin
+	msgComp    *MsgCompression // see SetMsgCompression, nil means none
+	msgCompMin int             // smaller bodies are not compressed
+
+	leaseMu  sync.Mutex
+	leaseDur time.Duration     // see SetLeaseDuration
+	leases   map[string]*lease // by "type:id", see LeaseHolder
 }
 
 // NewCluster creates a new Cluster with reasonable defaults.
@@ -144,6 +153,8 @@ func NewClusterBind(baddr string, bport int, aaddr string, aport int, rpcport in
 	}
 
 	c.snd, c.rcv = c.RegisterMsgType()
+	c.relinq = make(chan *Msg, 128)
+	go c.ddMessages()
 
 	rpc.Register(&ClusterRPC{c})
 	if c.rpc, err = net.Listen("tcp", fmt.Sprintf("%s:%d", baddr, c.rpcPort)); err != nil {
@@ -319,8 +330,8 @@ func (sn sortableNodes) Swap(i, j int) {
 // structure. The nodes of the cluster must call RegisterMsgType in
 // exact same order because that is what determines the internal
 // message id and the channel to which it will be passed. The message
-// is sent to the destination specified in Msg.Dst. Messages are
-// compressed using flate.
+// is sent to the destination specified in Msg.Dst. The message body
+// is compressed as per SetMsgCompression.
 func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 
 	snd, rcv = make(chan *Msg, 128), make(chan *Msg, 128)
@@ -350,6 +361,7 @@ func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 
 			msg.Src = c.LocalNode()
 			msg.Id = id
+			c.compress(msg)
 
 			var resp Msg
 			if err := msg.Dst.rpc.Call("ClusterRPC.Message", msg, &resp); err != nil {
@@ -539,6 +551,7 @@ type Msg struct {
 	Id       int
 	Dst, Src *Node
 	Body     []byte
+	Enc      string // the compression of Body, empty means none
 }
 
 // NewMsg creates a Msg from a payload which is gob-encodable
@@ -566,7 +579,12 @@ func (m *Msg) bytes() []byte {
 
 // implement gob.GobDecoder interface.
 func (m *Msg) Decode(dst interface{}) error {
-	if err := gob.NewDecoder(bytes.NewBuffer(m.Body)).Decode(dst); err != nil {
+	body, err := m.body()
+	if err != nil {
+		log.Printf("Msg.Decode() decompression error: %v", err)
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(body)).Decode(dst); err != nil {
 		log.Printf("Msg.Decode() decoding error: %v", err)
 		return err
 	}
@@ -674,6 +692,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 
 	var waitDdsLock sync.RWMutex
 	waitDds := make(map[string]DistDatum)
+	waitFrom := make(map[string]*Node) // the previous node, see grantLease
 
 	for _, dde := range c.dds {
 		wg.Add(1)
@@ -691,8 +710,11 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			if len(dde.nodes) > 0 {
 				oldNode = dde.nodes[0]
 			}
+			ln := c.LocalNode()
+			if newNode == nil || newNode.Name() != ln.Name() {
+				c.endLease(ddKey(dde.dd), nil) // not ours to wait for anymore
+			}
 			if newNode == nil || oldNode.Name() != newNode.Name() {
-				ln := c.LocalNode()
 				if ln.Name() == oldNode.Name() { // we are the ex-node
 					if newNode != nil && debug {
 						log.Printf("Transition(): Id %s:%d (%s) is moving away to node %s", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), newNode.Name())
@@ -716,7 +738,8 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 					// Add to the list of dds to wait on, but only if there existed nodes
 					waitDdsLock.Lock()
 					if oldNode.Name() != "<nil>" {
-						waitDds[fmt.Sprintf("%s:%d", dde.dd.Type(), dde.dd.Id())] = dde.dd
+						waitDds[ddKey(dde.dd)] = dde.dd
+						waitFrom[ddKey(dde.dd)] = oldNode
 					}
 					waitDdsLock.Unlock()
 				}
@@ -748,11 +771,13 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 
 			var m *Msg
 			select {
-			case m = <-c.rcv:
+			case m = <-c.relinq:
 			case <-tmout:
 				log.Printf("Transition(): WARNING: Relinquish wait timeout! Continuing. Some data is likely lost.")
 				// We should still call Acquire on the ones we've been waiting for as we are ultimately taking them over
-				for _, dd := range waitDds {
+				for key, dd := range waitDds {
+					// Their previous node may still be saving them, see LeaseHolder
+					c.grantLease(key, waitFrom[key], time.Now())
 					log.Printf("Transition(): Calling Acquire for %s:%d (%s).", dd.Type(), dd.Id(), dd.GetName())
 					if err := dd.Acquire(); err != nil {
 						log.Printf("Transition(): Warning: Acquire() failed for id %s:%d (%s) with: %v", dd.Type(), dd.Id(), dd.GetName(), err)
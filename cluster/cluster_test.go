@@ -3,7 +3,10 @@ package cluster
 import (
 	"fmt"
 	"sync"
+	"testing"
 	"time"
+
+	"github.com/hashicorp/memberlist"
 )
 
 // This example joins a sole node cluster, and shows how to watch
@@ -47,3 +50,123 @@ func ExampleCluster_output() {
 
 	// Output: A cluster change occurred, running a transition.
 }
+
+// forwardedDP resembles a data point as forwarded by the receiver.
+type forwardedDP struct {
+	Ident     map[string]string
+	TimeStamp time.Time
+	Value     float64
+	Hops      int
+}
+
+func Test_Msg_compression(t *testing.T) {
+	c := &Cluster{}
+	if err := c.SetMsgCompression("bogus", 0); err == nil {
+		t.Errorf("SetMsgCompression: expected an error for an unknown compression")
+	}
+	if err := c.SetMsgCompression("flate", 64); err != nil {
+		t.Fatalf("SetMsgCompression: %v", err)
+	}
+
+	var raw, sent, compressed int
+	ts := time.Unix(1500000000, 0)
+	for i := 0; i < 1000; i++ {
+		dp := &forwardedDP{
+			Ident:     map[string]string{"name": fmt.Sprintf("servers.web%02d.cpu.%d.user", i%50, i%8), "dc": "us-east-1", "env": "prod"},
+			TimeStamp: ts.Add(time.Duration(i) * time.Second),
+			Value:     float64(i%100) * 1.5,
+		}
+		m, err := NewMsg(nil, dp)
+		if err != nil {
+			t.Fatalf("NewMsg: %v", err)
+		}
+		raw += len(m.Body)
+		c.compress(m)
+		sent += len(m.Body)
+		if m.Enc != "" {
+			compressed++
+		}
+
+		var got forwardedDP
+		if err := m.Decode(&got); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if got.Ident["name"] != dp.Ident["name"] || !got.TimeStamp.Equal(dp.TimeStamp) || got.Value != dp.Value {
+			t.Fatalf("Decode: expected %v, got %v", dp, got)
+		}
+	}
+	t.Logf("forwarded %d points: %d bytes raw, %d bytes sent (%.0f%% less), %d messages compressed",
+		1000, raw, sent, 100*float64(raw-sent)/float64(raw), compressed)
+	if compressed == 0 || sent >= raw {
+		t.Errorf("compression: expected fewer bytes sent, got %d of %d", sent, raw)
+	}
+
+	// Below the threshold messages are sent as is
+	c.SetMsgCompression("flate", 1<<20)
+	m, _ := NewMsg(nil, &forwardedDP{Ident: map[string]string{"name": "foo"}})
+	if c.compress(m); m.Enc != "" {
+		t.Errorf("compression: a small message should not be compressed")
+	}
+}
+
+type fakeDd struct{ id int64 }
+
+func (dd *fakeDd) Id() int64         { return dd.id }
+func (dd *fakeDd) Type() string      { return "Fake" }
+func (dd *fakeDd) Relinquish() error { return nil }
+func (dd *fakeDd) Acquire() error    { return nil }
+func (dd *fakeDd) GetName() string   { return "fake" }
+
+func Test_Cluster_lease(t *testing.T) {
+	c := &Cluster{dds: make(map[string]*ddEntry), snd: make(chan *Msg, 1), relinq: make(chan *Msg, 1)}
+	prev := &Node{Node: &memberlist.Node{Name: "prev"}}
+	other := &Node{Node: &memberlist.Node{Name: "other"}}
+	dd := &fakeDd{id: 7}
+	key := ddKey(dd)
+	start := time.Unix(1000, 0)
+
+	c.grantLease(key, prev, start)
+	if c.LeaseHolder(dd) != nil {
+		t.Errorf("LeaseHolder: leases should be disabled by default")
+	}
+
+	c.SetLeaseDuration(10 * time.Second)
+	c.grantLease(key, prev, start)
+	if lh := c.activeLease(key, start.Add(time.Second)); lh != prev || len(c.snd) != 0 {
+		t.Errorf("activeLease: expected prev and no message sent, got %v and %d messages", lh.Name(), len(c.snd))
+	}
+
+	// In the second half of the lease prev is asked, once
+	c.activeLease(key, start.Add(6*time.Second))
+	c.activeLease(key, start.Add(7*time.Second))
+	if len(c.snd) != 1 {
+		t.Fatalf("activeLease: expected a lease query, got %d messages", len(c.snd))
+	}
+	if m := <-c.snd; m.Dst != prev || string(m.Body) != leaseQuery+key {
+		t.Errorf("activeLease: unexpected query %q to %s", m.Body, m.Dst.Name())
+	}
+
+	// An answer from another node is ignored, prev renews it
+	c.handleDdMsg(&Msg{Src: other, Body: []byte(leaseGone + key)}, start.Add(8*time.Second))
+	c.handleDdMsg(&Msg{Src: prev, Body: []byte(leaseHeld + key)}, start.Add(8*time.Second))
+	if lh := c.activeLease(key, start.Add(12*time.Second)); lh != prev {
+		t.Errorf("activeLease: expected the lease renewed until 18s")
+	}
+	if lh := c.activeLease(key, start.Add(18*time.Second)); lh != nil {
+		t.Errorf("activeLease: expected the lease to expire, held by %s", lh.Name())
+	}
+
+	// A (late) relinquish ends it and is passed on to Transition
+	c.grantLease(key, prev, start)
+	c.handleDdMsg(&Msg{Src: prev, Body: []byte(key)}, start)
+	if lh := c.activeLease(key, start); lh != nil || len(c.relinq) != 1 {
+		t.Errorf("handleDdMsg: expected a relinquish to end the lease and be passed on")
+	}
+
+	// So does prev saying it no longer owns it
+	c.grantLease(key, prev, start)
+	c.handleDdMsg(&Msg{Src: prev, Body: []byte(leaseGone + key)}, start)
+	if lh := c.activeLease(key, start); lh != nil {
+		t.Errorf("handleDdMsg: expected lease- to end the lease")
+	}
+}
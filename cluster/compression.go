@@ -0,0 +1,122 @@
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// A MsgCompression compresses the bodies of messages sent to other
+// nodes. A compressed message names its compression, which is how
+// the receiving node knows how to decompress it, thus every node
+// must have the compressions used by any of the nodes registered,
+// but the nodes need not agree on which one to use.
+type MsgCompression struct {
+	Name       string
+	Compress   func([]byte) ([]byte, error)
+	Decompress func([]byte) ([]byte, error)
+}
+
+var flateCompression = &MsgCompression{
+	Name: "flate",
+	Compress: func(b []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		z, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := z.Write(b); err != nil {
+			return nil, err
+		}
+		if err := z.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	Decompress: func(b []byte) ([]byte, error) {
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+	},
+}
+
+var msgCompressions = struct {
+	sync.RWMutex
+	byName map[string]*MsgCompression
+}{byName: map[string]*MsgCompression{"flate": flateCompression}}
+
+// RegisterMsgCompression makes a message compression available by
+// its name, replacing any previously registered with the same
+// name. Only flate is built in, others (e.g. snappy or zstd) can be
+// registered by the program using their respective packages.
+func RegisterMsgCompression(mc *MsgCompression) {
+	msgCompressions.Lock()
+	defer msgCompressions.Unlock()
+	msgCompressions.byName[mc.Name] = mc
+}
+
+func lookupMsgCompression(name string) *MsgCompression {
+	msgCompressions.RLock()
+	defer msgCompressions.RUnlock()
+	return msgCompressions.byName[name]
+}
+
+// SetMsgCompression makes the messages this node sends to other
+// nodes compressed using the named compression, except for those
+// whose body is shorter than min bytes, for which the overhead is
+// not worth it. An empty name or "none" turns compression off. It can
+// be called at any time.
+func (c *Cluster) SetMsgCompression(name string, min int) error {
+	var mc *MsgCompression
+	if name != "" && name != "none" {
+		if mc = lookupMsgCompression(name); mc == nil {
+			return fmt.Errorf("unknown message compression: %q", name)
+		}
+	}
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	c.msgComp, c.msgCompMin = mc, min
+	return nil
+}
+
+// compress compresses the body of m as per SetMsgCompression. A body
+// which would not get any smaller is left as is.
+func (c *Cluster) compress(m *Msg) {
+	c.msgMu.RLock()
+	mc, min := c.msgComp, c.msgCompMin
+	c.msgMu.RUnlock()
+	if mc == nil || m.Enc != "" || len(m.Body) < min {
+		return
+	}
+	b, err := mc.Compress(m.Body)
+	if err != nil || len(b) >= len(m.Body) {
+		return
+	}
+	m.Body, m.Enc = b, mc.Name
+}
+
+// body returns the body of m, decompressed.
+func (m *Msg) body() ([]byte, error) {
+	if m.Enc == "" {
+		return m.Body, nil
+	}
+	mc := lookupMsgCompression(m.Enc)
+	if mc == nil {
+		return nil, fmt.Errorf("unknown message compression: %q", m.Enc)
+	}
+	return mc.Decompress(m.Body)
+}
@@ -0,0 +1,184 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Ownership leases cover the case of a DistDatum moving to this node
+// without the previous node confirming its Relinquish() within the
+// Transition timeout. The previous node is most likely yet to see
+// the cluster change and still considers the DistDatum its own, so
+// rather than having both nodes save it, the previous node keeps a
+// lease on it: LeaseHolder returns it instead of this node. The
+// lease is short, and as it nears its end this node asks the
+// previous node whether it still owns the DistDatum. If it does, the
+// lease is renewed, if it says it does not, does not answer or its
+// (late) relinquish message arrives, the lease ends and this node
+// takes over.
+//
+// Leases are disabled (LeaseHolder is the first node) unless a
+// duration is set with SetLeaseDuration.
+
+// The lease messages share the channel of the relinquish messages,
+// their bodies are one of these prefixes followed by "type:id". A
+// node unaware of leases ignores them.
+const (
+	leaseQuery = "lease?" // do you still own it?
+	leaseHeld  = "lease+" // yes
+	leaseGone  = "lease-" // no
+)
+
+// lease is a lease on a DistDatum held by another node.
+type lease struct {
+	holder *Node
+	until  time.Time
+	asked  bool // a leaseQuery is outstanding
+}
+
+// SetLeaseDuration sets how long the previous node keeps (and
+// renews) the lease on a DistDatum it did not confirm relinquishing,
+// see LeaseHolder. It should exceed the time it takes a cluster
+// change to reach all the nodes. Zero (the default) disables leases.
+func (c *Cluster) SetLeaseDuration(d time.Duration) {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	c.leaseDur = d
+}
+
+// LeaseHolder returns the node which should be saving the
+// DistDatum. This is the first node of NodesForDistDatum, unless
+// another node holds a lease on it. Like NodesForDistDatum it is
+// meant to be called a lot, it only sends a message when the lease
+// is due to be renewed.
+func (c *Cluster) LeaseHolder(dd DistDatum) *Node {
+	if l := c.activeLease(ddKey(dd), time.Now()); l != nil {
+		return l
+	}
+	if nodes := c.NodesForDistDatum(dd); len(nodes) > 0 {
+		return nodes[0]
+	}
+	return nil
+}
+
+func ddKey(dd DistDatum) string {
+	return fmt.Sprintf("%s:%d", dd.Type(), dd.Id())
+}
+
+// activeLease returns the holder of the lease on key, nil if there
+// is none or it expired. In the second half of the lease it asks the
+// holder to renew it.
+func (c *Cluster) activeLease(key string, now time.Time) *Node {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	l := c.leases[key]
+	if l == nil {
+		return nil
+	}
+	if !now.Before(l.until) {
+		log.Printf("Cluster: lease of %s by node %s expired.", key, l.holder.Name())
+		delete(c.leases, key)
+		return nil
+	}
+	if !l.asked && l.until.Sub(now) < c.leaseDur/2 {
+		select {
+		case c.snd <- &Msg{Dst: l.holder, Body: []byte(leaseQuery + key)}:
+			l.asked = true
+		default: // try again next time
+		}
+	}
+	return l.holder
+}
+
+// grantLease records that node holds a lease on key, if leases are
+// enabled.
+func (c *Cluster) grantLease(key string, node *Node, now time.Time) {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	if c.leaseDur <= 0 || node == nil {
+		return
+	}
+	if c.leases == nil {
+		c.leases = make(map[string]*lease)
+	}
+	log.Printf("Cluster: node %s holds a lease of %s for %v.", node.Name(), key, c.leaseDur)
+	c.leases[key] = &lease{holder: node, until: now.Add(c.leaseDur)}
+}
+
+// endLease ends the lease on key, if it is held by node, or by any
+// node if node is nil.
+func (c *Cluster) endLease(key string, node *Node) {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	if l := c.leases[key]; l != nil && (node == nil || l.holder.Name() == node.Name()) {
+		delete(c.leases, key)
+	}
+}
+
+// renewLease extends the lease on key held by node.
+func (c *Cluster) renewLease(key string, node *Node, now time.Time) {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	if l := c.leases[key]; l != nil && l.holder.Name() == node.Name() {
+		l.until, l.asked = now.Add(c.leaseDur), false
+	}
+}
+
+// answerLease tells node whether this node still owns key. This
+// waits for a Transition in progress, the answer is as of its end.
+func (c *Cluster) answerLease(node *Node, key string) {
+	c.RLock()
+	dde := c.dds[key]
+	held := dde != nil && dde.Node().Name() == c.LocalNode().Name()
+	c.RUnlock()
+	body := leaseGone + key
+	if held {
+		body = leaseHeld + key
+	}
+	c.snd <- &Msg{Dst: node, Body: []byte(body)}
+}
+
+// ddMessages reads the messages of the dds channel, passing the
+// relinquish messages on to Transition.
+func (c *Cluster) ddMessages() {
+	for m := range c.rcv {
+		c.handleDdMsg(m, time.Now())
+	}
+}
+
+func (c *Cluster) handleDdMsg(m *Msg, now time.Time) {
+	body := string(m.Body)
+	switch {
+	case strings.HasPrefix(body, leaseQuery):
+		go c.answerLease(m.Src, body[len(leaseQuery):])
+	case strings.HasPrefix(body, leaseHeld):
+		c.renewLease(body[len(leaseHeld):], m.Src, now)
+	case strings.HasPrefix(body, leaseGone):
+		c.endLease(body[len(leaseGone):], m.Src)
+	default:
+		// A relinquish, possibly a late one, ends the lease
+		c.endLease(body, m.Src)
+		select {
+		case c.relinq <- m:
+		default:
+			log.Printf("Cluster: too many relinquish messages pending, dropping %s from %s.", body, m.Src.Name())
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -28,31 +29,114 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
 type Config struct { // Needs to be exported for TOML to work
-	PidPath                  string   `toml:"pid-file"`
-	LogPath                  string   `toml:"log-file"`
-	LogCycle                 duration `toml:"log-cycle-interval"`
-	DbConnectString          string   `toml:"db-connect-string"`
-	MaxCachedPoints          int      `toml:"max-cached-points"`
-	MaxCache                 duration `toml:"max-cache-duration"`
-	MinCache                 duration `toml:"min-cache-duration"`
-	MaxFlushesPerSecond      int      `toml:"max-flushes-per-second"`
-	GraphiteTextListenSpec   string   `toml:"graphite-text-listen-spec"`
-	GraphiteUdpListenSpec    string   `toml:"graphite-udp-listen-spec"`
-	GraphitePickleListenSpec string   `toml:"graphite-pickle-listen-spec"`
-	StatsdTextListenSpec     string   `toml:"statsd-text-listen-spec"`
-	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
-	HttpListenSpec           string   `toml:"http-listen-spec"`
+	PidPath                  string     `toml:"pid-file"`
+	LogPath                  string     `toml:"log-file"`
+	LogCycle                 duration   `toml:"log-cycle-interval"`
+	DbConnectString          string     `toml:"db-connect-string"`
+	ReadOnly                 bool       `toml:"read-only"`
+	MaxCachedPoints          int        `toml:"max-cached-points"`
+	MaxTotalCachedPoints     int        `toml:"max-total-cached-points"`
+	SpillDir                 string     `toml:"spill-dir"`
+	MaxCache                 duration   `toml:"max-cache-duration"`
+	MinCache                 duration   `toml:"min-cache-duration"`
+	FlushJitter              duration   `toml:"flush-jitter"`
+	FlushJitterSeed          int64      `toml:"flush-jitter-seed"`
+	MaxFlushesPerSecond      int        `toml:"max-flushes-per-second"`
+	MaxFlushBurst            int        `toml:"max-flush-burst"`
+	MaxNewDSPerSecond        int        `toml:"max-new-ds-per-second"`
+	MaxConcurrentCreates     int        `toml:"max-concurrent-creates"`
+	MaxRRASlots              int        `toml:"max-rra-slots"`
+	FetchTimeout             duration   `toml:"fetch-timeout"`
+	MinValue                 float64    `toml:"min-value"`
+	MaxValue                 float64    `toml:"max-value"`
+	MaxFlushConnections      int        `toml:"max-flush-connections"`
+	SkipNaNWrites            bool       `toml:"skip-nan-writes"`
+	NaNRepresentation        nanRepr    `toml:"nan-representation"`
+	NaNSentinel              float64    `toml:"nan-sentinel"`
+	RRAFlushParallelism      int        `toml:"rra-flush-parallelism"`
+	ReorderWindow            duration   `toml:"reorder-window"`
+	TimeStampAlignment       alignment  `toml:"timestamp-alignment"`
+	FlushPriority            flushPrio  `toml:"flush-priority"`
+	AggOverrunPolicy         aggOverrun `toml:"agg-overrun-policy"`
+	AggQuietCounterPolicy    quietCntr  `toml:"agg-quiet-counter-policy"`
+	AggDirect                bool       `toml:"agg-direct"`
+	AggCardinality           int        `toml:"agg-cardinality"`
+	PacedSumCoalesce         duration   `toml:"paced-sum-coalesce"`
+	ClusterFailurePolicy     failPolicy `toml:"cluster-failure-policy"`
+	ClusterDownAfter         duration   `toml:"cluster-down-after"`
+	ClusterMsgCompression    string     `toml:"cluster-msg-compression"`
+	ClusterMsgCompressionMin int        `toml:"cluster-msg-compression-min"`
+	ClusterLeaseDuration     duration   `toml:"cluster-lease-duration"`
+	ClusterSumWindow         duration   `toml:"cluster-sum-window"`
+	ForwardAccumulateWindow  duration   `toml:"forward-accumulate-window"`
+	TypeConflictPolicy       typePolicy `toml:"type-conflict-policy"`
+	SkewTolerance            duration   `toml:"skew-tolerance"`
+	SkewPolicy               skewPolicy `toml:"skew-policy"`
+	WorkerPanicPolicy        wrkPanic   `toml:"worker-panic-policy"`
+	TagKeyAllowlist          []string   `toml:"tag-key-allowlist"`
+	StripDisallowedTagKeys   bool       `toml:"strip-disallowed-tag-keys"`
+	RequiredTagKeys          []string   `toml:"required-tag-keys"`
+	WhisperExportDir         string     `toml:"whisper-export-dir"`
+	WhisperExportOnly        bool       `toml:"whisper-export-only"`
+	WhisperExportFlushRate   int        `toml:"whisper-export-flush-rate"`
+	GraphitePathTags         []string   `toml:"graphite-path-tags"`
+	GraphitePathSeparator    string     `toml:"graphite-path-separator"`
+	FloatDigits              int        `toml:"float-digits"`
+	GraphiteTextListenSpec   string     `toml:"graphite-text-listen-spec"`
+	GraphiteUdpListenSpec    string     `toml:"graphite-udp-listen-spec"`
+	GraphitePickleListenSpec string     `toml:"graphite-pickle-listen-spec"`
+	StatsdTextListenSpec     string     `toml:"statsd-text-listen-spec"`
+	StatsdUdpListenSpec      string     `toml:"statsd-udp-listen-spec"`
+	SyslogUdpListenSpec      string     `toml:"syslog-udp-listen-spec"`
+	SyslogTcpListenSpec      string     `toml:"syslog-tcp-listen-spec"`
+	HttpListenSpec           string     `toml:"http-listen-spec"`
+	GrpcListenSpec           string     `toml:"grpc-listen-spec"`
+	GrpcAckEvery             int        `toml:"grpc-ack-every"`
 	Workers                  int
+	Directors                int            `toml:"directors"`
 	DSs                      []ConfigDSSpec `toml:"ds"`
+	ListenerFilters          filterMap      `toml:"listener-filter"`
 	StatFlush                duration       `toml:"stat-flush-interval"`
+	ReportStats              *bool          `toml:"report-stats"`
 	StatsNamePrefix          string         `toml:"stats-name-prefix"`
 }
 
+// filterMap is the listener-filter of every listener by name.
+type filterMap map[string]ConfigListenerFilter
+
+// Needs to be exported for TOML
+type ConfigListenerFilter struct {
+	Allow []cidr `toml:"allow"`
+	Deny  []cidr `toml:"deny"`
+}
+
+// cidr is a network in CIDR notation, or a single address.
+type cidr struct{ *net.IPNet }
+
+func (c *cidr) UnmarshalText(text []byte) (err error) {
+	s := string(text)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		c.IPNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+	_, c.IPNet, err = net.ParseCIDR(s)
+	return err
+}
+
 type regex struct{ *regexp.Regexp }
 
 func (r *regex) UnmarshalText(text []byte) (err error) {
@@ -67,18 +151,93 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+type alignment struct{ receiver.TimeStampAlignment }
+
+func (a *alignment) UnmarshalText(text []byte) (err error) {
+	a.TimeStampAlignment, err = receiver.ParseTimeStampAlignment(string(text))
+	return err
+}
+
+type flushPrio struct{ receiver.FlushPriority }
+
+func (p *flushPrio) UnmarshalText(text []byte) (err error) {
+	p.FlushPriority, err = receiver.ParseFlushPriority(string(text))
+	return err
+}
+
+type aggOverrun struct{ receiver.AggOverrunPolicy }
+
+func (p *aggOverrun) UnmarshalText(text []byte) (err error) {
+	p.AggOverrunPolicy, err = receiver.ParseAggOverrunPolicy(string(text))
+	return err
+}
+
+type quietCntr struct{ receiver.QuietCounterPolicy }
+
+func (p *quietCntr) UnmarshalText(text []byte) (err error) {
+	p.QuietCounterPolicy, err = receiver.ParseQuietCounterPolicy(string(text))
+	return err
+}
+
+type nanRepr struct{ serde.NaNRepresentation }
+
+func (r *nanRepr) UnmarshalText(text []byte) (err error) {
+	r.NaNRepresentation, err = serde.ParseNaNRepresentation(string(text))
+	return err
+}
+
+type failPolicy struct{ receiver.ClusterFailurePolicy }
+
+func (p *failPolicy) UnmarshalText(text []byte) (err error) {
+	p.ClusterFailurePolicy, err = receiver.ParseClusterFailurePolicy(string(text))
+	return err
+}
+
+type typePolicy struct{ receiver.TypeConflictPolicy }
+
+func (p *typePolicy) UnmarshalText(text []byte) (err error) {
+	p.TypeConflictPolicy, err = receiver.ParseTypeConflictPolicy(string(text))
+	return err
+}
+
+type skewPolicy struct{ receiver.SkewPolicy }
+
+func (p *skewPolicy) UnmarshalText(text []byte) (err error) {
+	p.SkewPolicy, err = receiver.ParseSkewPolicy(string(text))
+	return err
+}
+
+type wrkPanic struct{ receiver.WorkerPanicPolicy }
+
+func (p *wrkPanic) UnmarshalText(text []byte) (err error) {
+	p.WorkerPanicPolicy, err = receiver.ParseWorkerPanicPolicy(string(text))
+	return err
+}
+
 // Needs to be exported for TOML
 type ConfigDSSpec struct {
-	Regexp    regex
-	Step      duration
-	Heartbeat duration
-	RRAs      []ConfigRRASpec
+	Regexp      regex
+	Step        duration
+	Heartbeat   duration
+	RRAs        []ConfigRRASpec
+	SampleEvery int `toml:"sample-every"`
+	// Override the global cache parameters of the same name
+	MaxCachedPoints int      `toml:"max-cached-points"`
+	MaxCache        duration `toml:"max-cache-duration"`
+	MinCache        duration `toml:"min-cache-duration"`
+	LateGrace       duration `toml:"late-grace"`
+	FlushOnChange   bool     `toml:"flush-on-change"`
+	FlushEpsilon    float64  `toml:"flush-epsilon"`
+	RateUnit        duration `toml:"rate-unit"`
+	MinValue        float64  `toml:"min-value"`
+	MaxValue        float64  `toml:"max-value"`
 }
 type ConfigRRASpec struct {
-	Function rrd.Consolidation
-	Step     time.Duration
-	Span     time.Duration
-	Xff      float64
+	Function   rrd.Consolidation
+	Percentile float64 // of a PERCENTILE RRA, e.g. "P99:1h:30d"
+	Step       time.Duration
+	Span       time.Duration
+	Xff        float64
 }
 
 func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
@@ -104,7 +263,11 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 	case "LAST":
 		r.Function = rrd.LAST
 	default:
-		return fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last)", parts[0])
+		var ok bool
+		if r.Percentile, ok = rrd.ParsePercentileName(parts[0]); !ok {
+			return fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last, p<percentile>)", parts[0])
+		}
+		r.Function = rrd.PERCENTILE
 	}
 
 	var err error
@@ -258,13 +421,56 @@ func (c *Config) processStatsNamePrefix() error {
 }
 
 func (c *Config) processWorkers() error {
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must not be negative")
+	}
 	if c.Workers == 0 {
-		return fmt.Errorf("workers missing, must be an integer")
+		log.Printf("Number of workers (and flushers) will be %d, based on the number of CPUs.", receiver.DefaultNWorkers())
+		return nil
 	}
 	log.Printf("Number of workers (and flushers) will be %d.", c.Workers)
 	return nil
 }
 
+func (c *Config) processWhisperExport() error {
+	if len(c.GraphitePathTags) > 0 {
+		serde.GraphitePath = serde.TagsPath(c.GraphitePathTags, c.GraphitePathSeparator)
+		log.Printf("Graphite paths will be the name and the tags %v (graphite-path-tags).", c.GraphitePathTags)
+	}
+	if c.WhisperExportDir == "" {
+		if c.WhisperExportOnly {
+			return fmt.Errorf("whisper-export-only requires whisper-export-dir")
+		}
+		return nil
+	}
+	if c.WhisperExportOnly {
+		log.Printf("Data Sources will be flushed to whisper files in %q only (whisper-export-dir).", c.WhisperExportDir)
+	} else {
+		log.Printf("Data Sources will also be flushed to whisper files in %q (whisper-export-dir).", c.WhisperExportDir)
+	}
+	return nil
+}
+
+func (c *Config) processFloatDigits() error {
+	if c.FloatDigits < 0 {
+		return fmt.Errorf("float-digits must not be negative")
+	}
+	if c.FloatDigits > 0 {
+		log.Printf("Values in text output will be rounded to %d significant digits (float-digits).", c.FloatDigits)
+	}
+	misc.FloatDigits = c.FloatDigits
+	return nil
+}
+
+func (c *Config) processListenerFilters() error {
+	for name := range c.ListenerFilters {
+		if !listenerNames[name] {
+			return fmt.Errorf("listener-filter: unknown listener %q", name)
+		}
+	}
+	return nil
+}
+
 func (c *Config) processDSSpec() error {
 	// TODO validate function, regular expression, all that
 	for _, ds := range c.DSs {
@@ -301,12 +507,24 @@ func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
 	}
 	for i, r := range dsSpec.RRAs {
 		serdeDSSpec.RRAs[i] = rrd.RRASpec{
-			Function: r.Function,
-			Step:     r.Step,
-			Span:     r.Span,
-			Xff:      float32(r.Xff),
+			Function:   r.Function,
+			Percentile: r.Percentile,
+			Step:       r.Step,
+			Span:       r.Span,
+			Xff:        float32(r.Xff),
 		}
 	}
+	if dsSpec.SampleEvery > 1 {
+		serdeDSSpec.NewSampling = rrd.SystematicSampling(dsSpec.SampleEvery)
+	}
+	serdeDSSpec.MinCacheDuration = dsSpec.MinCache.Duration
+	serdeDSSpec.MaxCacheDuration = dsSpec.MaxCache.Duration
+	serdeDSSpec.MaxCachedPoints = dsSpec.MaxCachedPoints
+	serdeDSSpec.LateGrace = dsSpec.LateGrace.Duration
+	serdeDSSpec.FlushOnChange = dsSpec.FlushOnChange
+	serdeDSSpec.FlushEpsilon = dsSpec.FlushEpsilon
+	serdeDSSpec.RateUnit = dsSpec.RateUnit.Duration
+	serdeDSSpec.MinValue, serdeDSSpec.MaxValue = dsSpec.MinValue, dsSpec.MaxValue
 	return serdeDSSpec
 }
 
@@ -322,6 +540,9 @@ type configer interface {
 	processStatFlushInterval() error
 	processStatsNamePrefix() error
 	processWorkers() error
+	processWhisperExport() error
+	processFloatDigits() error
+	processListenerFilters() error
 	processDSSpec() error
 }
 
@@ -360,6 +581,15 @@ var processConfig = func(c configer, wd string) error {
 	if err := c.processWorkers(); err != nil {
 		return err
 	}
+	if err := c.processWhisperExport(); err != nil {
+		return err
+	}
+	if err := c.processFloatDigits(); err != nil {
+		return err
+	}
+	if err := c.processListenerFilters(); err != nil {
+		return err
+	}
 	if err := c.processDSSpec(); err != nil {
 		return err
 	}
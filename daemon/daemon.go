@@ -106,22 +106,83 @@ var initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.C
 	return c, nil
 }
 
-var createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) *receiver.Receiver {
-	r := receiver.New(db, receiver.MatchingDSSpecFinder(cfg))
-	r.NWorkers = cfg.Workers
+// withWhisperExport arranges for DSs to be flushed to whisper files
+// in addition to (or instead of) the database, if so configured. With
+// a whisper-export-flush-rate, the whisper files are written at that
+// rate, lagging behind the database if need be.
+func withWhisperExport(cfg *Config, db serde.SerDe) serde.SerDe {
+	if cfg.WhisperExportDir == "" {
+		return db
+	}
+	var wf serde.Flusher = serde.NewWhisperFlusher(cfg.WhisperExportDir)
+	if cfg.WhisperExportFlushRate > 0 {
+		wf = serde.NewRateLimitedFlusher(wf, cfg.WhisperExportFlushRate, 0)
+	}
+	if cfg.WhisperExportOnly || db.Flusher() == nil {
+		return serde.WithFlusher(db, wf)
+	}
+	return serde.WithFlusher(db, serde.NewMultiFlusher(db.Flusher(), wf))
+}
+
+var createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) (*receiver.Receiver, error) {
+	r, err := receiver.New(withWhisperExport(cfg, db), receiver.MatchingDSSpecFinder(cfg))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Workers > 0 {
+		r.NWorkers = cfg.Workers
+	}
+	r.NDirectors = cfg.Directors
 	r.MaxCacheDuration = cfg.MaxCache.Duration
 	r.MinCacheDuration = cfg.MinCache.Duration
+	r.FlushJitter = cfg.FlushJitter.Duration
+	r.FlushJitterSeed = cfg.FlushJitterSeed
 	r.MaxCachedPoints = cfg.MaxCachedPoints
+	r.MaxTotalCachedPoints = cfg.MaxTotalCachedPoints
+	r.SpillDir = cfg.SpillDir
+	r.ReadOnly = cfg.ReadOnly
 	r.StatFlushDuration = cfg.StatFlush.Duration
 	r.StatsNamePrefix = cfg.StatsNamePrefix
 	r.MaxFlushRatePerSecond = cfg.MaxFlushesPerSecond
-	r.ReportStats = true
+	r.MaxFlushBurst = cfg.MaxFlushBurst
+	r.MaxNewDSPerSecond = cfg.MaxNewDSPerSecond
+	r.MaxConcurrentCreates = cfg.MaxConcurrentCreates
+	r.MaxRRASlots = cfg.MaxRRASlots
+	r.MinValue = cfg.MinValue
+	r.MaxValue = cfg.MaxValue
+	r.FetchTimeout = cfg.FetchTimeout.Duration
+	r.MaxFlushConnections = cfg.MaxFlushConnections
+	r.ReorderWindow = cfg.ReorderWindow.Duration
+	r.TimeStampAlignment = cfg.TimeStampAlignment.TimeStampAlignment
+	r.FlushPriority = cfg.FlushPriority.FlushPriority
+	r.AggOverrunPolicy = cfg.AggOverrunPolicy.AggOverrunPolicy
+	r.AggQuietCounterPolicy = cfg.AggQuietCounterPolicy.QuietCounterPolicy
+	r.AggDirect = cfg.AggDirect
+	r.AggCardinality = cfg.AggCardinality
+	r.PacedSumCoalesce = cfg.PacedSumCoalesce.Duration
+	r.ClusterFailurePolicy = cfg.ClusterFailurePolicy.ClusterFailurePolicy
+	if cfg.ClusterDownAfter.Duration > 0 {
+		r.ClusterDownAfter = cfg.ClusterDownAfter.Duration
+	}
+	r.ForwardAccumulateWindow = cfg.ForwardAccumulateWindow.Duration
+	r.ClusterSumWindow = cfg.ClusterSumWindow.Duration
+	r.TypeConflictPolicy = cfg.TypeConflictPolicy.TypeConflictPolicy
+	r.SkewTolerance = cfg.SkewTolerance.Duration
+	r.SkewPolicy = cfg.SkewPolicy.SkewPolicy
+	r.WorkerPanicPolicy = cfg.WorkerPanicPolicy.WorkerPanicPolicy
+	r.TagKeyAllowlist = cfg.TagKeyAllowlist
+	r.StripDisallowedTagKeys = cfg.StripDisallowedTagKeys
+	if cfg.RequiredTagKeys != nil {
+		r.RequiredTagKeys = cfg.RequiredTagKeys
+	}
+	r.ReportStats = cfg.ReportStats == nil || *cfg.ReportStats
+	r.CollectStats = true
 	r.SetCluster(c)
-	return r
+	return r, nil
 }
 
-var startReceiver = func(r *receiver.Receiver) {
-	r.Start()
+var startReceiver = func(r *receiver.Receiver) error {
+	return r.Start()
 }
 
 var waitForSignal = func(r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {
@@ -173,6 +234,32 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		return
 	}
 	log.Printf("Initialized DB connection.")
+	if cfg.SkipNaNWrites {
+		if s, ok := db.(interface {
+			SetSkipNaNWrites(bool)
+		}); ok {
+			s.SetSkipNaNWrites(true)
+			log.Printf("NaN slots already NaN in the DB will not be written (skip-nan-writes).")
+		}
+	}
+	if rep := cfg.NaNRepresentation.NaNRepresentation; rep != serde.NaNAsNaN {
+		if s, ok := db.(serde.NaNRepresenter); ok {
+			s.SetNaNRepresentation(rep, cfg.NaNSentinel)
+			as := "NULL"
+			if rep == serde.NaNAsSentinel {
+				as = fmt.Sprintf("%v (nan-sentinel)", cfg.NaNSentinel)
+			}
+			log.Printf("NaN slots will be written as %s (nan-representation).", as)
+		}
+	}
+	if cfg.RRAFlushParallelism > 1 {
+		if s, ok := db.(interface {
+			SetRRAFlushParallelism(int)
+		}); ok {
+			s.SetRRAFlushParallelism(cfg.RRAFlushParallelism)
+			log.Printf("Up to %d RRAs of a DS will be written at once (rra-flush-parallelism).", cfg.RRAFlushParallelism)
+		}
+	}
 
 	// Determine cluster bind address
 	var bindAddr, advAddr string
@@ -191,7 +278,11 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 	}
 
 	// Create Receiver (with nil cluster, because if graceful, then we must wait for parent to shutdown)
-	rcvr := createReceiver(cfg, nil, db)
+	rcvr, err := createReceiver(cfg, nil, db)
+	if err != nil {
+		log.Printf("Could not create the receiver: %v", err)
+		return
+	}
 
 	// Create and run the Service Manager
 	rcache := dsl.NewNamedDSFetcher(db.Fetcher())
@@ -226,6 +317,13 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		log.Printf("Error initializing cluster, exiting: %v", err)
 		return
 	}
+	if c != nil {
+		if err := c.SetMsgCompression(cfg.ClusterMsgCompression, cfg.ClusterMsgCompressionMin); err != nil {
+			log.Printf("Error in cluster-msg-compression, exiting: %v", err)
+			return
+		}
+		c.SetLeaseDuration(cfg.ClusterLeaseDuration.Duration)
+	}
 	rcvr.SetCluster(c)
 
 	// Save PID (by now the graceful parent pid can be overwritten)
@@ -237,7 +335,10 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 	}
 
 	// *finally* start the receiver (because graceful restart, parent must save data first)
-	startReceiver(rcvr)
+	if err := startReceiver(rcvr); err != nil {
+		log.Printf("Unable to start the receiver, exiting: %v", err)
+		return
+	}
 	log.Printf("Receiver started, Tgres is ready.")
 
 	// Wait for HUP or TERM, etc.
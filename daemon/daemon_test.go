@@ -16,7 +16,12 @@
 package daemon
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -73,12 +78,12 @@ func Test_Init(t *testing.T) {
 
 	// createReceiver
 	save_createReceiver := createReceiver
-	createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) *receiver.Receiver {
+	createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) (*receiver.Receiver, error) {
 		return receiver.New(db, nil)
 	}
 
 	save_startReceiver := startReceiver
-	startReceiver = func(r *receiver.Receiver) {}
+	startReceiver = func(r *receiver.Receiver) error { return nil }
 
 	// waitForSignal
 	save_waitForSignal := waitForSignal
@@ -145,3 +150,134 @@ func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpe
 		return serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*receiver.DftDSSPec)), nil
 	}
 }
+
+func Test_ipFilter(t *testing.T) {
+	var lf ConfigListenerFilter
+	for _, s := range []string{"10.0.0.0/8", "127.0.0.1"} {
+		var c cidr
+		if err := c.UnmarshalText([]byte(s)); err != nil {
+			t.Fatalf("cidr: %v", err)
+		}
+		lf.Allow = append(lf.Allow, c)
+	}
+	var c cidr
+	if err := c.UnmarshalText([]byte("10.0.66.0/24")); err != nil {
+		t.Fatalf("cidr: %v", err)
+	}
+	lf.Deny = append(lf.Deny, c)
+	if err := c.UnmarshalText([]byte("bogus")); err == nil {
+		t.Errorf("cidr: expected an error for an invalid address")
+	}
+
+	f := newIPFilter(lf)
+	for addr, expect := range map[string]bool{
+		"10.1.2.3":   true,
+		"127.0.0.1":  true,
+		"127.0.0.2":  false,
+		"10.0.66.7":  false,
+		"192.0.2.10": false,
+	} {
+		if got := f.allowed(&net.UDPAddr{IP: net.ParseIP(addr), Port: 8125}); got != expect {
+			t.Errorf("ipFilter: %s: expected %v, got %v", addr, expect, got)
+		}
+	}
+
+	var nilf *ipFilter
+	if !nilf.allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.10")}) {
+		t.Errorf("ipFilter: a nil filter should allow everything")
+	}
+	if f := newIPFilter(ConfigListenerFilter{Deny: lf.Deny}); !f.allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.10")}) {
+		t.Errorf("ipFilter: without allow, anything not denied should be allowed")
+	}
+}
+
+func Test_parseSyslogMetrics(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	ms, err := parseSyslogMetrics(`<134>1 2017-06-01T12:00:00Z dev42 sensord - - [origin ip="10.0.0.1"][metric name="temp c" value="21.5" room="a\]b"][metric@32473 name="hum" value="40" timestamp="1500000000"] some text`, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("parseSyslogMetrics: expected 2 metrics, got %d", len(ms))
+	}
+	if ms[0].ident["name"] != "temp_c" || ms[0].ident["room"] != "a]b" || ms[0].value != 21.5 {
+		t.Errorf("parseSyslogMetrics: unexpected first metric: %v %v", ms[0].ident, ms[0].value)
+	}
+	if !ms[0].ts.Equal(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseSyslogMetrics: expected the message time stamp, got %v", ms[0].ts)
+	}
+	if ms[1].ident["name"] != "hum" || !ms[1].ts.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("parseSyslogMetrics: unexpected second metric: %v %v", ms[1].ident, ms[1].ts)
+	}
+
+	ms, err = parseSyslogMetrics(`<14>1 - - - - - [metric name="x" value="1"]`, now)
+	if err != nil || len(ms) != 1 || !ms[0].ts.Equal(now) {
+		t.Errorf("parseSyslogMetrics: expected the time of arrival without a time stamp, got %v %v", ms, err)
+	}
+
+	for _, msg := range []string{
+		`<14>1 - host app - - - just a log line`,
+		`<14>1 - host app - - [origin ip="10.0.0.1"]`,
+		`<14>Jun  1 12:00:00 host app: an RFC3164 line`,
+		`not syslog at all`,
+	} {
+		if ms, err := parseSyslogMetrics(msg, now); ms != nil || err != nil {
+			t.Errorf("parseSyslogMetrics: %q should be ignored, got %v %v", msg, ms, err)
+		}
+	}
+
+	for _, msg := range []string{
+		`<14>1 - - - - - [metric name="x"]`,
+		`<14>1 - - - - - [metric name="x" value="abc"]`,
+		`<14>1 - - - - - [metric name="x" value="1"`,
+		`<14>1 - - - - - [metric name="x" value="1" timestamp="soon"]`,
+	} {
+		if _, err := parseSyslogMetrics(msg, now); err == nil {
+			t.Errorf("parseSyslogMetrics: %q should be an error", msg)
+		}
+	}
+}
+
+func Test_readSyslogFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("5 <1>1 <14>1 - - - - - -\n3 abc"))
+	for _, expect := range []string{"<1>1 ", "<14>1 - - - - - -\n", "abc"} {
+		msg, err := readSyslogFrame(r)
+		if err != nil || msg != expect {
+			t.Errorf("readSyslogFrame: expected %q, got %q %v", expect, msg, err)
+		}
+	}
+	if _, err := readSyslogFrame(r); err == nil {
+		t.Errorf("readSyslogFrame: expected an error at the end")
+	}
+
+	// Neither a line nor a length is read past the buffer
+	for _, frame := range []string{strings.Repeat("x", 100) + "\n", strings.Repeat("9", 100) + " x"} {
+		r := bufio.NewReaderSize(strings.NewReader(frame), 16)
+		if msg, err := readSyslogFrame(r); err == nil {
+			t.Errorf("readSyslogFrame: expected an error for an oversized frame, got %q", msg)
+		}
+	}
+}
+
+func Test_readPickleFrame(t *testing.T) {
+	r := bytes.NewReader([]byte{0, 0, 0, 3, 'a', 'b', 'c', 0, 0, 0, 1, 'd'})
+	for _, expect := range []string{"abc", "d"} {
+		frame, err := readPickleFrame(r)
+		if err != nil || string(frame) != expect {
+			t.Errorf("readPickleFrame: expected %q, got %q %v", expect, frame, err)
+		}
+	}
+	if _, err := readPickleFrame(r); err != io.EOF {
+		t.Errorf("readPickleFrame: expected io.EOF at the end, got %v", err)
+	}
+	for _, bad := range [][]byte{
+		{0x7f, 0xff, 0xff, 0xff}, // larger than graphitePickleMaxFrame
+		{0, 0, 0, 0},
+		{0, 0, 0, 5, 'a'}, // truncated
+	} {
+		if _, err := readPickleFrame(bytes.NewReader(bad)); err == nil {
+			t.Errorf("readPickleFrame: expected an error for %v", bad)
+		}
+	}
+}
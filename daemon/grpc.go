@@ -0,0 +1,82 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/ingest"
+	"github.com/tgres/tgres/receiver"
+)
+
+// grpcServiceManager serves the streaming ingest protocol (see
+// package ingest) to gRPC clients, over unencrypted HTTP/2.
+type grpcServiceManager struct {
+	rcvr       *receiver.Receiver
+	listener   *graceful.Listener
+	listenSpec string
+	ackEvery   int
+}
+
+func (g *grpcServiceManager) File() *os.File {
+	if g.listener != nil {
+		return g.listener.File()
+	}
+	return nil
+}
+
+func (g *grpcServiceManager) Stop() {
+	if g.listener != nil {
+		g.listener.Close()
+	}
+}
+
+func (g *grpcServiceManager) Start(file *os.File) error {
+	var (
+		gl  net.Listener
+		err error
+	)
+
+	if g.listenSpec != "" {
+		if file != nil {
+			gl, err = net.FileListener(file)
+		} else {
+			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
+		}
+	} else {
+		log.Printf("Not starting gRPC ingest protocol because grpc-listen-spec is blank.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting gRPC ingest protocol serviceManager: %v", err)
+	}
+
+	g.listener = graceful.NewListener(gl)
+
+	fmt.Println("gRPC ingest protocol Listening on " + processListenSpec(g.listenSpec))
+
+	server := &http.Server{Handler: ingest.NewGRPCHandler(g.rcvr, g.ackEvery), Protocols: new(http.Protocols)}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(g.listener)
+
+	return nil
+}
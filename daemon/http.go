@@ -32,6 +32,7 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 	http.HandleFunc("/render", h.GraphiteRenderHandler(rcache))
 
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	http.HandleFunc("/metrics", h.InternalStatsHandler(rcvr))
 
 	http.HandleFunc("/pixel", h.PixelHandler(rcvr))
 	http.HandleFunc("/pixel/add", h.PixelAddHandler(rcvr))
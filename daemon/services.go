@@ -17,7 +17,10 @@ package daemon
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -45,18 +48,116 @@ type serviceManager struct {
 	services serviceMap
 }
 
+// listenerNames are the names of the data listeners, as used for
+// their stats and in listener-filter.
+var listenerNames = map[string]bool{"graphite_text": true, "graphite_udp": true, "graphite_pickle": true, "statsd_udp": true,
+	"syslog_udp": true, "syslog_tcp": true}
+
 func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *Config) *serviceManager {
+	filter := func(name string) *ipFilter {
+		if lf, ok := cfg.ListenerFilters[name]; ok {
+			return newIPFilter(lf)
+		}
+		return nil
+	}
 	return &serviceManager{rcvr: rcvr,
 		services: serviceMap{
-			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec},
-			"gu":  &graphiteUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec},
-			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec},
-			"su":  &statsdUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec},
+			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, stats: rcvr.ListenerStats("graphite_text"), filter: filter("graphite_text")},
+			"gu":  &graphiteUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, stats: rcvr.ListenerStats("graphite_udp"), filter: filter("graphite_udp")},
+			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec, stats: rcvr.ListenerStats("graphite_pickle"), filter: filter("graphite_pickle")},
+			"su":  &statsdUdpTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, stats: rcvr.ListenerStats("statsd_udp"), filter: filter("statsd_udp")},
+			"syu": &syslogUdpServiceManager{rcvr: rcvr, listenSpec: cfg.SyslogUdpListenSpec, stats: rcvr.ListenerStats("syslog_udp"), filter: filter("syslog_udp")},
+			"syt": &syslogTcpServiceManager{rcvr: rcvr, listenSpec: cfg.SyslogTcpListenSpec, stats: rcvr.ListenerStats("syslog_tcp"), filter: filter("syslog_tcp")},
 			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec},
+			"grp": &grpcServiceManager{rcvr: rcvr, listenSpec: cfg.GrpcListenSpec, ackEvery: cfg.GrpcAckEvery},
 		},
 	}
 }
 
+// ipFilter decides which source addresses a listener accepts data
+// from. An address in a deny network is refused, otherwise it is
+// accepted if there are no allow networks or it is in one of them. A
+// nil ipFilter accepts everything.
+type ipFilter struct {
+	allow, deny []*net.IPNet
+}
+
+func newIPFilter(lf ConfigListenerFilter) *ipFilter {
+	f := &ipFilter{}
+	for _, c := range lf.Allow {
+		f.allow = append(f.allow, c.IPNet)
+	}
+	for _, c := range lf.Deny {
+		f.deny = append(f.deny, c.IPNet)
+	}
+	return f
+}
+
+func (f *ipFilter) allowed(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				ip = net.ParseIP(host)
+			}
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredPacketConn reads only the packets whose source is allowed
+// by the filter, the others are discarded and counted as rejected.
+type filteredPacketConn struct {
+	net.Conn
+	pc     net.PacketConn
+	filter *ipFilter
+	stats  *receiver.ListenerStats
+}
+
+// filterPacketConn returns conn wrapped in a filteredPacketConn, or
+// conn itself if there is no filter.
+func filterPacketConn(conn net.Conn, filter *ipFilter, stats *receiver.ListenerStats) net.Conn {
+	pc, ok := conn.(net.PacketConn)
+	if filter == nil || !ok {
+		return conn
+	}
+	return &filteredPacketConn{Conn: conn, pc: pc, filter: filter, stats: stats}
+}
+
+func (c *filteredPacketConn) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := c.pc.ReadFrom(p)
+		if err != nil || c.filter.allowed(addr) {
+			return n, err
+		}
+		c.stats.Rejected()
+	}
+}
+
 func processListenSpec(listenSpec string) string {
 	if os.Getenv("TGRES_BIND") != "" {
 		return strings.Replace(listenSpec, "0.0.0.0", os.Getenv("TGRES_BIND"), 1)
@@ -169,6 +270,8 @@ type graphitePickleServiceManager struct {
 	rcvr       *receiver.Receiver
 	listener   *graceful.Listener
 	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
 }
 
 func (g *graphitePickleServiceManager) File() *os.File {
@@ -241,19 +344,43 @@ func (g *graphitePickleServiceManager) graphitePickleServer() error {
 		}
 		tempDelay = 0
 
-		go handleGraphitePickleProtocol(g.rcvr, conn, 10)
+		if !g.filter.allowed(conn.RemoteAddr()) {
+			g.stats.Rejected()
+			conn.Close()
+			continue
+		}
+
+		go handleGraphitePickleProtocol(g.rcvr, g.stats, conn, 10)
 	}
 }
 
-func handleGraphitePickleProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int) {
+// graphitePickleMaxFrame is the largest pickle frame accepted, same
+// as the MAX_LENGTH of carbon.
+const graphitePickleMaxFrame = 1024 * 1024
 
-	defer conn.Close() // decrements graceful.TcpWg
-
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+// readPickleFrame reads a frame of the Graphite pickle protocol,
+// which is a 4 byte big-endian length followed by that many bytes of
+// pickled data points. Frames larger than graphitePickleMaxFrame are
+// rejected before anything is allocated for them.
+func readPickleFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > graphitePickleMaxFrame {
+		return nil, fmt.Errorf("invalid pickle frame length %d (max %d)", n, graphitePickleMaxFrame)
 	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
 
-	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
+// handleGraphitePickleFrame queues the data points of a pickle frame,
+// a list of (path, (timestamp, value)) tuples.
+func handleGraphitePickleFrame(rcvr *receiver.Receiver, stats *receiver.ListenerStats, frame []byte) error {
 
 	var (
 		name                 string
@@ -265,41 +392,60 @@ func handleGraphitePickleProtocol(rcvr *receiver.Receiver, conn net.Conn, timeou
 		items, itemSlice, dp []interface{}
 	)
 
-	items, err = pickle.ListOrTuple(pickle.Unpickle(conn))
-	if err == nil {
-		for _, item = range items {
-			itemSlice, err = pickle.ListOrTuple(item, err)
-			if len(itemSlice) == 2 {
-				name, err = pickle.String(itemSlice[0], err)
-				dp, err = pickle.ListOrTuple(itemSlice[1], err)
-				if len(dp) == 2 {
-					tstamp, err = pickle.Int(dp[0], err)
-					if value, err = pickle.Float(dp[1], err); err != nil {
-						if _, ok := err.(pickle.WrongTypeError); ok {
-							if int_value, err = pickle.Int(dp[1], nil); err == nil {
-								value = float64(int_value)
-							}
-						}
-					}
-					rcvr.QueueDataPoint(serde.Ident{"name": name}, time.Unix(tstamp, 0), value)
-				} else {
-					err = fmt.Errorf("dp wrong length: %d", len(dp))
-					break
+	items, err = pickle.ListOrTuple(pickle.Unpickle(bytes.NewReader(frame)))
+	if err != nil {
+		return err
+	}
+	for _, item = range items {
+		itemSlice, err = pickle.ListOrTuple(item, err)
+		if len(itemSlice) != 2 {
+			return fmt.Errorf("item wrong length: %d", len(itemSlice))
+		}
+		name, err = pickle.String(itemSlice[0], err)
+		dp, err = pickle.ListOrTuple(itemSlice[1], err)
+		if len(dp) != 2 {
+			return fmt.Errorf("dp wrong length: %d", len(dp))
+		}
+		tstamp, err = pickle.Int(dp[0], err)
+		if value, err = pickle.Float(dp[1], err); err != nil {
+			if _, ok := err.(pickle.WrongTypeError); ok {
+				if int_value, err = pickle.Int(dp[1], nil); err == nil {
+					value = float64(int_value)
 				}
-			} else {
-				err = fmt.Errorf("item wrong length: %d", len(itemSlice))
-				break
 			}
 		}
+		if err != nil {
+			return err
+		}
+		if rcvr.QueueDataPoint(serde.Ident{"name": name}, time.Unix(tstamp, 0), value, receiver.WithSource(stats.Proto())) == nil {
+			stats.PointsAccepted(1)
+		}
 	}
+	return nil
+}
 
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	}
+func handleGraphitePickleProtocol(rcvr *receiver.Receiver, stats *receiver.ListenerStats, conn net.Conn, timeout int) {
 
-	if err != nil {
-		if !strings.Contains(err.Error(), "use of closed") {
-			log.Println("handleGraphitePickleProtocol(): Error reading: %v", err.Error())
+	defer conn.Close() // decrements graceful.TcpWg
+
+	stats.ConnOpened()
+	defer stats.ConnClosed()
+
+	r := bufio.NewReader(&statsReader{conn, stats})
+	for {
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+		frame, err := readPickleFrame(r)
+		if err == nil {
+			err = handleGraphitePickleFrame(rcvr, stats, frame)
+		}
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+				stats.ParseError()
+				log.Printf("handleGraphitePickleProtocol(): Error reading: %v", err)
+			}
+			return
 		}
 	}
 }
@@ -310,6 +456,8 @@ type graphiteUdpTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	conn       net.Conn
 	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
 }
 
 func (g *graphiteUdpTextServiceManager) Stop() {
@@ -352,7 +500,7 @@ func (g *graphiteUdpTextServiceManager) Start(file *os.File) error {
 	fmt.Printf("Graphite UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
 	// for UDP timeout must be 0
-	go handleGraphiteTextProtocol(g.rcvr, g.conn, 0)
+	go handleGraphiteTextProtocol(g.rcvr, g.stats, filterPacketConn(g.conn, g.filter, g.stats), 0)
 
 	return nil
 }
@@ -363,6 +511,8 @@ type graphiteTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	listener   *graceful.Listener
 	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
 }
 
 func (g *graphiteTextServiceManager) File() *os.File {
@@ -433,30 +583,40 @@ func (g *graphiteTextServiceManager) graphiteTextServer() error {
 		}
 		tempDelay = 0
 
-		go handleGraphiteTextProtocol(g.rcvr, conn, 10)
+		if !g.filter.allowed(conn.RemoteAddr()) {
+			g.stats.Rejected()
+			conn.Close()
+			continue
+		}
+
+		go handleGraphiteTextProtocol(g.rcvr, g.stats, conn, 10)
 	}
 }
 
 // Handles incoming requests for both TCP and UDP
-func handleGraphiteTextProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int) {
+func handleGraphiteTextProtocol(rcvr *receiver.Receiver, stats *receiver.ListenerStats, conn net.Conn, timeout int) {
 
 	defer conn.Close() // decrements graceful.TcpWg
 
+	stats.ConnOpened()
+	defer stats.ConnClosed()
+
 	if timeout != 0 {
 		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 	}
 
 	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
 
-	connbuf := bufio.NewScanner(conn)
+	connbuf := bufio.NewScanner(&statsReader{conn, stats})
 
 	for connbuf.Scan() {
 		packetStr := connbuf.Text()
 
 		if name, ts, v, err := parseGraphitePacket(packetStr); err != nil {
+			stats.ParseError()
 			log.Printf("handleGraphiteTextProtocol(): bad backet: %v")
-		} else {
-			rcvr.QueueDataPoint(serde.Ident{"name": name}, ts, v)
+		} else if rcvr.QueueDataPoint(serde.Ident{"name": name}, ts, v, receiver.WithSource(stats.Proto())) == nil {
+			stats.PointsAccepted(1)
 		}
 
 		if timeout != 0 {
@@ -471,6 +631,18 @@ func handleGraphiteTextProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout
 	}
 }
 
+// statsReader counts the bytes read from the underlying reader.
+type statsReader struct {
+	io.Reader
+	stats *receiver.ListenerStats
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.stats.BytesRead(n)
+	return n, err
+}
+
 func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 
 	var (
@@ -493,21 +665,27 @@ func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 }
 
 // TODO isn't this identical to handleGraphiteTextProtocol?
-func handleStatsdTextProtocol(rcvr *receiver.Receiver, conn net.Conn, timeout int) {
+func handleStatsdTextProtocol(rcvr *receiver.Receiver, stats *receiver.ListenerStats, conn net.Conn, timeout int) {
 	defer conn.Close() // decrements graceful.TcpWg
 
+	stats.ConnOpened()
+	defer stats.ConnClosed()
+
 	if timeout != 0 {
 		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 	}
 
 	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
 
-	connbuf := bufio.NewScanner(conn)
+	connbuf := bufio.NewScanner(&statsReader{conn, stats})
 
 	for connbuf.Scan() {
 		if stat, err := statsd.ParseStatsdPacket(connbuf.Text()); err == nil {
-			rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
+			if rcvr.QueueAggregatorCommand(stat.AggregatorCmd()) == nil {
+				stats.PointsAccepted(1)
+			}
 		} else {
+			stats.ParseError()
 			log.Printf("parseStatsdPacket(): %v", err)
 		}
 
@@ -529,6 +707,8 @@ type statsdUdpTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	conn       net.Conn
 	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
 }
 
 func (g *statsdUdpTextServiceManager) Stop() {
@@ -571,7 +751,7 @@ func (g *statsdUdpTextServiceManager) Start(file *os.File) error {
 	fmt.Printf("Statsd UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
 	// for UDP timeout must be 0
-	go handleStatsdTextProtocol(g.rcvr, g.conn, 0)
+	go handleStatsdTextProtocol(g.rcvr, g.stats, filterPacketConn(g.conn, g.filter, g.stats), 0)
 
 	return nil
 }
@@ -0,0 +1,414 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// Syslog messages (RFC5424) carry data points in their structured
+// data, one per SD-ELEMENT whose SD-ID is "metric" (or "metric@"
+// followed by an enterprise number), e.g.:
+//
+//   <134>1 2017-06-01T12:00:00Z dev42 sensord - - - [metric name="temp.c" value="21.5"]
+//
+// The name and value params are required. The time stamp is that of
+// the timestamp param, in seconds since the epoch or RFC3339, if
+// there is one, otherwise that of the message, or the time of
+// arrival if the message has none. Any other params are tags of the
+// ident. Messages without such elements (or which are not RFC5424
+// at all) are ignored, as is the MSG part of every message.
+
+// syslogMaxMessage is the largest syslog message accepted over TCP.
+const syslogMaxMessage = 64 * 1024
+
+type syslogMetric struct {
+	ident serde.Ident
+	ts    time.Time
+	value float64
+}
+
+// parseSyslogMetrics returns the data points of a syslog message, nil
+// if it carries none. An error means that it has metric elements
+// which are malformed.
+func parseSyslogMetrics(msg string, now time.Time) ([]syslogMetric, error) {
+	ts, sd, ok := splitSyslogHeader(msg)
+	if !ok {
+		return nil, nil
+	}
+	if ts.IsZero() {
+		ts = now
+	}
+	var result []syslogMetric
+	for sd != "" && sd[0] == '[' {
+		id, params, rest, err := parseSDElement(sd)
+		if err != nil {
+			return nil, err
+		}
+		sd = rest
+		if id != "metric" && !strings.HasPrefix(id, "metric@") {
+			continue
+		}
+		m := syslogMetric{ident: serde.Ident{}, ts: ts}
+		var haveValue bool
+		for _, p := range params {
+			switch p[0] {
+			case "name":
+				m.ident["name"] = misc.SanitizeName(p[1])
+			case "value":
+				if m.value, err = strconv.ParseFloat(p[1], 64); err != nil {
+					return nil, fmt.Errorf("invalid value %q", p[1])
+				}
+				haveValue = true
+			case "timestamp":
+				if m.ts, err = parseSyslogTime(p[1]); err != nil {
+					return nil, err
+				}
+			default:
+				m.ident[p[0]] = p[1]
+			}
+		}
+		if m.ident["name"] == "" || !haveValue {
+			return nil, fmt.Errorf("metric element without a name or a value: %q", msg)
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// splitSyslogHeader returns the TIMESTAMP (zero if it is "-") and
+// the STRUCTURED-DATA (and whatever follows) of an RFC5424 message,
+// ok is false if it is not one.
+func splitSyslogHeader(msg string) (ts time.Time, sd string, ok bool) {
+	end := strings.IndexByte(msg, '>')
+	if !strings.HasPrefix(msg, "<") || end < 2 || end > 4 {
+		return ts, "", false
+	}
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA...
+	fields := strings.SplitN(msg[end+1:], " ", 7)
+	if len(fields) < 7 || fields[0] != "1" {
+		return ts, "", false
+	}
+	if fields[1] != "-" {
+		var err error
+		if ts, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return ts, "", false
+		}
+	}
+	return ts, fields[6], true
+}
+
+// parseSDElement parses the SD-ELEMENT at the beginning of sd, it
+// returns its SD-ID, its params as name, value pairs, and the rest
+// of sd.
+func parseSDElement(sd string) (id string, params [][2]string, rest string, err error) {
+	i := 1
+	for i < len(sd) && sd[i] != ' ' && sd[i] != ']' {
+		i++
+	}
+	id = sd[1:i]
+	for i < len(sd) && sd[i] == ' ' {
+		eq := strings.IndexByte(sd[i:], '=')
+		if eq < 0 || i+eq+1 >= len(sd) || sd[i+eq+1] != '"' {
+			return "", nil, "", fmt.Errorf("malformed structured data param in %q", sd)
+		}
+		name := sd[i+1 : i+eq]
+		i += eq + 2
+		var value []byte
+		for ; i < len(sd) && sd[i] != '"'; i++ {
+			if sd[i] == '\\' && i+1 < len(sd) && strings.IndexByte(`"\]`, sd[i+1]) >= 0 {
+				i++
+			}
+			value = append(value, sd[i])
+		}
+		if i >= len(sd) {
+			return "", nil, "", fmt.Errorf("unterminated structured data param value in %q", sd)
+		}
+		params = append(params, [2]string{name, string(value)})
+		i++
+	}
+	if i >= len(sd) || sd[i] != ']' {
+		return "", nil, "", fmt.Errorf("unterminated structured data element in %q", sd)
+	}
+	return id, params, sd[i+1:], nil
+}
+
+// parseSyslogTime parses a timestamp param, which is either seconds
+// since the epoch or RFC3339.
+func parseSyslogTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// handleSyslogMessage queues the data points of a syslog message.
+func handleSyslogMessage(rcvr *receiver.Receiver, stats *receiver.ListenerStats, msg string) {
+	metrics, err := parseSyslogMetrics(strings.TrimRight(msg, "\r\n"), time.Now())
+	if err != nil {
+		stats.ParseError()
+		log.Printf("handleSyslogMessage(): %v", err)
+		return
+	}
+	if len(metrics) == 0 {
+		stats.Ignored()
+		return
+	}
+	for _, m := range metrics {
+		if rcvr.QueueDataPoint(m.ident, m.ts, m.value, receiver.WithSource(stats.Proto())) == nil {
+			stats.PointsAccepted(1)
+		}
+	}
+}
+
+// readSyslogFrame reads a message from a syslog TCP stream, which is
+// either octet counted ("<length> <message>") or terminated by a
+// newline (RFC6587). A newline terminated message cannot be longer
+// than the buffer of r, an octet counted one than syslogMaxMessage,
+// longer ones are an error.
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("syslog message longer than %d bytes", r.Size())
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return string(line), err
+	}
+	count, err := r.ReadSlice(' ')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("invalid syslog frame length: no space within %d bytes", r.Size())
+	}
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(string(count), " "))
+	if err != nil || n <= 0 || n > syslogMaxMessage {
+		return "", fmt.Errorf("invalid syslog frame length %q", count)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// handleSyslogTCP handles a syslog TCP connection.
+func handleSyslogTCP(rcvr *receiver.Receiver, stats *receiver.ListenerStats, conn net.Conn, timeout int) {
+	defer conn.Close() // decrements graceful.TcpWg
+
+	stats.ConnOpened()
+	defer stats.ConnClosed()
+
+	r := bufio.NewReaderSize(&statsReader{conn, stats}, syslogMaxMessage)
+	for {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		msg, err := readSyslogFrame(r)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleSyslogTCP(): Error reading: %v", err)
+			}
+			return
+		}
+		handleSyslogMessage(rcvr, stats, msg)
+	}
+}
+
+// handleSyslogUDP handles syslog datagrams, one message each. Like
+// with the other UDP listeners, the socket counts as a connection.
+func handleSyslogUDP(rcvr *receiver.Receiver, stats *receiver.ListenerStats, conn net.Conn) {
+	defer conn.Close()
+
+	stats.ConnOpened()
+	defer stats.ConnClosed()
+
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleSyslogUDP(): Error reading: %v", err)
+			}
+			return
+		}
+		stats.BytesRead(n)
+		handleSyslogMessage(rcvr, stats, string(buf[:n]))
+	}
+}
+
+// --
+
+type syslogUdpServiceManager struct {
+	rcvr       *receiver.Receiver
+	conn       net.Conn
+	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
+}
+
+func (g *syslogUdpServiceManager) Stop() {
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+func (g *syslogUdpServiceManager) File() *os.File {
+	if g.conn != nil {
+		f, _ := g.conn.(*net.UDPConn).File()
+		return f
+	}
+	return nil
+}
+
+func (g *syslogUdpServiceManager) Start(file *os.File) error {
+	var (
+		err     error
+		udpAddr *net.UDPAddr
+	)
+
+	if g.listenSpec != "" {
+		if file != nil {
+			g.conn, err = net.FileConn(file)
+		} else {
+			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(g.listenSpec))
+			if err == nil {
+				g.conn, err = net.ListenUDP("udp", udpAddr)
+			}
+		}
+	} else {
+		log.Printf("Not starting Syslog UDP protocol because syslog-udp-listen-spec is blank.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error starting Syslog UDP Protocol serviceManager: %v", err)
+	}
+
+	fmt.Printf("Syslog UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+
+	go handleSyslogUDP(g.rcvr, g.stats, filterPacketConn(g.conn, g.filter, g.stats))
+
+	return nil
+}
+
+// --
+
+type syslogTcpServiceManager struct {
+	rcvr       *receiver.Receiver
+	listener   *graceful.Listener
+	listenSpec string
+	stats      *receiver.ListenerStats
+	filter     *ipFilter
+}
+
+func (g *syslogTcpServiceManager) File() *os.File {
+	if g.listener != nil {
+		return g.listener.File()
+	}
+	return nil
+}
+
+func (g *syslogTcpServiceManager) Stop() {
+	if g.listener != nil {
+		g.listener.Close()
+	}
+}
+
+func (g *syslogTcpServiceManager) Start(file *os.File) error {
+	var (
+		gl  net.Listener
+		err error
+	)
+
+	if g.listenSpec != "" {
+		if file != nil {
+			gl, err = net.FileListener(file)
+		} else {
+			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
+		}
+	} else {
+		log.Printf("Not starting Syslog TCP protocol because syslog-tcp-listen-spec is blank.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting Syslog TCP Protocol serviceManager: %v", err)
+	}
+
+	g.listener = graceful.NewListener(gl)
+
+	fmt.Println("Syslog TCP protocol Listening on " + processListenSpec(g.listenSpec))
+
+	go g.syslogTcpServer()
+
+	return nil
+}
+
+func (g *syslogTcpServiceManager) syslogTcpServer() error {
+
+	var tempDelay time.Duration
+	for {
+		conn, err := g.listener.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("syslogTcpServer(): Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		if !g.filter.allowed(conn.RemoteAddr()) {
+			g.stats.Rejected()
+			conn.Close()
+			continue
+		}
+
+		// Devices may log rarely, hence the generous timeout
+		go handleSyslogTCP(g.rcvr, g.stats, conn, 300)
+	}
+}
@@ -109,7 +109,7 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 						if math.IsNaN(value) || math.IsInf(value, 0) {
 							fmt.Fprintf(w, "[null, %v]", ts)
 						} else {
-							fmt.Fprintf(w, "[%v, %v]", value, ts)
+							fmt.Fprintf(w, "[%s, %v]", misc.FormatFloat(value), ts)
 						}
 						n++
 					}
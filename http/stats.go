@@ -0,0 +1,64 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+)
+
+// InternalStatsHandler serves the internal stats of the receiver (see
+// Receiver.CollectStats) in the Prometheus text exposition format,
+// sorted by name. A name is prefixed with "tgres_" and has its dots
+// (and any other characters not allowed by Prometheus) replaced with
+// underscores, e.g. "receiver.datapoints.total" becomes
+// "tgres_receiver_datapoints_total". Counts are of type counter, the
+// rest are gauges.
+func InternalStatsHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, counts := rcvr.InternalStats(), rcvr.InternalStatCounts()
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, name := range names {
+			typ := "gauge"
+			if counts[name] {
+				typ = "counter"
+			}
+			pname := promName(name)
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", pname, typ, pname, misc.FormatFloat(stats[name]))
+		}
+	}
+}
+
+// promName returns name as a valid Prometheus metric name.
+func promName(name string) string {
+	return "tgres_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,250 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCPath is the HTTP/2 path of the Ingester.Ingest call.
+const GRPCPath = "/ingest.Ingester/Ingest"
+
+// maxMessageSize is the largest Batch accepted, the gRPC default.
+const maxMessageSize = 4 << 20
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+)
+
+// grpcError is an error which ends the call with a gRPC status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// NewGRPCHandler returns an http.Handler serving the Ingester service
+// of ingest.proto to gRPC clients, each Ingest call being handled by
+// Serve with q and ackEvery. It must be served over HTTP/2, e.g. by an
+// http.Server whose Protocols include unencrypted HTTP/2, since gRPC
+// clients do not upgrade from HTTP/1. Messages are not compressed.
+func NewGRPCHandler(q Queuer, ackEvery int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != GRPCPath {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "ingest: expecting a gRPC request", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.ProtoMajor != 2 {
+			http.Error(w, "ingest: gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		code, msg := grpcOK, ""
+		if err := Serve(q, &grpcStream{r: r.Body, w: w}, ackEvery); err != nil {
+			code, msg = grpcUnknown, err.Error()
+			if ge, ok := err.(*grpcError); ok {
+				code = ge.code
+			}
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", msg)
+	})
+}
+
+// grpcStream is the Stream of a gRPC call: the request body is a
+// sequence of length-prefixed Batch messages, and so is the response
+// body of Acks.
+type grpcStream struct {
+	r io.Reader
+	w http.ResponseWriter
+}
+
+func (s *grpcStream) Recv() (*Batch, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return nil, err // io.EOF between messages is the end of the stream
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "ingest: compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxMessageSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("ingest: message of %d bytes is larger than %d", n, maxMessageSize)}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(s.r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	batch, err := unmarshalBatch(msg)
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return batch, nil
+}
+
+func (s *grpcStream) Send(ack *Ack) error {
+	msg := marshalAck(ack)
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// Protocol buffer encoding of the messages of ingest.proto. There are
+// only three of them, which is not worth a dependency on protoc.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("ingest: truncated message")
+
+// eachField calls fn for every field of the protocol buffer message
+// b. The value of a varint or fixed field is in v, that of a length
+// delimited one in data.
+func eachField(b []byte, fn func(num, typ int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		num, typ := int(tag>>3), int(tag&7)
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("ingest: unsupported wire type %d", typ)
+		}
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalBatch(b []byte) (*Batch, error) {
+	batch := &Batch{}
+	err := eachField(b, func(num, typ int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == wireVarint:
+			batch.Seq = v
+		case num == 2 && typ == wireBytes:
+			p, err := unmarshalPoint(data)
+			if err != nil {
+				return err
+			}
+			batch.Points = append(batch.Points, p)
+		}
+		return nil
+	})
+	return batch, err
+}
+
+func unmarshalPoint(b []byte) (*Point, error) {
+	p := &Point{Ident: make(map[string]string)}
+	err := eachField(b, func(num, typ int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes: // a map entry
+			var key, value string
+			if err := eachField(data, func(num, typ int, _ uint64, data []byte) error {
+				if typ == wireBytes && num == 1 {
+					key = string(data)
+				} else if typ == wireBytes && num == 2 {
+					value = string(data)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			p.Ident[key] = value
+		case num == 2 && typ == wireVarint:
+			p.TimestampMs = int64(v)
+		case num == 3 && typ == wireFixed64:
+			p.Value = math.Float64frombits(v)
+		case num == 4 && typ == wireVarint:
+			p.Kind = Kind(int32(v))
+		}
+		return nil
+	})
+	return p, err
+}
+
+func marshalAck(ack *Ack) []byte {
+	var b []byte
+	for num, v := range []uint64{1: ack.Seq, 2: ack.Accepted, 3: ack.Rejected} {
+		if v != 0 { // proto3 leaves out default values
+			b = binary.AppendUvarint(b, uint64(num<<3|wireVarint))
+			b = binary.AppendUvarint(b, v)
+		}
+	}
+	return b
+}
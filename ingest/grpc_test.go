@@ -0,0 +1,166 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// The client side encoding, which the server does not need.
+
+func appendBytesField(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num<<3|wireBytes))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func marshalBatch(batch *Batch) []byte {
+	b := binary.AppendUvarint(nil, 1<<3|wireVarint)
+	b = binary.AppendUvarint(b, batch.Seq)
+	for _, p := range batch.Points {
+		var pb []byte
+		for k, v := range p.Ident {
+			pb = appendBytesField(pb, 1, appendBytesField(appendBytesField(nil, 1, []byte(k)), 2, []byte(v)))
+		}
+		pb = binary.AppendUvarint(pb, 2<<3|wireVarint)
+		pb = binary.AppendUvarint(pb, uint64(p.TimestampMs))
+		pb = binary.AppendUvarint(pb, 3<<3|wireFixed64)
+		pb = binary.LittleEndian.AppendUint64(pb, math.Float64bits(p.Value))
+		pb = binary.AppendUvarint(pb, 4<<3|wireVarint)
+		pb = binary.AppendUvarint(pb, uint64(p.Kind))
+		b = appendBytesField(b, 2, pb)
+	}
+	return b
+}
+
+func unmarshalAck(b []byte) (*Ack, error) {
+	ack := &Ack{}
+	err := eachField(b, func(num, typ int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			ack.Seq = v
+		case 2:
+			ack.Accepted = v
+		case 3:
+			ack.Rejected = v
+		}
+		return nil
+	})
+	return ack, err
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+func readAck(r io.Reader) (*Ack, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return unmarshalAck(msg)
+}
+
+func Test_unmarshalBatch(t *testing.T) {
+	batch := &Batch{Seq: 7, Points: []*Point{
+		{Ident: map[string]string{"name": "foo", "host": "a"}, TimestampMs: 1500000000000, Value: 1.5, Kind: KindGauge},
+		{Ident: map[string]string{"name": "bar"}, Value: -2},
+	}}
+	got, err := unmarshalBatch(marshalBatch(batch))
+	if err != nil || !reflect.DeepEqual(got, batch) {
+		t.Errorf("unmarshalBatch: expected %+v, got %+v (%v)", batch, got, err)
+	}
+	if _, err := unmarshalBatch(marshalBatch(batch)[:10]); err == nil {
+		t.Errorf("unmarshalBatch: expected an error for a truncated message")
+	}
+	if ack, _ := unmarshalAck(marshalAck(&Ack{Seq: 3, Rejected: 1})); *ack != (Ack{Seq: 3, Rejected: 1}) {
+		t.Errorf("marshalAck: got %+v", ack)
+	}
+}
+
+func Test_NewGRPCHandler(t *testing.T) {
+	q := &fakeQueuer{fail: "bad"}
+	srv := httptest.NewUnstartedServer(NewGRPCHandler(q, 1))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	if resp, err := http.Post(srv.URL+GRPCPath, "application/grpc", nil); err != nil || resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("NewGRPCHandler: expected HTTP/1 to be refused, got %v (%v)", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: tr}
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", srv.URL+GRPCPath, pr)
+	req.Header.Set("Content-Type", "application/grpc")
+	respCh := make(chan *http.Response)
+	go func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("Ingest: %v", err)
+			close(respCh)
+			return
+		}
+		respCh <- resp
+	}()
+
+	// A point per batch, the ack of each comes before the next is sent
+	writeFrame(pw, marshalBatch(&Batch{Seq: 1, Points: []*Point{{Ident: map[string]string{"name": "foo"}, Value: 1}}}))
+	resp := <-respCh
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if ack, err := readAck(resp.Body); err != nil || *ack != (Ack{Seq: 1, Accepted: 1}) {
+		t.Errorf("Ingest: unexpected first ack %+v (%v)", ack, err)
+	}
+	writeFrame(pw, marshalBatch(&Batch{Seq: 2, Points: []*Point{{Ident: map[string]string{"name": "bad"}, Value: 2}}}))
+	if ack, err := readAck(resp.Body); err != nil || *ack != (Ack{Seq: 2, Accepted: 1, Rejected: 1}) {
+		t.Errorf("Ingest: unexpected second ack %+v (%v)", ack, err)
+	}
+	pw.Close()
+	if ack, err := readAck(resp.Body); err != nil || *ack != (Ack{Seq: 2, Accepted: 1, Rejected: 1}) {
+		t.Errorf("Ingest: unexpected final ack %+v (%v)", ack, err)
+	}
+	if _, err := readAck(resp.Body); err != io.EOF {
+		t.Errorf("Ingest: expected the end of the response, got %v", err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Ingest: expected status 0, got %q (%q)", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	if expect := []string{"foo"}; !reflect.DeepEqual(q.queued, expect) {
+		t.Errorf("Ingest: expected %v queued, got %v", expect, q.queued)
+	}
+}
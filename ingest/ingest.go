@@ -0,0 +1,155 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ingest implements the streaming ingest protocol described
+// in ingest.proto. The types here mirror the protocol messages and
+// Serve does the work of the Ingest call, which keeps it independent
+// of the transport. NewGRPCHandler serves it to gRPC clients over
+// HTTP/2, encoding the messages itself, as protoc and the gRPC
+// packages are not among the dependencies of Tgres. Likewise,
+// ConsumeKafka ingests the messages of a Kafka topic read by way of
+// the KafkaConsumer interface.
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// Kind is how the value of a Point is to be interpreted.
+type Kind int32
+
+const (
+	KindDataPoint Kind = 0 // a rate, see Receiver.QueueDataPoint
+	KindSum       Kind = 1 // a counter/sum, see Receiver.QueueSum
+	KindGauge     Kind = 2 // a gauge, see Receiver.QueueGauge
+)
+
+// A Point is a data point.
+type Point struct {
+	Ident       map[string]string // must include "name"
+	TimestampMs int64             // milliseconds since epoch, 0 means now
+	Value       float64
+	Kind        Kind
+}
+
+// A Batch is what the client sends.
+type Batch struct {
+	Seq    uint64 // chosen by the client, echoed in the Ack
+	Points []*Point
+}
+
+// An Ack is what the server replies with.
+type Ack struct {
+	Seq      uint64 // seq of the last batch processed
+	Accepted uint64 // points accepted by the receiver so far
+	Rejected uint64 // points rejected so far
+}
+
+// Stream is the server side of an Ingest call.
+type Stream interface {
+	Recv() (*Batch, error)
+	Send(*Ack) error
+}
+
+// Queuer is where the points go, normally a *receiver.Receiver.
+type Queuer interface {
+	QueueDataPoint(serde.Ident, time.Time, float64, ...receiver.QueueOption) error
+	QueueSum(serde.Ident, float64, ...receiver.QueueOption) error
+	QueueGauge(serde.Ident, float64, ...receiver.QueueOption) error
+}
+
+// Serve receives batches from stream and queues their points until
+// the client closes the stream, sending an Ack after every ackEvery
+// batches (every batch if ackEvery is less than 1), as well as a
+// final one. A point is accepted once the Queuer has taken it, which
+// blocks when the receiver is busy, thereby slowing the client
+// down. Points without a name, with a non-finite value or an unknown
+// kind, as well as points the Queuer returns an error for (e.g. while
+// paused), are rejected.
+func Serve(q Queuer, stream Stream, ackEvery int) error {
+	var (
+		ack Ack
+		n   int
+	)
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Send(&ack)
+		}
+		if err != nil {
+			return err
+		}
+		for _, p := range batch.Points {
+			if queuePoint(q, p) == nil {
+				ack.Accepted++
+			} else {
+				ack.Rejected++
+			}
+		}
+		ack.Seq = batch.Seq
+		if n++; n >= ackEvery {
+			if err := stream.Send(&ack); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+}
+
+func queuePoint(q Queuer, p *Point) error {
+	if err := checkPoint(p); err != nil {
+		return err
+	}
+
+	ident := make(serde.Ident, len(p.Ident))
+	for k, v := range p.Ident {
+		ident[k] = v
+	}
+	ident["name"] = misc.SanitizeName(ident["name"])
+
+	switch p.Kind {
+	case KindDataPoint:
+		ts := time.Now()
+		if p.TimestampMs != 0 {
+			ts = time.Unix(0, p.TimestampMs*int64(time.Millisecond))
+		}
+		return q.QueueDataPoint(ident, ts, p.Value)
+	case KindSum:
+		return q.QueueSum(ident, p.Value)
+	case KindGauge:
+		return q.QueueGauge(ident, p.Value)
+	}
+	return fmt.Errorf("ingest: unknown kind: %d", p.Kind)
+}
+
+// checkPoint returns an error for a point which cannot be queued
+// whatever the state of the Queuer, i.e. without a name or with a
+// non-finite value.
+func checkPoint(p *Point) error {
+	if p.Ident["name"] == "" {
+		return fmt.Errorf("ingest: point without a name")
+	}
+	if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+		return fmt.Errorf("ingest: non-finite value: %v", p.Value)
+	}
+	return nil
+}
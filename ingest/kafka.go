@@ -0,0 +1,233 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A KafkaMessage is a message read from a Kafka topic.
+type KafkaMessage struct {
+	Partition int32
+	Offset    int64
+	Value     []byte
+}
+
+// KafkaConsumer is what ConsumeKafka reads messages from. It is
+// meant to be a thin adapter of a consumer (group) of a Kafka client
+// package subscribed to the topic, as no Kafka client is among the
+// dependencies of Tgres.
+type KafkaConsumer interface {
+	// Fetch returns the next message, or io.EOF once the consumer
+	// is closed.
+	Fetch() (*KafkaMessage, error)
+	// Commit commits the offset of the message (i.e. of all the
+	// messages up to and including it in its partition).
+	Commit(*KafkaMessage) error
+}
+
+// Payload formats of the messages.
+const (
+	FormatJSON   = "json"   // newline delimited JSON, see jsonPoint
+	FormatInflux = "influx" // InfluxDB line protocol
+)
+
+// jsonPoint is a line of a FormatJSON message, e.g.
+// {"ident":{"name":"foo.bar","host":"a"},"timestamp_ms":1480000000000,"value":1.5}
+type jsonPoint struct {
+	Ident       map[string]string `json:"ident"`
+	TimestampMs int64             `json:"timestamp_ms"`
+	Value       float64           `json:"value"`
+}
+
+// ConsumeKafka reads messages from c until it is closed, parses
+// their payload as per format and queues the data points to q as
+// rates (QueueDataPoint). The offset of a message is committed once
+// all of its points have been queued, every commitEvery messages
+// (every message if commitEvery is less than 1) and once more when
+// c is closed. Lines which cannot be parsed, as well as points
+// without a name or with a non-finite value, are logged and skipped,
+// their message is committed like the others. If q returns an error
+// for a point (e.g. while the receiver is paused or its queue is
+// full), the messages before it are committed and ConsumeKafka
+// returns the error without committing the message of the point,
+// thus consuming again (with a new consumer) starts with it.
+//
+// This gives at-least-once semantics: after an error, a rebalance or
+// a restart the messages after the last committed offset are
+// delivered again, including the points of a message which were
+// queued before the error. Redelivered points are not deduplicated:
+// a point older than the last update of its DS is rejected, but one
+// accepted late (see DSSpec.LateGrace and Receiver.ReorderWindow)
+// counts twice. Note that queued is not the same as stored, points
+// which were queued but not yet flushed when Tgres stops abnormally
+// are lost.
+func ConsumeKafka(q Queuer, c KafkaConsumer, format string, commitEvery int) error {
+	var parse func([]byte) ([]*Point, error)
+	switch format {
+	case FormatJSON:
+		parse = parseJSONLine
+	case FormatInflux:
+		parse = parseInfluxLine
+	default:
+		return fmt.Errorf("ConsumeKafka: unknown format: %q (valid: json, influx)", format)
+	}
+
+	// The last message of every partition not yet committed
+	pending := make(map[int32]*KafkaMessage)
+	commit := func() error {
+		for p, m := range pending {
+			if err := c.Commit(m); err != nil {
+				return err
+			}
+			delete(pending, p)
+		}
+		return nil
+	}
+
+	n := 0
+	for {
+		m, err := c.Fetch()
+		if err == io.EOF {
+			return commit()
+		}
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(m.Value))
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			points, err := parse(line)
+			if err != nil {
+				log.Printf("ConsumeKafka: partition %d offset %d: %v", m.Partition, m.Offset, err)
+				continue
+			}
+			for _, p := range points {
+				if err := checkPoint(p); err != nil {
+					log.Printf("ConsumeKafka: partition %d offset %d: %v", m.Partition, m.Offset, err)
+					continue
+				}
+				if err := queuePoint(q, p); err != nil {
+					if cerr := commit(); cerr != nil {
+						return cerr
+					}
+					return fmt.Errorf("ConsumeKafka: partition %d offset %d: %v", m.Partition, m.Offset, err)
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("ConsumeKafka: partition %d offset %d: %v", m.Partition, m.Offset, err)
+		}
+
+		pending[m.Partition] = m
+		if n++; n >= commitEvery {
+			if err := commit(); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+}
+
+func parseJSONLine(line []byte) ([]*Point, error) {
+	var jp jsonPoint
+	if err := json.Unmarshal(line, &jp); err != nil {
+		return nil, err
+	}
+	return []*Point{{Ident: jp.Ident, TimestampMs: jp.TimestampMs, Value: jp.Value, Kind: KindDataPoint}}, nil
+}
+
+// parseInfluxLine parses a line of the InfluxDB line protocol, e.g.
+//
+//	cpu,host=a,region=b user=1.5,system=2i 1480000000000000000
+//
+// Every numeric field becomes a point named measurement.field, or
+// just measurement if the field is called "value", with the tags as
+// the other ident tags. String, boolean and non-finite (NaN, +Inf,
+// -Inf) fields are ignored. The time stamp is in nanoseconds and is
+// optional. Escaped separators are not supported.
+func parseInfluxLine(line []byte) ([]*Point, error) {
+	parts := strings.Fields(string(line))
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid line protocol: %q", line)
+	}
+
+	var tsMs int64
+	if len(parts) == 3 {
+		ns, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time stamp: %q", parts[2])
+		}
+		tsMs = ns / int64(time.Millisecond)
+	}
+
+	tags := strings.Split(parts[0], ",")
+	measurement := tags[0]
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement: %q", line)
+	}
+
+	var result []*Point
+	for _, field := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid field: %q", field)
+		}
+		value, ok := influxValue(kv[1])
+		if !ok {
+			continue
+		}
+		ident := make(map[string]string, len(tags))
+		for _, tag := range tags[1:] {
+			tkv := strings.SplitN(tag, "=", 2)
+			if len(tkv) != 2 {
+				return nil, fmt.Errorf("invalid tag: %q", tag)
+			}
+			ident[tkv[0]] = tkv[1]
+		}
+		ident["name"] = measurement
+		if kv[0] != "value" {
+			ident["name"] = measurement + "." + kv[0]
+		}
+		result = append(result, &Point{Ident: ident, TimestampMs: tsMs, Value: value, Kind: KindDataPoint})
+	}
+	return result, nil
+}
+
+// influxValue parses a numeric field value (a float, or an integer
+// with an "i" suffix). It returns false for strings, booleans and
+// non-finite values.
+func influxValue(s string) (float64, bool) {
+	s = strings.TrimSuffix(s, "i")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
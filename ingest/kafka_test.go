@@ -0,0 +1,133 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeConsumer struct {
+	msgs    []*KafkaMessage
+	commits []string // partition:offset
+}
+
+func (c *fakeConsumer) Fetch() (*KafkaMessage, error) {
+	if len(c.msgs) == 0 {
+		return nil, io.EOF
+	}
+	m := c.msgs[0]
+	c.msgs = c.msgs[1:]
+	return m, nil
+}
+
+func (c *fakeConsumer) Commit(m *KafkaMessage) error {
+	c.commits = append(c.commits, fmt.Sprintf("%d:%d", m.Partition, m.Offset))
+	return nil
+}
+
+type fakeQueuer struct {
+	queued []string
+	fail   string // name to return an error for
+}
+
+func (q *fakeQueuer) QueueDataPoint(ident serde.Ident, ts time.Time, v float64, _ ...receiver.QueueOption) error {
+	if ident["name"] == q.fail {
+		return receiver.ErrPaused
+	}
+	q.queued = append(q.queued, ident["name"])
+	return nil
+}
+func (q *fakeQueuer) QueueSum(serde.Ident, float64, ...receiver.QueueOption) error   { return nil }
+func (q *fakeQueuer) QueueGauge(serde.Ident, float64, ...receiver.QueueOption) error { return nil }
+
+func Test_ConsumeKafka(t *testing.T) {
+	c := &fakeConsumer{msgs: []*KafkaMessage{
+		{Partition: 0, Offset: 1, Value: []byte(`{"ident":{"name":"foo"},"value":1}` + "\nnot json\n")},
+		{Partition: 1, Offset: 7, Value: []byte("cpu,host=a user=1.5,system=2i\n")},
+		{Partition: 0, Offset: 2, Value: []byte(`{"ident":{"name":"bar"},"value":2}`)},
+	}}
+	q := &fakeQueuer{}
+	if err := ConsumeKafka(q, c, FormatJSON+"x", 1); err == nil {
+		t.Errorf("ConsumeKafka: expected an error for an unknown format")
+	}
+	if err := ConsumeKafka(q, c, FormatJSON, 10); err != nil {
+		t.Errorf("ConsumeKafka: %v", err)
+	}
+	if expect := []string{"foo", "bar"}; !reflect.DeepEqual(q.queued, expect) {
+		t.Errorf("ConsumeKafka: expected %v queued, got %v", expect, q.queued)
+	}
+	if len(c.commits) != 2 {
+		t.Errorf("ConsumeKafka: expected the last message of both partitions committed at the end, got %v", c.commits)
+	}
+}
+
+func Test_ConsumeKafka_queueError(t *testing.T) {
+	c := &fakeConsumer{msgs: []*KafkaMessage{
+		{Partition: 0, Offset: 1, Value: []byte(`{"ident":{"name":"foo"},"value":1}`)},
+		{Partition: 1, Offset: 5, Value: []byte(`{"ident":{"name":"foo"},"value":1}`)},
+		{Partition: 0, Offset: 2, Value: []byte(`{"ident":{"name":"foo"},"value":1}` + "\n" + `{"ident":{"name":"bar"},"value":2}`)},
+		{Partition: 0, Offset: 3, Value: []byte(`{"ident":{"name":"foo"},"value":3}`)},
+	}}
+	q := &fakeQueuer{fail: "bar"}
+	if err := ConsumeKafka(q, c, FormatJSON, 10); err == nil {
+		t.Fatalf("ConsumeKafka: expected the queue error")
+	}
+	committed := make(map[string]bool)
+	for _, cm := range c.commits {
+		committed[cm] = true
+	}
+	if len(c.commits) != 2 || !committed["0:1"] || !committed["1:5"] {
+		t.Errorf("ConsumeKafka: expected only the messages before the failed one committed, got %v", c.commits)
+	}
+	if len(c.msgs) != 1 {
+		t.Errorf("ConsumeKafka: expected to stop at the failed message, %d left", len(c.msgs))
+	}
+}
+
+func Test_ConsumeKafka_invalidPoint(t *testing.T) {
+	c := &fakeConsumer{msgs: []*KafkaMessage{
+		{Partition: 0, Offset: 1, Value: []byte(`{"ident":{"host":"a"},"value":1}`)},
+		{Partition: 0, Offset: 2, Value: []byte(`{"ident":{"name":"foo"},"value":2}`)},
+	}}
+	q := &fakeQueuer{}
+	if err := ConsumeKafka(q, c, FormatJSON, 1); err != nil {
+		t.Fatalf("ConsumeKafka: expected a point without a name to be skipped, got %v", err)
+	}
+	if expect := []string{"foo"}; !reflect.DeepEqual(q.queued, expect) {
+		t.Errorf("ConsumeKafka: expected %v queued, got %v", expect, q.queued)
+	}
+	if expect := []string{"0:1", "0:2"}; !reflect.DeepEqual(c.commits, expect) {
+		t.Errorf("ConsumeKafka: expected the invalid message committed too, got %v", c.commits)
+	}
+
+	c = &fakeConsumer{msgs: []*KafkaMessage{
+		{Partition: 0, Offset: 1, Value: []byte("cpu x=+Inf,y=-Inf,z=NaN,value=1")},
+	}}
+	q = &fakeQueuer{}
+	if err := ConsumeKafka(q, c, FormatInflux, 1); err != nil {
+		t.Fatalf("ConsumeKafka: %v", err)
+	}
+	if expect := []string{"cpu"}; !reflect.DeepEqual(q.queued, expect) {
+		t.Errorf("ConsumeKafka: expected only the finite field queued, got %v", q.queued)
+	}
+}
@@ -65,3 +65,21 @@ func BetterParseDuration(s string) (time.Duration, error) {
 		return d, nil
 	}
 }
+
+// FloatDigits is the number of significant digits with which
+// FormatFloat renders values. Zero (the default) means as many as
+// necessary to represent the value exactly, and no more.
+var FloatDigits = 0
+
+// FormatFloat renders a float64 for text output (e.g. the Graphite
+// render API or the internal stats at /metrics) rounded to
+// FloatDigits significant digits. Exponent (scientific) notation is
+// never used, since not every parser supports it. All text output
+// should go through this function so that values look the same
+// everywhere.
+func FormatFloat(f float64) string {
+	if FloatDigits > 0 {
+		f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', FloatDigits, 64), 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/statsd"
 )
 
@@ -111,6 +112,90 @@ func reportAggChannelFillPercent(aggCh chan *aggregator.Command, sr statReporter
 	}
 }
 
+// How long to wait before retrying to queue aggregated data points.
+var aggRetryBackoff = 100 * time.Millisecond
+
+// How many times to retry queueing aggregated data points on exit.
+var aggExitRetries = 10
+
+// How long Relinquish waits for the aggWorker to flush.
+var aggRelinquishTimeout = 5 * time.Second
+
+type dataPointTryQueuer interface {
+	tryQueueDataPoint(serde.Ident, time.Time, float64) bool
+}
+
+// aggRetryQueue is the aggregator.DataPointQueuer used by the
+// aggWorker. It queues data points without blocking, and those that
+// cannot be queued because the receiver is busy are kept in a bounded
+// buffer to be retried later. Losing aggregated points is worse than
+// losing regular points, since each one represents many observations.
+type aggRetryQueue struct {
+	dpq     dataPointTryQueuer
+	sr      statReporter
+	max     int
+	pending []*incomingDP
+}
+
+func (q *aggRetryQueue) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	// Retry first so that points are queued in order
+	if q.retry() && q.dpq.tryQueueDataPoint(ident, ts, v) {
+		return
+	}
+	if len(q.pending) >= q.max {
+		q.sr.reportStatCount("receiver.aggworker.retry.dropped", 1)
+		return
+	}
+	q.pending = append(q.pending, &incomingDP{Ident: ident, TimeStamp: ts, Value: v})
+}
+
+// retry attempts to queue the pending data points and returns true
+// if none are left.
+func (q *aggRetryQueue) retry() bool {
+	for len(q.pending) > 0 {
+		dp := q.pending[0]
+		if !q.dpq.tryQueueDataPoint(dp.Ident, dp.TimeStamp, dp.Value) {
+			return false
+		}
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+	}
+	return true
+}
+
+// aggDirectQueue is the aggregator.DataPointQueuer used by the
+// aggWorker with AggDirect: data points for cached DSs are sent
+// straight to the worker responsible for the DS, skipping the
+// director, the rest go to next.
+type aggDirectQueue struct {
+	dsc       *dsCache
+	workerChs workerChannels
+	sr        statReporter
+	next      aggregator.DataPointQueuer
+	touched   map[int64]*cachedDs // queued to, not yet flushed
+}
+
+func (q *aggDirectQueue) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	cds := q.dsc.getByIdent(ident)
+	if cds == nil {
+		q.next.QueueDataPoint(ident, ts, v)
+		return
+	}
+	q.workerChs.queue(&incomingDP{Ident: ident, TimeStamp: ts, Value: v}, cds)
+	q.touched[cds.Id()] = cds
+	q.sr.reportStatCount("receiver.aggworker.agg.direct", 1)
+}
+
+// flush asks the workers to flush the DSs queued to. The worker
+// applies the points queued before the request first, a DS which
+// cannot be flushed (rate limited) is left to its periodic flush.
+func (q *aggDirectQueue) flush() {
+	for id, cds := range q.touched {
+		q.workerChs.queueFlush(cds)
+		delete(q.touched, id)
+	}
+}
+
 var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration time.Duration, statsNamePrefix string, sr statReporter, dpq *Receiver) {
 
 	wc.onEnter()
@@ -136,9 +221,20 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 
 	statsd.Prefix = statsNamePrefix
 
-	agg := aggregator.NewAggregator(dpq) // aggregator.dataPointQueuer
+	retryq := &aggRetryQueue{dpq: dpq, sr: sr, max: dpq.AggRetryQueueSize}
+	var (
+		queuer aggregator.DataPointQueuer = retryq
+		direct *aggDirectQueue
+	)
+	if dpq.AggDirect && clstr == nil && dpq.flusher != nil && dpq.flusher.enabled() {
+		direct = &aggDirectQueue{dsc: dpq.dsc, workerChs: dpq.workerChs, sr: sr, next: retryq, touched: make(map[int64]*cachedDs)}
+		queuer = direct
+	}
+	agg := aggregator.NewAggregatorSize(queuer, dpq.AggCardinality) // aggregator.dataPointQueuer
 	agg.AppendAttr = "name"
-	aggDd := &distDatumAggregator{agg}
+	agg.NodeSumWindow = dpq.ClusterSumWindow
+	agg.ZeroFillCounters = dpq.AggQuietCounterPolicy == QuietCounterZeroFill
+	aggDd := &distDatumAggregator{Aggregator: agg, relinquishCh: make(chan chan bool)}
 	if clstr != nil {
 		clstr.LoadDistData(func() ([]cluster.DistDatum, error) {
 			log.Printf("%s: adding the aggregator.Aggregator DistDatum to the cluster", wc.ident())
@@ -146,23 +242,85 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 		})
 	}
 
+	var flushesDropped int64 // as of the last periodic
+	periodic := func(now time.Time) {
+		dpq.checkStaleness(now)
+		dpq.checkStepUp(now)
+		sr.reportStatGauge("receiver.goroutines", float64(dpq.Goroutines()))
+		sr.reportStatGauge("receiver.cache.oldest_unflushed_age", dpq.oldestUnflushedAge(now).Seconds())
+		dropped := dpq.flushesDropped()
+		sr.reportStatCount("serde.flushes_dropped", float64(dropped-flushesDropped))
+		flushesDropped = dropped
+	}
+	flush := func(now time.Time) {
+		agg.Flush(now)
+		if direct != nil {
+			direct.flush()
+		}
+		periodic(now)
+	}
+
+	// onTick is flush at the end of a period, unless the flush is
+	// so late that it is an overrun.
+	onTick := func(now time.Time) {
+		if statFlushDuration <= 0 || time.Since(now) < statFlushDuration {
+			flush(now)
+			return
+		}
+		log.Printf("%s: aggregator overrun, flush of %v is late by %v", wc.ident(), now, time.Since(now))
+		sr.reportStatCount("receiver.aggworker.agg.overrun", 1)
+		switch dpq.AggOverrunPolicy {
+		case AggOverrunExtend:
+			flush(time.Now())
+		case AggOverrunSkip:
+			agg.Discard(time.Now())
+			periodic(now)
+		default:
+			flush(now)
+		}
+	}
+
+	var retryCh <-chan time.Time // nil unless there are points to retry
+
 	for {
 		// It's nice to flush stats at as precise time as
 		// possible. This non-blocking select trick guarantees that we
 		// always process flushCh even if there is stuff in the stCh.
 		select {
 		case now := <-flushCh:
-			agg.Flush(now)
+			onTick(now)
 		default:
 		}
 
+		if retryCh == nil && len(retryq.pending) > 0 {
+			retryCh = time.After(aggRetryBackoff)
+		}
+
 		select {
 		case now := <-flushCh:
-			agg.Flush(now)
+			onTick(now)
+		case <-retryCh:
+			retryCh = nil
+			retryq.retry()
+		case done := <-aggDd.relinquishCh:
+			// Another node is taking over, flush the partial window
+			log.Printf("%s: relinquishing the aggregator, flushing", wc.ident())
+			flush(time.Now())
+			close(done)
 		case ac, ok := <-aggCh:
 			if !ok {
 				log.Printf("%s: channel closed, performing last flush", wc.ident())
 				agg.Flush(time.Now())
+				if direct != nil {
+					direct.flush()
+				}
+				for i := 0; i < aggExitRetries && !retryq.retry(); i++ {
+					time.Sleep(aggRetryBackoff)
+				}
+				if len(retryq.pending) > 0 {
+					log.Printf("%s: dropping %d aggregated data points on exit", wc.ident(), len(retryq.pending))
+					sr.reportStatCount("receiver.aggworker.retry.dropped", float64(len(retryq.pending)))
+				}
 				return
 			}
 
@@ -180,13 +338,29 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 
 type distDatumAggregator struct {
 	aggregator.Aggregator
+	relinquishCh chan chan bool // flush requests to the aggWorker, nil means flush directly
 }
 
 func (d *distDatumAggregator) Id() int64       { return 1 }
 func (d *distDatumAggregator) Type() string    { return "aggregator.Aggregator" }
 func (d *distDatumAggregator) GetName() string { return "TheAggregator" }
+
+// Relinquish flushes the aggregator so that its partial window is
+// not lost when another node takes it over. The aggregator belongs to
+// the aggWorker goroutine, which is asked to do the flush.
 func (d *distDatumAggregator) Relinquish() error {
-	d.Flush(time.Now())
-	return nil
+	if d.relinquishCh == nil {
+		d.Flush(time.Now())
+		return nil
+	}
+	done := make(chan bool)
+	select {
+	case d.relinquishCh <- done:
+		<-done
+		return nil
+	case <-time.After(aggRelinquishTimeout):
+		return fmt.Errorf("distDatumAggregator: timed out waiting for aggWorker to flush")
+	}
 }
+
 func (d *distDatumAggregator) Acquire() error { return nil }
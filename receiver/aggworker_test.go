@@ -27,6 +27,8 @@ import (
 	"github.com/hashicorp/memberlist"
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 func Test_aggworkerIncomingAggCmds(t *testing.T) {
@@ -199,7 +201,7 @@ func Test_aggworkerProcessOrForward(t *testing.T) {
 
 	ac := aggregator.NewCommand(aggregator.CmdAdd, "foo", 123)
 	agg := &fakeAggregatorer{}
-	aggDd := &distDatumAggregator{agg}
+	aggDd := &distDatumAggregator{Aggregator: agg}
 
 	// cluster
 	clstr := &fakeCluster{}
@@ -347,9 +349,181 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	aggWorkerIncomingAggCmds, aggWorkerPeriodicFlushSignal, aggWorkerProcessOrForward = saveFn1, saveFn2, saveFn3
 }
 
+func Test_aggworker_overrun(t *testing.T) {
+	saveFn := aggWorkerPeriodicFlushSignal
+	defer func() { aggWorkerPeriodicFlushSignal = saveFn }()
+
+	late := time.Now().Add(-time.Hour)
+	for _, policy := range []AggOverrunPolicy{AggOverrunQueue, AggOverrunExtend, AggOverrunSkip} {
+		ticks := make(chan time.Time)
+		aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur time.Duration) {
+			for tick := range ticks {
+				flushCh <- tick
+			}
+		}
+		wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "aggident"}
+		aggCh := make(chan *aggregator.Command)
+		r := &Receiver{dpChs: newDirectorChannels(1, 10), AggOverrunPolicy: policy}
+
+		wc.startWg.Add(1)
+		go aggWorker(wc, aggCh, nil, time.Minute, "prefix", &fakeSr{}, r)
+		wc.startWg.Wait()
+
+		aggCh <- aggregator.NewCommand(aggregator.CmdSetGauge, serde.Ident{"name": "foo"}, 1)
+		ticks <- late
+		time.Sleep(10 * time.Millisecond) // for the tick to be processed before the close
+		close(aggCh)
+		wc.wg.Wait()
+		close(ticks)
+
+		switch policy {
+		case AggOverrunQueue:
+			if len(r.dpChs[0]) != 1 || !(<-r.dpChs[0]).TimeStamp.Equal(late) {
+				t.Errorf("aggWorker: with AggOverrunQueue, expected a data point stamped with the late tick")
+			}
+		case AggOverrunExtend:
+			if len(r.dpChs[0]) != 1 || (<-r.dpChs[0]).TimeStamp.Before(late.Add(time.Minute)) {
+				t.Errorf("aggWorker: with AggOverrunExtend, expected a data point stamped with the time of the flush")
+			}
+		case AggOverrunSkip:
+			if len(r.dpChs[0]) != 0 {
+				t.Errorf("aggWorker: with AggOverrunSkip, expected no data points, got %d", len(r.dpChs[0]))
+			}
+		}
+	}
+}
+
+func Test_aggworker_quietCounters(t *testing.T) {
+	if p, err := ParseQuietCounterPolicy("Zero-Fill"); p != QuietCounterZeroFill || err != nil {
+		t.Errorf("ParseQuietCounterPolicy: expected QuietCounterZeroFill, got %v (%v)", p, err)
+	}
+	if _, err := ParseQuietCounterPolicy("bogus"); err == nil {
+		t.Errorf("ParseQuietCounterPolicy: expected an error")
+	}
+
+	saveFn := aggWorkerPeriodicFlushSignal
+	defer func() { aggWorkerPeriodicFlushSignal = saveFn }()
+
+	for _, policy := range []QuietCounterPolicy{QuietCounterDelete, QuietCounterZeroFill} {
+		ticks := make(chan time.Time)
+		aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur time.Duration) {
+			for tick := range ticks {
+				flushCh <- tick
+			}
+		}
+		wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "aggident"}
+		aggCh := make(chan *aggregator.Command)
+		r := &Receiver{dpChs: newDirectorChannels(1, 10), AggQuietCounterPolicy: policy}
+
+		wc.startWg.Add(1)
+		go aggWorker(wc, aggCh, nil, time.Minute, "prefix", &fakeSr{}, r)
+		wc.startWg.Wait()
+
+		aggCh <- aggregator.NewCommand(aggregator.CmdAdd, serde.Ident{"name": "foo"}, 10)
+		time.Sleep(time.Millisecond)
+		ticks <- time.Now()
+		time.Sleep(time.Millisecond)
+		ticks <- time.Now() // a period without foo
+		time.Sleep(10 * time.Millisecond)
+		close(aggCh)
+		wc.wg.Wait()
+		close(ticks)
+
+		switch policy {
+		case QuietCounterDelete:
+			if len(r.dpChs[0]) != 1 {
+				t.Errorf("aggWorker: with QuietCounterDelete, expected 1 data point, got %d", len(r.dpChs[0]))
+			}
+		case QuietCounterZeroFill:
+			// the last flush on close zero-fills foo as well
+			if len(r.dpChs[0]) != 3 {
+				t.Fatalf("aggWorker: with QuietCounterZeroFill, expected 3 data points, got %d", len(r.dpChs[0]))
+			}
+			if first, second := <-r.dpChs[0], <-r.dpChs[0]; first.Value <= 0 || second.Value != 0 {
+				t.Errorf("aggWorker: with QuietCounterZeroFill, expected a rate then 0, got %v, %v", first.Value, second.Value)
+			}
+		}
+	}
+}
+
+func Test_aggworker_aggRetryQueue(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP, 2)}}
+	sr := &fakeSr{}
+	q := &aggRetryQueue{dpq: r, sr: sr, max: 2}
+
+	ts := time.Now()
+	for i := 0; i < 5; i++ {
+		q.QueueDataPoint(serde.Ident{"name": "foo"}, ts, float64(i))
+	}
+	if len(r.dpChs[0]) != 2 || len(q.pending) != 2 {
+		t.Errorf("aggRetryQueue: expected 2 queued and 2 pending, got %d and %d", len(r.dpChs[0]), len(q.pending))
+	}
+	if sr.called != 1 {
+		t.Errorf("aggRetryQueue: expected 1 drop to be reported, got %d", sr.called)
+	}
+
+	<-r.dpChs[0]
+	<-r.dpChs[0]
+	if !q.retry() || len(r.dpChs[0]) != 2 {
+		t.Errorf("aggRetryQueue: retry should have queued all pending points")
+	}
+	// order is preserved
+	if dp := <-r.dpChs[0]; dp.Value != 2 {
+		t.Errorf("aggRetryQueue: expected value 2, got %v", dp.Value)
+	}
+}
+
+func Test_aggworker_aggDirectQueue(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP, 2)}}
+	sr := &fakeSr{}
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	dsc := newDsCache(nil, nil, dsf)
+	foo := serde.Ident{"name": "foo"}
+	cds := &cachedDs{DbDataSourcer: serde.NewDbDataSource(1, foo, rrd.NewDataSource(*DftDSSPec))}
+	dsc.insert(cds)
+	workerCh := make(chan *incomingDpWithDs, 10)
+	q := &aggDirectQueue{dsc: dsc, workerChs: workerChannels{workerCh}, sr: sr, next: &aggRetryQueue{dpq: r, sr: sr, max: 2}, touched: make(map[int64]*cachedDs)}
+
+	// The worker applies and flushes the points, as it does for
+	// any other, so it runs concurrently with the queue.
+	wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+	wc.startWg.Add(1)
+	go worker(wc, dsf, workerCh, 0, 0, 10, time.Hour, 0, AlignNone, FlushAnyOrder, nil, nil, &fakeSr{})
+	wc.startWg.Wait()
+
+	ts := time.Now()
+	q.QueueDataPoint(foo, ts.Add(-time.Minute), 1)
+	q.QueueDataPoint(foo, ts, 2)
+	q.QueueDataPoint(serde.Ident{"name": "bar"}, ts, 3)
+
+	if len(r.dpChs[0]) != 1 {
+		t.Errorf("aggDirectQueue: expected the uncached DS point to be queued, got %d", len(r.dpChs[0]))
+	}
+	if len(q.touched) != 1 {
+		t.Errorf("aggDirectQueue: expected the cached DS to be touched")
+	}
+
+	q.flush()
+	if len(q.touched) != 0 {
+		t.Errorf("aggDirectQueue: expected the flush request to be sent")
+	}
+	close(workerCh)
+	wc.wg.Wait()
+
+	if dsf.called != 1 {
+		t.Errorf("aggDirectQueue: expected the worker to flush the DS once, got %d", dsf.called)
+	}
+	if !cds.LastUpdate().Equal(ts) {
+		t.Errorf("aggDirectQueue: expected the points to be applied, last update %v", cds.LastUpdate())
+	}
+	if cds.lastFlushRT.IsZero() {
+		t.Errorf("aggDirectQueue: expected the last flush time to be set")
+	}
+}
+
 func Test_aggworker_distDatumAggregator(t *testing.T) {
 	agg := &fakeAggregatorer{}
-	aggDd := &distDatumAggregator{agg}
+	aggDd := &distDatumAggregator{Aggregator: agg}
 
 	if aggDd.Id() != 1 {
 		t.Errorf("distDatumAggregator.Id() != 1")
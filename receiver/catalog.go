@@ -0,0 +1,188 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// catalogDS is how ExportCatalog writes a DS, as one line of JSON.
+// Durations are in milliseconds, like in the database.
+type catalogDS struct {
+	Ident       serde.Ident  `json:"ident"`
+	StepMs      int64        `json:"step_ms"`
+	HeartbeatMs int64        `json:"heartbeat_ms"`
+	RRAs        []catalogRRA `json:"rras"`
+}
+
+type catalogRRA struct {
+	Function string  `json:"cf"`
+	StepMs   int64   `json:"step_ms"`
+	SpanMs   int64   `json:"span_ms"`
+	Xff      float32 `json:"xff"`
+}
+
+type catalogByIdent []*catalogDS
+
+func (c catalogByIdent) Len() int           { return len(c) }
+func (c catalogByIdent) Less(i, j int) bool { return c[i].Ident.String() < c[j].Ident.String() }
+func (c catalogByIdent) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// The consolidation functions by rrd.Consolidation, PERCENTILE is
+// named after its percentile, see rrd.PercentileName.
+var catalogCFs = []string{"WMEAN", "MAX", "MIN", "LAST"}
+
+func newCatalogDS(ds serde.DbDataSourcer) *catalogDS {
+	c := &catalogDS{
+		Ident:       ds.Ident(),
+		StepMs:      ds.Step().Nanoseconds() / 1e6,
+		HeartbeatMs: ds.Heartbeat().Nanoseconds() / 1e6,
+		RRAs:        []catalogRRA{},
+	}
+	for _, rra := range ds.RRAs() {
+		cf := fmt.Sprintf("%d", rra.Consolidation())
+		if rra.Consolidation() == rrd.PERCENTILE {
+			cf = rrd.PercentileName(rra.Percentile())
+		} else if int(rra.Consolidation()) < len(catalogCFs) {
+			cf = catalogCFs[rra.Consolidation()]
+		}
+		c.RRAs = append(c.RRAs, catalogRRA{
+			Function: cf,
+			StepMs:   rra.Step().Nanoseconds() / 1e6,
+			SpanMs:   rra.Step().Nanoseconds() / 1e6 * rra.Size(),
+			Xff:      rra.Xff(),
+		})
+	}
+	return c
+}
+
+// spec returns the DSSpec to create the DS with.
+func (c *catalogDS) spec() (*rrd.DSSpec, error) {
+	if len(c.Ident) == 0 || c.StepMs <= 0 {
+		return nil, fmt.Errorf("invalid data source %v: an ident and a step are required", c.Ident)
+	}
+	spec := &rrd.DSSpec{
+		Step:      time.Duration(c.StepMs) * time.Millisecond,
+		Heartbeat: time.Duration(c.HeartbeatMs) * time.Millisecond,
+	}
+	for _, r := range c.RRAs {
+		cf := -1
+		for i, name := range catalogCFs {
+			if name == r.Function {
+				cf = i
+			}
+		}
+		pct, ok := rrd.ParsePercentileName(r.Function)
+		if ok {
+			cf = int(rrd.PERCENTILE)
+		}
+		if cf < 0 {
+			return nil, fmt.Errorf("invalid consolidation %q of data source %v", r.Function, c.Ident)
+		}
+		if r.StepMs <= 0 || r.SpanMs < r.StepMs || r.SpanMs%r.StepMs != 0 {
+			return nil, fmt.Errorf("invalid RRA step %dms and span %dms of data source %v", r.StepMs, r.SpanMs, c.Ident)
+		}
+		spec.RRAs = append(spec.RRAs, rrd.RRASpec{
+			Function:   rrd.Consolidation(cf),
+			Percentile: pct,
+			Step:       time.Duration(r.StepMs) * time.Millisecond,
+			Span:       time.Duration(r.SpanMs) * time.Millisecond,
+			Xff:        r.Xff,
+		})
+	}
+	return spec, nil
+}
+
+// ExportCatalog writes the definitions of all the DSs in the database
+// (not just the cached ones) to w: the ident, the step and the
+// heartbeat of every DS along with the consolidation, step, span and
+// XFF of its RRAs, but no data. It is meant for recreating the DSs
+// with ImportCatalog, e.g. on a fresh database when recovering from a
+// disaster, before backfilling the data. The format is one JSON
+// object per line, one line per DS, sorted by ident, thus exporting
+// the same DSs always writes the same catalog. It returns the number
+// of DSs written.
+func (r *Receiver) ExportCatalog(w io.Writer) (int, error) {
+	dss, err := r.serde.Fetcher().FetchDataSources()
+	if err != nil {
+		return 0, fmt.Errorf("ExportCatalog: %v", err)
+	}
+	var entries []*catalogDS
+	for _, ds := range dss {
+		if dbds, ok := ds.(serde.DbDataSourcer); ok {
+			entries = append(entries, newCatalogDS(dbds))
+		}
+	}
+	sort.Sort(catalogByIdent(entries))
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw) // Encode ends every object with a newline
+	for _, c := range entries {
+		if err := enc.Encode(c); err != nil {
+			return 0, fmt.Errorf("ExportCatalog: %v", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("ExportCatalog: %v", err)
+	}
+	return len(entries), nil
+}
+
+// ImportCatalog creates the DSs of a catalog written by ExportCatalog
+// in the database, by way of the SerDe, as if their first data
+// points had arrived. A DS which already exists is not changed,
+// except that RRAs it does not have are added. The whole catalog is
+// checked before anything is created. It returns the number of DSs
+// imported.
+func (r *Receiver) ImportCatalog(rd io.Reader) (int, error) {
+	if r.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	type entry struct {
+		ident serde.Ident
+		spec  *rrd.DSSpec
+	}
+	var entries []entry
+	dec := json.NewDecoder(rd)
+	for {
+		var c catalogDS
+		if err := dec.Decode(&c); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("ImportCatalog: entry %d: %v", len(entries)+1, err)
+		}
+		spec, err := c.spec()
+		if err != nil {
+			return 0, fmt.Errorf("ImportCatalog: entry %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry{c.Ident, spec})
+	}
+
+	for n, e := range entries {
+		if _, err := r.serde.Fetcher().FetchOrCreateDataSource(e.ident, e.spec); err != nil {
+			return n, fmt.Errorf("ImportCatalog: %v: %v", e.ident, err)
+		}
+	}
+	return len(entries), nil
+}
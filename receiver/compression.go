@@ -0,0 +1,94 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Compression is a compression format for snapshots. Compressed
+// data must begin with Magic, which is how the format is recognized
+// when reading, so that files written with any (or no) compression
+// can be read back regardless of the current setting.
+type Compression struct {
+	Name      string
+	Magic     []byte
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.Reader, error)
+}
+
+var compressions = struct {
+	sync.RWMutex
+	byName map[string]*Compression
+}{byName: map[string]*Compression{
+	"gzip": {
+		Name:      "gzip",
+		Magic:     []byte{0x1f, 0x8b},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	},
+}}
+
+// RegisterCompression makes a compression format available by its
+// name, replacing any format previously registered with the same
+// name. Only gzip is built in, other formats (e.g. snappy or zstd)
+// can be registered by the program using their respective packages.
+func RegisterCompression(c *Compression) {
+	compressions.Lock()
+	defer compressions.Unlock()
+	compressions.byName[c.Name] = c
+}
+
+// compressWriter returns an io.WriteCloser which compresses to w
+// using the named compression. An empty name or "none" means no
+// compression, in which case Close is a noop.
+func compressWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	if name == "" || name == "none" {
+		return nopWriteCloser{w}, nil
+	}
+	compressions.RLock()
+	c := compressions.byName[name]
+	compressions.RUnlock()
+	if c == nil {
+		return nil, fmt.Errorf("unknown compression: %q", name)
+	}
+	return c.NewWriter(w)
+}
+
+// decompressReader detects the compression of r from its first bytes
+// and returns a reader of the decompressed data. If no registered
+// format matches, the data is assumed to be uncompressed.
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	compressions.RLock()
+	defer compressions.RUnlock()
+	for _, c := range compressions.byName {
+		magic, _ := br.Peek(len(c.Magic))
+		if len(c.Magic) > 0 && bytes.Equal(magic, c.Magic) {
+			return c.NewReader(br)
+		}
+	}
+	return br, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -17,14 +17,97 @@ package receiver
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/serde"
 )
 
-var directorincomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan *incomingDP) {
+// directorChannels are the input channels of the directors, one per
+// director. A data point always goes to the same director based on
+// its ident, so that the points of a DS are processed in the order
+// in which they were queued.
+type directorChannels []chan *incomingDP
+
+func newDirectorChannels(n, size int) directorChannels {
+	result := make(directorChannels, n)
+	for i := range result {
+		result[i] = make(chan *incomingDP, size)
+	}
+	return result
+}
+
+// forIdent returns the channel of the director responsible for ident.
+func (d directorChannels) forIdent(ident serde.Ident) chan *incomingDP {
+	switch len(d) {
+	case 0:
+		return nil
+	case 1:
+		return d[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ident.String()))
+	return d[h.Sum32()%uint32(len(d))]
+}
+
+func (d directorChannels) queue(dp *incomingDP) {
+	d.forIdent(dp.Ident) <- dp
+}
+
+// send sends dp to the director channel responsible for it, waiting
+// as per o.
+func (d directorChannels) send(dp *incomingDP, o queueOptions) error {
+	if o.source != "" {
+		dp.Source = o.source
+	}
+	if t := newDpTrace(o); t != nil {
+		dp.trace = t
+		defer t.startSpan(SpanEnqueue, dp.Ident).End()
+	}
+	ch := d.forIdent(dp.Ident)
+	select {
+	case ch <- dp:
+		return nil
+	default:
+		if o.noWait() {
+			return ErrQueueFull
+		}
+	}
+	timeout, stop := o.timeout()
+	defer stop()
+	select {
+	case ch <- dp:
+		return nil
+	case <-timeout:
+		return ErrQueueFull
+	}
+}
+
+// resize returns n channels of the same capacity as the first one,
+// moving over whatever is already queued. It must only be used
+// before the directors are started.
+func (d directorChannels) resize(n int) directorChannels {
+	result := newDirectorChannels(n, cap(d[0]))
+	for _, ch := range d {
+		for len(ch) > 0 {
+			result.queue(<-ch)
+		}
+	}
+	return result
+}
+
+func (d directorChannels) close() {
+	for _, ch := range d {
+		close(ch)
+	}
+}
+
+var directorincomingDPMessages = func(rcv chan *cluster.Msg, dpChs directorChannels) {
 	defer func() { recover() }() // if we're writing to a closed channel below
 
 	for {
@@ -46,7 +129,7 @@ var directorincomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan *incoming
 			continue
 		}
 
-		dpCh <- &dp // See recover above
+		dpChs.queue(&dp) // See recover above
 	}
 }
 
@@ -63,29 +146,106 @@ var directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan
 	return nil
 }
 
-var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, clstr clusterer, workerChs workerChannels, dp *incomingDP, snd chan *cluster.Msg) (forwarded int) {
+// directorProcessOrForward queues the data point to a local worker
+// or forwards it to the node(s) responsible for the DS, returning how
+// many times it was forwarded and queued locally. If the cluster is
+// down (see clusterHealth), a point which could not be forwarded is
+// queued locally instead. A point for a DS of this node on which
+// another node still holds a lease is forwarded to that node.
+var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, clstr clusterer, workerChs workerChannels, dp *incomingDP, snd chan *cluster.Msg) (forwarded, local int) {
+	var fallback bool
 
 	for _, node := range clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc}) {
 		if node.Name() == clstr.LocalNode().Name() {
-			workerChs.queue(dp, cds)
-		} else {
-			if err := directorForwardDPToNode(dp, node, snd); err != nil {
-				log.Printf("director: Error forwarding a data point: %v", err)
-				// TODO For not ready error - sleep and return the dp to the channel?
+			if lh := directorLeaseHolder(dsc, cds, clstr); lh != nil && dp.Hops == 0 {
+				// Another node is still saving it, see Cluster.LeaseHolder
+				node = lh
+			} else {
+				workerChs.queue(dp, cds)
+				local++
 				continue
 			}
-			forwarded++
-			// Always clear RRAs to prevent it from being saved
-			if pc := cds.PointCount(); pc > 0 {
-				log.Printf("director: WARNING: Clearing DS with PointCount > 0: %v", pc)
+		}
+		if err := directorForwardDPToNode(dp, node, snd); err != nil {
+			log.Printf("director: Error forwarding a data point: %v", err)
+			// TODO For not ready error - sleep and return the dp to the channel?
+			if dsc.health.forwarded(err, time.Now()) {
+				fallback = true
 			}
-			cds.ClearRRAs(true)
+			continue
+		}
+		dsc.health.forwarded(nil, time.Now())
+		forwarded++
+		// Always clear RRAs to prevent it from being saved
+		if pc := cds.PointCount(); pc > 0 {
+			log.Printf("director: WARNING: Clearing DS with PointCount > 0: %v", pc)
 		}
+		cds.ClearRRAs(true)
+	}
+	if fallback && local == 0 {
+		workerChs.queue(dp, cds)
+		dsc.health.processedLocally()
+		local++
 	}
 	return
 }
 
-var directorProcessincomingDP = func(dp *incomingDP, sr statReporter, dsc *dsCache, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg) {
+// directorFetchDs returns the DS for the data point from the cache,
+// creating it if necessary.
+func directorFetchDs(dsc *dsCache, dp *incomingDP) (*cachedDs, error) {
+	specIdent := dp.Ident
+	if dp.SpecIdent != nil {
+		specIdent = dp.SpecIdent
+	}
+	return dsc.fetchOrCreate(dp.Ident, specIdent, dp.Source)
+}
+
+// directorOwns returns true if this node is the (first) node
+// responsible for the DS and no other node holds a lease on it.
+func directorOwns(dsc *dsCache, cds *cachedDs, clstr clusterer) bool {
+	nodes := clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc})
+	return len(nodes) > 0 && nodes[0].Name() == clstr.LocalNode().Name() && directorLeaseHolder(dsc, cds, clstr) == nil
+}
+
+// directorLeaseHolder returns the node holding a lease on the DS when
+// it is not this node, i.e. the node the DS moved from, which is yet
+// to relinquish it. Otherwise it returns nil.
+func directorLeaseHolder(dsc *dsCache, cds *cachedDs, clstr clusterer) *cluster.Node {
+	lh := clstr.LeaseHolder(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc})
+	if lh == nil || lh.Name() == clstr.LocalNode().Name() {
+		return nil
+	}
+	return lh
+}
+
+// directorRemoteOnly returns true if none of the nodes responsible
+// for the DS is this node.
+func directorRemoteOnly(dsc *dsCache, cds *cachedDs, clstr clusterer) bool {
+	for _, node := range clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc}) {
+		if node.Name() == clstr.LocalNode().Name() {
+			return false
+		}
+	}
+	return true
+}
+
+// directorForward processes or forwards the data point (see
+// directorProcessOrForward) and reports the stats.
+func directorForward(dp *incomingDP, sr statReporter, dsc *dsCache, cds *cachedDs, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg) {
+	forwarded, local := directorProcessOrForward(dsc, cds, clstr, workerChs, dp, snd)
+	sr.reportStatCount("receiver.datapoints.forwarded", float64(forwarded))
+	// Per node distribution, for checking cluster balance
+	sr.reportStatCount("receiver.cluster.local", float64(local))
+	sr.reportStatCount("receiver.cluster.forwarded_out", float64(forwarded))
+}
+
+// If transit is not nil, a data point forwarded to us for a DS which
+// this node does not (yet) own is held in it instead of being
+// dropped, see dpTransit. If fwd is not nil, a data point for a DS
+// owned only by other nodes is accumulated in it rather than
+// forwarded right away, see dpAccumulator.
+var directorProcessincomingDP = func(dp *incomingDP, sr statReporter, dsc *dsCache, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg, transit *dpTransit, fwd *dpAccumulator) {
+	defer dp.trace.startSpan(SpanRoute, dp.Ident).End()
 
 	sr.reportStatCount("receiver.datapoints.total", 1)
 
@@ -93,17 +253,93 @@ var directorProcessincomingDP = func(dp *incomingDP, sr statReporter, dsc *dsCac
 		// NaN is meaningless, e.g. "the thermometer is
 		// registering a NaN". Or it means that "for certain it is
 		// offline", but that is not part of our scope. You can
-		// only get a NaN by exceeding HB. Silently ignore it.
+		// only get a NaN by exceeding HB. Ignore it.
+		sr.reportDeadLetter(dp, DeadLetterNotFinite, nil)
 		return
 	}
 
-	cds, err := dsc.fetchOrCreateByName(dp.Ident)
+	ident, err := dsc.allowedIdent(dp.Ident)
+	if err == errTagKeyNotAllowed {
+		sr.reportStatCount("receiver.datapoints.tag_key_rejected", 1)
+		sr.reportDeadLetter(dp, DeadLetterTagKey, err)
+		return
+	}
+	if err == errTagKeyMissing {
+		sr.reportStatCount("receiver.datapoints.tag_key_missing", 1)
+		sr.reportDeadLetter(dp, DeadLetterTagKeyMissing, err)
+		return
+	}
+	dp.Ident = ident
+
+	var cds *cachedDs
+	if dsc.createHold != nil && dsc.createHold.holding(dp.Ident) {
+		err = errCreatePending // behind the points already held
+	} else {
+		cds, err = directorFetchDs(dsc, dp)
+	}
+	if err == errCreatePending {
+		if dsc.createHold.hold(dp, time.Now()) {
+			sr.reportStatCount("receiver.datapoints.create_held", 1)
+		} else {
+			sr.reportStatCount("receiver.datapoints.create_held_dropped", 1)
+			sr.reportDeadLetter(dp, DeadLetterCreatePending, err)
+		}
+		return
+	}
+	if !directorFetched(dp, cds, err, sr) {
+		return
+	}
+	directorProcessFetched(dp, cds, sr, dsc, workerChs, clstr, snd, transit, fwd)
+}
+
+// directorFetched reports the outcome of fetching the DS of the data
+// point, it returns false if there is no DS to process the point
+// with, in which case it is dead lettered.
+func directorFetched(dp *incomingDP, cds *cachedDs, err error, sr statReporter) bool {
+	if err == errCreateRateLimited {
+		sr.reportStatCount("receiver.datapoints.create_rate_limited", 1)
+		sr.reportDeadLetter(dp, DeadLetterRateLimited, err)
+		return false
+	}
+	if err == errFetchTimeout {
+		sr.reportStatCount("receiver.datapoints.fetch_timeout", 1)
+		sr.reportDeadLetter(dp, DeadLetterFetchTimeout, err)
+		return false
+	}
 	if err != nil {
 		log.Printf("director: dsCache error: %v", err)
-		return
+		sr.reportDeadLetter(dp, DeadLetterDbError, err)
+		return false
 	}
 	if cds == nil {
 		log.Printf("director: No spec matched ident: %#v, ignoring data point", dp.Ident)
+		sr.reportDeadLetter(dp, DeadLetterNoSpec, nil)
+		return false
+	}
+	return true
+}
+
+// directorProcessFetched is the rest of directorProcessincomingDP
+// once the DS of the data point is fetched.
+func directorProcessFetched(dp *incomingDP, cds *cachedDs, sr statReporter, dsc *dsCache, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg, transit *dpTransit, fwd *dpAccumulator) {
+	if dsc.kindConflicts(cds, dp) {
+		sr.reportStatCount("receiver.datapoints.type_conflict", 1)
+		if dsc.typePolicy != TypeConflictSuffix {
+			sr.reportDeadLetter(dp, DeadLetterTypeConflict, nil)
+			return
+		}
+		if dp.SpecIdent == nil {
+			dp.SpecIdent = dp.Ident
+		}
+		dp.Ident = KindIdent(dp.Ident, dp.kind())
+		var err error
+		if cds, err = directorFetchDs(dsc, dp); err != nil || cds == nil || dsc.kindConflicts(cds, dp) {
+			sr.reportDeadLetter(dp, DeadLetterTypeConflict, err)
+			return
+		}
+	}
+
+	if dp.Hops == 0 && !directorCheckSkew(dsc, cds, dp, time.Now(), sr) {
 		return
 	}
 
@@ -111,64 +347,165 @@ var directorProcessincomingDP = func(dp *incomingDP, sr statReporter, dsc *dsCac
 		if clstr == nil {
 			workerChs.queue(dp, cds)
 		} else {
-			forwarded := directorProcessOrForward(dsc, cds, clstr, workerChs, dp, snd)
-			sr.reportStatCount("receiver.datapoints.forwarded", float64(forwarded))
+			if dp.Hops > 0 {
+				sr.reportStatCount("receiver.cluster.forwarded_in", 1)
+				if transit != nil && !directorOwns(dsc, cds, clstr) && !dsc.health.isDown(time.Now()) {
+					// It can't be forwarded again, the cluster is in transition
+					if transit.hold(dp, time.Now()) {
+						sr.reportStatCount("receiver.cluster.transit.held", 1)
+					} else {
+						sr.reportStatCount("receiver.cluster.transit.dropped", 1)
+						sr.reportDeadLetter(dp, DeadLetterTransit, nil)
+					}
+					return
+				}
+			}
+			if fwd != nil && dp.Hops == 0 && fwd.accepts(dp) && directorRemoteOnly(dsc, cds, clstr) && !dsc.health.isDown(time.Now()) {
+				if prev := fwd.add(dp, cds, time.Now()); prev != nil {
+					directorForward(prev.dp, sr, dsc, prev.cds, workerChs, clstr, snd)
+				}
+				sr.reportStatCount("receiver.cluster.accumulated", 1)
+				return
+			}
+			directorForward(dp, sr, dsc, cds, workerChs, clstr, snd)
 		}
 	}
 }
 
-func reportDirectorChannelFillPercent(dpCh chan *incomingDP, queue *dpQueue, sr statReporter, nap time.Duration) {
+// directorCheckSkew clamps, or rejects, a data point time stamped
+// further ahead of now than the skew tolerance, see
+// Receiver.SkewTolerance. It returns false if the point is
+// rejected. A forwarded point has been checked by the node which
+// forwarded it.
+func directorCheckSkew(dsc *dsCache, cds *cachedDs, dp *incomingDP, now time.Time, sr statReporter) bool {
+	edge := now.Add(dsc.skewTolerance)
+	if dsc.skewTolerance <= 0 || !dp.TimeStamp.After(edge) {
+		return true
+	}
+	atomic.AddInt64(&cds.skewed, 1)
+	if dsc.skewPolicy == SkewReject {
+		sr.reportStatCount("receiver.datapoints.skew_rejected", 1)
+		sr.reportDeadLetter(dp, DeadLetterSkewed, fmt.Errorf("time stamp %v is %v ahead", dp.TimeStamp, dp.TimeStamp.Sub(now)))
+		return false
+	}
+	sr.reportStatCount("receiver.datapoints.skew_clamped", 1)
+	dp.TimeStamp = edge
+	return true
+}
+
+// The channel stats are named receiver.channel.* and
+// receiver.overrun_queue.*, with more than one director
+// receiver.director.N.channel.* etc, see directorStatPrefix.
+func reportDirectorChannelFillPercent(dpCh chan *incomingDP, queue *dpQueue, sr statReporter, prefix string, nap time.Duration) {
 	cp := float64(cap(dpCh))
 	for {
 		time.Sleep(nap) // TODO this should be a ticker really
 		ln := float64(len(dpCh))
 		if cp > 0 {
 			fillPct := (ln / cp) * 100
-			sr.reportStatGauge("receiver.channel.fill_percent", fillPct)
+			sr.reportStatGauge(prefix+"channel.fill_percent", fillPct)
 			if fillPct > 75 {
 				log.Printf("WARNING: receiver channel %v percent full!", fillPct)
 			}
 		}
-		sr.reportStatGauge("receiver.channel.len", ln)
+		sr.reportStatGauge(prefix+"channel.len", ln)
 
 		// Overrun queue
 		qsz := queue.size()
 		pct := (float64(qsz) / cp) * 100
-		sr.reportStatGauge("receiver.overrun_queue.len", float64(qsz))
-		sr.reportStatGauge("receiver.overrun_queue.pct", pct)
+		sr.reportStatGauge(prefix+"overrun_queue.len", float64(qsz))
+		sr.reportStatGauge(prefix+"overrun_queue.pct", pct)
+	}
+}
+
+func directorStatPrefix(n, of int) string {
+	if of > 1 {
+		return fmt.Sprintf("receiver.director.%d.", n)
 	}
+	return "receiver."
 }
 
-var director = func(wc wController, dpCh chan *incomingDP, clstr clusterer, sr statReporter, dss *dsCache, workerChs workerChannels) {
+// director runs a director per channel in dpChs, each in its own
+// goroutine (the first one in this one), which are all done once all
+// the channels are closed. Cluster changes are handled by the first
+// director.
+var director = func(wc wController, dpChs directorChannels, clstr clusterer, sr statReporter, dss *dsCache, workerChs workerChannels) {
 	wc.onEnter()
 	defer wc.onExit()
 
 	var (
 		clusterChgCh chan bool
 		snd, rcv     chan *cluster.Msg
-		queue        = &dpQueue{}
 	)
 
 	if clstr != nil {
 		clusterChgCh = clstr.NotifyClusterChanges() // Monitor Cluster changes
 		snd, rcv = clstr.RegisterMsgType()          // Channel for event forwards to other nodes and us
-		go directorincomingDPMessages(rcv, dpCh)
+		go directorincomingDPMessages(rcv, dpChs)
 		log.Printf("director: marking cluster node as Ready.")
 		clstr.Ready(true)
 	}
 
-	// Monitor channel fill TODO: this is wrong, there should be better ways
-	go reportDirectorChannelFillPercent(dpCh, queue, sr, time.Second)
+	var wg sync.WaitGroup
+	for n := 1; n < len(dpChs); n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			directorLoop(dpChs[n], nil, directorStatPrefix(n, len(dpChs)), clstr, sr, dss, workerChs, snd)
+		}(n)
+	}
+
+	wc.onStarted()
+
+	directorLoop(dpChs[0], clusterChgCh, directorStatPrefix(0, len(dpChs)), clstr, sr, dss, workerChs, snd)
+	wg.Wait()
+}
+
+// directorLoop processes the data points from dpCh until it is
+// closed. If clusterChgCh is not nil, it also handles cluster
+// changes.
+func directorLoop(dpCh chan *incomingDP, clusterChgCh chan bool, statPrefix string, clstr clusterer, sr statReporter, dss *dsCache, workerChs workerChannels, snd chan *cluster.Msg) {
+	var (
+		queue   = &dpQueue{}
+		transit *dpTransit
+		fwd     *dpAccumulator
+	)
+
+	retryCreateHold := func() {
+		applied, dropped := dss.createHold.retry(time.Now(), dss, sr, func(dp *incomingDP, cds *cachedDs) {
+			directorProcessFetched(dp, cds, sr, dss, workerChs, clstr, snd, transit, fwd)
+		})
+		sr.reportStatCount("receiver.datapoints.create_held_applied", float64(applied))
+		sr.reportStatCount("receiver.datapoints.create_held_dropped", float64(dropped))
+	}
 
-	go func() {
-		defer func() { recover() }()
-		for {
-			time.Sleep(time.Second)
-			dpCh <- nil // This ensures that overrun queue is flushed
+	retryTransit := func() {
+		applied, dropped := transit.retry(time.Now(), dss, clstr, workerChs)
+		sr.reportStatCount("receiver.cluster.transit.applied", float64(applied))
+		sr.reportStatCount("receiver.cluster.transit.dropped", float64(dropped))
+	}
+
+	forwardAccumulated := func(all bool) {
+		for _, a := range fwd.due(time.Now(), all) {
+			directorForward(a.dp, sr, dss, a.cds, workerChs, clstr, snd)
 		}
-	}()
+	}
 
-	wc.onStarted()
+	if clstr != nil {
+		transit = &dpTransit{max: directorTransitSize, timeout: directorTransitTimeout}
+		if dss.fwdWindow > 0 {
+			fwd = &dpAccumulator{window: dss.fwdWindow}
+		}
+	}
+
+	// Monitor channel fill TODO: this is wrong, there should be better ways
+	go reportDirectorChannelFillPercent(dpCh, queue, sr, statPrefix, time.Second)
+
+	// A nil dp once a second ensures that overrun queue is
+	// flushed. It comes from a ticker rather than being sent on dpCh
+	// so that nothing else writes to dpCh while it is being closed.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
 
 	for {
 
@@ -177,34 +514,280 @@ var director = func(wc wController, dpCh chan *incomingDP, clstr clusterer, sr s
 		select {
 		case _, ok = <-clusterChgCh:
 			if ok {
-				if err := clstr.Transition(45 * time.Second); err != nil {
+				forwardAccumulated(true) // before ownership changes
+				err := clstr.Transition(45 * time.Second)
+				if err != nil {
 					log.Printf("director: Transition error: %v", err)
 				}
+				dss.health.transitioned(err, time.Now())
+				retryTransit()
 			}
 			continue
+		case <-tick.C:
+			ok = true
 		case dp, ok = <-dpCh:
 		}
 		if !ok {
+			forwardAccumulated(true)
 			log.Printf("director: channel closed, shutting down")
 			break
 		}
 
+		if dp == nil && dss.createHold != nil { // periodic, see above
+			retryCreateHold()
+		}
+		if dp == nil && transit != nil { // periodic, see above
+			retryTransit()
+			forwardAccumulated(false)
+			if clusterChgCh != nil {
+				dss.health.report(time.Now(), sr)
+			}
+		}
+
 		queueOnly := float32(len(dpCh))/float32(cap(dpCh)) > 0.5
 		dp = checkSetAside(dp, queue, queueOnly)
 
 		if dp != nil {
-			directorProcessincomingDP(dp, sr, dss, workerChs, clstr, snd)
+			directorProcessincomingDP(dp, sr, dss, workerChs, clstr, snd, transit, fwd)
 		}
 
 		// Try to flush the queue if we are idle
 		for (len(dpCh) == 0) && (queue.size() > 0) {
 			if dp = checkSetAside(nil, queue, false); dp != nil {
-				directorProcessincomingDP(dp, sr, dss, workerChs, clstr, snd)
+				directorProcessincomingDP(dp, sr, dss, workerChs, clstr, snd, transit, fwd)
 			}
 		}
 	}
 }
 
+// Limits of the dpTransit used by the director.
+var (
+	directorTransitSize    = 16384
+	directorTransitTimeout = time.Minute
+)
+
+// Limits of the dpCreateHold of the dsCache.
+var (
+	directorCreateHoldSize    = 16384
+	directorCreateHoldTimeout = 10 * time.Second
+)
+
+// dpCreateHold holds the data points of DSs which could not be
+// created right away because as many DSs as allowed were being
+// created already, see Receiver.MaxConcurrentCreates. Unlike
+// dpTransit, it is shared by the directors. The held points are
+// retried periodically, points held longer than timeout are dropped,
+// as are points arriving when there are already max points held.
+// Once a point is held, so are the later points of its DS, until the
+// held ones are retried, so that they are applied in order.
+type dpCreateHold struct {
+	sync.Mutex
+	held    []*heldDP
+	idents  map[string]int // number of points held (or being retried) by ident
+	max     int
+	timeout time.Duration
+}
+
+// hold adds a data point, it returns false if there is no room.
+func (h *dpCreateHold) hold(dp *incomingDP, now time.Time) bool {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.held) >= h.max {
+		return false
+	}
+	h.held = append(h.held, &heldDP{dp: dp, rt: now})
+	if h.idents == nil {
+		h.idents = make(map[string]int)
+	}
+	h.idents[dp.Ident.String()]++
+	return true
+}
+
+// holding returns true if there are points held for the ident, in
+// which case a new point for it must be held too, behind them, even
+// if its DS is cached by now.
+func (h *dpCreateHold) holding(ident serde.Ident) bool {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.idents) == 0 {
+		return false
+	}
+	return h.idents[ident.String()] > 0
+}
+
+// retry passes the held points whose DS is now fetched (or created)
+// to process, in the order they arrived, keeping those whose DS is
+// still waiting to be created. It returns the number of points
+// processed and dropped (held for too long or their DS could not be
+// fetched, in which case they are dead lettered).
+func (h *dpCreateHold) retry(now time.Time, dsc *dsCache, sr statReporter, process func(*incomingDP, *cachedDs)) (applied, dropped int) {
+	h.Lock()
+	held := h.held
+	h.held = nil
+	h.Unlock()
+	var keep, done []*heldDP
+	for _, hd := range held {
+		if now.Sub(hd.rt) > h.timeout {
+			sr.reportDeadLetter(hd.dp, DeadLetterCreatePending, errCreatePending)
+			dropped++
+			done = append(done, hd)
+			continue
+		}
+		cds, err := directorFetchDs(dsc, hd.dp)
+		if err == errCreatePending {
+			keep = append(keep, hd)
+			continue
+		}
+		done = append(done, hd)
+		if !directorFetched(hd.dp, cds, err, sr) {
+			dropped++
+			continue
+		}
+		process(hd.dp, cds)
+		applied++
+	}
+	h.Lock()
+	if len(keep) > 0 {
+		h.held = append(keep, h.held...)
+	}
+	for _, hd := range done { // only now can new points bypass the hold
+		key := hd.dp.Ident.String()
+		if h.idents[key]--; h.idents[key] <= 0 {
+			delete(h.idents, key)
+		}
+	}
+	h.Unlock()
+	return applied, dropped
+}
+
+// dpTransit holds data points which were forwarded to this node for
+// DSs which, as far as this node can tell, belong to another
+// node. This happens while the cluster is in transition, because the
+// nodes do not change their view of DS ownership at the same
+// time. The held points are retried periodically and after every
+// Transition, and are applied once this node owns the DS. Points
+// held longer than timeout are dropped, as are points arriving when
+// there are already max points held.
+type dpTransit struct {
+	held    []*heldDP
+	max     int
+	timeout time.Duration
+}
+
+// hold adds a data point, it returns false if there is no room.
+func (t *dpTransit) hold(dp *incomingDP, now time.Time) bool {
+	if len(t.held) >= t.max {
+		return false
+	}
+	t.held = append(t.held, &heldDP{dp: dp, rt: now})
+	return true
+}
+
+// retry queues the held points for DSs which are now owned by this
+// node to the workers, keeping the rest. It returns the number of
+// points applied and dropped (because they were held for too long or
+// their DS could not be fetched).
+func (t *dpTransit) retry(now time.Time, dsc *dsCache, clstr clusterer, workerChs workerChannels) (applied, dropped int) {
+	if len(t.held) == 0 {
+		return 0, 0
+	}
+	held := t.held
+	t.held = nil
+	for _, h := range held {
+		if now.Sub(h.rt) > t.timeout {
+			dropped++
+			continue
+		}
+		cds, err := directorFetchDs(dsc, h.dp)
+		if err != nil || cds == nil {
+			dropped++
+			continue
+		}
+		if !directorOwns(dsc, cds, clstr) {
+			t.held = append(t.held, h)
+			continue
+		}
+		workerChs.queue(h.dp, cds)
+		applied++
+	}
+	return applied, dropped
+}
+
+// dpAccumulator accumulates the data points of DSs owned by other
+// nodes for up to window, so that they are forwarded as one point per
+// DS, see Receiver.ForwardAccumulateWindow. Every director has its
+// own, thus the points of a DS are forwarded in order. A nil
+// dpAccumulator accumulates nothing.
+type dpAccumulator struct {
+	window time.Duration
+	accs   map[string]*accumulatedDP
+}
+
+// accumulatedDP is the sum of the values of the points of a DS
+// within a step of it.
+type accumulatedDP struct {
+	dp    *incomingDP // the last point
+	cds   *cachedDs
+	sum   float64
+	n     int
+	step  time.Time // the step the points belong to
+	since time.Time // when the first point was accumulated (real time)
+}
+
+// accepts returns true if the point can be accumulated, i.e. its
+// value can be averaged: counters and integer values cannot, nor can
+// an exemplar be.
+func (a *dpAccumulator) accepts(dp *incomingDP) bool {
+	return a != nil && dp.WrapAt == 0 && !dp.IsInt && dp.Exemplar == nil
+}
+
+// add accumulates the point. If it belongs to a different step of
+// the DS than the points already accumulated, these are returned to
+// be forwarded (and the point starts a new accumulation).
+func (a *dpAccumulator) add(dp *incomingDP, cds *cachedDs, now time.Time) (prev *accumulatedDP) {
+	if a.accs == nil {
+		a.accs = make(map[string]*accumulatedDP)
+	}
+	key := dp.Ident.String()
+	step := dp.TimeStamp.Truncate(cds.Step())
+	acc := a.accs[key]
+	if acc != nil && !acc.step.Equal(step) {
+		prev = acc.result()
+		acc = nil
+	}
+	if acc == nil {
+		acc = &accumulatedDP{cds: cds, step: step, since: now}
+		a.accs[key] = acc
+	}
+	acc.dp, acc.sum, acc.n = dp, acc.sum+dp.Value, acc.n+1
+	return prev
+}
+
+// due removes and returns the accumulations older than window, or
+// all of them if all is true.
+func (a *dpAccumulator) due(now time.Time, all bool) []*accumulatedDP {
+	if a == nil {
+		return nil
+	}
+	var result []*accumulatedDP
+	for key, acc := range a.accs {
+		if all || now.Sub(acc.since) >= a.window {
+			result = append(result, acc.result())
+			delete(a.accs, key)
+		}
+	}
+	return result
+}
+
+// result sets the value of the last point to the mean and returns
+// the accumulatedDP.
+func (acc *accumulatedDP) result() *accumulatedDP {
+	dp := *acc.dp
+	dp.Value = acc.sum / float64(acc.n)
+	acc.dp = &dp
+	return acc
+}
+
 type dpQueue []*incomingDP
 
 func (q *dpQueue) push(dp *incomingDP) {
@@ -241,3 +824,95 @@ func checkSetAside(dp *incomingDP, queue *dpQueue, skip bool) *incomingDP {
 
 	return dp
 }
+
+// clusterHealth decides whether the cluster is down, for the
+// ClusterFallbackLocal policy. The cluster is down once forwarding
+// has been failing without a single success for downAfter, or when
+// the last Transition failed, and it is up again after a successful
+// forward or Transition. It is shared by all the directors. A nil
+// *clusterHealth is never down.
+type clusterHealth struct {
+	sync.Mutex
+	downAfter     time.Duration
+	failingSince  time.Time     // zero if the last forward succeeded
+	transitionErr bool          // the last Transition failed
+	downSince     time.Time     // zero if not down
+	checked       time.Time     // last time the state was updated
+	fallback      time.Duration // time spent down since the last report
+	local         int           // points processed locally since the last report
+}
+
+// forwarded records the outcome of a forward, it returns true if the
+// cluster is down.
+func (h *clusterHealth) forwarded(err error, now time.Time) bool {
+	if h == nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	if err == nil {
+		h.failingSince = time.Time{}
+	} else if h.failingSince.IsZero() {
+		h.failingSince = now
+	}
+	return h.update(now)
+}
+
+func (h *clusterHealth) transitioned(err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.transitionErr = err != nil
+	h.update(now)
+}
+
+func (h *clusterHealth) processedLocally() {
+	h.Lock()
+	defer h.Unlock()
+	h.local++
+}
+
+func (h *clusterHealth) isDown(now time.Time) bool {
+	if h == nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	return h.update(now)
+}
+
+// update must be called with h locked.
+func (h *clusterHealth) update(now time.Time) bool {
+	if !h.downSince.IsZero() {
+		h.fallback += now.Sub(h.checked)
+	}
+	h.checked = now
+	down := h.transitionErr || (!h.failingSince.IsZero() && now.Sub(h.failingSince) >= h.downAfter)
+	if down && h.downSince.IsZero() {
+		log.Printf("director: cluster is down, processing data points locally.")
+		h.downSince = now
+	} else if !down && !h.downSince.IsZero() {
+		log.Printf("director: cluster is up again after %v, forwarding data points.", now.Sub(h.downSince))
+		h.downSince = time.Time{}
+	}
+	return down
+}
+
+// report reports the receiver.cluster.fallback.* stats.
+func (h *clusterHealth) report(now time.Time, sr statReporter) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	var down float64
+	if h.update(now) {
+		down = 1
+	}
+	sr.reportStatGauge("receiver.cluster.fallback", down)
+	sr.reportStatCount("receiver.cluster.fallback.seconds", h.fallback.Seconds())
+	sr.reportStatCount("receiver.cluster.fallback.local", float64(h.local))
+	h.fallback, h.local = 0, 0
+}
@@ -62,7 +62,7 @@ func Test_directorIncomingDPMessages(t *testing.T) {
 		}
 	}()
 
-	go directorIncomingDPMessages(rcv, dpCh)
+	go directorIncomingDPMessages(rcv, directorChannels{dpCh})
 
 	// Sending a bogus message should not cause anything be written to dpCh
 	rcv <- &cluster.Msg{}
@@ -105,7 +105,7 @@ func Test_directorIncomingDPMessages(t *testing.T) {
 	rcv <- m
 
 	// Closing the channel exists (not sure how to really test for that)
-	go directorIncomingDPMessages(rcv, dpCh)
+	go directorIncomingDPMessages(rcv, directorChannels{dpCh})
 	close(rcv)
 }
 
@@ -196,21 +196,24 @@ func Test_directorProcessOrForward(t *testing.T) {
 
 	// Test if we are LocalNode
 	directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
-	directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
+	_, local := directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
 	if sent < 1 {
 		t.Errorf("directorProcessOrForward: Nothing sent to workerChs")
 	}
+	if local != 1 {
+		t.Errorf("directorProcessOrForward: local != 1")
+	}
 
 	// Now test we are NOT LN, forward
 	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
 	clstr.nodesForDd = []*cluster.Node{remote}
 
-	n := directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
+	n, local := directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
 	if forward != 1 {
 		t.Errorf("directorProcessOrForward: directorForwardDPToNode not called")
 	}
-	if n != 1 {
-		t.Errorf("directorProcessOrForward: return value != 1")
+	if n != 1 || local != 0 {
+		t.Errorf("directorProcessOrForward: return value != 1, 0")
 	}
 
 	fl := &fakeLogger{}
@@ -221,7 +224,7 @@ func Test_directorProcessOrForward(t *testing.T) {
 	}()
 
 	fwErr = fmt.Errorf("some error")
-	n = directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
+	n, _ = directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil)
 	if n != 0 {
 		t.Errorf("directorProcessOrForward: return value != 0")
 	}
@@ -258,13 +261,179 @@ func Test_directorProcessOrForward(t *testing.T) {
 	directorForwardDPToNode = saveFn
 }
 
+func Test_directorProcessOrForward_fallback(t *testing.T) {
+	saveFn := directorForwardDPToNode
+	defer func() { directorForwardDPToNode = saveFn }()
+	directorForwardDPToNode = func(dp *IncomingDP, node *cluster.Node, snd chan *cluster.Msg) error {
+		return fmt.Errorf("some error")
+	}
+	fl := &fakeLogger{}
+	log.SetOutput(fl)
+	defer log.SetOutput(os.Stderr)
+
+	dsc := newDsCache(nil, nil, nil)
+	dsc.health = &clusterHealth{downAfter: time.Hour}
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	rds := &cachedDs{DbDataSourcer: ds}
+
+	clstr := &fakeCluster{}
+	md := make([]byte, 20)
+	md[0] = 1 // Ready
+	clstr.ln = &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	clstr.nodesForDd = []*cluster.Node{&cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}}
+
+	workerChs := make([]chan *incomingDpWithDs, 1)
+	workerChs[0] = make(chan *incomingDpWithDs, 10)
+
+	// Not down yet
+	if n, local := directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil); n != 0 || local != 0 {
+		t.Errorf("directorProcessOrForward: expected 0, 0 before the cluster is down, got %d, %d", n, local)
+	}
+
+	// A failed transition means down
+	dsc.health.transitioned(fmt.Errorf("stuck"), time.Now())
+	if !strings.Contains(string(fl.last), "cluster is down") {
+		t.Errorf("clusterHealth: expected the cluster to be logged as down")
+	}
+	if _, local := directorProcessOrForward(dsc, rds, clstr, workerChs, nil, nil); local != 1 || len(workerChs[0]) != 1 {
+		t.Errorf("directorProcessOrForward: expected the point to be queued locally, got %d", local)
+	}
+	sr := &fakeSr{}
+	dsc.health.report(time.Now(), sr)
+	if dsc.health.local != 0 || sr.called != 3 {
+		t.Errorf("report: expected 3 stats and the counters reset, got %d stats", sr.called)
+	}
+}
+
+func Test_directorProcessOrForward_lease(t *testing.T) {
+	saveFn := directorForwardDPToNode
+	defer func() { directorForwardDPToNode = saveFn }()
+	var to []string
+	directorForwardDPToNode = func(dp *IncomingDP, node *cluster.Node, snd chan *cluster.Msg) error {
+		to = append(to, node.Name())
+		return nil
+	}
+
+	dsc := newDsCache(nil, nil, nil)
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	rds := &cachedDs{DbDataSourcer: ds}
+
+	clstr := &fakeCluster{}
+	md := make([]byte, 20)
+	md[0] = 1 // Ready
+	clstr.ln = &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	clstr.nodesForDd = []*cluster.Node{clstr.ln}
+	clstr.leaseHolder = &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "previous"}}
+
+	workerChs := make([]chan *incomingDpWithDs, 1)
+	workerChs[0] = make(chan *incomingDpWithDs, 10)
+
+	// The previous node holds the lease, the point goes to it
+	n, local := directorProcessOrForward(dsc, rds, clstr, workerChs, &IncomingDP{}, nil)
+	if n != 1 || local != 0 || len(to) != 1 || to[0] != "previous" {
+		t.Errorf("directorProcessOrForward: expected the point forwarded to the lease holder, got %d, %d, %v", n, local, to)
+	}
+	if directorOwns(dsc, rds, clstr) {
+		t.Errorf("directorOwns: should be false while another node holds the lease")
+	}
+
+	// A point forwarded to us cannot be forwarded again
+	if n, local = directorProcessOrForward(dsc, rds, clstr, workerChs, &IncomingDP{Hops: 1}, nil); n != 0 || local != 1 {
+		t.Errorf("directorProcessOrForward: expected a forwarded point queued locally, got %d, %d", n, local)
+	}
+
+	// The lease has ended
+	clstr.leaseHolder = nil
+	if n, local = directorProcessOrForward(dsc, rds, clstr, workerChs, &IncomingDP{}, nil); n != 0 || local != 1 || len(to) != 1 {
+		t.Errorf("directorProcessOrForward: expected the point queued locally once the lease ended, got %d, %d", n, local)
+	}
+	if !directorOwns(dsc, rds, clstr) {
+		t.Errorf("directorOwns: should be true once the lease ended")
+	}
+}
+
+func Test_directorCheckSkew(t *testing.T) {
+	dsc := newDsCache(nil, nil, nil)
+	cds := &cachedDs{DbDataSourcer: serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))}
+	sr := &fakeSr{}
+	now := time.Unix(1000, 0)
+
+	// No tolerance, anything goes
+	dp := &IncomingDP{TimeStamp: now.Add(time.Hour)}
+	if !directorCheckSkew(dsc, cds, dp, now, sr) || !dp.TimeStamp.Equal(now.Add(time.Hour)) {
+		t.Errorf("directorCheckSkew: without a tolerance the point should be left alone")
+	}
+
+	dsc.skewTolerance = 5 * time.Second
+	for _, ts := range []time.Time{now.Add(-time.Hour), now.Add(5 * time.Second)} {
+		dp = &IncomingDP{TimeStamp: ts}
+		if !directorCheckSkew(dsc, cds, dp, now, sr) || !dp.TimeStamp.Equal(ts) {
+			t.Errorf("directorCheckSkew: %v is within the tolerance and should be left alone", ts)
+		}
+	}
+	dp = &IncomingDP{TimeStamp: now.Add(time.Minute)}
+	if !directorCheckSkew(dsc, cds, dp, now, sr) || !dp.TimeStamp.Equal(now.Add(5*time.Second)) {
+		t.Errorf("directorCheckSkew: expected the point clamped to 1005, got %v", dp.TimeStamp)
+	}
+
+	dsc.skewPolicy = SkewReject
+	dp = &IncomingDP{TimeStamp: now.Add(time.Minute)}
+	if directorCheckSkew(dsc, cds, dp, now, sr) {
+		t.Errorf("directorCheckSkew: expected the point rejected")
+	}
+	if cds.skewed != 2 || len(sr.deadLetters) != 1 || sr.deadLetters[0] != DeadLetterSkewed {
+		t.Errorf("directorCheckSkew: expected 2 skewed and a skewed dead letter, got %d, %v", cds.skewed, sr.deadLetters)
+	}
+
+	if p, err := ParseSkewPolicy("Reject"); p != SkewReject || err != nil {
+		t.Errorf("ParseSkewPolicy: expected SkewReject, got %v (%v)", p, err)
+	}
+	if _, err := ParseSkewPolicy("bogus"); err == nil {
+		t.Errorf("ParseSkewPolicy: expected an error")
+	}
+}
+
+func Test_clusterHealth(t *testing.T) {
+	var nilHealth *clusterHealth
+	if nilHealth.forwarded(fmt.Errorf("x"), time.Now()) || nilHealth.isDown(time.Now()) {
+		t.Errorf("clusterHealth: nil should never be down")
+	}
+
+	h := &clusterHealth{downAfter: 10 * time.Second}
+	start := time.Unix(1000, 0)
+	if h.forwarded(fmt.Errorf("x"), start) || h.forwarded(fmt.Errorf("x"), start.Add(9*time.Second)) {
+		t.Errorf("clusterHealth: should not be down before downAfter")
+	}
+	if !h.forwarded(fmt.Errorf("x"), start.Add(10*time.Second)) {
+		t.Errorf("clusterHealth: should be down after downAfter")
+	}
+	if h.forwarded(nil, start.Add(15*time.Second)) {
+		t.Errorf("clusterHealth: should be up after a successful forward")
+	}
+	if h.fallback != 5*time.Second {
+		t.Errorf("clusterHealth: expected 5s in fallback, got %v", h.fallback)
+	}
+
+	h.transitioned(fmt.Errorf("x"), start.Add(20*time.Second))
+	if !h.isDown(start.Add(20 * time.Second)) {
+		t.Errorf("clusterHealth: should be down after a failed transition")
+	}
+	h.transitioned(nil, start.Add(30*time.Second))
+	if h.isDown(start.Add(30 * time.Second)) {
+		t.Errorf("clusterHealth: should be up after a successful transition")
+	}
+	if h.fallback != 15*time.Second {
+		t.Errorf("clusterHealth: expected 15s in fallback, got %v", h.fallback)
+	}
+}
+
 func Test_directorProcessIncomingDP(t *testing.T) {
 
 	saveFn := directorProcessOrForward
 	dpofCalled := 0
-	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, clstr clusterer, workerChs workerChannels, dp *IncomingDP, snd chan *cluster.Msg) (forwarded int) {
+	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, clstr clusterer, workerChs workerChannels, dp *IncomingDP, snd chan *cluster.Msg) (forwarded, local int) {
 		dpofCalled++
-		return 0
+		return 0, 1
 	}
 
 	fl := &fakeLogger{}
@@ -300,29 +469,41 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 
 	// NaN
 	dp.Value = math.NaN()
-	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil)
+	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil, nil, nil)
 	if scr.called != 1 {
 		t.Errorf("directorProcessIncomingDP: With a NaN, reportStatCount() should only be called once")
 	}
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a NaN, directorProcessOrForward should not be called")
 	}
+	if len(scr.deadLetters) != 1 || scr.deadLetters[0] != DeadLetterNotFinite {
+		t.Errorf("directorProcessIncomingDP: With a NaN, expected a not_finite dead letter: %v", scr.deadLetters)
+	}
 
 	// A value
 	dp.Value = 1234
 	scr.called, dpofCalled = 0, 0
-	directorProcessIncomingDP(dp, scr, dsc, workerChs, clstr, nil)
-	if scr.called != 2 {
-		t.Errorf("directorProcessIncomingDP: With a value, reportStatCount() should be called twice: %v", scr.called)
+	directorProcessIncomingDP(dp, scr, dsc, workerChs, clstr, nil, nil, nil)
+	if scr.called != 4 {
+		t.Errorf("directorProcessIncomingDP: With a value, reportStatCount() should be called 4 times: %v", scr.called)
 	}
 	if dpofCalled != 1 {
 		t.Errorf("directorProcessIncomingDP: With a value, directorProcessOrForward should be called once: %v", dpofCalled)
 	}
 
+	// A value forwarded to us by a peer
+	dp.Hops = 1
+	scr.called, dpofCalled = 0, 0
+	directorProcessIncomingDP(dp, scr, dsc, workerChs, clstr, nil, nil, nil)
+	if scr.called != 5 {
+		t.Errorf("directorProcessIncomingDP: With a forwarded value, reportStatCount() should be called 5 times: %v", scr.called)
+	}
+	dp.Hops = 0
+
 	// A blank name should cause a nil rds
 	dp.Name = ""
 	scr.called, dpofCalled = 0, 0
-	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil)
+	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil, nil, nil)
 	if scr.called != 1 {
 		t.Errorf("directorProcessIncomingDP: With a blank name, reportStatCount() should be called once")
 	}
@@ -332,12 +513,15 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	if !strings.Contains(string(fl.last), "No spec matched") {
 		t.Errorf("should log 'No spec matched'")
 	}
+	if n := len(scr.deadLetters); n != 2 || scr.deadLetters[n-1] != DeadLetterNoSpec {
+		t.Errorf("directorProcessIncomingDP: With a blank name, expected a no_spec dead letter: %v", scr.deadLetters)
+	}
 
 	// fake a db error
 	dp.Name = "blah"
 	db.fakeErr = true
 	scr.called, dpofCalled = 0, 0
-	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil)
+	directorProcessIncomingDP(dp, scr, dsc, nil, nil, nil, nil, nil)
 	if scr.called != 1 {
 		t.Errorf("directorProcessIncomingDP: With a db error, reportStatCount() should be called once")
 	}
@@ -347,12 +531,15 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	if !strings.Contains(string(fl.last), "error") {
 		t.Errorf("should log 'error'")
 	}
+	if n := len(scr.deadLetters); n != 3 || scr.deadLetters[n-1] != DeadLetterDbError {
+		t.Errorf("directorProcessIncomingDP: With a db error, expected a db_error dead letter: %v", scr.deadLetters)
+	}
 
 	// nil cluster
 	dp.Value = 1234
 	db.fakeErr = false
 	scr.called = 0
-	directorProcessIncomingDP(dp, scr, dsc, workerChs, nil, nil)
+	directorProcessIncomingDP(dp, scr, dsc, workerChs, nil, nil, nil, nil)
 	if scr.called != 1 {
 		t.Errorf("directorProcessIncomingDP: With a value, reportStatCount() should be called once: %v", scr.called)
 	}
@@ -368,9 +555,9 @@ func Test_the_director(t *testing.T) {
 	saveFn1 := directorIncomingDPMessages
 	saveFn2 := directorProcessIncomingDP
 	dimCalled := 0
-	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan *IncomingDP) { dimCalled++ }
+	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpChs directorChannels) { dimCalled++ }
 	dpidpCalled := 0
-	directorProcessIncomingDP = func(dp *IncomingDP, scr statReporter, dsc *dsCache, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg) {
+	directorProcessIncomingDP = func(dp *IncomingDP, scr statReporter, dsc *dsCache, workerChs workerChannels, clstr clusterer, snd chan *cluster.Msg, transit *dpTransit, fwd *dpAccumulator) {
 		dpidpCalled++
 	}
 
@@ -393,7 +580,7 @@ func Test_the_director(t *testing.T) {
 	dsc := newDsCache(db, df, dsf)
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, clstr, sr, dsc, nil)
+	go director(wc, directorChannels{dpCh}, clstr, sr, dsc, nil)
 	wc.startWg.Wait()
 
 	if clstr.nReady == 0 {
@@ -455,7 +642,7 @@ func Test_the_director(t *testing.T) {
 	dpCh <- dp
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, clstr, sr, dsc, nil)
+	go director(wc, directorChannels{dpCh}, clstr, sr, dsc, nil)
 	wc.startWg.Wait()
 
 	time.Sleep(100 * time.Millisecond)
@@ -466,6 +653,37 @@ func Test_the_director(t *testing.T) {
 	directorProcessIncomingDP = saveFn2
 }
 
+func Test_directorChannels(t *testing.T) {
+
+	dpChs := newDirectorChannels(1, 8)
+	foo := serde.Ident{"name": "foo"}
+	dpChs.queue(&IncomingDP{Ident: foo, Value: 1})
+	dpChs.queue(&IncomingDP{Ident: serde.Ident{"name": "bar"}, Value: 2})
+
+	dpChs = dpChs.resize(4)
+	if len(dpChs) != 4 || cap(dpChs[3]) != 8 {
+		t.Errorf("resize: expected 4 channels of capacity 8, got %d of %d", len(dpChs), cap(dpChs[3]))
+	}
+	total := 0
+	for _, ch := range dpChs {
+		total += len(ch)
+	}
+	if total != 2 {
+		t.Errorf("resize: expected the 2 queued points to be moved, got %d", total)
+	}
+
+	ch := dpChs.forIdent(foo)
+	for i := 0; i < 3; i++ {
+		dpChs.queue(&IncomingDP{Ident: serde.Ident{"name": "foo"}, Value: 3})
+	}
+	if len(ch) != 4 {
+		t.Errorf("forIdent: expected all points for the same ident in the same channel, got %d", len(ch))
+	}
+	if ch := (directorChannels{}).forIdent(foo); ch != nil {
+		t.Errorf("forIdent: expected nil without channels")
+	}
+}
+
 func Test_director_reportDirectorChannelFillPercent(t *testing.T) {
 	defer func() {
 		// restore default output
@@ -482,7 +700,7 @@ func Test_director_reportDirectorChannelFillPercent(t *testing.T) {
 	}
 	queue := &dpQueue{}
 	queue.push(&IncomingDP{})
-	go reportDirectorChannelFillPercent(ch, queue, sr, time.Millisecond)
+	go reportDirectorChannelFillPercent(ch, queue, sr, "receiver.", time.Millisecond)
 	time.Sleep(50 * time.Millisecond)
 	if sr.called == 0 {
 		t.Errorf("reportDirectorChannelFillPercent: statReporter should have been called a bunch of times")
@@ -537,3 +755,207 @@ func Test_director_checkSetAside(t *testing.T) {
 		t.Errorf("with skip false and empty queue, checkSetAside should return our point: nil")
 	}
 }
+
+func Test_dpTransit(t *testing.T) {
+	db := &fakeSerde{}
+	df := &SimpleDSFinder{DftDSSPec}
+	dsc := newDsCache(db, df, nil)
+
+	md := make([]byte, 20)
+	md[0] = 1 // Ready
+	local := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
+	clstr := &fakeCluster{}
+	clstr.nodesForDd = []*cluster.Node{remote}
+	clstr.ln = local
+
+	workerChs := make([]chan *incomingDpWithDs, 1)
+	workerChs[0] = make(chan *incomingDpWithDs, 10)
+
+	now := time.Now()
+	tr := &dpTransit{max: 2, timeout: time.Minute}
+	foo := serde.Ident{"name": "foo"}
+	if !tr.hold(&incomingDP{Ident: foo, Value: 1}, now.Add(-2*time.Minute)) || !tr.hold(&incomingDP{Ident: foo, Value: 2}, now) {
+		t.Errorf("hold: expected true")
+	}
+	if tr.hold(&incomingDP{Ident: foo, Value: 3}, now) {
+		t.Errorf("hold: expected false when full")
+	}
+
+	// Not ours yet, the first one is too old
+	applied, dropped := tr.retry(now, dsc, clstr, workerChs)
+	if applied != 0 || dropped != 1 || len(tr.held) != 1 {
+		t.Errorf("retry: expected 0 applied, 1 dropped, 1 held, got %d, %d, %d", applied, dropped, len(tr.held))
+	}
+
+	// Now ours
+	clstr.nodesForDd = []*cluster.Node{local}
+	applied, dropped = tr.retry(now, dsc, clstr, workerChs)
+	if applied != 1 || dropped != 0 || len(tr.held) != 0 {
+		t.Errorf("retry: expected 1 applied, 0 dropped, 0 held, got %d, %d, %d", applied, dropped, len(tr.held))
+	}
+	if dpds := <-workerChs[0]; dpds.dp.Value != 2 {
+		t.Errorf("retry: wrong data point queued: %v", dpds.dp)
+	}
+
+	// directorProcessincomingDP holds a forwarded point for a DS owned by another node
+	clstr.nodesForDd = []*cluster.Node{remote}
+	sr := &fakeSr{}
+	directorProcessincomingDP(&incomingDP{Ident: foo, Value: 4, Hops: 1}, sr, dsc, workerChs, clstr, nil, tr, nil)
+	if len(tr.held) != 1 || len(workerChs[0]) != 0 {
+		t.Errorf("directorProcessincomingDP: forwarded point should be held, held: %d", len(tr.held))
+	}
+}
+
+func Test_dpAccumulator(t *testing.T) {
+	saveFn := directorForwardDPToNode
+	defer func() { directorForwardDPToNode = saveFn }()
+	var sent []*incomingDP
+	directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg) error {
+		sent = append(sent, dp)
+		return nil
+	}
+
+	dsc := newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, nil)
+	md := make([]byte, 20)
+	md[0] = 1 // Ready
+	local := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
+	clstr := &fakeCluster{ln: local}
+	clstr.nodesForDd = []*cluster.Node{remote}
+	workerChs := make([]chan *incomingDpWithDs, 1)
+	workerChs[0] = make(chan *incomingDpWithDs, 10)
+	sr := &fakeSr{}
+	fwd := &dpAccumulator{window: time.Minute}
+	foo := serde.Ident{"name": "foo"}
+
+	// Points within a step (DftDSSPec has 10s) are accumulated
+	for i, v := range []float64{1, 2, 3} {
+		dp := &incomingDP{Ident: foo, TimeStamp: time.Unix(1000+int64(i), 0), Value: v}
+		directorProcessincomingDP(dp, sr, dsc, workerChs, clstr, nil, nil, fwd)
+	}
+	if len(sent) != 0 || len(fwd.accs) != 1 {
+		t.Fatalf("dpAccumulator: expected nothing forwarded and 1 accumulation, got %d, %d", len(sent), len(fwd.accs))
+	}
+
+	// A point of the next step forwards the mean of the previous ones
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1010, 0), Value: 10}, sr, dsc, workerChs, clstr, nil, nil, fwd)
+	if len(sent) != 1 || sent[0].Value != 2 || !sent[0].TimeStamp.Equal(time.Unix(1002, 0)) {
+		t.Errorf("dpAccumulator: expected the mean 2 at 1002 forwarded, got %v", sent)
+	}
+
+	// Counters are forwarded right away
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1011, 0), Value: 5, WrapAt: 100}, sr, dsc, workerChs, clstr, nil, nil, fwd)
+	if len(sent) != 2 || sent[1].WrapAt != 100 {
+		t.Errorf("dpAccumulator: expected a counter to be forwarded right away, got %v", sent)
+	}
+
+	// Not yet due, then due
+	if due := fwd.due(time.Now(), false); len(due) != 0 {
+		t.Errorf("due: expected nothing due yet, got %d", len(due))
+	}
+	due := fwd.due(time.Now().Add(time.Minute), false)
+	if len(due) != 1 || due[0].dp.Value != 10 || len(fwd.accs) != 0 {
+		t.Errorf("due: expected the point of value 10 due, got %v", due)
+	}
+
+	// DSs owned by this node are not accumulated
+	clstr.nodesForDd = []*cluster.Node{local}
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1020, 0), Value: 1}, sr, dsc, workerChs, clstr, nil, nil, fwd)
+	if len(workerChs[0]) != 1 || len(fwd.accs) != 0 {
+		t.Errorf("dpAccumulator: a local DS should be queued to a worker, got %d queued, %d accumulated", len(workerChs[0]), len(fwd.accs))
+	}
+}
+
+func Test_director_typeConflict(t *testing.T) {
+	db := serde.NewMemSerDe()
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	workerChs := make([]chan *incomingDpWithDs, 1)
+	workerChs[0] = make(chan *incomingDpWithDs, 10)
+	sr := &fakeSr{}
+	foo := serde.Ident{"name": "foo"}
+	gauge := func() *incomingDP { return &incomingDP{Ident: foo, TimeStamp: time.Unix(1000, 0), Value: 1} }
+	counter := func() *incomingDP {
+		return &incomingDP{Ident: foo, TimeStamp: time.Unix(1000, 0), Value: 1, WrapAt: 100}
+	}
+
+	// ignored by default
+	directorProcessincomingDP(gauge(), sr, dsc, workerChs, nil, nil, nil, nil)
+	directorProcessincomingDP(counter(), sr, dsc, workerChs, nil, nil, nil, nil)
+	if len(workerChs[0]) != 2 {
+		t.Errorf("typeConflict: with TypeConflictIgnore both points should be queued, got %d", len(workerChs[0]))
+	}
+	<-workerChs[0]
+	<-workerChs[0]
+
+	// reject, the DS is a gauge as of the first point
+	dsc.typePolicy = TypeConflictReject
+	dsc.delete(foo)
+	var dead []DeadLetterReason
+	r := &Receiver{}
+	r.SetDeadLetterHandler(func(dl *DeadLetter) { dead = append(dead, dl.Reason) })
+	directorProcessincomingDP(gauge(), r, dsc, workerChs, nil, nil, nil, nil)
+	directorProcessincomingDP(counter(), r, dsc, workerChs, nil, nil, nil, nil)
+	if len(workerChs[0]) != 1 || len(dead) != 1 || dead[0] != DeadLetterTypeConflict {
+		t.Errorf("typeConflict: expected 1 queued and a type conflict dead letter, got %d, %v", len(workerChs[0]), dead)
+	}
+	<-workerChs[0]
+
+	// suffix
+	dsc.typePolicy = TypeConflictSuffix
+	directorProcessincomingDP(counter(), sr, dsc, workerChs, nil, nil, nil, nil)
+	if dpds := <-workerChs[0]; dpds.cds.Ident()["name"] != "foo.counter" {
+		t.Errorf("typeConflict: expected the counter to go to foo.counter, got %v", dpds.cds.Ident())
+	}
+	directorProcessincomingDP(gauge(), sr, dsc, workerChs, nil, nil, nil, nil)
+	if dpds := <-workerChs[0]; dpds.cds.Ident()["name"] != "foo" {
+		t.Errorf("typeConflict: expected the gauge to go to foo, got %v", dpds.cds.Ident())
+	}
+}
+
+func Test_director_createHold(t *testing.T) {
+	db := &fakeSerde{block: make(chan bool)}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	dsc.limitConcurrentCreates(1)
+	workerChs := workerChannels{make(chan *incomingDpWithDs, 10)}
+	sr := &fakeSr{}
+	foo := serde.Ident{"name": "foo"}
+
+	done := make(chan error)
+	go func() {
+		_, err := dsc.fetchOrCreateByName(foo)
+		done <- err
+	}()
+	for i := 0; i < 100 && len(dsc.createSem) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1000, 0), Value: 1}, sr, dsc, workerChs, nil, nil, nil, nil)
+	db.block <- true
+	if err := <-done; err != nil {
+		t.Fatalf("fetchOrCreateByName: %v", err)
+	}
+
+	// The DS is cached now, but a point arriving before the held
+	// one is retried must not overtake it.
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1010, 0), Value: 2}, sr, dsc, workerChs, nil, nil, nil, nil)
+	if len(workerChs[0]) != 0 {
+		t.Errorf("createHold: expected the direct point to be held, got %d queued", len(workerChs[0]))
+	}
+	applied, _ := dsc.createHold.retry(time.Now(), dsc, sr, func(dp *incomingDP, cds *cachedDs) {
+		directorProcessFetched(dp, cds, sr, dsc, workerChs, nil, nil, nil, nil)
+	})
+	if applied != 2 || len(workerChs[0]) != 2 {
+		t.Fatalf("createHold: expected both points applied, got %d", applied)
+	}
+	for _, v := range []float64{1, 2} {
+		if dpds := <-workerChs[0]; dpds.dp.Value != v {
+			t.Errorf("createHold: expected point %v, got %v", v, dpds.dp.Value)
+		}
+	}
+
+	// Nothing held, a point goes straight through
+	directorProcessincomingDP(&incomingDP{Ident: foo, TimeStamp: time.Unix(1020, 0), Value: 3}, sr, dsc, workerChs, nil, nil, nil, nil)
+	if len(workerChs[0]) != 1 {
+		t.Errorf("createHold: expected the point to be queued once nothing is held")
+	}
+}
@@ -17,13 +17,51 @@ package receiver
 
 import (
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"golang.org/x/time/rate"
 )
 
+// errCreateRateLimited is returned by fetchOrCreateByName when a new
+// DS cannot be created because of the creation rate limit.
+var errCreateRateLimited = fmt.Errorf("dsCache: new DS creation rate limited")
+
+// errFetchTimeout is returned by fetchOrCreate when fetching or
+// creating a DS takes longer than the fetch timeout. The fetch is
+// not abandoned, the DS is cached once it completes.
+var errFetchTimeout = fmt.Errorf("dsCache: fetching the DS timed out")
+
+// errCreatePending is returned by fetchOrCreate when the DS needs to
+// be created, but as many DSs as allowed are being created already,
+// see Receiver.MaxConcurrentCreates.
+var errCreatePending = fmt.Errorf("dsCache: too many DSs being created")
+
+// maxPendingFetches is how many timed out fetches can be pending
+// before further ones fail right away.
+const maxPendingFetches = 1024
+
+// nFetchers is how many goroutines fetch (or create) DSs for the
+// directors when there is a fetch timeout, see createWithTimeout.
+const nFetchers = 4
+
+// errTagKeyNotAllowed is returned by allowedIdent when an ident has a
+// tag key which is not in the allowlist.
+var errTagKeyNotAllowed = fmt.Errorf("dsCache: tag key not allowed")
+
+// errTagKeyMissing is returned by allowedIdent when an ident lacks a
+// required tag key, or its value is empty.
+var errTagKeyMissing = fmt.Errorf("dsCache: required tag key missing")
+
 // A collection of data sources kept by name (string).
 type dsCache struct {
 	sync.RWMutex
@@ -32,6 +70,44 @@ type dsCache struct {
 	dsf     dsFlusherBlocking
 	finder  MatchingDSSpecFinder
 	clstr   clusterer
+
+	createLimiter *rate.Limiter // limits new DS creation, nil means no limit
+	createMu      sync.Mutex    // there can be several directors creating DSs
+	maxRRASlots   int64         // RRA size limit for new DSs, 0 means no limit
+
+	// With createSem, createMu only guards creating, and up to
+	// cap(createSem) DSs are created at once rather than one.
+	createSem  chan struct{}   // nil means no limit other than createMu
+	creating   map[string]bool // idents being created, only with createSem
+	createHold *dpCreateHold   // points waiting for createSem, only with createSem
+
+	fetchTimeout time.Duration      // see Receiver.FetchTimeout
+	fetchMu      sync.Mutex         // guards fetching
+	fetching     map[string]bool    // idents with a fetch in progress, only with fetchTimeout
+	fetchCh      chan *fetchRequest // to the fetchers, only with fetchTimeout
+
+	tagKeys      map[string]bool // allowed ident tag keys, nil means all
+	stripTagKeys bool            // strip disallowed tag keys instead of rejecting
+	requiredKeys []string        // ident tag keys which must not be empty
+
+	health    *clusterHealth // nil unless ClusterFallbackLocal
+	fwdWindow time.Duration  // see Receiver.ForwardAccumulateWindow
+
+	typePolicy TypeConflictPolicy
+	bounds     *valueBounds // see Receiver.MinValue, nil means none
+
+	skewTolerance time.Duration // see Receiver.SkewTolerance, 0 means none
+	skewPolicy    SkewPolicy
+
+	drained  map[int]bool // workers not given DSs, see Receiver.RebalanceWorker
+	nWorkers int          // number of workers, set along with drained
+
+	spiller *dsSpiller // nil unless Receiver.SpillDir
+
+	jitter    time.Duration // see Receiver.FlushJitter
+	jitterRnd *rand.Rand    // only with jitter, guarded by the lock
+
+	newDSHook func(serde.Ident, string) // see Receiver.SetNewDSHook
 }
 
 // Returns a new dsCache object.
@@ -56,16 +132,304 @@ func (d *dsCache) getByIdent(ident serde.Ident) *cachedDs {
 func (d *dsCache) insert(cds *cachedDs) {
 	d.Lock()
 	defer d.Unlock()
+	if cds.bounds == nil {
+		cds.bounds = d.bounds
+	}
+	if d.jitter > 0 && cds.jitter == 0 {
+		cds.jitter = time.Duration(d.jitterRnd.Int63n(int64(d.jitter)))
+	}
+	if len(d.drained) > 0 && d.drained[cds.workerIndex(d.nWorkers)] {
+		cds.setWorker(d.undrainedWorker(cds.Id()))
+	}
 	d.byIdent[cds.Ident().String()] = cds
 }
 
+// setFlushJitter sets the most jitter added to the max cache
+// duration of the DSs inserted from now on, drawn from a random
+// source seeded with seed, or a random one if it is 0.
+func (d *dsCache) setFlushJitter(jitter time.Duration, seed int64) {
+	d.Lock()
+	defer d.Unlock()
+	d.jitter = jitter
+	if jitter <= 0 {
+		d.jitterRnd = nil
+		return
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	d.jitterRnd = rand.New(rand.NewSource(seed))
+}
+
+// drainWorker marks the worker at index (out of n) as drained, so
+// that new DSs are not given to it, and returns where its DSs are to
+// move: each to the worker which is not drained and has the fewest
+// DSs at that point.
+func (d *dsCache) drainWorker(index, n int) ([]dsMove, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.drained == nil || d.nWorkers != n {
+		d.drained = make(map[int]bool)
+		d.nWorkers = n
+	}
+	others := n - len(d.drained)
+	if !d.drained[index] {
+		others--
+	}
+	if others < 1 {
+		return nil, fmt.Errorf("no other worker to move data sources to")
+	}
+	d.drained[index] = true
+
+	load := make([]int, n)
+	var owned []*cachedDs
+	for _, cds := range d.byIdent {
+		if i := cds.workerIndex(n); i == index {
+			owned = append(owned, cds)
+		} else {
+			load[i]++
+		}
+	}
+	moves := make([]dsMove, 0, len(owned))
+	for _, cds := range owned {
+		to := -1
+		for i := range load {
+			if !d.drained[i] && (to == -1 || load[i] < load[to]) {
+				to = i
+			}
+		}
+		load[to]++
+		moves = append(moves, dsMove{cds: cds, to: to})
+	}
+	return moves, nil
+}
+
+// undrainedWorker returns a worker which is not drained for the DS
+// id, it must be called with the cache locked.
+func (d *dsCache) undrainedWorker(id int64) int {
+	var workers []int
+	for i := 0; i < d.nWorkers; i++ {
+		if !d.drained[i] {
+			workers = append(workers, i)
+		}
+	}
+	return workers[id%int64(len(workers))]
+}
+
+// rename changes the ident of the cached DS identified by oldIdent,
+// in the database (by way of renamer) first. The cache is locked for
+// the duration, thus directors wait for the rename instead of
+// creating a DS with either ident meanwhile.
+func (d *dsCache) rename(oldIdent, newIdent serde.Ident, renamer serde.DataSourceRenamer) error {
+	d.Lock()
+	defer d.Unlock()
+	cds := d.byIdent[oldIdent.String()]
+	if cds == nil {
+		return fmt.Errorf("unknown data source: %v", oldIdent)
+	}
+	if d.byIdent[newIdent.String()] != nil {
+		return fmt.Errorf("a data source with ident %v already exists", newIdent)
+	}
+	ds, ok := cds.DbDataSourcer.(interface {
+		SetIdent(serde.Ident)
+	})
+	if !ok {
+		return fmt.Errorf("the ident of this data source cannot be changed")
+	}
+	if err := renamer.RenameDataSource(cds.Id(), newIdent); err != nil {
+		return err
+	}
+	cds.Lock()
+	ds.SetIdent(newIdent)
+	cds.Unlock()
+	delete(d.byIdent, oldIdent.String())
+	d.byIdent[newIdent.String()] = cds
+	return nil
+}
+
 // Delete a DS
 func (d *dsCache) delete(ident serde.Ident) {
 	d.Lock()
 	defer d.Unlock()
+	if cds := d.byIdent[ident.String()]; cds != nil && d.spiller != nil {
+		os.Remove(d.spiller.path(cds.Id())) // if any
+	}
 	delete(d.byIdent, ident.String())
 }
 
+// all rlocks and returns a slice of all the cached DSs.
+func (d *dsCache) all() []*cachedDs {
+	d.RLock()
+	defer d.RUnlock()
+	result := make([]*cachedDs, 0, len(d.byIdent))
+	for _, cds := range d.byIdent {
+		result = append(result, cds)
+	}
+	return result
+}
+
+// copyAll returns copies of all the cached DSs. The cache is read
+// locked for the duration and every DS is locked while it is being
+// copied, so the result is a consistent snapshot.
+func (d *dsCache) copyAll() []serde.DbDataSourcer {
+	d.RLock()
+	defer d.RUnlock()
+	result := make([]serde.DbDataSourcer, 0, len(d.byIdent))
+	for _, cds := range d.byIdent {
+		cds.Lock()
+		cds.unspillLogged()
+		result = append(result, cds.Copy().(serde.DbDataSourcer))
+		cds.Unlock()
+	}
+	return result
+}
+
+// limitCreateRate sets the maximum number of new DSs that can be
+// created per second. Zero or less means no limit.
+func (d *dsCache) limitCreateRate(n int) {
+	if n > 0 {
+		d.createLimiter = rate.NewLimiter(rate.Limit(n), n)
+	} else {
+		d.createLimiter = nil
+	}
+}
+
+// limitConcurrentCreates sets the maximum number of DSs being
+// created at once, see Receiver.MaxConcurrentCreates. Zero or less
+// means one at a time.
+func (d *dsCache) limitConcurrentCreates(n int) {
+	if n > 0 {
+		d.createSem = make(chan struct{}, n)
+		d.creating = make(map[string]bool)
+		d.createHold = &dpCreateHold{max: directorCreateHoldSize, timeout: directorCreateHoldTimeout}
+	} else {
+		d.createSem, d.creating, d.createHold = nil, nil, nil
+	}
+}
+
+// startCreate takes one of createSem for creating the DS with the
+// ident key, it returns false if there is none left or the DS is
+// being created already.
+func (d *dsCache) startCreate(key string) bool {
+	d.createMu.Lock()
+	defer d.createMu.Unlock()
+	if d.creating[key] {
+		return false
+	}
+	select {
+	case d.createSem <- struct{}{}:
+	default:
+		return false
+	}
+	d.creating[key] = true
+	return true
+}
+
+// endCreate gives back what startCreate took.
+func (d *dsCache) endCreate(key string) {
+	d.createMu.Lock()
+	defer d.createMu.Unlock()
+	delete(d.creating, key)
+	<-d.createSem
+}
+
+// allowTagKeys restricts the ident tag keys to keys (and "name",
+// which is always allowed). If strip is true, disallowed tag keys are
+// removed from the ident, otherwise the ident is rejected. An empty
+// keys means all tag keys are allowed.
+func (d *dsCache) allowTagKeys(keys []string, strip bool) {
+	d.tagKeys, d.stripTagKeys = nil, strip
+	if len(keys) > 0 {
+		d.tagKeys = map[string]bool{"name": true}
+		for _, k := range keys {
+			d.tagKeys[k] = true
+		}
+	}
+}
+
+// limitRRASlots sets the maximum number of slots an RRA of a new DS
+// can have, 0 means no limit. See clampRRAs.
+func (d *dsCache) limitRRASlots(n int) {
+	d.maxRRASlots = int64(n)
+}
+
+// clampRRAs returns dsSpec, or if any of its RRAs would have more than
+// maxRRASlots slots, a copy of it with the span of those RRAs reduced
+// to fit, which is logged. A misconfigured spec thus results in a
+// shorter retention rather than enormous flushes.
+func (d *dsCache) clampRRAs(ident serde.Ident, dsSpec *rrd.DSSpec) *rrd.DSSpec {
+	if d.maxRRASlots <= 0 {
+		return dsSpec
+	}
+	clamped := dsSpec
+	for i, rs := range dsSpec.RRAs {
+		if rs.Step <= 0 || rs.Span/rs.Step <= time.Duration(d.maxRRASlots) {
+			continue
+		}
+		if clamped == dsSpec {
+			spec := *dsSpec
+			spec.RRAs = append([]rrd.RRASpec(nil), dsSpec.RRAs...)
+			clamped = &spec
+		}
+		span := rs.Step * time.Duration(d.maxRRASlots)
+		log.Printf("dsCache: RRA %d of %v would have %d slots, more than the maximum of %d, reducing its span from %v to %v",
+			i, ident, rs.Span/rs.Step, d.maxRRASlots, rs.Span, span)
+		clamped.RRAs[i].Span = span
+	}
+	return clamped
+}
+
+// requireTagKeys sets the tag keys every ident must have (with a
+// non-empty value). An empty keys means none are required.
+func (d *dsCache) requireTagKeys(keys []string) {
+	d.requiredKeys = keys
+}
+
+// allowedIdent checks the ident tag keys against the allowlist. It
+// returns errTagKeyNotAllowed if a tag key is not allowed, unless
+// stripping, in which case a copy of the ident without the
+// disallowed tag keys is returned. The resulting ident is then
+// checked for the required tag keys, errTagKeyMissing is returned if
+// one is missing.
+func (d *dsCache) allowedIdent(ident serde.Ident) (serde.Ident, error) {
+	ident, err := d.strippedIdent(ident)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range d.requiredKeys {
+		if ident[k] == "" {
+			return nil, errTagKeyMissing
+		}
+	}
+	return ident, nil
+}
+
+func (d *dsCache) strippedIdent(ident serde.Ident) (serde.Ident, error) {
+	if d.tagKeys == nil {
+		return ident, nil
+	}
+	var result serde.Ident
+	for k := range ident {
+		if d.tagKeys[k] {
+			continue
+		}
+		if !d.stripTagKeys {
+			return nil, errTagKeyNotAllowed
+		}
+		if result == nil {
+			result = make(serde.Ident, len(ident))
+			for k, v := range ident {
+				result[k] = v
+			}
+		}
+		delete(result, k)
+	}
+	if result == nil {
+		return ident, nil
+	}
+	return result, nil
+}
+
 func (d *dsCache) preLoad() error {
 	dss, err := d.db.FetchDataSources()
 	if err != nil {
@@ -77,7 +441,21 @@ func (d *dsCache) preLoad() error {
 		if !ok {
 			return fmt.Errorf("preLoad: ds must be a serde.DbDataSourcer")
 		}
-		d.insert(&cachedDs{DbDataSourcer: dbds})
+		var dsSpec *rrd.DSSpec
+		if d.finder != nil {
+			dsSpec = d.finder.FindMatchingDSSpec(dbds.Ident())
+		}
+		if cds := d.getByIdent(dbds.Ident()); cds != nil {
+			// Already cached (restored from a snapshot), which is
+			// more recent than what is in the database.
+			cds.applySpec(dsSpec)
+			if cds.bounds == nil {
+				cds.bounds = d.bounds
+			}
+			d.register(cds.DbDataSourcer)
+			continue
+		}
+		d.insert(newCachedDs(dbds, dsSpec))
 		d.register(dbds)
 	}
 
@@ -86,9 +464,126 @@ func (d *dsCache) preLoad() error {
 
 // get a cached ds
 func (d *dsCache) fetchOrCreateByName(ident serde.Ident) (*cachedDs, error) {
+	return d.fetchOrCreate(ident, ident, "")
+}
+
+// fetchOrCreate is the same as fetchOrCreateByName, except that the
+// DSSpec for a new DS is matched using specIdent. This is how a
+// companion series gets the same DSSpec as its value series. The
+// source is passed on to newDSHook.
+func (d *dsCache) fetchOrCreate(ident, specIdent serde.Ident, source string) (*cachedDs, error) {
+	if result := d.getByIdent(ident); result != nil {
+		return result, nil
+	}
+	if d.fetchTimeout <= 0 {
+		return d.create(ident, specIdent, source)
+	}
+	return d.createWithTimeout(ident, specIdent, source)
+}
+
+// setFetchTimeout sets the fetch timeout, zero means none. With a
+// timeout, the fetchers must be started, see startFetchers.
+func (d *dsCache) setFetchTimeout(timeout time.Duration) {
+	d.fetchTimeout = timeout
+	d.fetching = make(map[string]bool)
+	d.fetchCh = make(chan *fetchRequest, maxPendingFetches)
+}
+
+// A fetchRequest is a create call for a fetcher to make.
+type fetchRequest struct {
+	ident, specIdent serde.Ident
+	source           string
+	resp             chan fetchResult
+}
+
+type fetchResult struct {
+	cds *cachedDs
+	err error
+}
+
+// startFetchers starts nFetchers goroutines making the create calls
+// of createWithTimeout, until stopFetchers.
+func (d *dsCache) startFetchers(wg, startWg *sync.WaitGroup, count *int32) {
+	startWg.Add(nFetchers)
+	for i := 0; i < nFetchers; i++ {
+		go dsFetcher(&wrkCtl{wg: wg, startWg: startWg, id: fmt.Sprintf("fetcher_%d", i), count: count}, d, d.fetchCh)
+	}
+}
+
+// stopFetchers stops the fetchers once the fetches queued so far are
+// done. It must not be called while createWithTimeout can be.
+func (d *dsCache) stopFetchers(wg *sync.WaitGroup) {
+	close(d.fetchCh)
+	wg.Wait()
+}
+
+func dsFetcher(wc wController, d *dsCache, fetchCh chan *fetchRequest) {
+	wc.onEnter()
+	defer wc.onExit()
+	wc.onStarted()
+	for fr := range fetchCh {
+		cds, err := d.create(fr.ident, fr.specIdent, fr.source)
+		d.fetchMu.Lock()
+		delete(d.fetching, fr.ident.String())
+		d.fetchMu.Unlock()
+		fr.resp <- fetchResult{cds, err}
+	}
+}
+
+// createWithTimeout is create, but it returns errFetchTimeout if it
+// takes longer than fetchTimeout, in which case create carries on in
+// the background, in one of the fetchers. While it does, further
+// calls for the same ident return errFetchTimeout without waiting,
+// as do all calls while maxPendingFetches are pending.
+func (d *dsCache) createWithTimeout(ident, specIdent serde.Ident, source string) (*cachedDs, error) {
+	key := ident.String()
+	d.fetchMu.Lock()
+	if d.fetching[key] || len(d.fetching) >= maxPendingFetches {
+		d.fetchMu.Unlock()
+		return nil, errFetchTimeout
+	}
+	d.fetching[key] = true
+	d.fetchMu.Unlock()
+
+	// There is room, because fetchCh can take maxPendingFetches
+	ch := make(chan fetchResult, 1)
+	d.fetchCh <- &fetchRequest{ident: ident, specIdent: specIdent, source: source, resp: ch}
+
+	timer := time.NewTimer(d.fetchTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.cds, res.err
+	case <-timer.C:
+		return nil, errFetchTimeout
+	}
+}
+
+// create fetches the DS from the database, or creates it there if
+// its ident matches a DSSpec, and caches it. It returns nil if no
+// DSSpec matches. With createSem, it returns errCreatePending rather
+// than wait for it.
+func (d *dsCache) create(ident, specIdent serde.Ident, source string) (*cachedDs, error) {
 	result := d.getByIdent(ident)
 	if result == nil {
-		if dsSpec := d.finder.FindMatchingDSSpec(ident); dsSpec != nil {
+		if d.createSem == nil {
+			d.createMu.Lock()
+			defer d.createMu.Unlock()
+		} else {
+			key := ident.String()
+			if !d.startCreate(key) {
+				return nil, errCreatePending
+			}
+			defer d.endCreate(key)
+		}
+		if result = d.getByIdent(ident); result != nil {
+			return result, nil // created by another director meanwhile
+		}
+		if dsSpec := d.finder.FindMatchingDSSpec(specIdent); dsSpec != nil {
+			if d.createLimiter != nil && !d.createLimiter.Allow() {
+				return nil, errCreateRateLimited
+			}
+			dsSpec = d.clampRRAs(ident, dsSpec)
 			ds, err := d.db.FetchOrCreateDataSource(ident, dsSpec)
 			if err != nil {
 				return nil, err
@@ -98,15 +593,166 @@ func (d *dsCache) fetchOrCreateByName(ident serde.Ident) (*cachedDs, error) {
 				if !ok {
 					return nil, fmt.Errorf("fetchDataSourceByName: ds must be a serde.DbDataSourcer")
 				}
-				result = &cachedDs{DbDataSourcer: dbds}
+				result = newCachedDs(dbds, dsSpec)
+				d.loadKind(result)
 				d.insert(result)
 				d.register(dbds)
+				d.recordRateUnit(dbds, dsSpec)
+				if d.newDSHook != nil {
+					d.newDSHook(ident, source)
+				}
 			}
 		}
 	}
 	return result, nil
 }
 
+// reload replaces the DS with a new cachedDs of the state stored in
+// the database, discarding whatever it cached and did not flush,
+// e.g. after it caused a worker to panic, and returns it. The DS is
+// fetched as per its own definition, so that the same RRAs are
+// fetched rather than created as per a DSSpec which may have changed
+// since. The subscriptions of the DS end. The new cachedDs takes the
+// place of the old one in the cache, which is left alone otherwise,
+// since others may be using it unlocked.
+func (d *dsCache) reload(cds *cachedDs) (*cachedDs, error) {
+	ncds, err := func() (*cachedDs, error) {
+		cds.Lock()
+		defer cds.Unlock()
+		spec := &rrd.DSSpec{Step: cds.Step(), Heartbeat: cds.Heartbeat()}
+		for _, rra := range cds.RRAs() {
+			spec.RRAs = append(spec.RRAs, rrd.RRASpec{
+				Function:   rra.Consolidation(),
+				Percentile: rra.Percentile(),
+				Step:       rra.Step(),
+				Span:       rra.Step() * time.Duration(rra.Size()),
+				Xff:        rra.Xff(),
+			})
+		}
+		ds, err := d.db.FetchOrCreateDataSource(cds.Ident(), spec)
+		if err != nil {
+			return nil, err
+		}
+		dbds, ok := ds.(serde.DbDataSourcer)
+		if !ok || dbds.Id() != cds.Id() {
+			return nil, fmt.Errorf("reload: %v is not the same DS in the database", cds.Ident())
+		}
+		if cds.spiller != nil {
+			os.Remove(cds.spiller.path(cds.Id()))
+		}
+		cds.endSubscriptions()
+		return &cachedDs{
+			DbDataSourcer:   dbds,
+			lastFlushRT:     cds.lastFlushRT,
+			lastDpRT:        cds.lastDpRT,
+			stale:           cds.stale,
+			stepUpDps:       cds.stepUpDps,
+			stepUpChecked:   cds.stepUpChecked,
+			stepUpStreak:    cds.stepUpStreak,
+			stepUpSent:      cds.stepUpSent,
+			kind:            cds.kind,
+			sampling:        cds.sampling,
+			minCache:        cds.minCache,
+			maxCache:        cds.maxCache,
+			maxCachedPoints: cds.maxCachedPoints,
+			jitter:          cds.jitter,
+			bounds:          cds.bounds,
+			outOfBounds:     atomic.LoadInt64(&cds.outOfBounds),
+			skewed:          atomic.LoadInt64(&cds.skewed),
+			worker:          atomic.LoadInt32(&cds.worker),
+		}, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if d.finder != nil {
+		ncds.applySpec(d.finder.FindMatchingDSSpec(ncds.Ident()))
+	}
+	d.Lock()
+	defer d.Unlock()
+	if key := ncds.Ident().String(); d.byIdent[key] == cds {
+		d.byIdent[key] = ncds
+	}
+	return ncds, nil
+}
+
+// recordRateUnit saves the RateUnit of dsSpec in the metadata of the
+// DS, unless it is already there (or the SerDe cannot store
+// metadata). Failing to save it is logged, it does not prevent the
+// DS from being used.
+func (d *dsCache) recordRateUnit(ds serde.DbDataSourcer, dsSpec *rrd.DSSpec) {
+	if dsSpec.RateUnit <= 0 {
+		return
+	}
+	if err := d.recordMeta(ds, serde.MetaRateUnit, dsSpec.RateUnit.String()); err != nil {
+		log.Printf("dsCache: cannot record the rate unit of %v: %v", ds.Ident(), err)
+	}
+}
+
+// recordMeta sets key to value in the metadata of the DS, unless it
+// is already set (or the SerDe cannot store metadata). Other
+// metadata is preserved.
+func (d *dsCache) recordMeta(ds serde.DbDataSourcer, key, value string) error {
+	ms, ok := d.db.(serde.DataSourceMetaStorer)
+	if !ok {
+		return nil
+	}
+	meta, err := ms.FetchDataSourceMeta(ds.Id())
+	if err != nil {
+		return err
+	}
+	if v, ok := meta[key]; ok && v == value {
+		return nil
+	}
+	newMeta := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		newMeta[k] = v
+	}
+	newMeta[key] = value
+	return ms.SetDataSourceMeta(ds.Id(), newMeta)
+}
+
+// loadKind sets the kind of the DS to that saved in its metadata, if
+// any, see kindConflicts.
+func (d *dsCache) loadKind(cds *cachedDs) {
+	if d.typePolicy == TypeConflictIgnore {
+		return
+	}
+	ms, ok := d.db.(serde.DataSourceMetaStorer)
+	if !ok {
+		return
+	}
+	meta, err := ms.FetchDataSourceMeta(cds.Id())
+	if err != nil {
+		log.Printf("dsCache: cannot load the kind of %v: %v", cds.Ident(), err)
+		return
+	}
+	cds.kind = meta[serde.MetaKind]
+}
+
+// kindConflicts returns true if the data point is not of the same
+// kind as the DS, unless the policy is TypeConflictIgnore. The first
+// point sets the kind of the DS, which is saved in its metadata so
+// that it survives a restart or eviction.
+func (d *dsCache) kindConflicts(cds *cachedDs, dp *incomingDP) bool {
+	if d.typePolicy == TypeConflictIgnore {
+		return false
+	}
+	cds.Lock()
+	kind := cds.kind
+	if kind == "" {
+		cds.kind = dp.kind()
+	}
+	cds.Unlock()
+	if kind == "" {
+		if err := d.recordMeta(cds.DbDataSourcer, serde.MetaKind, dp.kind()); err != nil {
+			log.Printf("dsCache: cannot record the kind of %v: %v", cds.Ident(), err)
+		}
+		return false
+	}
+	return kind != dp.kind()
+}
+
 // register the rds as a DistDatum with the cluster
 func (d *dsCache) register(ds serde.DbDataSourcer) {
 	if d.clstr != nil {
@@ -121,14 +767,316 @@ func (d *dsCache) register(ds serde.DbDataSourcer) {
 // and provides a shouldByFlushed() method.
 type cachedDs struct {
 	serde.DbDataSourcer
+	sync.Mutex            // Held by the worker while modifying the DS.
 	lastFlushRT time.Time // Last time this DS was flushed (actual real time).
+	lastDpRT    time.Time // Last time a data point was processed (actual real time).
+	unflushedRT time.Time // When the first data point since the last flush was processed, zero if none.
+	stale       bool      // No data points for longer than the staleness window.
+
+	// Arrival rate of data points, see SetStepUpHook.
+	stepUpDps     int       // Data points since the last check.
+	stepUpChecked time.Time // Last check (actual real time).
+	stepUpStreak  int       // Consecutive checks with at least two data points per step.
+	stepUpSent    bool      // The hook was called for the current streak.
+
+	// Previous value and time stamp of a wrapping counter.
+	lastCounter    float64
+	lastIntCounter int64 // used instead of lastCounter by integer counters
+	lastCounterTs  time.Time
+
+	// The kind of the data points, see Receiver.TypeConflictPolicy.
+	kind string
+
+	// Data points not yet applied, sorted by time stamp. Only used
+	// by the worker if there is a reorder window.
+	held []*heldDP
+
+	sampling rrd.SamplingStrategy // nil means accumulate all points
+
+	// Cache parameters overriding those of the Receiver, zero means
+	// no override.
+	minCache, maxCache time.Duration
+	maxCachedPoints    int
+	jitter             time.Duration // added to the max cache duration, see Receiver.FlushJitter
+
+	subs []*Subscription // see Receiver.Subscribe
+
+	bounds      *valueBounds // nil means none
+	outOfBounds int64        // atomic, points dropped as out of bounds
+	skewed      int64        // atomic, points clamped or rejected, see Receiver.SkewTolerance
+
+	trace *dpTrace // of the last traced point applied since the last flush
+
+	// If spiller is not nil, the RRAs are in its spill file, see
+	// Receiver.SpillDir, and hold no points until unspilled.
+	spiller       *dsSpiller
+	spilledPoints int
+
+	// The index (plus 1) of the worker responsible for the DS, 0
+	// means the worker its id hashes to. Atomic, see
+	// Receiver.RebalanceWorker.
+	worker int32
+	route  sync.RWMutex // read locked while queueing to the worker, locked while moving
+
+	// Held from copying the DS for a flush until the copy is
+	// queued, taken with the DS locked, see flushCachedDs.
+	flushMu sync.Mutex
+}
+
+// workerIndex returns the index of the worker (out of n) responsible
+// for the DS.
+func (cds *cachedDs) workerIndex(n int) int {
+	if w := int(atomic.LoadInt32(&cds.worker)); w > 0 && w <= n {
+		return w - 1
+	}
+	return int(cds.Id() % int64(n))
+}
+
+// setWorker makes the worker at index responsible for the DS.
+func (cds *cachedDs) setWorker(index int) {
+	atomic.StoreInt32(&cds.worker, int32(index+1))
+}
+
+// setLastFlushRT records t as the last time the DS was flushed.
+func (cds *cachedDs) setLastFlushRT(t time.Time) {
+	cds.Lock()
+	defer cds.Unlock()
+	cds.lastFlushRT = t
+}
+
+// lockTimed locks the DS and returns how long it waited for the
+// lock.
+func (cds *cachedDs) lockTimed() time.Duration {
+	start := time.Now()
+	cds.Lock()
+	return time.Since(start)
+}
+
+// newCachedDs returns a cachedDs with the sampling strategy and cache
+// parameters from dsSpec, which can be nil.
+func newCachedDs(ds serde.DbDataSourcer, dsSpec *rrd.DSSpec) *cachedDs {
+	cds := &cachedDs{DbDataSourcer: ds}
+	cds.applySpec(dsSpec)
+	return cds
+}
+
+func (cds *cachedDs) applySpec(dsSpec *rrd.DSSpec) {
+	if dsSpec == nil {
+		return
+	}
+	if dsSpec.NewSampling != nil {
+		cds.sampling = dsSpec.NewSampling()
+	}
+	cds.minCache, cds.maxCache = dsSpec.MinCacheDuration, dsSpec.MaxCacheDuration
+	cds.maxCachedPoints = dsSpec.MaxCachedPoints
+	if dsSpec.LateGrace > 0 {
+		cds.SetLateGrace(dsSpec.LateGrace)
+	}
+	if dsSpec.FlushOnChange {
+		cds.SetFlushOnChange(true, dsSpec.FlushEpsilon)
+	}
+	if b := newValueBounds(dsSpec.MinValue, dsSpec.MaxValue); b != nil {
+		cds.bounds = b
+	}
+}
+
+// valueBounds are the bounds of the values of data points, see
+// Receiver.MinValue.
+type valueBounds struct {
+	min, max float64
+}
+
+// newValueBounds returns the bounds, or nil if min is not less than
+// max, i.e. they are not set.
+func newValueBounds(min, max float64) *valueBounds {
+	if !(min < max) {
+		return nil
+	}
+	return &valueBounds{min: min, max: max}
+}
+
+// outOfBoundsValue tells whether value is outside of the bounds of
+// the DS, counting it if so.
+func (cds *cachedDs) outOfBoundsValue(value float64) bool {
+	if b := cds.bounds; b == nil || !(value < b.min || value > b.max) {
+		return false
+	}
+	atomic.AddInt64(&cds.outOfBounds, 1)
+	return true
+}
+
+type heldDP struct {
+	dp *incomingDP
+	rt time.Time // When it arrived (actual real time).
+}
+
+// hold inserts a data point into the held list keeping it sorted by
+// time stamp. Points with equal time stamps stay in arrival order.
+func (cds *cachedDs) hold(dp *incomingDP, now time.Time) {
+	i := sort.Search(len(cds.held), func(i int) bool { return cds.held[i].dp.TimeStamp.After(dp.TimeStamp) })
+	cds.held = append(cds.held, nil)
+	copy(cds.held[i+1:], cds.held[i:])
+	cds.held[i] = &heldDP{dp: dp, rt: now}
+}
+
+// release removes and returns, in time stamp order, the held data
+// points which are at least window older than the latest held point,
+// or have been held for window or longer. A window of 0 releases all.
+func (cds *cachedDs) release(window time.Duration, now time.Time) []*incomingDP {
+	if len(cds.held) == 0 {
+		return nil
+	}
+	latest := cds.held[len(cds.held)-1].dp.TimeStamp
+	var result []*incomingDP
+	for len(cds.held) > 0 {
+		h := cds.held[0]
+		if latest.Sub(h.dp.TimeStamp) < window && now.Sub(h.rt) < window {
+			break
+		}
+		result = append(result, h.dp)
+		cds.held[0] = nil
+		cds.held = cds.held[1:]
+	}
+	return result
+}
+
+// counterRate takes a counter value which wraps around at wrapAt and
+// returns the per second rate since the previous counter value. The
+// second return value is false if no rate could be computed, which is
+// the case the first time it is called or if the time stamp is not
+// after the previous one, or the value is not valid for wrapAt.
+func (cds *cachedDs) counterRate(value, wrapAt float64, ts time.Time) (float64, bool) {
+	if value < 0 || value >= wrapAt {
+		return 0, false
+	}
+	prev, prevTs := cds.lastCounter, cds.lastCounterTs
+	if !prevTs.IsZero() && !ts.After(prevTs) {
+		return 0, false
+	}
+	cds.lastCounter, cds.lastCounterTs = value, ts
+	if prevTs.IsZero() {
+		return 0, false
+	}
+	delta := value - prev
+	if delta < 0 { // the counter wrapped
+		delta += wrapAt
+	}
+	return delta / ts.Sub(prevTs).Seconds(), true
+}
+
+// counterRateInt is the same as counterRate for integer counters. The
+// difference between the values is computed with integer precision,
+// which matters for large (above 2^53) counter values.
+func (cds *cachedDs) counterRateInt(value, wrapAt int64, ts time.Time) (float64, bool) {
+	if value < 0 || value >= wrapAt {
+		return 0, false
+	}
+	prev, prevTs := cds.lastIntCounter, cds.lastCounterTs
+	if !prevTs.IsZero() && !ts.After(prevTs) {
+		return 0, false
+	}
+	cds.lastIntCounter, cds.lastCounterTs = value, ts
+	if prevTs.IsZero() {
+		return 0, false
+	}
+	delta := value - prev
+	if delta < 0 { // the counter wrapped
+		delta += wrapAt
+	}
+	return float64(delta) / ts.Sub(prevTs).Seconds(), true
+}
+
+// currentPdp returns the value of the PDP currently being accumulated
+// along with the beginning of the PDP. The last return value is false
+// if there is no partial PDP data.
+func (cds *cachedDs) currentPdp() (float64, time.Time, bool) {
+	cds.Lock()
+	defer cds.Unlock()
+	lu := cds.LastUpdate()
+	if lu.IsZero() || cds.Duration() == 0 {
+		return math.NaN(), time.Time{}, false
+	}
+	return cds.Value(), lu.Truncate(cds.Step()), true
+}
+
+// updateStale compares the time of the last processed data point
+// with the staleness window and updates the stale flag. It returns
+// the new value of the flag and whether it changed. A DS which never
+// received a data point is never stale.
+func (cds *cachedDs) updateStale(now time.Time, window time.Duration) (stale, changed bool) {
+	cds.Lock()
+	defer cds.Unlock()
+	if cds.lastDpRT.IsZero() {
+		return false, false
+	}
+	stale = now.Sub(cds.lastDpRT) > window
+	changed = stale != cds.stale
+	cds.stale = stale
+	return stale, changed
 }
 
+// unflushedAge returns how long ago the oldest data point not yet
+// flushed was processed, 0 if there is none.
+func (cds *cachedDs) unflushedAge(now time.Time) time.Duration {
+	cds.Lock()
+	defer cds.Unlock()
+	if cds.unflushedRT.IsZero() {
+		return 0
+	}
+	return now.Sub(cds.unflushedRT)
+}
+
+// updateStepUp computes the average interval between the data points
+// processed since the last call. It returns true once the interval
+// has been at most half the step for periods consecutive calls, and
+// not again until the interval grows past that.
+func (cds *cachedDs) updateStepUp(now time.Time, periods int) (interval time.Duration, propose bool) {
+	cds.Lock()
+	defer cds.Unlock()
+	n, last := cds.stepUpDps, cds.stepUpChecked
+	cds.stepUpDps, cds.stepUpChecked = 0, now
+	if last.IsZero() {
+		return 0, false
+	}
+	if n > 0 {
+		interval = now.Sub(last) / time.Duration(n)
+	}
+	if n == 0 || interval*2 > cds.Step() {
+		cds.stepUpStreak, cds.stepUpSent = 0, false
+		return interval, false
+	}
+	cds.stepUpStreak++
+	if cds.stepUpStreak >= periods && !cds.stepUpSent {
+		cds.stepUpSent = true
+		return interval, true
+	}
+	return interval, false
+}
+
+// unflushedPoints returns the number of points not yet flushed,
+// including the spilled ones.
+func (cds *cachedDs) unflushedPoints() int {
+	return cds.PointCount() + cds.spilledPoints
+}
+
+// shouldBeFlushed decides whether the DS is due for a flush, the
+// arguments are the Receiver cache parameters, which are overridden
+// by those of the DS, if any.
 func (cds *cachedDs) shouldBeFlushed(maxCachedPoints int, minCache, maxCache time.Duration) bool {
 	if cds.LastUpdate().IsZero() {
 		return false
 	}
-	pc := cds.PointCount()
+	if cds.maxCachedPoints > 0 {
+		maxCachedPoints = cds.maxCachedPoints
+	}
+	if cds.minCache > 0 {
+		minCache = cds.minCache
+	}
+	if cds.maxCache > 0 {
+		maxCache = cds.maxCache
+	}
+	maxCache += cds.jitter
+	pc := cds.unflushedPoints()
 	if pc > maxCachedPoints {
 		return cds.lastFlushRT.Add(minCache).Before(time.Now())
 	} else if pc > 0 {
@@ -148,7 +1096,23 @@ type distDs struct {
 
 func (ds *distDs) Relinquish() error {
 	if !ds.LastUpdate().IsZero() {
+		// A worker may be applying a data point, which must not
+		// happen while the DS is being flushed. Its subscribers
+		// will not see any more points on this node.
+		cds := ds.dsc.getByIdent(ds.Ident())
+		if cds != nil {
+			cds.Lock()
+			cds.flushMu.Lock() // after any flush in progress
+			cds.unspillLogged()
+		}
 		ds.dsc.dsf.flushDs(ds.DbDataSourcer, true)
+		if cds != nil {
+			cds.flushMu.Unlock()
+			cds.endSubscriptions()
+			// Unlocked before delete locks the cache, which
+			// copyAll locks before the DSs, like FlushAndEvict.
+			cds.Unlock()
+		}
 		ds.dsc.delete(ds.Ident())
 	}
 	return nil
@@ -16,6 +16,10 @@ package receiver
 
 import (
 	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,6 +62,40 @@ func Test_dscache_insert(t *testing.T) {
 	}
 }
 
+func Test_dscache_setFlushJitter(t *testing.T) {
+	jitters := func(seed int64) []time.Duration {
+		d := newDsCache(nil, nil, nil)
+		d.setFlushJitter(time.Minute, seed)
+		var result []time.Duration
+		for i, name := range []string{"foo", "bar", "baz"} {
+			ds := serde.NewDbDataSource(int64(i), serde.Ident{"name": name}, rrd.NewDataSource(*DftDSSPec))
+			rds := &cachedDs{DbDataSourcer: ds}
+			d.insert(rds)
+			if rds.jitter < 0 || rds.jitter >= time.Minute {
+				t.Errorf("setFlushJitter: jitter %v out of range", rds.jitter)
+			}
+			result = append(result, rds.jitter)
+		}
+		return result
+	}
+	if a, b := jitters(42), jitters(42); !reflect.DeepEqual(a, b) {
+		t.Errorf("setFlushJitter: same seed, expected the same jitter, got %v and %v", a, b)
+	}
+
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	rds := &cachedDs{DbDataSourcer: ds, jitter: time.Hour}
+	rds.ProcessDataPoint(123, time.Now().Add(-2*time.Hour))
+	rds.ProcessDataPoint(123, time.Now().Add(-time.Hour))
+	rds.lastFlushRT = time.Now().Add(-30 * time.Minute)
+	if rds.shouldBeFlushed(1000, 0, time.Minute) {
+		t.Errorf("with jitter of 1h, rds.shouldBeFlushed == true")
+	}
+	rds.jitter = 0
+	if !rds.shouldBeFlushed(1000, 0, time.Minute) {
+		t.Errorf("without jitter, rds.shouldBeFlushed != true")
+	}
+}
+
 func Test_dscache_delete(t *testing.T) {
 	d := newDsCache(nil, nil, nil)
 
@@ -108,6 +146,8 @@ type fakeSerde struct {
 	fakeErr                                bool
 	returnDss                              []rrd.DataSourcer
 	nondb                                  bool
+	createSpec                             *rrd.DSSpec
+	block                                  chan bool // if not nil, FetchOrCreateDataSource waits for it
 }
 
 func (m *fakeSerde) Fetcher() serde.Fetcher                                { return m }
@@ -135,7 +175,11 @@ func (f *fakeSerde) FlushDataSource(ds rrd.DataSourcer) error {
 }
 
 func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if f.block != nil {
+		<-f.block
+	}
 	f.createCalled++
+	f.createSpec = dsSpec
 	if f.fakeErr {
 		return nil, fmt.Errorf("some error")
 	}
@@ -187,6 +231,301 @@ func Test_dscache_fetchOrCreateByName(t *testing.T) {
 
 }
 
+type fakeFinder struct {
+	idents []serde.Ident
+}
+
+func (f *fakeFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	f.idents = append(f.idents, ident)
+	return DftDSSPec
+}
+
+func Test_dscache_fetchOrCreate(t *testing.T) {
+	db := &fakeSerde{}
+	df := &fakeFinder{}
+	d := newDsCache(db, df, nil)
+
+	foo := serde.Ident{"name": "foo"}
+	cnt := CountIdent(foo)
+	cds, err := d.fetchOrCreate(cnt, foo, "")
+	if err != nil || cds == nil {
+		t.Fatalf("fetchOrCreate: expected a DS, got %v %v", cds, err)
+	}
+	if len(df.idents) != 1 || !reflect.DeepEqual(df.idents[0], foo) {
+		t.Errorf("fetchOrCreate: DSSpec should be matched using specIdent, got %v", df.idents)
+	}
+}
+
+func Test_dscache_newDSHook(t *testing.T) {
+	d := newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, nil)
+	var created []string
+	d.newDSHook = func(ident serde.Ident, source string) {
+		created = append(created, ident["name"]+":"+source)
+	}
+
+	dpChs := newDirectorChannels(1, 10)
+	dpChs.send(&incomingDP{Ident: serde.Ident{"name": "foo"}}, newQueueOptions([]QueueOption{WithSource("graphite_text")}))
+	dpChs.send(&incomingDP{Ident: serde.Ident{"name": "foo"}}, newQueueOptions(nil))
+	dpChs.send(&incomingDP{Ident: serde.Ident{"name": "bar"}}, newQueueOptions(nil))
+	for i := 0; i < 3; i++ {
+		if _, err := directorFetchDs(d, <-dpChs[0]); err != nil {
+			t.Fatalf("directorFetchDs: %v", err)
+		}
+	}
+	if expect := []string{"foo:graphite_text", "bar:"}; !reflect.DeepEqual(created, expect) {
+		t.Errorf("newDSHook: expected %v, got %v", expect, created)
+	}
+}
+
+func Test_dscache_fetchTimeout(t *testing.T) {
+	db := &fakeSerde{block: make(chan bool)}
+	d := newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	d.setFetchTimeout(10 * time.Millisecond)
+	var wg, startWg sync.WaitGroup
+	var count int32
+	d.startFetchers(&wg, &startWg, &count)
+	startWg.Wait()
+	foo := serde.Ident{"name": "foo"}
+
+	if _, err := d.fetchOrCreateByName(foo); err != errFetchTimeout {
+		t.Errorf("fetchTimeout: expected errFetchTimeout, got %v", err)
+	}
+	// The fetch is in progress, no waiting this time
+	start := time.Now()
+	if _, err := d.fetchOrCreateByName(foo); err != errFetchTimeout || time.Since(start) >= 10*time.Millisecond {
+		t.Errorf("fetchTimeout: expected errFetchTimeout right away, got %v", err)
+	}
+	// Timed out fetches wait for a fetcher, they do not get a
+	// goroutine of their own
+	for i := 0; i < 10; i++ {
+		if _, err := d.fetchOrCreateByName(serde.Ident{"name": fmt.Sprintf("bar%d", i)}); err != errFetchTimeout {
+			t.Errorf("fetchTimeout: expected errFetchTimeout, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&count); n != nFetchers {
+		t.Errorf("fetchTimeout: expected %d fetcher goroutines, got %d", nFetchers, n)
+	}
+
+	db.block <- true
+	for i := 0; i < 100 && d.getByIdent(foo) == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if cds, err := d.fetchOrCreateByName(foo); cds == nil || err != nil {
+		t.Errorf("fetchTimeout: expected the DS to be cached once the fetch completes, got %v %v", cds, err)
+	}
+	if db.createCalled != 1 {
+		t.Errorf("fetchTimeout: expected 1 fetch, got %d", db.createCalled)
+	}
+
+	close(db.block)
+	d.stopFetchers(&wg)
+	if n := atomic.LoadInt32(&count); n != 0 {
+		t.Errorf("fetchTimeout: expected the fetchers to be stopped, %d left", n)
+	}
+}
+
+func Test_dscache_limitCreateRate(t *testing.T) {
+	db := &fakeSerde{}
+	df := &SimpleDSFinder{DftDSSPec}
+	d := newDsCache(db, df, nil)
+
+	d.limitCreateRate(1)
+	if _, err := d.fetchOrCreateByName(serde.Ident{"name": "foo"}); err != nil {
+		t.Errorf("limitCreateRate: first creation should be allowed: %v", err)
+	}
+	d.delete(serde.Ident{"name": "foo"})
+	if _, err := d.fetchOrCreateByName(serde.Ident{"name": "foo"}); err != errCreateRateLimited {
+		t.Errorf("limitCreateRate: second creation should be rate limited, got: %v", err)
+	}
+	if db.createCalled != 1 {
+		t.Errorf("limitCreateRate: rate limited creation should not reach the db, createCalled: %d", db.createCalled)
+	}
+
+	d.limitCreateRate(0)
+	if d.createLimiter != nil {
+		t.Errorf("limitCreateRate: 0 should remove the limit")
+	}
+}
+
+func Test_dscache_limitConcurrentCreates(t *testing.T) {
+	db := &fakeSerde{block: make(chan bool)}
+	d := newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	d.limitConcurrentCreates(1)
+	foo, bar := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}
+
+	done := make(chan error)
+	go func() {
+		_, err := d.fetchOrCreateByName(foo)
+		done <- err
+	}()
+	for i := 0; i < 100 && len(d.createSem) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := d.fetchOrCreateByName(bar); err != errCreatePending {
+		t.Errorf("limitConcurrentCreates: expected errCreatePending, got %v", err)
+	}
+	if _, err := d.fetchOrCreateByName(foo); err != errCreatePending {
+		t.Errorf("limitConcurrentCreates: expected errCreatePending for a DS being created, got %v", err)
+	}
+
+	sr := &fakeSr{}
+	d.createHold.hold(&incomingDP{Ident: foo, Value: 1}, time.Now())
+	d.createHold.hold(&incomingDP{Ident: bar, Value: 1}, time.Now().Add(-time.Minute))
+	var processed []*incomingDP
+	process := func(dp *incomingDP, cds *cachedDs) { processed = append(processed, dp) }
+	if applied, dropped := d.createHold.retry(time.Now(), d, sr, process); applied != 0 || dropped != 1 || len(d.createHold.held) != 1 {
+		t.Errorf("retry: expected the old point dropped and the other kept, got %d %d %d", applied, dropped, len(d.createHold.held))
+	}
+	if len(sr.deadLetters) != 1 || sr.deadLetters[0] != DeadLetterCreatePending {
+		t.Errorf("retry: expected a create_pending dead letter, got %v", sr.deadLetters)
+	}
+
+	db.block <- true
+	if err := <-done; err != nil {
+		t.Errorf("limitConcurrentCreates: unexpected error: %v", err)
+	}
+	if applied, _ := d.createHold.retry(time.Now(), d, sr, process); applied != 1 || len(processed) != 1 || len(d.createHold.held) != 0 {
+		t.Errorf("retry: expected the held point processed once its DS is created, got %d", applied)
+	}
+	if len(d.createSem) != 0 || len(d.creating) != 0 {
+		t.Errorf("limitConcurrentCreates: expected nothing being created, got %d", len(d.createSem))
+	}
+
+	d.limitConcurrentCreates(0)
+	if d.createSem != nil || d.createHold != nil {
+		t.Errorf("limitConcurrentCreates: 0 should remove the limit")
+	}
+}
+
+func Test_dscache_limitRRASlots(t *testing.T) {
+	db := &fakeSerde{}
+	df := &SimpleDSFinder{DftDSSPec}
+	d := newDsCache(db, df, nil)
+
+	d.limitRRASlots(2000)
+	if _, err := d.fetchOrCreateByName(serde.Ident{"name": "foo"}); err != nil {
+		t.Errorf("limitRRASlots: unexpected error: %v", err)
+	}
+	if db.createSpec == DftDSSPec {
+		t.Fatalf("limitRRASlots: expected a clamped copy of the DSSpec")
+	}
+	for i, rs := range db.createSpec.RRAs {
+		if rs.Span/rs.Step > 2000 {
+			t.Errorf("limitRRASlots: RRA %d has %d slots, more than 2000", i, rs.Span/rs.Step)
+		}
+		if orig := DftDSSPec.RRAs[i]; orig.Span/orig.Step <= 2000 && rs.Span != orig.Span {
+			t.Errorf("limitRRASlots: RRA %d within the limit should not change, got span %v", i, rs.Span)
+		}
+	}
+	if DftDSSPec.RRAs[0].Span != 6*time.Hour {
+		t.Errorf("limitRRASlots: the original DSSpec must not be modified")
+	}
+
+	d.limitRRASlots(0)
+	d.delete(serde.Ident{"name": "foo"})
+	d.fetchOrCreateByName(serde.Ident{"name": "foo"})
+	if db.createSpec != DftDSSPec {
+		t.Errorf("limitRRASlots: 0 should remove the limit")
+	}
+}
+
+func Test_dscache_recordRateUnit(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := *DftDSSPec
+	spec.RateUnit = time.Minute
+	d := newDsCache(db, &SimpleDSFinder{&spec}, nil)
+
+	cds, err := d.fetchOrCreateByName(serde.Ident{"name": "foo"})
+	if err != nil {
+		t.Fatalf("fetchOrCreateByName: %v", err)
+	}
+	meta, _ := db.FetchDataSourceMeta(cds.Id())
+	if unit, ok := serde.RateUnit(meta); !ok || unit != time.Minute {
+		t.Errorf("recordRateUnit: expected a rate unit of 1m, got %v", meta)
+	}
+
+	// other metadata is preserved
+	db.SetDataSourceMeta(cds.Id(), map[string]string{"unit": "ms"})
+	spec.RateUnit = time.Second
+	d.recordRateUnit(cds.DbDataSourcer, &spec)
+	meta, _ = db.FetchDataSourceMeta(cds.Id())
+	if meta["unit"] != "ms" || meta[serde.MetaRateUnit] != "1s" {
+		t.Errorf("recordRateUnit: expected unit ms and rate unit 1s, got %v", meta)
+	}
+}
+
+func Test_dscache_kindConflicts(t *testing.T) {
+	db := serde.NewMemSerDe()
+	foo := serde.Ident{"name": "foo"}
+	counter := &incomingDP{Ident: foo, Value: 1, WrapAt: 100}
+	gauge := &incomingDP{Ident: foo, Value: 1}
+
+	d := newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	d.typePolicy = TypeConflictReject
+	cds, _ := d.fetchOrCreateByName(foo)
+	if d.kindConflicts(cds, counter) || !d.kindConflicts(cds, gauge) {
+		t.Errorf("kindConflicts: expected the DS to be a counter as of the first point")
+	}
+	meta, _ := db.FetchDataSourceMeta(cds.Id())
+	if meta[serde.MetaKind] != "counter" {
+		t.Errorf("kindConflicts: expected the kind saved in the metadata, got %v", meta)
+	}
+
+	// the kind survives a reload from the database
+	d = newDsCache(db, &SimpleDSFinder{DftDSSPec}, nil)
+	d.typePolicy = TypeConflictReject
+	cds, _ = d.fetchOrCreateByName(foo)
+	if !d.kindConflicts(cds, gauge) {
+		t.Errorf("kindConflicts: expected the saved kind (counter) to be loaded, got %q", cds.kind)
+	}
+}
+
+func Test_dscache_allowedIdent(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	ident := serde.Ident{"name": "foo", "host": "a", "hsot": "b"}
+
+	if result, err := d.allowedIdent(ident); err != nil || !reflect.DeepEqual(result, ident) {
+		t.Errorf("allowedIdent: without an allowlist all keys should be allowed: %v %v", result, err)
+	}
+
+	d.allowTagKeys([]string{"host"}, false)
+	if _, err := d.allowedIdent(ident); err != errTagKeyNotAllowed {
+		t.Errorf("allowedIdent: expected errTagKeyNotAllowed, got %v", err)
+	}
+	if _, err := d.allowedIdent(serde.Ident{"name": "foo", "host": "a"}); err != nil {
+		t.Errorf("allowedIdent: name and host should be allowed: %v", err)
+	}
+
+	d.allowTagKeys([]string{"host"}, true)
+	result, err := d.allowedIdent(ident)
+	if expect := (serde.Ident{"name": "foo", "host": "a"}); err != nil || !reflect.DeepEqual(result, expect) {
+		t.Errorf("allowedIdent: expected %v, got %v %v", expect, result, err)
+	}
+	if len(ident) != 3 {
+		t.Errorf("allowedIdent: the original ident should not be modified")
+	}
+
+	d.allowTagKeys(nil, false)
+	if d.tagKeys != nil {
+		t.Errorf("allowTagKeys: empty keys should allow all")
+	}
+
+	d.requireTagKeys([]string{"name"})
+	for _, id := range []serde.Ident{{}, {"host": "a"}, {"name": ""}} {
+		if _, err := d.allowedIdent(id); err != errTagKeyMissing {
+			t.Errorf("allowedIdent: expected errTagKeyMissing for %v, got %v", id, err)
+		}
+	}
+	if _, err := d.allowedIdent(ident); err != nil {
+		t.Errorf("allowedIdent: ident with a name should be allowed: %v", err)
+	}
+	d.allowTagKeys([]string{"name"}, true)
+	d.requireTagKeys([]string{"name", "host"})
+	if _, err := d.allowedIdent(ident); err != errTagKeyMissing {
+		t.Errorf("allowedIdent: expected errTagKeyMissing once host is stripped, got %v", err)
+	}
+}
+
 func Test_dscache_register(t *testing.T) {
 	d := newDsCache(nil, nil, nil)
 	d.clstr = &fakeCluster{}
@@ -249,6 +588,152 @@ func Test_dscache_cachedDs_shouldBeFlushed(t *testing.T) {
 		t.Errorf("with flushed maxCachedPoints == 1000, minCache 0, maxCache 0, rds.shouldBeFlushed != true")
 	}
 
+	// per DS overrides
+	rds.maxCache = time.Minute
+	if !rds.shouldBeFlushed(1000, 0, 24*time.Hour) {
+		t.Errorf("with DS maxCache 1m, rds.shouldBeFlushed != true")
+	}
+	rds.maxCache, rds.maxCachedPoints = 0, 1
+	if rds.shouldBeFlushed(1000, 24*time.Hour, 24*time.Hour) {
+		t.Errorf("with DS maxCachedPoints 1, minCache 24hr, rds.shouldBeFlushed == true")
+	}
+	rds.minCache = time.Minute
+	if !rds.shouldBeFlushed(1000, 24*time.Hour, 24*time.Hour) {
+		t.Errorf("with DS maxCachedPoints 1, DS minCache 1m, rds.shouldBeFlushed != true")
+	}
+
+}
+
+func Test_dscache_cachedDs_counterRate(t *testing.T) {
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	rds := &cachedDs{DbDataSourcer: ds}
+
+	// first value is only remembered
+	if _, ok := rds.counterRate(100, 1000, time.Unix(1000, 0)); ok {
+		t.Errorf("counterRate: first value should not produce a rate")
+	}
+
+	// regular increment
+	if r, ok := rds.counterRate(200, 1000, time.Unix(1010, 0)); !ok || r != 10 {
+		t.Errorf("counterRate: expected 10, true, got %v, %v", r, ok)
+	}
+
+	// wrap around: 200 -> 1000 (800) + 0 -> 100 (100)
+	if r, ok := rds.counterRate(100, 1000, time.Unix(1020, 0)); !ok || r != 90 {
+		t.Errorf("counterRate: across the wrap expected 90, true, got %v, %v", r, ok)
+	}
+
+	// time stamp not after the previous one
+	if _, ok := rds.counterRate(150, 1000, time.Unix(1020, 0)); ok {
+		t.Errorf("counterRate: same time stamp should not produce a rate")
+	}
+
+	// value out of range
+	if _, ok := rds.counterRate(1000, 1000, time.Unix(1030, 0)); ok {
+		t.Errorf("counterRate: value >= wrapAt should not produce a rate")
+	}
+	if rds.lastCounter != 100 {
+		t.Errorf("counterRate: invalid values should not be remembered, lastCounter: %v", rds.lastCounter)
+	}
+}
+
+func Test_dscache_cachedDs_counterRateInt(t *testing.T) {
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	rds := &cachedDs{DbDataSourcer: ds}
+
+	// float64 cannot tell these apart, the integer difference is exact
+	base := int64(1<<53 + 1)
+	if _, ok := rds.counterRateInt(base, 1<<62, time.Unix(1000, 0)); ok {
+		t.Errorf("counterRateInt: first value should not produce a rate")
+	}
+	if r, ok := rds.counterRateInt(base+1, 1<<62, time.Unix(1001, 0)); !ok || r != 1 {
+		t.Errorf("counterRateInt: expected 1, true, got %v, %v", r, ok)
+	}
+
+	// wrap around: base+1 -> 1<<62, then 0 -> 9
+	expect := float64(1<<62 - (base + 1) + 9)
+	if r, ok := rds.counterRateInt(9, 1<<62, time.Unix(1002, 0)); !ok || r != expect {
+		t.Errorf("counterRateInt: across the wrap expected %v, true, got %v, %v", expect, r, ok)
+	}
+
+	// value out of range
+	if _, ok := rds.counterRateInt(-1, 1<<62, time.Unix(1003, 0)); ok {
+		t.Errorf("counterRateInt: negative value should not produce a rate")
+	}
+	if rds.lastIntCounter != 9 {
+		t.Errorf("counterRateInt: invalid values should not be remembered, lastIntCounter: %v", rds.lastIntCounter)
+	}
+}
+
+func Test_dscache_cachedDs_updateStale(t *testing.T) {
+	cds := &cachedDs{}
+	now := time.Now()
+
+	if stale, changed := cds.updateStale(now, time.Second); stale || changed {
+		t.Errorf("updateStale: DS without data points should never be stale")
+	}
+
+	cds.lastDpRT = now
+	if stale, changed := cds.updateStale(now.Add(2*time.Second), time.Second); !stale || !changed {
+		t.Errorf("updateStale: expected stale and changed")
+	}
+	if stale, changed := cds.updateStale(now.Add(3*time.Second), time.Second); !stale || changed {
+		t.Errorf("updateStale: expected stale and not changed")
+	}
+	if stale, changed := cds.updateStale(now, time.Second); stale || !changed {
+		t.Errorf("updateStale: expected not stale and changed")
+	}
+}
+
+func Test_dscache_cachedDs_holdRelease(t *testing.T) {
+	cds := &cachedDs{}
+	now := time.Now()
+	for _, ts := range []int64{100, 130, 110, 120} {
+		cds.hold(&incomingDP{TimeStamp: time.Unix(ts, 0), Value: float64(ts)}, now)
+	}
+
+	// latest is 130, so with a 15s window only 100 and 110 can go
+	dps := cds.release(15*time.Second, now)
+	if len(dps) != 2 || dps[0].Value != 100 || dps[1].Value != 110 {
+		t.Errorf("release: expected 100, 110, got %v", dps)
+	}
+
+	// a late arrival within the window is still applied in order
+	cds.hold(&incomingDP{TimeStamp: time.Unix(115, 0), Value: 115}, now)
+	dps = cds.release(15*time.Second, now.Add(time.Second))
+	if len(dps) != 1 || dps[0].Value != 115 {
+		t.Errorf("release: expected 115, got %v", dps)
+	}
+
+	// held long enough
+	dps = cds.release(15*time.Second, now.Add(15*time.Second))
+	if len(dps) != 2 || dps[0].Value != 120 || dps[1].Value != 130 || len(cds.held) != 0 {
+		t.Errorf("release: expected 120, 130, got %v", dps)
+	}
+}
+
+func Test_dscache_newCachedDs(t *testing.T) {
+	if cds := newCachedDs(nil, nil); cds.sampling != nil {
+		t.Errorf("newCachedDs: nil spec should mean no sampling")
+	}
+	spec := &rrd.DSSpec{NewSampling: rrd.SystematicSampling(3)}
+	cds := newCachedDs(nil, spec)
+	n := 0
+	for i := 0; i < 9; i++ {
+		if cds.sampling.Accumulate(float64(i), time.Now()) {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("newCachedDs: expected every 3rd point accumulated, got %d of 9", n)
+	}
+
+	spec = &rrd.DSSpec{MinCacheDuration: time.Second, MaxCacheDuration: time.Minute, MaxCachedPoints: 10}
+	if cds := newCachedDs(nil, spec); cds.minCache != time.Second || cds.maxCache != time.Minute || cds.maxCachedPoints != 10 {
+		t.Errorf("newCachedDs: cache parameters not set from spec: %v %v %v", cds.minCache, cds.maxCache, cds.maxCachedPoints)
+	}
 }
 
 func Test_dscache_cachedDs_Relinquish(t *testing.T) {
@@ -300,3 +785,94 @@ func Test_dscache_cachedDs_Relinquish(t *testing.T) {
 		t.Errorf("id should be 0")
 	}
 }
+
+// blockingDsFlusher signals flushing and waits for release in flushDs.
+type blockingDsFlusher struct {
+	*fakeDsFlusher
+	flushing, release chan bool
+}
+
+func (f *blockingDsFlusher) flushDs(ds serde.DbDataSourcer, block bool) bool {
+	f.flushing <- true
+	<-f.release
+	return f.fakeDsFlusher.flushDs(ds, block)
+}
+
+func Test_dscache_distDs_RelinquishSnapshot(t *testing.T) {
+	dsf := &blockingDsFlusher{&fakeDsFlusher{}, make(chan bool), make(chan bool)}
+	r := &Receiver{dsc: newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, dsf)}
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	ds.ProcessDataPoint(123, time.Unix(1000, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+
+	relinquished := make(chan bool)
+	go func() {
+		(&distDs{DbDataSourcer: ds, dsc: r.dsc}).Relinquish()
+		close(relinquished)
+	}()
+	<-dsf.flushing // Relinquish has the DS locked
+
+	// The snapshot gets the cache read lock and waits for the DS
+	snapped := make(chan error, 1)
+	go func() { snapped <- r.Snapshot(ioutil.Discard) }()
+	time.Sleep(50 * time.Millisecond)
+	close(dsf.release)
+
+	timeout := time.After(5 * time.Second)
+	for relinquished != nil || snapped != nil {
+		select {
+		case <-relinquished:
+			relinquished = nil
+		case err := <-snapped:
+			if err != nil {
+				t.Errorf("Snapshot: %v", err)
+			}
+			snapped = nil
+		case <-timeout:
+			t.Fatalf("Relinquish and Snapshot deadlocked")
+		}
+	}
+	if n := len(r.dsc.all()); n != 0 || dsf.called != 1 {
+		t.Errorf("Relinquish: expected the DS flushed and removed, got %d flushed and %d left", dsf.called, n)
+	}
+}
+
+func Test_dscache_drainWorker(t *testing.T) {
+	d := newDsCache(nil, nil, nil)
+	for id := int64(0); id < 6; id++ {
+		ds := serde.NewDbDataSource(id, serde.Ident{"name": fmt.Sprintf("foo%d", id)}, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds})
+	}
+
+	moves, err := d.drainWorker(0, 3)
+	if err != nil {
+		t.Fatalf("drainWorker: unexpected error: %v", err)
+	}
+	if len(moves) != 2 {
+		t.Fatalf("drainWorker: expected 2 moves (ids 0 and 3), got %d", len(moves))
+	}
+	if moves[0].to == moves[1].to || moves[0].to == 0 || moves[1].to == 0 {
+		t.Errorf("drainWorker: expected one DS each to workers 1 and 2, got %v and %v", moves[0].to, moves[1].to)
+	}
+	for _, m := range moves {
+		m.cds.setWorker(m.to)
+		if m.cds.workerIndex(3) != m.to {
+			t.Errorf("workerIndex: expected %d, got %d", m.to, m.cds.workerIndex(3))
+		}
+	}
+
+	// A new DS hashing to the drained worker goes elsewhere
+	ds := serde.NewDbDataSource(9, serde.Ident{"name": "bar"}, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	d.insert(cds)
+	if cds.workerIndex(3) == 0 {
+		t.Errorf("insert: a new DS should not be given to a drained worker")
+	}
+
+	if _, err := d.drainWorker(1, 3); err != nil {
+		t.Errorf("drainWorker: unexpected error: %v", err)
+	}
+	if _, err := d.drainWorker(2, 3); err == nil {
+		t.Errorf("drainWorker: expected an error when no other worker is left")
+	}
+}
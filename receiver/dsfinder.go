@@ -66,3 +66,40 @@ func (s *SimpleDSFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
 	}
 	return s.DSSpec
 }
+
+// A TemplateDSFinder computes the DSSpec from the ident (e.g. its
+// tags) by way of Template, which lets retention be expressed as
+// code, such as one RRA per environment tier:
+//
+//	&TemplateDSFinder{Template: func(ident serde.Ident) *rrd.DSSpec {
+//		spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: 2 * time.Hour}
+//		spec.RRAs = append(spec.RRAs, rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 6 * time.Hour})
+//		if ident["env"] == "prod" {
+//			spec.RRAs = append(spec.RRAs, rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Minute, Span: 93 * 24 * time.Hour})
+//		}
+//		return spec
+//	}}
+//
+// Template is called for every new DS and must construct a new
+// DSSpec each time (or at least not modify one it returned
+// earlier). When Template returns nil, Fallback (if not nil) is
+// consulted instead.
+type TemplateDSFinder struct {
+	Template func(ident serde.Ident) *rrd.DSSpec
+	Fallback MatchingDSSpecFinder
+}
+
+func (t *TemplateDSFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	if name := ident["name"]; name == "" {
+		return nil
+	}
+	if t.Template != nil {
+		if spec := t.Template(ident); spec != nil {
+			return spec
+		}
+	}
+	if t.Fallback != nil {
+		return t.Fallback.FindMatchingDSSpec(ident)
+	}
+	return nil
+}
@@ -18,6 +18,9 @@ package receiver
 import (
 	"testing"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 func Test_dsfinder_FindMatchingDSSpec(t *testing.T) {
@@ -27,3 +30,40 @@ func Test_dsfinder_FindMatchingDSSpec(t *testing.T) {
 		t.Errorf("FindMatchingDSSpec: d.Step != 10s || len(d.RRAs) == 0")
 	}
 }
+
+func Test_dsfinder_TemplateDSFinder(t *testing.T) {
+	df := &TemplateDSFinder{
+		Template: func(ident serde.Ident) *rrd.DSSpec {
+			if ident["env"] == "" {
+				return nil
+			}
+			spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: 2 * time.Hour}
+			n := 1
+			if ident["env"] == "prod" {
+				n = 3
+			}
+			for i := 0; i < n; i++ {
+				spec.RRAs = append(spec.RRAs, rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour})
+			}
+			return spec
+		},
+		Fallback: &SimpleDSFinder{DftDSSPec},
+	}
+
+	if d := df.FindMatchingDSSpec(serde.Ident{"name": "foo", "env": "prod"}); d == nil || len(d.RRAs) != 3 {
+		t.Errorf("TemplateDSFinder: expected 3 RRAs for env=prod, got %v", d)
+	}
+	if d := df.FindMatchingDSSpec(serde.Ident{"name": "foo", "env": "dev"}); d == nil || len(d.RRAs) != 1 {
+		t.Errorf("TemplateDSFinder: expected 1 RRA for env=dev, got %v", d)
+	}
+	if d := df.FindMatchingDSSpec(serde.Ident{"name": "foo"}); d != DftDSSPec {
+		t.Errorf("TemplateDSFinder: expected the fallback spec without env")
+	}
+	if d := df.FindMatchingDSSpec(serde.Ident{"env": "prod"}); d != nil {
+		t.Errorf("TemplateDSFinder: expected nil without a name")
+	}
+	df.Fallback = nil
+	if d := df.FindMatchingDSSpec(serde.Ident{"name": "foo"}); d != nil {
+		t.Errorf("TemplateDSFinder: expected nil without env and fallback")
+	}
+}
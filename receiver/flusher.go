@@ -31,16 +31,67 @@ type dsFlusher struct {
 	flushLimiter *rate.Limiter
 	db           serde.Flusher
 	sr           statReporter
+	goroutines   *int32 // running flusher count, can be nil
+
+	statsMu sync.Mutex
+	stats   map[int64]*DSFlushStats // by DS id
+}
+
+// DSFlushStats is the flush bookkeeping of a DS, see
+// Receiver.DSFlushStats. Points is the number of data points (RRA
+// slots) written, the size in bytes is up to the SerDe and not known
+// to the receiver.
+type DSFlushStats struct {
+	LastFlush    time.Time     // when the last flush started
+	LastDuration time.Duration // how long the last flush took
+	Flushes      int64         // number of flushes
+	Errors       int64         // number of flushes which failed
+	Points       int64         // data points written, all flushes
+}
+
+func (f *dsFlusher) recordFlush(id int64, start time.Time, dur time.Duration, points int, err error) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	if f.stats == nil {
+		f.stats = make(map[int64]*DSFlushStats)
+	}
+	st := f.stats[id]
+	if st == nil {
+		st = &DSFlushStats{}
+		f.stats[id] = st
+	}
+	st.LastFlush, st.LastDuration = start, dur
+	st.Flushes++
+	if err != nil {
+		st.Errors++
+	} else {
+		st.Points += int64(points)
+	}
+}
+
+func (f *dsFlusher) flushStats(id int64) (DSFlushStats, bool) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	if st := f.stats[id]; st != nil {
+		return *st, true
+	}
+	return DSFlushStats{}, false
 }
 
-func (f *dsFlusher) start(n int, flusherWg, startWg *sync.WaitGroup, mfs int) {
+// start starts n flushers, limited to mfs flushes per second (if
+// greater than 0) with bursts of up to burst flushes, or mfs if
+// burst is 0.
+func (f *dsFlusher) start(n int, flusherWg, startWg *sync.WaitGroup, mfs, burst int) {
 	if mfs > 0 {
-		f.flushLimiter = rate.NewLimiter(rate.Limit(mfs), mfs)
+		if burst <= 0 {
+			burst = mfs
+		}
+		f.flushLimiter = rate.NewLimiter(rate.Limit(mfs), burst)
 	}
 	f.flusherChs = make(flusherChannels, n)
 	for i := 0; i < n; i++ {
 		f.flusherChs[i] = make(chan *dsFlushRequest, 1024) // TODO why 1024?
-		go flusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("flusher_%d", i)}, f, f.flusherChs[i])
+		go flusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("flusher_%d", i), count: f.goroutines}, f, f.flusherChs[i])
 	}
 }
 
@@ -57,6 +108,38 @@ func (f *dsFlusher) flushDs(ds serde.DbDataSourcer, block bool) bool {
 	return true
 }
 
+// flushCachedDs is flushDs for a DS which is not locked by the
+// caller: the copy of the DS is taken and its RRAs cleared under the
+// DS lock, but the copy is queued after the lock is released, thus a
+// full flusher channel (i.e. a slow database) holds up only the
+// caller, not other users of the DS lock. The flush lock of the DS
+// is held until the copy is queued, so that a flush which takes a
+// later copy cannot queue it first.
+func (f *dsFlusher) flushCachedDs(cds *cachedDs) bool {
+	if f.db == nil {
+		return true
+	}
+	if f.flushLimiter != nil && !f.flushLimiter.Allow() {
+		f.sr.reportStatCount("serde.flushes_rate_limited", 1)
+		return false
+	}
+	cp, trace := func() (rrd.DataSourcer, *dpTrace) {
+		cds.Lock()
+		defer cds.Unlock()
+		cds.flushMu.Lock() // unlocked once the copy is queued
+		cds.unspillLogged()
+		cp := cds.Copy()
+		cds.ClearRRAs(false)
+		cds.unflushedRT = time.Time{}
+		trace := cds.trace
+		cds.trace = nil
+		return cp, trace
+	}()
+	defer cds.flushMu.Unlock()
+	f.flusherChs.queueCopy(cds.Id(), cp, trace.startSpan(SpanFlush, cds.Ident()), false)
+	return true
+}
+
 func (f *dsFlusher) enabled() bool {
 	return f.db != nil
 }
@@ -75,26 +158,35 @@ func (f *dsFlusher) channels() flusherChannels {
 
 type dsFlusherBlocking interface {
 	flushDs(serde.DbDataSourcer, bool) bool
+	flushCachedDs(*cachedDs) bool
 	enabled() bool
 	statReporter() statReporter
 	flusher() serde.Flusher
 	channels() flusherChannels
-	start(n int, flusherWg, startWg *sync.WaitGroup, mfs int)
+	start(n int, flusherWg, startWg *sync.WaitGroup, mfs, burst int)
+	recordFlush(id int64, start time.Time, dur time.Duration, points int, err error)
+	flushStats(id int64) (DSFlushStats, bool)
 }
 
 type dsFlushRequest struct {
 	ds   rrd.DataSourcer
 	resp chan bool
+	span Span // ended once flushed, nil if not traced
 }
 
 type flusherChannels []chan *dsFlushRequest
 
 func (f flusherChannels) queueBlocking(ds serde.DbDataSourcer, block bool) {
-	fr := &dsFlushRequest{ds: ds.Copy()}
+	f.queueCopy(ds.Id(), ds.Copy(), nil, block)
+}
+
+// queueCopy queues cp, a copy of the DS with the given id.
+func (f flusherChannels) queueCopy(id int64, cp rrd.DataSourcer, span Span, block bool) {
+	fr := &dsFlushRequest{ds: cp, span: span}
 	if block {
 		fr.resp = make(chan bool, 1)
 	}
-	f[ds.Id()%int64(len(f))] <- fr
+	f[id%int64(len(f))] <- fr
 	if block {
 		<-fr.resp
 	}
@@ -115,6 +207,10 @@ func reportFlusherChannelFillPercent(flusherCh chan *dsFlushRequest, sr statRepo
 	}
 }
 
+// flushRetryInterval is how often a flusher retries the flushes
+// which failed with a transient error (see serde.TransientError).
+var flushRetryInterval = time.Second
+
 var flusher = func(wc wController, dsf dsFlusherBlocking, flusherCh chan *dsFlushRequest) {
 	wc.onEnter()
 	defer wc.onExit()
@@ -124,20 +220,85 @@ var flusher = func(wc wController, dsf dsFlusherBlocking, flusherCh chan *dsFlus
 	log.Printf("  - %s started.", wc.ident())
 	wc.onStarted()
 
+	// Flushes which failed with a transient error, oldest first,
+	// kept until the database takes writes again. Meanwhile new
+	// requests queue up behind them, so that the flushes of a DS
+	// stay in order.
+	var pending []*dsFlushRequest
+	retryTicker := time.NewTicker(flushRetryInterval)
+	defer retryTicker.Stop()
+
 	for {
-		fr, ok := <-flusherCh
-		if !ok {
-			log.Printf("%s: channel closed, exiting", wc.ident())
-			return
-		}
-		err := dsf.flusher().FlushDataSource(fr.ds)
-		if err != nil {
-			log.Printf("%s: error flushing data source %v: %v", wc.ident(), fr.ds, err)
-		}
-		if fr.resp != nil {
-			fr.resp <- (err == nil)
+		select {
+		case fr, ok := <-flusherCh:
+			if !ok {
+				if pending = flusherRetry(wc.ident(), dsf, pending); len(pending) > 0 {
+					log.Printf("%s: channel closed, %d flushes failed with a transient error are lost, exiting", wc.ident(), len(pending))
+				} else {
+					log.Printf("%s: channel closed, exiting", wc.ident())
+				}
+				return
+			}
+			if len(pending) > 0 {
+				if fr.resp != nil {
+					fr.resp <- false
+					fr.resp = nil
+				}
+				pending = append(pending, fr)
+			} else if !flusherFlush(wc.ident(), dsf, fr) {
+				log.Printf("%s: transient error flushing, holding data until the database takes writes again", wc.ident())
+				pending = append(pending, fr)
+			}
+			if len(pending) > 0 {
+				dsf.statReporter().reportStatGauge(fmt.Sprintf("receiver.flushers.%s.pending", wc.ident()), float64(len(pending)))
+			}
+		case <-retryTicker.C:
+			if len(pending) > 0 {
+				if pending = flusherRetry(wc.ident(), dsf, pending); len(pending) == 0 {
+					log.Printf("%s: flushing again after transient errors", wc.ident())
+				}
+				dsf.statReporter().reportStatGauge(fmt.Sprintf("receiver.flushers.%s.pending", wc.ident()), float64(len(pending)))
+			}
 		}
-		dsf.statReporter().reportStatCount("serde.datapoints_flushed", float64(fr.ds.PointCount()))
-		dsf.statReporter().reportStatCount("serde.flushes", 1)
 	}
 }
+
+// flusherFlush saves the DS of the request. It returns false if that
+// failed with a transient error, in which case the request is to be
+// retried, any other error loses the data.
+func flusherFlush(ident string, dsf dsFlusherBlocking, fr *dsFlushRequest) bool {
+	start := time.Now()
+	err := dsf.flusher().FlushDataSource(fr.ds)
+	transient := err != nil && serde.IsTransient(err)
+	if err != nil && !transient {
+		log.Printf("%s: error flushing data source %v: %v", ident, fr.ds, err)
+	}
+	if dbds, ok := fr.ds.(serde.DbDataSourcer); ok {
+		dsf.recordFlush(dbds.Id(), start, time.Now().Sub(start), fr.ds.PointCount(), err)
+	}
+	if fr.resp != nil {
+		fr.resp <- (err == nil)
+		fr.resp = nil // a retry must not respond again
+	}
+	if transient {
+		dsf.statReporter().reportStatCount("serde.flushes_transient_errors", 1)
+		return false
+	}
+	if fr.span != nil {
+		fr.span.End()
+	}
+	dsf.statReporter().reportStatCount("serde.datapoints_flushed", float64(fr.ds.PointCount()))
+	dsf.statReporter().reportStatCount("serde.flushes", 1)
+	return true
+}
+
+// flusherRetry retries the pending requests in order up to the first
+// one that fails (with a transient error) again, and returns those
+// still pending.
+func flusherRetry(ident string, dsf dsFlusherBlocking, pending []*dsFlushRequest) []*dsFlushRequest {
+	for len(pending) > 0 && flusherFlush(ident, dsf, pending[0]) {
+		pending[0] = nil
+		pending = pending[1:]
+	}
+	return pending
+}
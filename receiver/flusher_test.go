@@ -23,6 +23,7 @@ import (
 
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"golang.org/x/time/rate"
 )
 
 func Test_flusher_flusherChannels_queueBlocking(t *testing.T) {
@@ -52,6 +53,7 @@ type fakeDsFlusher struct {
 	called    int
 	fdsReturn bool
 	sr        statReporter
+	recorded  int
 }
 
 func (f *fakeDsFlusher) flushDs(ds serde.DbDataSourcer, block bool) bool {
@@ -59,6 +61,14 @@ func (f *fakeDsFlusher) flushDs(ds serde.DbDataSourcer, block bool) bool {
 	return f.fdsReturn
 }
 
+func (f *fakeDsFlusher) flushCachedDs(cds *cachedDs) bool {
+	if !f.flushDs(cds.DbDataSourcer, false) {
+		return false
+	}
+	cds.unflushedRT = time.Time{}
+	return true
+}
+
 func (*fakeDsFlusher) enabled() bool { return true }
 
 func (f *fakeDsFlusher) statReporter() statReporter {
@@ -76,11 +86,18 @@ func (f *fakeDsFlusher) channels() flusherChannels {
 	return make(flusherChannels, 0)
 }
 
-func (f *fakeDsFlusher) start(n int, flusherWg, startWg *sync.WaitGroup, mfs int) {}
+func (f *fakeDsFlusher) start(n int, flusherWg, startWg *sync.WaitGroup, mfs, burst int) {}
+
+func (f *fakeDsFlusher) recordFlush(id int64, start time.Time, dur time.Duration, points int, err error) {
+	f.recorded++
+}
+
+func (f *fakeDsFlusher) flushStats(id int64) (DSFlushStats, bool) { return DSFlushStats{}, false }
 
 // fake stats reporter
 type fakeSr struct {
-	called int
+	called      int
+	deadLetters []DeadLetterReason
 }
 
 func (f *fakeSr) reportStatCount(string, float64) {
@@ -91,6 +108,10 @@ func (f *fakeSr) reportStatGauge(string, float64) {
 	f.called++
 }
 
+func (f *fakeSr) reportDeadLetter(dp *incomingDP, reason DeadLetterReason, err error) {
+	f.deadLetters = append(f.deadLetters, reason)
+}
+
 func Test_flusher(t *testing.T) {
 
 	wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
@@ -113,6 +134,10 @@ func Test_flusher(t *testing.T) {
 		t.Errorf("FlushDataSource() not called.")
 	}
 
+	if dsf.recorded != 1 {
+		t.Errorf("recordFlush() not called.")
+	}
+
 	if sr.called != 2 {
 		t.Errorf("reportStatCount() should have been called 2 times.")
 	}
@@ -121,6 +146,35 @@ func Test_flusher(t *testing.T) {
 	wc.wg.Wait()
 }
 
+func Test_Receiver_DSFlushStats(t *testing.T) {
+	db := serde.NewMemSerDe()
+	ident := serde.Ident{"name": "foo"}
+	ds, err := db.FetchOrCreateDataSource(ident, &rrd.DSSpec{Step: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("FetchOrCreateDataSource: %v", err)
+	}
+	f := &dsFlusher{db: db.Flusher(), sr: &fakeSr{}}
+	r := &Receiver{dsc: newDsCache(db, nil, f), flusher: f}
+	r.dsc.insert(newCachedDs(ds.(serde.DbDataSourcer), nil))
+
+	if _, ok := r.DSFlushStats(ident); ok {
+		t.Errorf("DSFlushStats: expected no stats before a flush")
+	}
+	start := time.Unix(1000, 0)
+	f.recordFlush(ds.(serde.DbDataSourcer).Id(), start, time.Second, 3, nil)
+	f.recordFlush(ds.(serde.DbDataSourcer).Id(), start.Add(time.Minute), 2*time.Second, 5, fmt.Errorf("Fake error."))
+	st, ok := r.DSFlushStats(ident)
+	if !ok {
+		t.Fatalf("DSFlushStats: expected stats after a flush")
+	}
+	if st.Flushes != 2 || st.Errors != 1 || st.Points != 3 || st.LastDuration != 2*time.Second || !st.LastFlush.Equal(start.Add(time.Minute)) {
+		t.Errorf("DSFlushStats: unexpected %+v", st)
+	}
+	if _, ok := r.DSFlushStats(serde.Ident{"name": "bar"}); ok {
+		t.Errorf("DSFlushStats: expected no stats for a DS not cached")
+	}
+}
+
 func Test_flusher_reportFlusherChannelFillPercent(t *testing.T) {
 	ch := make(chan *dsFlushRequest, 10)
 	sr := &fakeSr{}
@@ -145,7 +199,7 @@ func Test_flusher_start(t *testing.T) {
 		wc.onStarted()
 	}
 	startWg.Add(1)
-	f.start(1, &flusherWg, &startWg, 10)
+	f.start(1, &flusherWg, &startWg, 10, 0)
 	startWg.Wait()
 	if fCalled == 0 {
 		t.Errorf("fCalled == 0")
@@ -156,6 +210,38 @@ func Test_flusher_start(t *testing.T) {
 	flusher = save1
 }
 
+func Test_flusher_startBurst(t *testing.T) {
+	var startWg, flusherWg sync.WaitGroup
+	save1 := flusher
+	defer func() { flusher = save1 }()
+	flusher = func(wc wController, dsf dsFlusherBlocking, flusherCh chan *dsFlushRequest) {}
+
+	for _, c := range []struct{ mfs, burst, expect int }{{10, 0, 10}, {10, 50, 50}} {
+		f := &dsFlusher{}
+		f.start(1, &flusherWg, &startWg, c.mfs, c.burst)
+		if f.flushLimiter.Burst() != c.expect {
+			t.Errorf("start(%d, %d): expected a burst of %d, got %d", c.mfs, c.burst, c.expect, f.flushLimiter.Burst())
+		}
+		if f.flushLimiter.Limit() != rate.Limit(c.mfs) {
+			t.Errorf("start(%d, %d): expected a limit of %d, got %v", c.mfs, c.burst, c.mfs, f.flushLimiter.Limit())
+		}
+	}
+
+	// idle capacity lets a backlog of up to burst through at once
+	f := &dsFlusher{db: &fakeSerde{}, sr: &fakeSr{}}
+	f.start(1, &flusherWg, &startWg, 1, 5)
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	n := 0
+	for i := 0; i < 10; i++ {
+		if f.flushDs(ds, false) {
+			n++
+		}
+	}
+	if n != 5 {
+		t.Errorf("flushDs: expected 5 flushes in a burst, got %d", n)
+	}
+}
+
 func Test_flusher_flushDs(t *testing.T) {
 	db := &fakeSerde{}
 	sr := &fakeSr{}
@@ -173,7 +259,7 @@ func Test_flusher_flushDs(t *testing.T) {
 	save1 := flusher
 	flusher = func(wc wController, dsf dsFlusherBlocking, flusherCh chan *dsFlushRequest) {}
 	f = &dsFlusher{db: db, sr: sr}
-	f.start(1, &flusherWg, &startWg, 1)
+	f.start(1, &flusherWg, &startWg, 1, 0)
 
 	f.flushDs(ds, false)
 	f.flushDs(ds, false)
@@ -188,6 +274,44 @@ func Test_flusher_flushDs(t *testing.T) {
 	flusher = save1
 }
 
+func Test_flusher_flushCachedDs(t *testing.T) {
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	now := time.Now()
+	cds.ProcessDataPoint(1, now.Add(-time.Minute))
+	cds.ProcessDataPoint(1, now)
+	cds.unflushedRT = time.Now()
+
+	// An unbuffered channel nobody reads stands for a slow database
+	f := &dsFlusher{db: &fakeSerde{}, sr: &fakeSr{}, flusherChs: flusherChannels{make(chan *dsFlushRequest)}}
+	done := make(chan bool)
+	go func() { done <- f.flushCachedDs(cds) }()
+
+	locked := make(chan bool)
+	go func() {
+		cds.Lock()
+		cds.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("flushCachedDs: the DS lock is held while queuing")
+	}
+
+	fr := <-f.flusherChs[0]
+	if !<-done {
+		t.Errorf("flushCachedDs: expected true")
+	}
+	if fr.ds.PointCount() == 0 {
+		t.Errorf("flushCachedDs: the queued copy has no points")
+	}
+	if cds.PointCount() != 0 || !cds.unflushedRT.IsZero() {
+		t.Errorf("flushCachedDs: the DS should be cleared")
+	}
+}
+
 func Test_flusher_methods(t *testing.T) {
 	db := &fakeSerde{}
 	sr := &fakeSr{}
@@ -207,3 +331,89 @@ func Test_flusher_methods(t *testing.T) {
 		t.Errorf("len(f.channels()) != 0")
 	}
 }
+
+type transientFlusher struct {
+	sync.Mutex
+	fails   int // transient failures before writes succeed again
+	flushed []rrd.DataSourcer
+}
+
+func (f *transientFlusher) FlushDataSource(ds rrd.DataSourcer) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return &serde.TransientError{Err: fmt.Errorf("read only")}
+	}
+	f.flushed = append(f.flushed, ds)
+	return nil
+}
+
+func Test_flusher_transientErrors(t *testing.T) {
+	saveInterval := flushRetryInterval
+	defer func() { flushRetryInterval = saveInterval }()
+	flushRetryInterval = 10 * time.Millisecond
+
+	tf := &transientFlusher{fails: 3}
+	dsf := &dsFlusher{db: tf, sr: &fakeSr{}}
+	wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+	fc := make(chan *dsFlushRequest)
+
+	wc.startWg.Add(1)
+	go flusher(wc, dsf, fc)
+	wc.startWg.Wait()
+
+	ds1 := serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	ds2 := serde.NewDbDataSource(2, serde.Ident{"name": "bar"}, rrd.NewDataSource(*DftDSSPec))
+	resp := make(chan bool, 1)
+	fc <- &dsFlushRequest{ds: ds1, resp: resp}
+	if <-resp {
+		t.Errorf("flusher: expected the response to report the failure")
+	}
+	fc <- &dsFlushRequest{ds: ds2}
+
+	for i := 0; ; i++ {
+		tf.Lock()
+		n := len(tf.flushed)
+		tf.Unlock()
+		if n == 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("flusher: the held flushes were not retried, %d flushed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tf.flushed[0] != ds1 || tf.flushed[1] != ds2 {
+		t.Errorf("flusher: the flushes should be retried in order")
+	}
+	if st, _ := dsf.flushStats(1); st.Errors != 3 || st.Flushes != 4 {
+		t.Errorf("flushStats: expected 3 errors in 4 flushes, got %+v", st)
+	}
+
+	close(fc)
+	wc.wg.Wait()
+}
+
+// A serde.Flusher which is a serde.FlushDropper and a
+// serde.FlushStopper
+type fakeDroppingFlusher struct {
+	dropped int64
+	stopped bool
+}
+
+func (f *fakeDroppingFlusher) FlushDataSource(rrd.DataSourcer) error { return nil }
+func (f *fakeDroppingFlusher) Dropped() int64                        { return f.dropped }
+func (f *fakeDroppingFlusher) Stop()                                 { f.stopped = true }
+
+func Test_flusher_flushesDropped(t *testing.T) {
+	db := &fakeDroppingFlusher{dropped: 3}
+	r := &Receiver{flusher: &dsFlusher{db: db}}
+	if n := r.flushesDropped(); n != 3 {
+		t.Errorf("flushesDropped: expected 3, got %d", n)
+	}
+	r.flusher = &dsFlusher{db: &fakeSerde{}}
+	if n := r.flushesDropped(); n != 0 {
+		t.Errorf("flushesDropped: expected 0 without a FlushDropper, got %d", n)
+	}
+}
@@ -17,6 +17,8 @@ package receiver
 
 import (
 	"log"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
@@ -32,26 +34,180 @@ const (
 )
 
 type pacedMetric struct {
-	kind  pacedMetricType
-	ident serde.Ident
-	value float64
+	kind      pacedMetricType
+	ident     serde.Ident
+	value     float64
+	alpha     float64 // non-zero for an EWMA gauge, see QueueGaugeEWMA
+	isInt     bool    // intValue is summed (as well as value), see QueueSumInt
+	intValue  int64
+	withCount bool  // see WithIncrementCount
+	n         int64 // number of increments combined, 0 means 1, see pacedSumCoalescer
+	nodeSum   bool  // see WithClusterSum, node is the local node
+	node      string
 }
 
+// pacedMetricSum is a sum accumulated over the pacing interval. It
+// is a plain sum of the increments, those from QueueSumInt are summed
+// as int64 so that large counts are exact, saturating at the limits
+// of int64 rather than wrapping around.
 type pacedMetricSum struct {
-	ident serde.Ident
-	sum   float64
+	ident     serde.Ident
+	sum       float64
+	intSum    int64
+	n         int64 // number of increments
+	withCount bool  // pass on n as well
+}
+
+// add adds the increment of pm, it returns false if the int64 sum
+// saturated.
+func (s *pacedMetricSum) add(pm *pacedMetric) bool {
+	if pm.n > 0 {
+		s.n += pm.n
+	} else {
+		s.n++
+	}
+	if pm.withCount {
+		s.withCount = true
+	}
+	s.sum += pm.value
+	if !pm.isInt {
+		return true
+	}
+	sum := s.intSum + pm.intValue
+	if pm.intValue > 0 && sum < s.intSum {
+		s.intSum = math.MaxInt64
+		return false
+	}
+	if pm.intValue < 0 && sum > s.intSum {
+		s.intSum = math.MinInt64
+		return false
+	}
+	s.intSum = sum
+	return true
+}
+
+// value returns the total of the increments.
+func (s *pacedMetricSum) value() float64 {
+	return s.sum + float64(s.intSum)
+}
+
+// metric returns the sum as one paced metric, carrying all of its
+// increments.
+func (s *pacedMetricSum) metric() *pacedMetric {
+	return &pacedMetric{kind: pacedSum, ident: s.ident, value: s.sum, isInt: true, intValue: s.intSum, withCount: s.withCount, n: s.n}
+}
+
+// pacedSumCoalescer combines the sums queued for the same ident
+// before they are sent to the paced metric worker, so that there is
+// only one message per ident per interval, see
+// Receiver.PacedSumCoalesce.
+type pacedSumCoalescer struct {
+	sync.Mutex
+	sums map[string]*pacedMetricSum
+}
+
+func newPacedSumCoalescer() *pacedSumCoalescer {
+	return &pacedSumCoalescer{sums: make(map[string]*pacedMetricSum)}
+}
+
+// add adds pm to the sum of its ident, it returns false if the int64
+// sum saturated.
+func (c *pacedSumCoalescer) add(pm *pacedMetric) bool {
+	key := pm.ident.String()
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.sums[key]
+	if !ok {
+		s = &pacedMetricSum{ident: pm.ident}
+		c.sums[key] = s
+	}
+	return s.add(pm)
+}
+
+// flush sends the combined sums to pacedMetricCh and starts over.
+func (c *pacedSumCoalescer) flush(pacedMetricCh chan *pacedMetric) {
+	c.Lock()
+	sums := c.sums
+	c.sums = make(map[string]*pacedMetricSum, len(sums))
+	c.Unlock()
+	for _, s := range sums {
+		pacedMetricCh <- s.metric()
+	}
+}
+
+// pacedSumCoalescerWorker flushes the coalescer every interval until
+// done is closed, whereupon it flushes it one last time.
+func pacedSumCoalescerWorker(wc wController, c *pacedSumCoalescer, pacedMetricCh chan *pacedMetric, interval time.Duration, done chan bool) {
+	wc.onEnter()
+	defer wc.onExit()
+	wc.onStarted()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush(pacedMetricCh)
+		case <-done:
+			c.flush(pacedMetricCh)
+			return
+		}
+	}
 }
 
 type pacedMetricGauge struct {
 	ident serde.Ident
 	*rrd.ClockPdp
+	ewma *pacedEWMA    // nil unless an EWMA gauge
+	sum  *pacedNodeSum // nil unless a cluster-wide sum gauge
+}
+
+// pacedNodeSum is the latest value of a gauge which is summed across
+// the cluster by the aggregator, see WithClusterSum.
+type pacedNodeSum struct {
+	node    string
+	value   float64
+	updated bool // value was set since it was last flushed
+}
+
+// pacedEWMA is the exponentially weighted moving average of the
+// values of a gauge, which carries over from one flush to the next.
+type pacedEWMA struct {
+	value   float64
+	updated time.Time // when the last value was added
+	flushed bool      // value was flushed since it was last updated
+}
+
+func (e *pacedEWMA) addValue(v, alpha float64, now time.Time) {
+	if e.updated.IsZero() {
+		e.value = v
+	} else {
+		e.value = alpha*v + (1-alpha)*e.value
+	}
+	e.updated, e.flushed = now, false
 }
 
 var pacedMetricFlush = func(sums map[string]*pacedMetricSum, gauges map[string]*pacedMetricGauge, acq aggregatorCommandQueuer, dpq dataPointQueuer) map[string]*pacedMetricSum {
 	for _, sum := range sums {
-		acq.QueueAggregatorCommand(aggregator.NewCommand(aggregator.CmdAdd, sum.ident, sum.sum))
+		acq.QueueAggregatorCommand(aggregator.NewCommand(aggregator.CmdAdd, sum.ident, sum.value()))
+		if sum.withCount {
+			acq.QueueAggregatorCommand(aggregator.NewCommand(aggregator.CmdAdd, CountIdent(sum.ident), float64(sum.n)))
+		}
 	}
 	for _, gauge := range gauges {
+		if gauge.sum != nil {
+			if gauge.sum.updated {
+				acq.QueueAggregatorCommand(aggregator.NewNodeSumCommand(gauge.ident, gauge.sum.node, gauge.sum.value))
+				gauge.sum.updated = false
+			}
+			continue
+		}
+		if gauge.ewma != nil {
+			if !gauge.ewma.flushed {
+				dpq.QueueDataPoint(gauge.ident, gauge.ewma.updated, gauge.ewma.value)
+				gauge.ewma.flushed = true
+			}
+			continue
+		}
 		dpq.QueueDataPoint(gauge.ident, gauge.End, gauge.Reset())
 	}
 	// NB: We do not reset the gauges map, it lives on
@@ -115,12 +271,25 @@ var pacedMetricWorker = func(wc wController, pacedMetricCh chan *pacedMetric, ac
 					if _, ok := sums[key]; !ok {
 						sums[key] = &pacedMetricSum{ident: ps.ident}
 					}
-					sums[key].sum += ps.value
+					if !sums[key].add(ps) {
+						sr.reportStatCount("receiver.pacedmetric.sum_saturated", 1)
+					}
 				case pacedGauge:
 					if _, ok := gauges[key]; !ok {
 						gauges[key] = &pacedMetricGauge{ident: ps.ident, ClockPdp: &rrd.ClockPdp{}}
+						if ps.nodeSum {
+							gauges[key].sum = &pacedNodeSum{node: ps.node}
+						} else if ps.alpha > 0 {
+							gauges[key].ewma = &pacedEWMA{}
+						}
+					}
+					if g := gauges[key]; g.sum != nil {
+						g.sum.value, g.sum.updated = ps.value, true
+					} else if g.ewma != nil {
+						g.ewma.addValue(ps.value, ps.alpha, time.Now())
+					} else {
+						g.AddValue(ps.value)
 					}
-					gauges[key].AddValue(ps.value)
 				}
 			}
 		}
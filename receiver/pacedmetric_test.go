@@ -17,6 +17,7 @@ package receiver
 
 import (
 	"log"
+	"math"
 	"os"
 	"strings"
 	"sync"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 type fakeAggregatorCommandQueuer struct {
@@ -66,6 +68,106 @@ func Test_pacedMetricFlush(t *testing.T) {
 	}
 }
 
+func Test_pacedMetricSum(t *testing.T) {
+	s := &pacedMetricSum{}
+	s.add(&pacedMetric{value: 1.5})
+	for i := 0; i < 3; i++ {
+		s.add(&pacedMetric{isInt: true, intValue: 1 << 60, withCount: i == 1})
+	}
+	if s.n != 4 || !s.withCount {
+		t.Errorf("pacedMetricSum: expected 4 increments with count, got %d %v", s.n, s.withCount)
+	}
+	if s.intSum != 3<<60 {
+		t.Errorf("pacedMetricSum: expected an exact int sum, got %d", s.intSum)
+	}
+	if s.add(&pacedMetric{isInt: true, intValue: math.MaxInt64}) || s.intSum != math.MaxInt64 {
+		t.Errorf("pacedMetricSum: expected saturation, got %d", s.intSum)
+	}
+	s = &pacedMetricSum{intSum: math.MinInt64 + 1}
+	if s.add(&pacedMetric{isInt: true, intValue: -2}) || s.intSum != math.MinInt64 {
+		t.Errorf("pacedMetricSum: expected negative saturation, got %d", s.intSum)
+	}
+	if v := (&pacedMetricSum{sum: 0.5, intSum: 2}).value(); v != 2.5 {
+		t.Errorf("pacedMetricSum: expected 2.5, got %v", v)
+	}
+}
+
+func Test_pacedEWMA(t *testing.T) {
+	e := &pacedEWMA{}
+	now := time.Unix(1000, 0)
+	e.addValue(10, 0.5, now)
+	if e.value != 10 {
+		t.Errorf("pacedEWMA: the first value should be taken as is, got %v", e.value)
+	}
+	e.addValue(20, 0.5, now.Add(time.Second))
+	e.addValue(20, 0.5, now.Add(2*time.Second))
+	if e.value != 17.5 || !e.updated.Equal(now.Add(2*time.Second)) || e.flushed {
+		t.Errorf("pacedEWMA: expected 17.5, got %v", e.value)
+	}
+
+	gauges := map[string]*pacedMetricGauge{"foo": {ClockPdp: &rrd.ClockPdp{}, ewma: e}}
+	acq := &fakeAggregatorCommandQueuer{}
+	dpq := &fakeDataPointQueuer{}
+	pacedMetricFlush(nil, gauges, acq, dpq)
+	pacedMetricFlush(nil, gauges, acq, dpq)
+	if dpq.qdpCalled != 1 || !e.flushed {
+		t.Errorf("pacedMetricFlush: expected the EWMA to be flushed once until updated, got %d", dpq.qdpCalled)
+	}
+}
+
+type aggCmdCollector struct {
+	cmds []*aggregator.Command
+}
+
+func (c *aggCmdCollector) QueueAggregatorCommand(cmd *aggregator.Command) {
+	c.cmds = append(c.cmds, cmd)
+}
+
+type dpCollector map[string]float64
+
+func (c dpCollector) QueueDataPoint(ident serde.Ident, _ time.Time, v float64) {
+	c[ident.String()] = v
+}
+
+func Test_pacedNodeSum(t *testing.T) {
+	ident := serde.Ident{"name": "conns"}
+	out := dpCollector{}
+	agg := aggregator.NewAggregator(out)
+	acq := &aggCmdCollector{}
+	dpq := &fakeDataPointQueuer{}
+	gauges := map[string]*pacedMetricGauge{
+		"a": {ident: ident, ClockPdp: &rrd.ClockPdp{}, sum: &pacedNodeSum{node: "a", value: 3, updated: true}},
+		"b": {ident: ident, ClockPdp: &rrd.ClockPdp{}, sum: &pacedNodeSum{node: "b", value: 4, updated: true}},
+	}
+	pacedMetricFlush(nil, gauges, acq, dpq)
+	pacedMetricFlush(nil, gauges, acq, dpq)
+	if len(acq.cmds) != 2 || dpq.qdpCalled != 0 {
+		t.Fatalf("pacedMetricFlush: expected one aggregator command per node until updated, got %d (and %d points)", len(acq.cmds), dpq.qdpCalled)
+	}
+
+	// The aggregator sums the latest value of every node, the
+	// node must survive gob, as when forwarded
+	for _, cmd := range acq.cmds {
+		var dec aggregator.Command
+		if b, err := cmd.GobEncode(); err != nil || dec.GobDecode(b) != nil {
+			t.Fatalf("Command gob round trip failed: %v", err)
+		}
+		agg.ProcessCmd(&dec)
+	}
+	agg.ProcessCmd(aggregator.NewNodeSumCommand(ident, "a", 5))
+	agg.Flush(time.Now())
+	if v := out[ident.String()]; v != 9 {
+		t.Errorf("CmdNodeSum: expected 5+4, got %v", v)
+	}
+	// With no window, nodes which did not send since drop out
+	delete(out, ident.String())
+	agg.ProcessCmd(aggregator.NewNodeSumCommand(ident, "b", 1))
+	agg.Flush(time.Now())
+	if v := out[ident.String()]; v != 1 {
+		t.Errorf("CmdNodeSum: expected only node b, got %v", v)
+	}
+}
+
 func Test_pacedMetricPeriodicFlushSignal(t *testing.T) {
 
 	fl := &fakeLogger{}
@@ -161,3 +263,35 @@ func Test_paced_reportPaceMetricChannelFillPercent(t *testing.T) {
 		t.Errorf("reportPacedMetricChannelFillPercent: statReporter should have been called a bunch of times")
 	}
 }
+
+func Test_pacedSumCoalescer(t *testing.T) {
+	c := newPacedSumCoalescer()
+	foo, bar := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}
+	for i := 0; i < 10; i++ {
+		c.add(&pacedMetric{kind: pacedSum, ident: foo, value: 0.5})
+		c.add(&pacedMetric{kind: pacedSum, ident: foo, isInt: true, intValue: 2, withCount: i == 5})
+	}
+	c.add(&pacedMetric{kind: pacedSum, ident: bar, value: 1})
+
+	ch := make(chan *pacedMetric, 10)
+	c.flush(ch)
+	if len(ch) != 2 {
+		t.Fatalf("pacedSumCoalescer: expected one message per ident, got %d", len(ch))
+	}
+	sums := make(map[string]*pacedMetricSum)
+	for len(ch) > 0 {
+		pm := <-ch
+		s := &pacedMetricSum{ident: pm.ident}
+		s.add(pm)
+		sums[pm.ident.String()] = s
+	}
+	if s := sums[foo.String()]; s.value() != 25 || s.n != 20 || !s.withCount {
+		t.Errorf("pacedSumCoalescer: expected 25 in 20 increments with count, got %v %d %v", s.value(), s.n, s.withCount)
+	}
+	if s := sums[bar.String()]; s.value() != 1 || s.n != 1 {
+		t.Errorf("pacedSumCoalescer: expected 1 in 1 increment, got %v %d", s.value(), s.n)
+	}
+	if c.flush(ch); len(ch) != 0 {
+		t.Errorf("pacedSumCoalescer: expected nothing after a flush, got %d", len(ch))
+	}
+}
@@ -19,13 +19,22 @@
 package receiver
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
@@ -60,7 +69,25 @@ func init() {
 // to the appropriate node for handling. By default metrics are paced
 // to be send once per second.
 type Receiver struct {
-	NWorkers int // number of workers, must be > 0
+	NWorkers int // number of workers, must be > 0, see DefaultNWorkers
+
+	// NDirectors is the number of director goroutines, which look
+	// up (or create) the DS of every incoming data point and pass
+	// it on to a worker (or another node). Each director is
+	// responsible for a subset of the idents, more than one is
+	// useful with very high rates of incoming data. Zero means 1.
+	NDirectors int
+
+	// NFlushers is the number of flusher goroutines, each of which
+	// can hold a database connection while flushing. Zero means
+	// same as NWorkers.
+	NFlushers int
+	// MaxFlushConnections is the number of database connections
+	// available for flushing. If the SerDe supports it, its
+	// connection pool is sized accordingly. Start() returns an error
+	// if there are more flushers than connections. Zero means no
+	// limit.
+	MaxFlushConnections int
 
 	// Cache parameters. These are tracked per Data Source.
 	// MinCacheDuration means data points will always be kept in the cache at least this long,
@@ -72,16 +99,283 @@ type Receiver struct {
 	// parameter mostly matters when the data stopped coming in and
 	// some data points are still cached in memory.
 	MaxCacheDuration time.Duration
+	// FlushJitter, if not zero, adds up to this much (chosen at
+	// random, once per DS) to the MaxCacheDuration of every DS, so
+	// that DSs which received points at the same time, e.g. after a
+	// restart, do not all come due for a flush at the same time.
+	FlushJitter time.Duration
+	// FlushJitterSeed seeds the random source of FlushJitter, so
+	// that the flush timing of the same DSs loaded in the same order
+	// can be reproduced. Zero means a random seed.
+	FlushJitterSeed int64
 	// MaxCachedPoints is the maximum number of cached points (as
 	// returned by DS.PointCoont(), which is the sum of all RRAs) for
 	// a Data Source. Note that MinCacheDuration trumps this
 	// parameter. This number is only relevant if it is below the
 	// total possible number of points in a MaxCacheDuration.
 	MaxCachedPoints int
+	// MaxTotalCachedPoints is the maximum number of cached points
+	// in all DSs combined, to bound the memory used by the
+	// cache. When it is exceeded, DSs are flushed early, regardless
+	// of the above, until the total is below it again, see also
+	// SetMemoryPressureHook. Zero means no limit.
+	MaxTotalCachedPoints int
+	// SpillDir, if not empty, is a directory where the cached
+	// points of the least recently accessed DSs are moved when
+	// MaxTotalCachedPoints is exceeded, rather than flushing DSs
+	// early. A spilled DS is loaded back from its file when it is
+	// next accessed (a data point arrives, it is due for a flush,
+	// etc), thus hot DSs keep coalescing their writes while the
+	// memory stays bounded, at the cost of disk I/O. Spill files do
+	// not survive a restart, no more than the cache does.
+	SpillDir string
 
 	// MaxFlushRatePerSecond controls how frequently we write to the
 	// database across all DSs. This trumps all other caching parameters.
+	// With several backends (serde.NewMultiFlusher) it applies to
+	// them all, a backend can be limited separately on top of it with
+	// serde.NewRateLimitedFlusher.
 	MaxFlushRatePerSecond int
+	// MaxFlushBurst is how many flushes MaxFlushRatePerSecond lets
+	// through at once when it has been idle: unused capacity
+	// accumulates up to this many flushes, so that a backlog after a
+	// quiet period is drained faster, while the sustained rate stays
+	// MaxFlushRatePerSecond. Zero means MaxFlushRatePerSecond, i.e.
+	// a second's worth.
+	MaxFlushBurst int
+
+	// MaxNewDSPerSecond limits how many previously unknown DSs can
+	// be created (in the database) per second. Data points for DSs
+	// which cannot be created because of this limit are dropped
+	// until capacity frees up. Zero means no limit.
+	MaxNewDSPerSecond int
+
+	// MaxConcurrentCreates limits how many previously unknown DSs
+	// can be being fetched from (or created in) the database at
+	// once, by all the directors as well as the fetches carrying on
+	// in the background (see FetchTimeout), which smooths the burst
+	// of creations after e.g. a fleet-wide deploy. A data point
+	// for a DS which cannot be created right away because of this
+	// limit does not hold up the director: it is held for up to 10
+	// seconds, retried every second, and is processed once its DS
+	// is created, or dropped (counted as
+	// receiver.datapoints.create_held_dropped and passed to the
+	// dead letter handler). Zero means DSs are created one at a
+	// time, each director waiting for its turn.
+	MaxConcurrentCreates int
+
+	// FetchTimeout is how long a director waits for a previously
+	// unknown DS to be fetched from (or created in) the database.
+	// Past it the data point is dropped (counted as
+	// receiver.datapoints.fetch_timeout and passed to the dead
+	// letter handler), and the fetch carries on in the background,
+	// in one of a fixed number of fetcher goroutines: the DS is
+	// cached once it completes, and points for it are dropped until
+	// then. A slow database thus cannot hold up a director for
+	// longer than this. Zero means no timeout.
+	FetchTimeout time.Duration
+
+	// If not nil, Tracer traces the data points queued by
+	// QueueDataPoint and the like through the stages of the
+	// receiver, see WithContext. Paced metrics and aggregator
+	// commands are not traced, nor are points past the director
+	// which forwards them to another node in a cluster.
+	Tracer Tracer
+
+	// MinValue and MaxValue bound the values of the data points
+	// like the fields of the same name of rrd.DSSpec, for every DS
+	// whose DSSpec does not set bounds of its own. Points out of
+	// bounds are dropped, counted as
+	// receiver.datapoints.out_of_bounds, per DS as well (see
+	// DescribeDS), and passed to the dead letter handler.
+	MinValue, MaxValue float64
+
+	// MaxRRASlots is the maximum number of slots (span divided by
+	// step) an RRA of a newly created DS can have. The span of an
+	// RRA that would be larger is reduced to fit, which is logged.
+	// This guards against a misconfigured DSSpec creating RRAs so
+	// large that flushing them bogs down the flusher. DSs already in
+	// the database are not affected. Zero means no limit.
+	MaxRRASlots int
+
+	// TagKeyAllowlist, if not empty, is the list of tag keys an
+	// incoming data point ident may have, which guards against
+	// cardinality explosions caused by mistyped tag keys. The
+	// "name" tag is always allowed. Data points with other tag keys
+	// are dropped (and counted), or, if StripDisallowedTagKeys is
+	// true, the other tag keys are removed from the ident.
+	TagKeyAllowlist        []string
+	StripDisallowedTagKeys bool
+
+	// RequiredTagKeys are the tag keys an incoming data point ident
+	// must have, with a non-empty value, so that buggy clients
+	// cannot create meaningless series. Data points without them
+	// are dropped (and counted) before a DSSpec is looked up. The
+	// default (as set by New) is "name", an empty list disables the
+	// check.
+	RequiredTagKeys []string
+
+	// ReorderWindow is the merge policy for points arriving from
+	// different sources (e.g. QueueDataPoint and the aggregator),
+	// whose interleaving is otherwise nondeterministic. If it is not
+	// zero, the worker holds data points for a DS so that they are
+	// applied in time stamp order. A held point is applied once a
+	// point with a time stamp at least ReorderWindow later arrives,
+	// or after it has been held for ReorderWindow (actual
+	// time). Points arriving later than that are still rejected if
+	// they are older than the DS last update. Zero means points are
+	// applied in order of arrival.
+	ReorderWindow time.Duration
+
+	// TimeStampAlignment aligns the time stamps of incoming data
+	// points to the DS step before they are applied, which makes
+	// slot assignment deterministic for points arriving at
+	// arbitrary sub-step times. The default, AlignNone, preserves
+	// the exact time stamps.
+	TimeStampAlignment TimeStampAlignment
+
+	// FlushPriority is the order in which DSs due for a periodic
+	// flush are flushed. It matters when flushes are rate limited
+	// and not all of them can be flushed at once. The default,
+	// FlushAnyOrder, is no particular order.
+	FlushPriority FlushPriority
+
+	// AggOverrunPolicy is what the aggregator does when it falls
+	// behind by a whole StatFlushDuration, i.e. the flush of a
+	// period happens after the end of the next one, in which case
+	// the aggregates are not for the period they are stamped
+	// with. Every overrun is counted in the
+	// receiver.aggworker.agg.overrun stat. The default,
+	// AggOverrunQueue, flushes as usual.
+	AggOverrunPolicy AggOverrunPolicy
+
+	// AggQuietCounterPolicy is what the aggregator flushes for a
+	// counter (e.g. a statsd "c" metric) in a period in which it
+	// was not sent. The default, QuietCounterDelete, flushes
+	// nothing, thus the DS gets no data point and its value is
+	// unknown (NaN) once the heartbeat is exceeded.
+	// QuietCounterZeroFill flushes a rate of 0 for every counter
+	// the aggregator has seen since it started, which is how a
+	// rate of a counter which went quiet is usually displayed, at
+	// the cost of remembering every counter (on the node running
+	// the aggregator, a node taking it over starts afresh).
+	AggQuietCounterPolicy QuietCounterPolicy
+
+	// AggDirect makes the aggregator send its results for the
+	// cached DSs straight to the workers responsible for them, and
+	// have those flushed at the end of every period, rather than
+	// queueing them as data points to go through the
+	// directors. Results for a DS which is not cached
+	// yet (including its first one) are queued as usual, which is
+	// how the DS gets created. It has no effect in a cluster, where
+	// the DS may belong to another node, or when flushing is not
+	// supported.
+	AggDirect bool
+
+	// AggCardinality is about how many distinct idents the
+	// aggregator expects per StatFlushDuration, e.g. the number of
+	// statsd metrics, for which it allocates upfront. The default,
+	// 0, grows the aggregator as needed, which for hundreds of
+	// thousands of metrics means rehashing during the first
+	// periods. Either way the aggregator memory is reused from one
+	// period to the next.
+	AggCardinality int
+
+	// ClusterSumWindow is how long the value of a gauge queued with
+	// WithClusterSum by a node counts towards the cluster-wide sum
+	// after the aggregator received it. The default, 0, counts every
+	// value until the end of the StatFlushDuration period in which
+	// it was received, which suits gauges queued at least once per
+	// period. Either way a node which stops sending the gauge
+	// (e.g. because it left the cluster) drops out of the sum.
+	ClusterSumWindow time.Duration
+
+	// ClusterFailurePolicy is what happens to data points which
+	// cannot be forwarded to the node responsible for their DS. The
+	// default, ClusterFailureDrop, drops them. With
+	// ClusterFallbackLocal they are processed locally once the
+	// cluster is deemed down, which is when forwarding has been
+	// failing without a single success for ClusterDownAfter, or the
+	// last cluster transition failed, and forwarding resumes as soon
+	// as it succeeds again. Points forwarded to this node during a
+	// cluster transition are then also processed locally rather
+	// than held. The receiver.cluster.fallback.* stats report the
+	// state, the time spent in fallback and the points processed
+	// locally because of it. Note that while in fallback more than
+	// one node may be writing to the same DS.
+	ClusterFailurePolicy ClusterFailurePolicy
+	ClusterDownAfter     time.Duration
+
+	// ForwardAccumulateWindow, if not zero, is how long the data
+	// points of a DS owned only by other nodes are accumulated
+	// locally before being forwarded as a single point, their mean
+	// value with the time stamp of the last one, which cuts down on
+	// the number of messages between nodes (e.g. across
+	// availability zones) at the expense of latency and some
+	// accuracy. Points of a different step of the DS than the
+	// accumulated ones cause these to be forwarded right away, so
+	// that every step still gets its own value. Counters and
+	// integer values are forwarded as usual, as are all points
+	// while the cluster is down (see ClusterFailurePolicy). DSs this
+	// node is responsible for are not affected.
+	ForwardAccumulateWindow time.Duration
+
+	// TypeConflictPolicy is what happens to a counter data point for
+	// a DS which receives values, or vice versa, e.g. because the
+	// same name is emitted as a counter and as a gauge by different
+	// sources. The kind of a DS is that of the first point it
+	// receives, it is saved in the DS metadata (see serde.MetaKind)
+	// if the SerDe can store metadata, otherwise it is only kept
+	// while the DS is cached. The default, TypeConflictIgnore,
+	// applies the point anyway. TypeConflictReject drops it (see
+	// DeadLetterTypeConflict), TypeConflictSuffix sends it to a DS
+	// with the kind appended to the name (see KindIdent), matched to
+	// the same DSSpec. Conflicts are counted as
+	// receiver.datapoints.type_conflict, unless ignored.
+	TypeConflictPolicy TypeConflictPolicy
+
+	// SkewTolerance is how far in the future of this node's clock
+	// a data point can be time stamped and still be applied as
+	// is, to allow for the clocks of the sources being somewhat
+	// off. A point further ahead is clamped to the edge of the
+	// tolerance or rejected (see DeadLetterSkewed) as per
+	// SkewPolicy, and counted as receiver.datapoints.skew_clamped
+	// or skew_rejected as well as in the Skewed count of its DS
+	// (see DescribeDS), which tells the badly skewed sources
+	// apart. Points in the past are not affected. The default, 0,
+	// applies all points as is.
+	SkewTolerance time.Duration
+	SkewPolicy    SkewPolicy
+
+	// WorkerPanicPolicy is what happens when a worker panics, e.g.
+	// because of a bug triggered by an odd value. The default,
+	// WorkerPanicCrash, lets the panic take down the process.
+	// WorkerPanicRestart recovers: the panic is logged along with
+	// its stack and counted as receiver.worker.panics, the worker
+	// resumes with the DSs it was responsible for, and the DS it was
+	// working on, if known, is reloaded from the database, which
+	// discards whatever that DS cached and did not flush, and ends
+	// its subscriptions. A request which caused the panic (e.g.
+	// MarkGap) fails.
+	WorkerPanicPolicy WorkerPanicPolicy
+
+	// BatchChunkSize is how many points of a batch QueueDataPoints
+	// queues before yielding the processor, so that a huge batch
+	// does not starve other traffic. Zero or less means the whole
+	// batch at once.
+	BatchChunkSize int
+
+	// AggRetryQueueSize is how many aggregated data points are kept
+	// for retrying when the aggregator cannot pass them on to the
+	// receiver because it is busy. Beyond that, points are dropped.
+	AggRetryQueueSize int
+
+	// SnapshotCompression is the name of the compression used by
+	// Snapshot, e.g. "gzip" or any format added with
+	// RegisterCompression. Empty or "none" means no
+	// compression. RestoreSnapshot detects the compression by
+	// itself and ignores this setting.
+	SnapshotCompression string
 
 	StatFlushDuration time.Duration // Period after which stats are flushed
 	StatsNamePrefix   string        // Stat names are prefixed with this
@@ -89,6 +383,51 @@ type Receiver struct {
 	ReportStats       bool   // report internal stats?
 	ReportStatsPrefix string // prefix for internal stats
 
+	// CollectStats keeps the internal stats in memory, where they
+	// can be read with InternalStats, e.g. to be scraped, which is
+	// independent of ReportStats. With ReportStats false they are
+	// collected without being reported as Tgres series.
+	CollectStats bool
+
+	// If PauseBlocks is true, the Queue* methods block while the
+	// receiver is paused rather than return ErrPaused. See Pause.
+	PauseBlocks bool
+
+	// DisableAggregator and DisablePacedMetrics turn off the
+	// aggregator (QueueAggregatorCommand) and the paced metrics
+	// (QueueSum, QueueGauge) respectively, for deployments which
+	// only queue rates. Their goroutines are not started and their
+	// Queue* methods return ErrAggregatorDisabled or
+	// ErrPacedMetricsDisabled. Paced metrics are passed on to the
+	// aggregator, therefore disabling the aggregator disables them
+	// too. Note that internal stats (ReportStats) are paced metrics
+	// and the staleness check (SetStalenessHook) as well as the
+	// arrival rate check (SetStepUpHook) are done by the aggregator.
+	DisableAggregator   bool
+	DisablePacedMetrics bool
+
+	// ReadOnly makes a receiver which only serves reads, e.g. a
+	// replica scaling out queries against the same database: Start
+	// loads the DSs into the cache, but starts no workers, flushers,
+	// aggregator or paced metric worker, thus nothing is ever
+	// flushed. The Queue* methods return ErrReadOnly, as do the
+	// methods which write to the database directly (SetDSMeta,
+	// RenameDS, RepairLastUpdate and ImportCatalog), and the
+	// methods which need the workers (e.g. Touch) fail as if the
+	// receiver were not running. Internal stats are not reported,
+	// though they can still be collected (CollectStats). The cache
+	// is as loaded by Start, DSs created since are not seen.
+	ReadOnly bool
+
+	// PacedSumCoalesce, if not zero, is how long the increments of
+	// QueueSum and QueueSumInt (and the internal stat counts) are
+	// combined by ident before being sent to the paced metric
+	// worker, so that many increments of a few idents make one
+	// message per ident per PacedSumCoalesce rather than one each.
+	// It should be well below the pacing interval (a second), as it
+	// delays the increments by up to that long.
+	PacedSumCoalesce time.Duration
+
 	// unexported internal stuff
 
 	cluster clusterer   // cluster or nil
@@ -96,16 +435,42 @@ type Receiver struct {
 	dsc     *dsCache    // the DS cache
 
 	flusher       dsFlusherBlocking        // orchestration of flush queues
-	dpCh          chan *incomingDP         // incoming data points
+	dpChs         directorChannels         // incoming data points
 	workerChs     workerChannels           // incoming data points with ds
 	aggCh         chan *aggregator.Command // aggregator commands (for statsd type stuff)
 	pacedMetricCh chan *pacedMetric        // paced metrics (only flushed periodically)
+	coalescer     *pacedSumCoalescer       // nil unless PacedSumCoalesce
+	coalescerDone chan bool                // stops the coalescer
 
 	workerWg      sync.WaitGroup
 	flusherWg     sync.WaitGroup
 	aggWg         sync.WaitGroup
 	directorWg    sync.WaitGroup
 	pacedMetricWg sync.WaitGroup
+	coalescerWg   sync.WaitGroup
+	fetcherWg     sync.WaitGroup
+
+	stalenessWindow time.Duration           // see SetStalenessHook
+	stalenessHook   func(serde.Ident, bool) // nil means no staleness checking
+
+	stepUpPeriods int                                             // see SetStepUpHook
+	stepUpHook    func(serde.Ident, time.Duration, time.Duration) // nil means no arrival rate checking
+
+	deadLetterHandler func(*DeadLetter) // see SetDeadLetterHandler
+
+	memoryPressureHook func(cachedPoints, budget int) // see SetMemoryPressureHook
+
+	newDSHook func(serde.Ident, string) // see SetNewDSHook
+
+	collected collectedStats // see CollectStats
+
+	goroutines int32 // running workers, flushers, etc, see Goroutines()
+
+	paused   int32         // 1 if paused, see Pause()
+	pauseMu  sync.Mutex    // protects resumeCh
+	resumeCh chan struct{} // closed on Resume
+
+	rebalanceMu sync.Mutex // one RebalanceWorker at a time
 
 	stopped bool
 }
@@ -121,56 +486,586 @@ type incomingDP struct {
 	TimeStamp time.Time
 	Value     float64
 	Hops      int
+	// If WrapAt is non-zero, Value is a monotonic counter which
+	// wraps around at WrapAt, and it will be converted to a rate.
+	WrapAt float64
+	// If IsInt is true, IntValue is the exact value, and Value is
+	// only its float64 approximation. IntWrapAt is then used
+	// instead of WrapAt.
+	IsInt     bool
+	IntValue  int64
+	IntWrapAt int64
+	// If not nil, the DSSpec for the DS is matched using this ident
+	// instead of Ident, see QueueSumCount.
+	SpecIdent serde.Ident
+	// If not nil, the point is an exemplar with these labels, see
+	// QueueDataPointWithExemplar.
+	Exemplar map[string]string
+	// Where the point came from, see WithSource.
+	Source string
+
+	trace *dpTrace // nil unless traced, see Receiver.Tracer
+}
+
+// kind returns "counter" if the data point is a counter value, and
+// "gauge" otherwise.
+func (dp *incomingDP) kind() string {
+	if dp.WrapAt != 0 || dp.IntWrapAt != 0 {
+		return "counter"
+	}
+	return "gauge"
 }
 
+// CountIdent returns the ident of the companion count series of the
+// series identified by ident, which is the same ident with ".count"
+// appended to the name, see QueueSumCount.
+func CountIdent(ident serde.Ident) serde.Ident {
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = ident["name"] + ".count"
+	return result
+}
+
+// TimeStampAlignment specifies how incoming time stamps are aligned
+// to the DS step.
+type TimeStampAlignment int
+
+const (
+	AlignNone  TimeStampAlignment = iota // time stamps are not changed
+	AlignFloor                           // beginning of the step
+	AlignRound                           // nearest step boundary, halfway rounds up
+	AlignCeil                            // end of the step
+)
+
+// ParseTimeStampAlignment converts "none", "floor", "round" or "ceil"
+// (case insensitive) to a TimeStampAlignment. Empty string is the
+// same as "none".
+func ParseTimeStampAlignment(s string) (TimeStampAlignment, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return AlignNone, nil
+	case "floor":
+		return AlignFloor, nil
+	case "round":
+		return AlignRound, nil
+	case "ceil":
+		return AlignCeil, nil
+	}
+	return AlignNone, fmt.Errorf("Invalid time stamp alignment: %q (valid: none, floor, round, ceil)", s)
+}
+
+// align returns ts aligned to step.
+func (a TimeStampAlignment) align(ts time.Time, step time.Duration) time.Time {
+	if step <= 0 {
+		return ts
+	}
+	switch a {
+	case AlignFloor:
+		return ts.Truncate(step)
+	case AlignRound:
+		return ts.Round(step)
+	case AlignCeil:
+		if floor := ts.Truncate(step); !floor.Equal(ts) {
+			return floor.Add(step)
+		}
+	}
+	return ts
+}
+
+// FlushPriority specifies which DSs are flushed first.
+type FlushPriority int
+
+const (
+	FlushAnyOrder         FlushPriority = iota // no particular order
+	FlushOldestDirtyFirst                      // least recently flushed first, minimizes staleness
+	FlushMostPointsFirst                       // most cached points first, minimizes memory use
+)
+
+// ParseFlushPriority converts "any", "oldest-dirty-first" or
+// "most-points-first" (case insensitive) to a FlushPriority. Empty
+// string is the same as "any".
+func ParseFlushPriority(s string) (FlushPriority, error) {
+	switch strings.ToLower(s) {
+	case "", "any":
+		return FlushAnyOrder, nil
+	case "oldest-dirty-first":
+		return FlushOldestDirtyFirst, nil
+	case "most-points-first":
+		return FlushMostPointsFirst, nil
+	}
+	return FlushAnyOrder, fmt.Errorf("Invalid flush priority: %q (valid: any, oldest-dirty-first, most-points-first)", s)
+}
+
+// AggOverrunPolicy specifies how the aggregator handles an overrun,
+// see Receiver.AggOverrunPolicy.
+type AggOverrunPolicy int
+
+const (
+	AggOverrunQueue  AggOverrunPolicy = iota // flush late, stamped with the end of the period
+	AggOverrunExtend                         // flush late, stamped with the time of the flush, extending the period
+	AggOverrunSkip                           // discard the aggregates of the period
+)
+
+// ParseAggOverrunPolicy converts "queue", "extend" or "skip" (case
+// insensitive) to an AggOverrunPolicy. Empty string is the same as
+// "queue".
+func ParseAggOverrunPolicy(s string) (AggOverrunPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "queue":
+		return AggOverrunQueue, nil
+	case "extend":
+		return AggOverrunExtend, nil
+	case "skip":
+		return AggOverrunSkip, nil
+	}
+	return AggOverrunQueue, fmt.Errorf("Invalid aggregator overrun policy: %q (valid: queue, extend, skip)", s)
+}
+
+// QuietCounterPolicy specifies what the aggregator does about a
+// counter without a value in a period, see
+// Receiver.AggQuietCounterPolicy.
+type QuietCounterPolicy int
+
+const (
+	QuietCounterDelete   QuietCounterPolicy = iota // flush nothing
+	QuietCounterZeroFill                           // flush a 0
+)
+
+// ParseQuietCounterPolicy converts "delete" or "zero-fill" (case
+// insensitive) to a QuietCounterPolicy. Empty string is the same as
+// "delete".
+func ParseQuietCounterPolicy(s string) (QuietCounterPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "delete":
+		return QuietCounterDelete, nil
+	case "zero-fill":
+		return QuietCounterZeroFill, nil
+	}
+	return QuietCounterDelete, fmt.Errorf("Invalid quiet counter policy: %q (valid: delete, zero-fill)", s)
+}
+
+// ClusterFailurePolicy specifies how the receiver handles a failing
+// cluster, see Receiver.ClusterFailurePolicy.
+type ClusterFailurePolicy int
+
+const (
+	ClusterFailureDrop   ClusterFailurePolicy = iota // drop the points which cannot be forwarded
+	ClusterFallbackLocal                             // process them locally while the cluster is down
+)
+
+// ParseClusterFailurePolicy converts "drop" or "local" (case
+// insensitive) to a ClusterFailurePolicy. Empty string is the same as
+// "drop".
+func ParseClusterFailurePolicy(s string) (ClusterFailurePolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "drop":
+		return ClusterFailureDrop, nil
+	case "local":
+		return ClusterFallbackLocal, nil
+	}
+	return ClusterFailureDrop, fmt.Errorf("Invalid cluster failure policy: %q (valid: drop, local)", s)
+}
+
+// TypeConflictPolicy specifies how the receiver handles a data point
+// of a different kind (counter or not) than the DS, see
+// Receiver.TypeConflictPolicy.
+type TypeConflictPolicy int
+
+const (
+	TypeConflictIgnore TypeConflictPolicy = iota // apply the point anyway
+	TypeConflictReject                           // drop the point
+	TypeConflictSuffix                           // send the point to a DS named after its kind
+)
+
+// ParseTypeConflictPolicy converts "ignore", "reject" or "suffix"
+// (case insensitive) to a TypeConflictPolicy. Empty string is the
+// same as "ignore".
+func ParseTypeConflictPolicy(s string) (TypeConflictPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "ignore":
+		return TypeConflictIgnore, nil
+	case "reject":
+		return TypeConflictReject, nil
+	case "suffix":
+		return TypeConflictSuffix, nil
+	}
+	return TypeConflictIgnore, fmt.Errorf("Invalid type conflict policy: %q (valid: ignore, reject, suffix)", s)
+}
+
+// SkewPolicy specifies what happens to a data point time stamped too
+// far in the future, see Receiver.SkewTolerance.
+type SkewPolicy int
+
+const (
+	SkewClamp  SkewPolicy = iota // apply the point as stamped at the edge of the tolerance
+	SkewReject                   // drop the point
+)
+
+// ParseSkewPolicy converts "clamp" or "reject" (case insensitive) to
+// a SkewPolicy. Empty string is the same as "clamp".
+func ParseSkewPolicy(s string) (SkewPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "clamp":
+		return SkewClamp, nil
+	case "reject":
+		return SkewReject, nil
+	}
+	return SkewClamp, fmt.Errorf("Invalid skew policy: %q (valid: clamp, reject)", s)
+}
+
+// WorkerPanicPolicy specifies what happens when a worker panics, see
+// Receiver.WorkerPanicPolicy.
+type WorkerPanicPolicy int
+
+const (
+	WorkerPanicCrash   WorkerPanicPolicy = iota // let the panic crash the process
+	WorkerPanicRestart                          // recover and resume the worker
+)
+
+// ParseWorkerPanicPolicy converts "crash" or "restart" (case
+// insensitive) to a WorkerPanicPolicy. Empty string is the same as
+// "crash".
+func ParseWorkerPanicPolicy(s string) (WorkerPanicPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "crash":
+		return WorkerPanicCrash, nil
+	case "restart":
+		return WorkerPanicRestart, nil
+	}
+	return WorkerPanicCrash, fmt.Errorf("Invalid worker panic policy: %q (valid: crash, restart)", s)
+}
+
+// KindIdent returns the ident to which a data point of kind
+// ("counter" or "gauge") conflicting with the DS identified by ident
+// is sent with TypeConflictSuffix, which is the same ident with "."
+// and the kind appended to the name.
+func KindIdent(ident serde.Ident, kind string) serde.Ident {
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = ident["name"] + "." + kind
+	return result
+}
+
+// MaxDefaultNWorkers caps DefaultNWorkers. Since the flushers
+// default to the same number as the workers, and every flusher can
+// hold a database connection, more workers than this are best
+// configured deliberately.
+const MaxDefaultNWorkers = 16
+
+// DefaultNWorkers returns the number of workers New sets NWorkers
+// to: the number of CPUs the Go runtime uses (GOMAXPROCS, which
+// reflects any limit set by way of the GOMAXPROCS environment
+// variable), but no more than MaxDefaultNWorkers.
+func DefaultNWorkers() int {
+	n := runtime.GOMAXPROCS(0)
+	if n > MaxDefaultNWorkers {
+		n = MaxDefaultNWorkers
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// ErrNoSerDe is returned by New when the SerDe is nil or has no
+// Fetcher.
+var ErrNoSerDe = fmt.Errorf("receiver: a SerDe with a Fetcher is required")
+
 // Create a Receiver. The first argument is a SerDe, the second is a
 // MatchingDSSpecFinder used to match previously unknown DS names to a
 // DSSpec with which the DS is to be created. If you pass nil, then
 // the default SimpleDSFinder is used which always returns DftDSSPec.
-func New(serde serde.SerDe, finder MatchingDSSpecFinder) *Receiver {
+// A SerDe is required, without one ErrNoSerDe is returned.
+func New(serde serde.SerDe, finder MatchingDSSpecFinder) (*Receiver, error) {
+	if serde == nil || serde.Fetcher() == nil {
+		return nil, ErrNoSerDe
+	}
 	if finder == nil {
 		finder = &SimpleDSFinder{DftDSSPec}
 	}
 	r := &Receiver{
 		serde:                 serde,
-		NWorkers:              4,
+		NWorkers:              DefaultNWorkers(),
 		MaxCacheDuration:      5 * time.Second,
 		MinCacheDuration:      1 * time.Second,
 		MaxCachedPoints:       256,
 		MaxFlushRatePerSecond: 100,
+		AggRetryQueueSize:     4096,
+		BatchChunkSize:        1024,
 		StatFlushDuration:     10 * time.Second,
 		StatsNamePrefix:       "stats",
-		dpCh:                  make(chan *incomingDP, 65536), // to be on the safe side
+		RequiredTagKeys:       []string{"name"},
+		ClusterDownAfter:      10 * time.Second,
+		dpChs:                 newDirectorChannels(1, 65536), // to be on the safe side
 		aggCh:                 make(chan *aggregator.Command, 1024),
 		pacedMetricCh:         make(chan *pacedMetric, 1024),
 		ReportStats:           false,
 		ReportStatsPrefix:     "tgres",
 	}
 
-	r.flusher = &dsFlusher{db: serde.Flusher(), sr: r}
+	r.flusher = &dsFlusher{db: serde.Flusher(), sr: r, goroutines: &r.goroutines}
 	r.dsc = newDsCache(serde.Fetcher(), finder, r.flusher)
-	return r
+	return r, nil
 }
 
 // Before using the receiver it must be Started. This starts all the
-// worker and flusher goroutines, etc.
-func (r *Receiver) Start() {
-	doStart(r)
+// worker and flusher goroutines, etc. An error is returned if the
+// Receiver is misconfigured (a *ConfigError for an invalid field) or
+// its database is unreachable, in which case nothing is started.
+func (r *Receiver) Start() error {
+	return doStart(r)
 }
 
 // Stops processing, waits for everything to finish and shuts down all
 // workers/flushers.
 func (r *Receiver) Stop() {
 	r.stopped = true
+	r.Resume() // let go of anyone blocked in Queue*
 	doStop(r, r.cluster)
 }
 
+// ErrPaused is returned by the Queue* methods while the receiver is
+// paused, unless PauseBlocks is set.
+var ErrPaused = fmt.Errorf("receiver is paused")
+
+// ErrReadOnly is returned by the Queue* methods (and others which
+// write) of a read-only receiver, see ReadOnly.
+var ErrReadOnly = fmt.Errorf("receiver is read-only")
+
+// ErrAggregatorDisabled and ErrPacedMetricsDisabled are returned by
+// the Queue* methods of a disabled subsystem, see DisableAggregator.
+var (
+	ErrAggregatorDisabled   = fmt.Errorf("aggregator is disabled")
+	ErrPacedMetricsDisabled = fmt.Errorf("paced metrics are disabled")
+)
+
+// ErrQueueFull is returned by the Queue* methods when the channel
+// stayed full for longer than the wait given with WithMaxWait.
+var ErrQueueFull = fmt.Errorf("receiver queue is full")
+
+// A QueueOption modifies how a Queue* method queues.
+type QueueOption func(*queueOptions)
+
+type queueOptions struct {
+	limited   bool
+	maxWait   time.Duration
+	withCount bool
+	nodeSum   bool
+	source    string          // see WithSource
+	ctx       context.Context // see WithContext
+	tracer    Tracer          // see Receiver.Tracer
+}
+
+// WithMaxWait limits the time a Queue* method waits for the
+// receiver channel to have space to d, after which it gives up and
+// returns ErrQueueFull. Zero means to never wait. Without it, the
+// Queue* methods wait as long as it takes, which slows the caller
+// down when the receiver is busy. This lets e.g. a UDP listener drop
+// data rather than block, while an HTTP handler tolerates some
+// backpressure.
+func WithMaxWait(d time.Duration) QueueOption {
+	return func(o *queueOptions) {
+		o.limited, o.maxWait = true, d
+	}
+}
+
+// WithIncrementCount makes QueueSum and QueueSumInt pass on the
+// number of increments in the pacing interval as well as their sum,
+// the former to the companion DS identified by CountIdent(ident). As
+// with QueueSumCount, the sum divided by the count is then the
+// average increment. It applies to every interval in which an ident
+// is queued with it at least once.
+func WithIncrementCount() QueueOption {
+	return func(o *queueOptions) {
+		o.withCount = true
+	}
+}
+
+// WithClusterSum makes QueueGauge sum the gauge across the cluster,
+// for a gauge which every node measures on its own (e.g. the number
+// of connections to it): rather than pass on its own value as the
+// value of the gauge, every node passes it on to the aggregator
+// along with the node name, and the aggregator (which runs on one
+// node) flushes the sum of the latest value from every node, see
+// ClusterSumWindow. The value of a node is the last one queued in
+// the pacing interval, not the average. It applies to an ident from
+// the first time it is queued, and is not supported by
+// QueueGaugeEWMA. Without a cluster the sum is that of the one node.
+func WithClusterSum() QueueOption {
+	return func(o *queueOptions) {
+		o.nodeSum = true
+	}
+}
+
+// WithSource labels the data points with the ingestion protocol or
+// whatever else they came from, e.g. "graphite_text", which is
+// passed on to the new DS hook if they cause a DS to be created, see
+// SetNewDSHook. It applies to the Queue* methods which queue data
+// points directly, those which go through the aggregator or paced
+// metrics lose the label.
+func WithSource(source string) QueueOption {
+	return func(o *queueOptions) {
+		o.source = source
+	}
+}
+
+func newQueueOptions(opts []QueueOption) queueOptions {
+	var o queueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// queueOptions returns the options along with the tracer of the
+// receiver.
+func (r *Receiver) queueOptions(opts []QueueOption) queueOptions {
+	o := newQueueOptions(opts)
+	o.tracer = r.Tracer
+	return o
+}
+
+func (o queueOptions) noWait() bool { return o.limited && o.maxWait <= 0 }
+
+// timeout returns a channel which fires once the wait is over, nil
+// (i.e. never) if the wait is not limited, and a func to stop the
+// timer.
+func (o queueOptions) timeout() (<-chan time.Time, func() bool) {
+	if !o.limited {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(o.maxWait)
+	return t.C, t.Stop
+}
+
+func (r *Receiver) aggregatorEnabled() bool {
+	return !r.DisableAggregator
+}
+
+func (r *Receiver) pacedMetricsEnabled() bool {
+	return !r.DisableAggregator && !r.DisablePacedMetrics
+}
+
+// Pause stops the receiver from accepting new data: until Resume is
+// called, the Queue* methods return ErrPaused, or, if PauseBlocks is
+// set, block. Everything else keeps running, data already accepted is
+// processed and flushed as usual, and listeners can stay connected.
+// This is meant for brief operational interventions, for which Stop
+// would be too disruptive.
+func (r *Receiver) Pause() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	if atomic.LoadInt32(&r.paused) == 0 {
+		r.resumeCh = make(chan struct{})
+		atomic.StoreInt32(&r.paused, 1)
+	}
+}
+
+// Resume undoes Pause, unblocking any Queue* callers.
+func (r *Receiver) Resume() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	if atomic.LoadInt32(&r.paused) == 1 {
+		atomic.StoreInt32(&r.paused, 0)
+		close(r.resumeCh)
+	}
+}
+
+// Paused tells whether the receiver is paused.
+func (r *Receiver) Paused() bool {
+	return atomic.LoadInt32(&r.paused) == 1
+}
+
+// waitIfPaused returns ErrPaused if the receiver is paused, or, if
+// PauseBlocks is set, waits until it is resumed. A read-only
+// receiver is never resumed, it returns ErrReadOnly.
+func (r *Receiver) waitIfPaused() error {
+	if r.ReadOnly {
+		return ErrReadOnly
+	}
+	for atomic.LoadInt32(&r.paused) == 1 {
+		if !r.PauseBlocks {
+			return ErrPaused
+		}
+		r.pauseMu.Lock()
+		ch := r.resumeCh
+		r.pauseMu.Unlock()
+		if ch != nil {
+			<-ch
+		}
+	}
+	return nil
+}
+
+// Goroutines returns the number of running receiver goroutines,
+// i.e. workers, flushers, the director, the aggregator worker, the
+// paced metric worker, the paced sum coalescer (see
+// PacedSumCoalesce) and the fetchers (see FetchTimeout), not
+// counting their helper goroutines, of which there is a fixed number
+// per each. The receiver does not spawn goroutines dynamically (e.g.
+// per flush, per DS or per timed out fetch), and flushes are never
+// retried in new goroutines, therefore this number does not change
+// while the receiver is running. It is also reported as the
+// receiver.goroutines stat.
+func (r *Receiver) Goroutines() int {
+	return int(atomic.LoadInt32(&r.goroutines))
+}
+
 // In a clustered set up informes other nodes that we are ready to
 // handle data.
 func (r *Receiver) ClusterReady(ready bool) {
 	r.cluster.Ready(ready)
 }
 
+// AggregatorOwner returns the cluster node currently responsible for
+// the aggregator (there is one per cluster). It returns nil if the
+// receiver is not clustered, in which case the aggregator is local,
+// or if the owner is not yet known.
+func (r *Receiver) AggregatorOwner() *cluster.Node {
+	if r.cluster == nil {
+		return nil
+	}
+	nodes := r.cluster.NodesForDistDatum(&distDatumAggregator{})
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// ClusterDistribution returns the idents of the cached DSs by the
+// name of the cluster node currently responsible for each (the first
+// of NodesForDistDatum), sorted, which shows how balanced the cluster
+// is. DSs for which no node is known are listed under "". This only
+// reads the cache and the cluster state, routing is not affected. It
+// returns nil if the receiver is not clustered.
+func (r *Receiver) ClusterDistribution() map[string][]serde.Ident {
+	if r.cluster == nil {
+		return nil
+	}
+	result := make(map[string][]serde.Ident)
+	for _, cds := range r.dsc.all() {
+		var name string
+		if nodes := r.cluster.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: r.dsc}); len(nodes) > 0 {
+			name = nodes[0].Name()
+		}
+		result[name] = append(result[name], cds.Ident())
+	}
+	for _, idents := range result {
+		sort.Sort(identsByString(idents))
+	}
+	return result
+}
+
+type identsByString []serde.Ident
+
+func (s identsByString) Len() int           { return len(s) }
+func (s identsByString) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s identsByString) Less(i, j int) bool { return s[i].String() < s[j].String() }
+
 // Make the receiver clustered. It will also cause internal stats to
 // be prefixed with the node address by setting ReportStatsPrefix.
 func (r *Receiver) SetCluster(c clusterer) {
@@ -192,49 +1087,1308 @@ func (r *Receiver) SetCluster(c clusterer) {
 // always treats incoming data as a rate, it is the responsibility of
 // the caller to present non-rate values such as counters as a
 // rate. Consider using the Aggregator (QueueAggregatorCommand) or
-// paced metrics (QueueSum/QueueGauge) for non-rate data.
-func (r *Receiver) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+// paced metrics (QueueSum/QueueGauge) for non-rate data. While the
+// receiver is paused, this (as all the other Queue* methods) returns
+// ErrPaused or blocks, see Pause. How long to wait while the receiver
+// channel is full can be limited with WithMaxWait.
+func (r *Receiver) QueueDataPoint(ident serde.Ident, ts time.Time, v float64, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
 	if !r.stopped {
-		r.dpCh <- &incomingDP{Ident: ident, TimeStamp: ts, Value: v}
+		return r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: v}, r.queueOptions(opts))
 	}
+	return nil
+}
+
+// QueueDataPointWithExemplar is QueueDataPoint for a sample which is
+// also an exemplar, e.g. one belonging to a trace, whose id would
+// then be among the labels. The labels, the value and the time stamp
+// are kept as the exemplar of the slot the sample falls into (the
+// latest one wins), and saved along with the slot by a SerDe which
+// supports it, see serde.ExemplarFetcher. The labels are not part of
+// the ident, they vary from sample to sample.
+func (r *Receiver) QueueDataPointWithExemplar(ident serde.Ident, ts time.Time, v float64, exemplar map[string]string, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if !r.stopped {
+		return r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: v, Exemplar: exemplar}, r.queueOptions(opts))
+	}
+	return nil
+}
+
+// queueDataPoint is QueueDataPoint regardless of Pause, for data
+// which has already been accepted, e.g. by the paced metric worker.
+func (r *Receiver) queueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	if !r.stopped {
+		r.dpChs.queue(&incomingDP{Ident: ident, TimeStamp: ts, Value: v})
+	}
+}
+
+// tryQueueDataPoint is like QueueDataPoint, except that it does not
+// block when the receiver channel is full, returning false instead.
+// Unlike QueueDataPoint, it can be used while the receiver is
+// stopping, which lets the aggregator flush before the director stops.
+func (r *Receiver) tryQueueDataPoint(ident serde.Ident, ts time.Time, v float64) bool {
+	select {
+	case r.dpChs.forIdent(ident) <- &incomingDP{Ident: ident, TimeStamp: ts, Value: v}:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueueSumCount sends a sum and a count (e.g. as aggregated
+// upstream over an interval) to the receiver channel. The sum is
+// stored in the DS identified by ident, and the count in its
+// companion DS identified by CountIdent(ident), which is created with
+// the same DSSpec as the former. Since both are consolidated the same
+// way, the accurate weighted average over any period is the value of
+// the former divided by the value of the companion. A zero count
+// still updates the companion. If ErrQueueFull is returned, the sum
+// may have been queued without the count.
+func (r *Receiver) QueueSumCount(ident serde.Ident, ts time.Time, sum, count float64, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if !r.stopped {
+		o := r.queueOptions(opts)
+		if err := r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: sum}, o); err != nil {
+			return err
+		}
+		return r.dpChs.send(&incomingDP{Ident: CountIdent(ident), TimeStamp: ts, Value: count, SpecIdent: ident}, o)
+	}
+	return nil
+}
+
+// A DataPoint is a data point of a batch, see QueueDataPoints.
+type DataPoint struct {
+	Ident     serde.Ident
+	TimeStamp time.Time
+	Value     float64
+}
+
+// batchYield is called between the chunks of a batch.
+var batchYield = runtime.Gosched
+
+// QueueDataPoints is the same as calling QueueDataPoint for every
+// point of the batch, in order. Every point goes to the director (and
+// from there the worker) responsible for its ident, like any other,
+// thus a batch spanning many idents is spread across them. Every
+// BatchChunkSize points, the caller yields the processor to let
+// other traffic through. It returns the number of points queued,
+// which is less than len(dps) if an error (e.g. ErrQueueFull with
+// WithMaxWait) occurred.
+func (r *Receiver) QueueDataPoints(dps []DataPoint, opts ...QueueOption) (int, error) {
+	if err := r.waitIfPaused(); err != nil {
+		return 0, err
+	}
+	if r.stopped {
+		return 0, nil
+	}
+	o := r.queueOptions(opts)
+	for i, dp := range dps {
+		if i > 0 && r.BatchChunkSize > 0 && i%r.BatchChunkSize == 0 {
+			batchYield()
+		}
+		if err := r.dpChs.send(&incomingDP{Ident: dp.Ident, TimeStamp: dp.TimeStamp, Value: dp.Value}, o); err != nil {
+			return i, err
+		}
+	}
+	return len(dps), nil
+}
+
+// QueueIntDataPoint is the same as QueueDataPoint for integer
+// values. The value is kept as an integer through the receiver
+// (including when forwarded to another node) and only converted to
+// float64 when it is applied to the DS, the RRD being floating
+// point. This is mostly relevant for counters, see
+// QueueIntCounterWrapped.
+func (r *Receiver) QueueIntDataPoint(ident serde.Ident, ts time.Time, v int64, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if !r.stopped {
+		return r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: float64(v), IsInt: true, IntValue: v}, r.queueOptions(opts))
+	}
+	return nil
+}
+
+// QueueIntCounterWrapped is the same as QueueCounterWrapped for
+// integer counters. The rate is computed from the integer difference
+// of the counter values, which, unlike with float64 values, is exact
+// for counters above 2^53.
+func (r *Receiver) QueueIntCounterWrapped(ident serde.Ident, ts time.Time, value, wrapAt int64, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if !r.stopped {
+		return r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: float64(value), IsInt: true, IntValue: value, IntWrapAt: wrapAt}, r.queueOptions(opts))
+	}
+	return nil
+}
+
+// Sends a counter value to the receiver channel. The counter is
+// expected to be monotonically increasing and to wrap around to zero
+// at wrapAt (e.g. 1<<32 for 32-bit network counters). The receiver
+// keeps the previous value per DS and computes a non-negative rate
+// across wrap boundaries. The first value for a DS is only
+// remembered, it does not produce a data point.
+func (r *Receiver) QueueCounterWrapped(ident serde.Ident, ts time.Time, value, wrapAt float64, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if !r.stopped {
+		return r.dpChs.send(&incomingDP{Ident: ident, TimeStamp: ts, Value: value, WrapAt: wrapAt}, r.queueOptions(opts))
+	}
+	return nil
 }
 
 // Sends a data point (in the form of an aggregator.Command) to the
 // aggregator.
-func (r *Receiver) QueueAggregatorCommand(agg *aggregator.Command) {
-	if !r.stopped {
+func (r *Receiver) QueueAggregatorCommand(agg *aggregator.Command, opts ...QueueOption) error {
+	if !r.aggregatorEnabled() {
+		return ErrAggregatorDisabled
+	}
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if r.stopped {
+		return nil
+	}
+	o := r.queueOptions(opts)
+	select {
+	case r.aggCh <- agg:
+		return nil
+	default:
+		if o.noWait() {
+			return ErrQueueFull
+		}
+	}
+	timeout, stop := o.timeout()
+	defer stop()
+	select {
+	case r.aggCh <- agg:
+		return nil
+	case <-timeout:
+		return ErrQueueFull
+	}
+}
+
+// queueAggregatorCommand is QueueAggregatorCommand regardless of Pause.
+func (r *Receiver) queueAggregatorCommand(agg *aggregator.Command) {
+	if !r.stopped && r.aggregatorEnabled() {
 		r.aggCh <- agg
 	}
 }
 
 // Send a counter/sum. This is a paced metric which will periodically
 // be passed to the aggregator and from the aggregator to the data
-// source as a rate.
-func (r *Receiver) QueueSum(ident serde.Ident, v float64) {
-	if !r.stopped {
-		r.pacedMetricCh <- &pacedMetric{kind: pacedSum, ident: ident, value: v}
+// source as a rate. The values queued within a pacing interval are
+// simply added up, and the sum is passed on once at the end of it
+// (see also WithIncrementCount). The sum is a float64, thus it is
+// exact only up to 2^53, for larger integer counts use QueueSumInt.
+func (r *Receiver) QueueSum(ident serde.Ident, v float64, opts ...QueueOption) error {
+	if !r.pacedMetricsEnabled() {
+		return ErrPacedMetricsDisabled
+	}
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	o := r.queueOptions(opts)
+	return r.sendPacedMetric(&pacedMetric{kind: pacedSum, ident: ident, value: v, withCount: o.withCount}, o)
+}
+
+// QueueSumInt is QueueSum for integer counts, which are summed as
+// int64 over the pacing interval, so that no increment is lost to
+// float64 rounding however large the sum. A sum beyond the range of
+// int64 saturates (and is counted in the
+// receiver.pacedmetric.sum_saturated stat) rather than wrapping
+// around. The aggregator and the DS store float64 values, so the
+// sum passed on is still rounded to 53 bits of precision.
+func (r *Receiver) QueueSumInt(ident serde.Ident, v int64, opts ...QueueOption) error {
+	if !r.pacedMetricsEnabled() {
+		return ErrPacedMetricsDisabled
+	}
+	if err := r.waitIfPaused(); err != nil {
+		return err
 	}
+	o := r.queueOptions(opts)
+	return r.sendPacedMetric(&pacedMetric{kind: pacedSum, ident: ident, isInt: true, intValue: v, withCount: o.withCount}, o)
 }
 
 // Send a gauge (i.e. a rate). This is a paced metric.
-func (r *Receiver) QueueGauge(ident serde.Ident, v float64) {
-	if !r.stopped {
-		r.pacedMetricCh <- &pacedMetric{kind: pacedGauge, ident: ident, value: v}
+func (r *Receiver) QueueGauge(ident serde.Ident, v float64, opts ...QueueOption) error {
+	if !r.pacedMetricsEnabled() {
+		return ErrPacedMetricsDisabled
+	}
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	o := r.queueOptions(opts)
+	pm := &pacedMetric{kind: pacedGauge, ident: ident, value: v, nodeSum: o.nodeSum}
+	if o.nodeSum && r.cluster != nil {
+		pm.node = r.cluster.LocalNode().Name()
+	}
+	return r.sendPacedMetric(pm, o)
+}
+
+// QueueGaugeEWMA sends a gauge which is smoothed with an exponentially
+// weighted moving average rather than averaged over the pacing
+// interval: every value v updates the average to alpha*v +
+// (1-alpha)*average, and the average is passed on at the end of
+// every interval in which it was updated, which suits noisy load
+// average style metrics. The average lives on from one interval to
+// the next. alpha must be in (0, 1], the larger, the less
+// smoothing. An ident should not be used with both QueueGauge and
+// QueueGaugeEWMA, whichever is used first determines which it is.
+func (r *Receiver) QueueGaugeEWMA(ident serde.Ident, v, alpha float64, opts ...QueueOption) error {
+	if !r.pacedMetricsEnabled() {
+		return ErrPacedMetricsDisabled
+	}
+	if alpha <= 0 || alpha > 1 {
+		return fmt.Errorf("QueueGaugeEWMA: alpha must be in (0, 1], got %v", alpha)
+	}
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	return r.sendPacedMetric(&pacedMetric{kind: pacedGauge, ident: ident, value: v, alpha: alpha}, r.queueOptions(opts))
+}
+
+// sendPacedMetric sends a paced metric, waiting as per o.
+func (r *Receiver) sendPacedMetric(pm *pacedMetric, o queueOptions) error {
+	if r.stopped {
+		return nil
+	}
+	if r.coalescePacedMetric(pm) {
+		return nil
+	}
+	select {
+	case r.pacedMetricCh <- pm:
+		return nil
+	default:
+		if o.noWait() {
+			return ErrQueueFull
+		}
+	}
+	timeout, stop := o.timeout()
+	defer stop()
+	select {
+	case r.pacedMetricCh <- pm:
+		return nil
+	case <-timeout:
+		return ErrQueueFull
+	}
+}
+
+// queuePacedMetric sends a paced metric regardless of Pause, which
+// is how internal stats are reported. If paced metrics are disabled
+// or the receiver is read-only, it is dropped.
+func (r *Receiver) queuePacedMetric(pm *pacedMetric) {
+	if !r.stopped && !r.ReadOnly && r.pacedMetricsEnabled() && !r.coalescePacedMetric(pm) {
+		r.pacedMetricCh <- pm
+	}
+}
+
+// coalescePacedMetric adds pm to the coalescer if it is a sum and
+// there is one, it returns false if pm is to be sent as is.
+func (r *Receiver) coalescePacedMetric(pm *pacedMetric) bool {
+	if r.coalescer == nil || pm.kind != pacedSum {
+		return false
+	}
+	if !r.coalescer.add(pm) {
+		r.reportStatCount("receiver.pacedmetric.sum_saturated", 1)
+	}
+	return true
+}
+
+// CurrentPDP returns the value of the Primary Data Point currently
+// being accumulated by the DS identified by ident, i.e. data that
+// has not yet been consolidated into any RRA slot. This is a partial
+// interval value: it covers the time from since to the DS last
+// update, not the whole step. The ok return value is false if the DS
+// is not in the cache or there is no partial data. In a clustered
+// set up only DSs handled by this node have PDP data.
+func (r *Receiver) CurrentPDP(ident serde.Ident) (value float64, since time.Time, ok bool) {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return math.NaN(), time.Time{}, false
+	}
+	return cds.currentPdp()
+}
+
+// Exists returns whether there is a DS identified by ident, first
+// in the cache, then by way of the SerDe if it implements
+// serde.DataSourceExister. Unlike queueing a data point, it has no
+// side effects: nothing is created, fetched into the cache or
+// counted. The ident is subject to the same tag key restrictions as
+// that of an incoming data point (see TagKeyAllowlist and
+// RequiredTagKeys), one which would be rejected does not exist. If
+// the SerDe cannot tell, or fails (which is logged), only the cache
+// is consulted.
+func (r *Receiver) Exists(ident serde.Ident) bool {
+	ident, err := r.dsc.allowedIdent(ident)
+	if err != nil {
+		return false
+	}
+	if r.dsc.getByIdent(ident) != nil {
+		return true
+	}
+	ex, ok := r.dsc.db.(serde.DataSourceExister)
+	if !ok {
+		return false
+	}
+	exists, err := ex.DataSourceExists(ident)
+	if err != nil {
+		log.Printf("Exists: %v", err)
+		return false
+	}
+	return exists
+}
+
+// QueueAnnotation saves a time stamped text event, e.g. a deploy
+// marker, for the series identified by ident, or for no series in
+// particular if ident is empty, see serde.Annotation. Annotations are
+// rare and have nothing to do with the RRAs, thus unlike data points
+// they are not cached, but saved right away by way of the SerDe,
+// which must implement serde.AnnotationStorer. The ident is subject
+// to the same tag key rules as that of a DS (see TagKeyAllowlist and
+// RequiredTagKeys), so that it matches the ident of the series. While
+// the receiver is paused, this returns ErrPaused or blocks, as the
+// other Queue* methods do.
+func (r *Receiver) QueueAnnotation(ident serde.Ident, ts time.Time, text string) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	as, ok := r.dsc.db.(serde.AnnotationStorer)
+	if !ok {
+		return fmt.Errorf("QueueAnnotation: this SerDe cannot store annotations")
+	}
+	if len(ident) > 0 {
+		var err error
+		if ident, err = r.dsc.allowedIdent(ident); err != nil {
+			return fmt.Errorf("QueueAnnotation: %v", err)
+		}
+	}
+	if err := as.StoreAnnotation(serde.Annotation{Ident: ident, TimeStamp: ts, Text: text}); err != nil {
+		return fmt.Errorf("QueueAnnotation: %v", err)
+	}
+	return nil
+}
+
+// FetchAnnotations returns the annotations saved with QueueAnnotation
+// for the series identified by ident, along with the global ones,
+// whose time stamps are within from and to, oldest first. With an
+// empty ident only the global ones are returned.
+func (r *Receiver) FetchAnnotations(ident serde.Ident, from, to time.Time) ([]serde.Annotation, error) {
+	as, ok := r.dsc.db.(serde.AnnotationStorer)
+	if !ok {
+		return nil, fmt.Errorf("FetchAnnotations: this SerDe cannot store annotations")
+	}
+	if len(ident) > 0 {
+		var err error
+		if ident, err = r.dsc.allowedIdent(ident); err != nil {
+			return nil, fmt.Errorf("FetchAnnotations: %v", err)
+		}
+	}
+	result, err := as.FetchAnnotations(ident, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("FetchAnnotations: %v", err)
+	}
+	return result, nil
+}
+
+// SetDSMeta replaces the descriptive metadata (e.g. unit,
+// description, source system) of the DS identified by ident and
+// saves it by way of the SerDe, which must implement
+// serde.DataSourceMetaStorer. Unlike tags, metadata is not part of
+// the ident and does not affect routing. The DS must be cached by
+// this node.
+func (r *Receiver) SetDSMeta(ident serde.Ident, meta map[string]string) error {
+	if r.ReadOnly {
+		return ErrReadOnly
+	}
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return fmt.Errorf("SetDSMeta: unknown data source: %v", ident)
+	}
+	ms, ok := r.dsc.db.(serde.DataSourceMetaStorer)
+	if !ok {
+		return fmt.Errorf("SetDSMeta: this SerDe cannot store metadata")
+	}
+	return ms.SetDataSourceMeta(cds.Id(), meta)
+}
+
+// RenameDS changes the ident of the DS identified by oldIdent to
+// newIdent, in the database as well as in the cache, keeping its
+// data. It fails if there already is a DS identified by newIdent.
+// Data points for oldIdent which were routed to the DS before the
+// rename are applied to it, whereas those arriving while it is in
+// progress wait for it, after which oldIdent is that of a new DS. The
+// SerDe must be a serde.DataSourceRenamer, and since the node
+// handling a DS in a cluster depends on its ident, it cannot be used
+// in a cluster of more than one node.
+func (r *Receiver) RenameDS(oldIdent, newIdent serde.Ident) error {
+	if r.ReadOnly {
+		return ErrReadOnly
+	}
+	if newIdent["name"] == "" {
+		return fmt.Errorf("RenameDS: ident without name tag")
+	}
+	renamer, ok := r.dsc.db.(serde.DataSourceRenamer)
+	if !ok {
+		return fmt.Errorf("RenameDS: this SerDe cannot rename data sources")
+	}
+	if r.cluster != nil && r.cluster.NumMembers() > 1 {
+		return fmt.Errorf("RenameDS: not supported in a cluster")
+	}
+	if err := r.dsc.rename(oldIdent, newIdent, renamer); err != nil {
+		return fmt.Errorf("RenameDS: %v", err)
+	}
+	return nil
+}
+
+// RepairLastUpdate is a repair tool for a DS whose last update, as
+// stored in the database, is wrong (e.g. after a botched migration),
+// which makes subsequent data points land in the wrong slots. The
+// true last update is taken to be the end of the latest slot with
+// data of the finest RRA as stored in the database, which is
+// written back as the last update of the DS (with its PDP
+// discarded) and returned. The DS is then reloaded into the cache:
+// whatever it cached but did not yet flush is discarded, having been
+// applied relative to the wrong last update, and the next data point
+// only counts from the repaired last update. Points time stamped
+// before it are as late as usual. The SerDe must be a
+// serde.DataSourceLastUpdateSetter.
+func (r *Receiver) RepairLastUpdate(ident serde.Ident) (time.Time, error) {
+	if r.ReadOnly {
+		return time.Time{}, ErrReadOnly
+	}
+	setter, ok := r.dsc.db.(serde.DataSourceLastUpdateSetter)
+	if !ok {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: this SerDe cannot set the last update")
+	}
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: unknown data source: %v", ident)
+	}
+
+	// Hold the lock throughout, so that no points are applied
+	// relative to the wrong last update meanwhile.
+	cds.Lock()
+	defer cds.Unlock()
+
+	stored, err := r.dsc.db.FetchDataSourceById(cds.Id())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: %v", err)
+	}
+	if stored == nil {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: data source %v is not in the database", ident)
+	}
+	var finest rrd.RoundRobinArchiver
+	for _, rra := range stored.RRAs() {
+		if finest == nil || rra.Step() < finest.Step() {
+			finest = rra
+		}
+	}
+	if finest == nil || finest.Latest().IsZero() {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: data source %v has no saved RRAs", ident)
+	}
+
+	// With finest as the only RRA, it is what gets fetched.
+	src := stored.Copy()
+	src.SetRRAs([]rrd.RoundRobinArchiver{finest.Copy()})
+	saved, err := recomputeSource(r.dsc.db, src, finest.Begins(finest.Latest()), finest.Latest())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: %v", err)
+	}
+	var lastUpdate time.Time
+	for _, sv := range saved {
+		if !math.IsNaN(sv.Value) && sv.End.After(lastUpdate) {
+			lastUpdate = sv.End
+		}
+	}
+	if lastUpdate.IsZero() {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: no data in the finest RRA of %v", ident)
+	}
+	if err := setter.SetDataSourceLastUpdate(cds.Id(), lastUpdate); err != nil {
+		return time.Time{}, fmt.Errorf("RepairLastUpdate: %v", err)
+	}
+
+	cds.unspillLogged()
+	cds.ClearRRAs(false)
+	cds.SetRRAs(stored.RRAs())
+	cds.SetLastUpdate(lastUpdate)
+	cds.unflushedRT, cds.lastCounterTs, cds.trace = time.Time{}, time.Time{}, nil
+	log.Printf("RepairLastUpdate: the last update of %v is now %v.", ident, lastUpdate)
+	return lastUpdate, nil
+}
+
+// A DSDescription is what DescribeDS returns.
+type DSDescription struct {
+	Id          int64
+	Ident       serde.Ident
+	Step        time.Duration
+	Heartbeat   time.Duration
+	LastUpdate  time.Time
+	Meta        map[string]string // see SetDSMeta
+	OutOfBounds int64             // data points dropped as out of bounds, see MinValue
+	Skewed      int64             // data points time stamped too far ahead, see SkewTolerance
+	Spilled     int               // cached points spilled to disk, see SpillDir
+	RRAs        []RRADescription  // by index, see FetchRRA
+}
+
+// An RRADescription describes an RRA of a DS, see DSDescription.
+type RRADescription struct {
+	Function rrd.Consolidation
+	Step     time.Duration
+	Size     int64     // number of slots
+	Latest   time.Time // end of the latest slot
+}
+
+// DescribeDS returns the parameters and the metadata of the DS
+// identified by ident. Meta is nil if the SerDe does not store
+// metadata. The DS must be cached by this node.
+func (r *Receiver) DescribeDS(ident serde.Ident) (*DSDescription, error) {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return nil, fmt.Errorf("DescribeDS: unknown data source: %v", ident)
+	}
+	cds.Lock()
+	result := &DSDescription{
+		Id:          cds.Id(),
+		Ident:       cds.Ident(),
+		Step:        cds.Step(),
+		Heartbeat:   cds.Heartbeat(),
+		LastUpdate:  cds.LastUpdate(),
+		OutOfBounds: atomic.LoadInt64(&cds.outOfBounds),
+		Skewed:      atomic.LoadInt64(&cds.skewed),
+		Spilled:     cds.spilledPoints,
+	}
+	for _, rra := range cds.RRAs() {
+		result.RRAs = append(result.RRAs, RRADescription{Function: rra.Consolidation(), Step: rra.Step(), Size: rra.Size(), Latest: rra.Latest()})
+	}
+	cds.Unlock()
+	if ms, ok := r.dsc.db.(serde.DataSourceMetaStorer); ok {
+		meta, err := ms.FetchDataSourceMeta(result.Id)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeDS: %v", err)
+		}
+		result.Meta = meta
+	}
+	return result, nil
+}
+
+// CachedDataSource returns a copy of the DS identified by ident as
+// currently cached, including data not yet flushed, or nil if it is
+// not cached. This is mostly useful in tests, see the receivertest
+// package.
+func (r *Receiver) CachedDataSource(ident serde.Ident) serde.DbDataSourcer {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return nil
+	}
+	cds.Lock()
+	defer cds.Unlock()
+	cds.unspillLogged()
+	return cds.Copy().(serde.DbDataSourcer)
+}
+
+// DSFlushStats returns the flush statistics of the DS identified by
+// ident, which is useful when a particular series is slow to flush
+// (e.g. because of a huge RRA). The second return value is false if
+// the DS is not cached or has not been flushed since the receiver
+// started.
+func (r *Receiver) DSFlushStats(ident serde.Ident) (DSFlushStats, bool) {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil || r.flusher == nil {
+		return DSFlushStats{}, false
+	}
+	return r.flusher.flushStats(cds.Id())
+}
+
+// MarkGap sets the slots of the DS identified by ident between from
+// and to to NaN and saves them, so that e.g. a maintenance window
+// shows up as an explicit gap. Only slots up to the latest update of
+// each RRA are affected. Any cached data is flushed first. The DS
+// must be cached (in a cluster, handled) by this node.
+func (r *Receiver) MarkGap(ident serde.Ident, from, to time.Time) error {
+	if r.stopped || len(r.workerChs) == 0 {
+		return fmt.Errorf("MarkGap: receiver is not running")
+	}
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return fmt.Errorf("MarkGap: unknown data source: %v", ident)
+	}
+	return r.workerChs.queueGap(cds, from, to)
+}
+
+// Touch advances the last update of the DS identified by ident to
+// ts without contributing a value (see rrd.DataSource.Touch), e.g. to
+// keep a DS which is known to be quiet but healthy from exceeding its
+// heartbeat, so that its next data point is not treated as following
+// a gap. This is unlike a data point of zero or NaN, the time since
+// the last update is merely unknown. The request is queued to the
+// worker responsible for the DS, thus it is ordered with respect to
+// the data points queued before it. The DS must be cached (in a
+// cluster, handled) by this node.
+func (r *Receiver) Touch(ident serde.Ident, ts time.Time) error {
+	if r.stopped || len(r.workerChs) == 0 {
+		return fmt.Errorf("Touch: receiver is not running")
+	}
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return fmt.Errorf("Touch: unknown data source: %v", ident)
+	}
+	r.workerChs.queueTouch(cds, ts)
+	return nil
+}
+
+// RebalanceWorker hands the DSs of the worker at index (0 to
+// NWorkers-1) over to the other workers, e.g. to relieve a worker
+// which is hot. Queueing to the DSs is held up while the request is
+// queued to the worker, which applies the points queued before it
+// (including any held for ReorderWindow) and flushes the DSs, then
+// each is routed to whichever of the other workers has the fewest
+// DSs. Thus the points of a DS are applied in order, by one worker
+// at a time. The worker is not given any new DSs afterwards, but
+// remains running. It returns the number of DSs moved.
+func (r *Receiver) RebalanceWorker(index int) (int, error) {
+	if r.stopped || len(r.workerChs) == 0 {
+		return 0, fmt.Errorf("RebalanceWorker: receiver is not running")
+	}
+	if index < 0 || index >= len(r.workerChs) {
+		return 0, fmt.Errorf("RebalanceWorker: no such worker: %d", index)
+	}
+	r.rebalanceMu.Lock()
+	defer r.rebalanceMu.Unlock()
+	moves, err := r.dsc.drainWorker(index, len(r.workerChs))
+	if err != nil {
+		return 0, fmt.Errorf("RebalanceWorker: %v", err)
+	}
+	for _, m := range moves {
+		m.cds.route.Lock()
+	}
+	drain := &drainRequest{moves: moves, resp: make(chan int, 1)}
+	r.workerChs[index] <- &incomingDpWithDs{drain: drain}
+	n := <-drain.resp
+	for _, m := range moves {
+		m.cds.setWorker(m.to)
+		m.cds.route.Unlock()
+	}
+	for _, cds := range drain.unflushed {
+		r.workerChs.queueFlush(cds) // the new worker tries again
+	}
+	r.reportStatCount("receiver.workers.rebalanced", float64(n))
+	return n, nil
+}
+
+// FlushAndEvict flushes every cached DS whose ident pred returns true
+// for and removes it from the cache, e.g. to free the memory of the
+// series of a decommissioned host, and returns the number of DSs
+// evicted. Other DSs are not touched. As when a cluster node gives
+// up a DS, the flush waits for the database, and subscribers of an
+// evicted DS see no more points. The DSs remain in the database, a
+// data point for one arriving later fetches it again. A point
+// already queued to a worker when its DS is evicted may be lost. A
+// DS which cannot be flushed right now (MaxFlushRatePerSecond) is
+// not evicted. This walks the whole cache and is meant to be run
+// rarely.
+func (r *Receiver) FlushAndEvict(pred func(serde.Ident) bool) (int, error) {
+	if r.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if r.stopped || len(r.workerChs) == 0 {
+		return 0, fmt.Errorf("FlushAndEvict: receiver is not running")
+	}
+	n := 0
+	for _, cds := range r.dsc.all() {
+		if !pred(cds.Ident()) {
+			continue
+		}
+		cds.Lock()
+		cds.flushMu.Lock() // after any flush in progress, see flushCachedDs
+		cds.unspillLogged()
+		flushed := cds.LastUpdate().IsZero() || r.flusher.flushDs(cds.DbDataSourcer, true)
+		cds.flushMu.Unlock()
+		if !flushed {
+			cds.Unlock()
+			continue
+		}
+		cds.endSubscriptions()
+		cds.Unlock()
+		r.dsc.delete(cds.Ident())
+		n++
+	}
+	r.reportStatCount("receiver.cache.evicted", float64(n))
+	return n, nil
+}
+
+// Recompute rebuilds the RRA at rraIndex of the DS identified by
+// ident from the highest resolution RRA of the DS as stored in the
+// database, using the current consolidation function of the RRA. It
+// is meant for when an RRA was added or its consolidation function
+// changed. See RecomputeFrom.
+func (r *Receiver) Recompute(ident serde.Ident, rraIndex int) error {
+	_, err := r.RecomputeFrom(ident, rraIndex, time.Time{})
+	return err
+}
+
+// RecomputeFrom is like Recompute, but only recomputes the slots
+// after from. The work is done in batches of recomputeBatchSize
+// slots, each of which is applied and saved by the worker responsible
+// for the DS, so that data points of other DSs are not held up for
+// long. It returns the end of the last slot saved, which can be
+// passed as from to resume if it was interrupted by an error. The DS
+// must be cached (in a cluster, handled) by this node.
+func (r *Receiver) RecomputeFrom(ident serde.Ident, rraIndex int, from time.Time) (time.Time, error) {
+	if r.stopped || len(r.workerChs) == 0 {
+		return from, fmt.Errorf("Recompute: receiver is not running")
+	}
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return from, fmt.Errorf("Recompute: unknown data source: %v", ident)
+	}
+
+	cds.Lock()
+	cds.unspillLogged()
+	srcDs := cds.Copy()
+	cds.Unlock()
+
+	rras := srcDs.RRAs()
+	if rraIndex < 0 || rraIndex >= len(rras) {
+		return from, fmt.Errorf("Recompute: no RRA at index %d", rraIndex)
+	}
+	target := rras[rraIndex]
+	var source rrd.RoundRobinArchiver
+	for _, rra := range rras {
+		if rra.Step() < target.Step() && target.Step()%rra.Step() == 0 {
+			if source == nil || rra.Step() < source.Step() {
+				source = rra
+			}
+		}
+	}
+	if source == nil {
+		return from, fmt.Errorf("Recompute: no higher resolution RRA to recompute RRA %d from", rraIndex)
+	}
+	// With the source as the only RRA, it is what gets fetched.
+	srcDs.SetRRAs([]rrd.RoundRobinArchiver{source})
+
+	begin, latest := target.Begins(target.Latest()), target.Latest()
+	if from.After(begin) {
+		begin = from.Truncate(target.Step())
+	}
+	for begin.Before(latest) {
+		end := begin.Add(target.Step() * time.Duration(recomputeBatchSize))
+		if end.After(latest) {
+			end = latest
+		}
+		src, err := recomputeSource(r.serde.Fetcher(), srcDs, begin, end)
+		if err != nil {
+			return begin, err
+		}
+		if err := r.workerChs.queueRecompute(cds, rraIndex, src, source.Step()); err != nil {
+			return begin, err
+		}
+		begin = end
+	}
+	return begin, nil
+}
+
+// FetchRRA returns the slots of the RRA at rraIndex (see
+// DSDescription.RRAs) of the DS identified by ident which end after
+// from and not after to, sorted by time. The slots are as saved in
+// the database, except for those cached and not yet flushed, which
+// take precedence. The PDP of the current slot is not included. Unlike
+// the SerDe FetchSeries, which picks the RRA best suited to the time
+// range, this allows e.g. verifying the consolidation of a particular
+// RRA. A zero to means up to the latest slot. The DS must be cached
+// (in a cluster, handled) by this node.
+func (r *Receiver) FetchRRA(ident serde.Ident, rraIndex int, from, to time.Time) ([]rrd.SlotValue, error) {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return nil, fmt.Errorf("FetchRRA: unknown data source: %v", ident)
+	}
+
+	cds.Lock()
+	cds.unspillLogged()
+	ds := cds.Copy()
+	cds.Unlock()
+
+	rras := ds.RRAs()
+	if rraIndex < 0 || rraIndex >= len(rras) {
+		return nil, fmt.Errorf("FetchRRA: no RRA at index %d", rraIndex)
+	}
+	rra := rras[rraIndex]
+	if to.IsZero() || to.After(rra.Latest()) {
+		to = rra.Latest()
+	}
+	// With rra as the only RRA, it is what gets fetched.
+	ds.SetRRAs([]rrd.RoundRobinArchiver{rra})
+
+	slots := make(map[int64]rrd.SlotValue)
+	saved, err := recomputeSource(r.serde.Fetcher(), ds, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("FetchRRA: %v", err)
+	}
+	for _, sv := range saved {
+		slots[sv.End.UnixNano()] = sv
+	}
+	for n, v := range rra.DPs() {
+		if end := rrd.SlotTime(n, rra.Latest(), rra.Step(), rra.Size()); end.After(from) && !end.After(to) {
+			slots[end.UnixNano()] = rrd.SlotValue{End: end, Value: v}
+		}
+	}
+
+	result := make([]rrd.SlotValue, 0, len(slots))
+	for _, sv := range slots {
+		result = append(result, sv)
+	}
+	sort.Sort(slotsByEnd(result))
+	return result, nil
+}
+
+// slotsByEnd sorts slots by time.
+type slotsByEnd []rrd.SlotValue
+
+func (s slotsByEnd) Len() int           { return len(s) }
+func (s slotsByEnd) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s slotsByEnd) Less(i, j int) bool { return s[i].End.Before(s[j].End) }
+
+// recomputeBatchSize is the number of slots Recompute does at a time.
+var recomputeBatchSize = 256
+
+// recomputeSource returns the slots of the (only) RRA of ds which end
+// after from and not after to, as stored in the database.
+var recomputeSource = func(db serde.Fetcher, ds rrd.DataSourcer, from, to time.Time) ([]rrd.SlotValue, error) {
+	ser, err := db.FetchSeries(ds, from, to, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ser.Close()
+	var result []rrd.SlotValue
+	for ser.Next() {
+		if t := ser.CurrentTime(); t.After(from) && !t.After(to) {
+			result = append(result, rrd.SlotValue{End: t, Value: ser.CurrentValue()})
+		}
+	}
+	return result, nil
+}
+
+// Snapshot writes the state of all the cached DSs, including data
+// not yet flushed to the database, to w. It can be used with
+// RestoreSnapshot to warm up the cache on restart. The snapshot is
+// consistent, every DS is copied while it is locked. It is
+// compressed as per SnapshotCompression. Every DS is a separate
+// checksummed record, so that a snapshot torn by a crash while it
+// was being written can still be restored up to the damage.
+func (r *Receiver) Snapshot(w io.Writer) error {
+	cw, err := compressWriter(w, r.SnapshotCompression)
+	if err != nil {
+		return fmt.Errorf("Snapshot: %v", err)
+	}
+	if _, err := cw.Write(snapshotMagic); err != nil {
+		return fmt.Errorf("Snapshot: %v", err)
+	}
+	for _, ds := range append(r.dsc.copyAll(), nil) { // nil is the end record
+		if err := writeSnapshotRecord(cw, ds); err != nil {
+			return fmt.Errorf("Snapshot: %v", err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("Snapshot: %v", err)
+	}
+	return nil
+}
+
+// RestoreSnapshot loads the DSs written by Snapshot into the
+// cache. It must be called before Start(). Restored DSs take
+// precedence over what is in the database, therefore the snapshot
+// should come from this same node and nothing else should have
+// updated these DSs in the database since it was taken. The records
+// of a torn or corrupt snapshot are restored up to the first bad one,
+// the rest is ignored (and logged).
+func (r *Receiver) RestoreSnapshot(rd io.Reader) error {
+	dr, err := decompressReader(rd)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot: %v", err)
+	}
+	dss, torn, err := readSnapshot(dr)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot: %v", err)
+	}
+	if torn != nil {
+		log.Printf("RestoreSnapshot: WARNING: %v, ignoring the rest.", torn)
+	}
+	for _, ds := range dss {
+		r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+	}
+	log.Printf("RestoreSnapshot: restored %d data sources.", len(dss))
+	return nil
+}
+
+// DeadLetterReason is the reason a data point was rejected.
+type DeadLetterReason int
+
+const (
+	DeadLetterNotFinite     DeadLetterReason = iota // value is NaN
+	DeadLetterTagKey                                // ident has a tag key not in TagKeyAllowlist
+	DeadLetterRateLimited                           // DS creation was rate limited
+	DeadLetterNoSpec                                // no DSSpec matched the ident
+	DeadLetterDbError                               // the DS could not be fetched or created
+	DeadLetterTransit                               // forwarded during a cluster transition and could not be held
+	DeadLetterRejected                              // the DS rejected it, e.g. time stamp before last update or ±Inf
+	DeadLetterLate                                  // older than the last update by more than the late grace of the DS
+	DeadLetterTagKeyMissing                         // ident lacks a tag key in RequiredTagKeys
+	DeadLetterTypeConflict                          // a counter for a DS of values or vice versa, see TypeConflictPolicy
+	DeadLetterFetchTimeout                          // fetching or creating the DS took longer than FetchTimeout
+	DeadLetterOutOfBounds                           // the value is outside of MinValue and MaxValue
+	DeadLetterSkewed                                // time stamped beyond SkewTolerance, with SkewReject
+	DeadLetterCreatePending                         // the DS waited too long to be created, see MaxConcurrentCreates
+)
+
+var deadLetterReasons = []string{"not_finite", "tag_key", "rate_limited", "no_spec", "db_error", "transit", "rejected", "late", "tag_key_missing", "type_conflict", "fetch_timeout", "out_of_bounds", "skewed", "create_pending"}
+
+// String returns the reason as a name suitable e.g. for a stat name.
+func (r DeadLetterReason) String() string {
+	if r < 0 || int(r) >= len(deadLetterReasons) {
+		return fmt.Sprintf("DeadLetterReason(%d)", int(r))
+	}
+	return deadLetterReasons[r]
+}
+
+// A DeadLetter is a data point which was rejected by the receiver.
+type DeadLetter struct {
+	Ident     serde.Ident
+	TimeStamp time.Time
+	Value     float64
+	Reason    DeadLetterReason
+	Err       error // the underlying error, if any
+
+	dp *incomingDP // the original, see Reinject
+}
+
+// SetDeadLetterHandler arranges for fn to be called with every data
+// point which the receiver drops because it cannot be routed or
+// applied, so that such data loss can be monitored (e.g. counted by
+// reason, or a sample logged). Data points not applied by design,
+// such as the first value of a counter, are not passed to fn. It is
+// called from the director and worker goroutines, so it must be
+// quick and not block. It must be called before Start().
+func (r *Receiver) SetDeadLetterHandler(fn func(*DeadLetter)) {
+	r.deadLetterHandler = fn
+}
+
+// SetMemoryPressureHook arranges for fn to be called when the total
+// number of cached points exceeds MaxTotalCachedPoints and the
+// receiver starts flushing early because of it, with the number of
+// cached points and MaxTotalCachedPoints. It is called once every
+// time this happens, not again until the total is back within the
+// budget. Frequent calls mean that the cache is too small to
+// coalesce writes as intended. It is called from a worker goroutine,
+// so it must not block. It must be called before Start().
+func (r *Receiver) SetMemoryPressureHook(fn func(cachedPoints, budget int)) {
+	r.memoryPressureHook = fn
+}
+
+func (r *Receiver) reportDeadLetter(dp *incomingDP, reason DeadLetterReason, err error) {
+	if r != nil && r.deadLetterHandler != nil {
+		orig := *dp
+		r.deadLetterHandler(&DeadLetter{Ident: dp.Ident, TimeStamp: dp.TimeStamp, Value: dp.Value, Reason: reason, Err: err, dp: &orig})
+	}
+}
+
+// Reinject queues the data point of a DeadLetter again, e.g. once
+// the cause of its rejection has been fixed (the DSSpec added, a
+// limit raised). It takes the same path as any other incoming point
+// and is validated again, so it may well be dead-lettered again. The
+// Ident, TimeStamp and Value of dl are used, thus they can be
+// corrected first. A point which was a counter is reinjected as one,
+// whereas a DeadLetter which did not come from the dead letter
+// handler (e.g. decoded from a log) is queued as by QueueDataPoint.
+// The receiver.datapoints.reinjected stat counts the points
+// reinjected.
+func (r *Receiver) Reinject(dl *DeadLetter, opts ...QueueOption) error {
+	if err := r.waitIfPaused(); err != nil {
+		return err
+	}
+	if r.stopped {
+		return nil
+	}
+	var dp incomingDP
+	if dl.dp != nil {
+		dp = *dl.dp
+	}
+	dp.Ident, dp.TimeStamp, dp.Value = dl.Ident, dl.TimeStamp, dl.Value
+	dp.Hops = 0 // it may need forwarding again
+	if err := r.dpChs.send(&dp, r.queueOptions(opts)); err != nil {
+		return err
+	}
+	r.reportStatCount("receiver.datapoints.reinjected", 1)
+	return nil
+}
+
+// SetStalenessHook arranges for fn to be called when a DS which has
+// not received any data points for longer than window becomes stale
+// (nowStale is true), and again when data points resume (nowStale is
+// false). The check is performed every StatFlushDuration, therefore
+// the window should be greater than that. Only DSs cached by this
+// node are checked, and the hook is called from the aggregator
+// worker, so it should not block. It must be called before Start().
+func (r *Receiver) SetStalenessHook(window time.Duration, fn func(ident serde.Ident, nowStale bool)) {
+	r.stalenessWindow = window
+	r.stalenessHook = fn
+}
+
+// SetNewDSHook arranges for fn to be called for every DS which a data
+// point caused to be added to the cache of this node, i.e. created in
+// the database, or fetched from it if it was neither preloaded nor
+// cached since (e.g. it was created by another node, or evicted). The
+// hook gets the ident and the source of the data point as given with
+// WithSource, empty if none, e.g. to count new series by ingestion
+// protocol. It is called by the director creating the DS, so it
+// should not block. It must be called before Start().
+func (r *Receiver) SetNewDSHook(fn func(ident serde.Ident, source string)) {
+	r.newDSHook = fn
+}
+
+// checkStaleness calls the staleness hook for every DS whose
+// staleness changed.
+func (r *Receiver) checkStaleness(now time.Time) {
+	if r == nil || r.stalenessHook == nil {
+		return
+	}
+	for _, cds := range r.dsc.all() {
+		if stale, changed := cds.updateStale(now, r.stalenessWindow); changed {
+			r.stalenessHook(cds.Ident(), stale)
+		}
+	}
+}
+
+// SetStepUpHook arranges for fn to be called when the data points of
+// a DS have consistently been arriving at least twice per step, i.e.
+// the DS is under-resolved: when the average interval between them
+// has been at most half the step for periods consecutive checks. The
+// hook gets the step of the DS and the observed interval, e.g. to
+// alert or to add a DSSpec with a finer step. It is called once,
+// and again only if the rate dropped in between. The step of an
+// existing DS cannot change, its RRAs would have to be recreated,
+// thus a finer DSSpec only applies to DSs created with it, e.g. after
+// the DS is deleted or under a new name. Like the staleness check,
+// the check is performed every StatFlushDuration by the aggregator
+// worker, only DSs cached by this node are checked, and fn should not
+// block. It must be called before Start().
+func (r *Receiver) SetStepUpHook(periods int, fn func(ident serde.Ident, step, interval time.Duration)) {
+	r.stepUpPeriods = periods
+	r.stepUpHook = fn
+}
+
+// OldestUnflushedAge returns how long ago the oldest data point
+// still waiting in the cache to be flushed (by a periodic flush) was
+// processed, across all the DSs cached by this node, 0 if there is
+// none. This is the age of the cache, not of the data in the
+// database: points handed to the flushers are not counted, however
+// long the database takes to write them. If it is much over
+// MaxCacheDuration, the workers are not flushing as often as
+// configured, e.g. because of MaxFlushRatePerSecond. It is also
+// reported every StatFlushDuration as the
+// receiver.cache.oldest_unflushed_age gauge, in seconds.
+func (r *Receiver) OldestUnflushedAge() time.Duration {
+	return r.oldestUnflushedAge(time.Now())
+}
+
+func (r *Receiver) oldestUnflushedAge(now time.Time) time.Duration {
+	var oldest time.Duration
+	if r == nil || r.dsc == nil {
+		return 0
+	}
+	for _, cds := range r.dsc.all() {
+		if age := cds.unflushedAge(now); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// flushesDropped returns the number of flushes dropped so far by the
+// serde Flusher rather than passed on (see serde.FlushDropper), e.g.
+// by a rate limited whisper export lagging too far behind.
+func (r *Receiver) flushesDropped() int64 {
+	if r == nil || r.flusher == nil {
+		return 0
+	}
+	if fd, ok := r.flusher.flusher().(serde.FlushDropper); ok {
+		return fd.Dropped()
+	}
+	return 0
+}
+
+// checkStepUp calls the step up hook for every DS which qualifies.
+func (r *Receiver) checkStepUp(now time.Time) {
+	if r == nil || r.stepUpHook == nil {
+		return
+	}
+	for _, cds := range r.dsc.all() {
+		if interval, propose := cds.updateStepUp(now, r.stepUpPeriods); propose {
+			r.stepUpHook(cds.Ident(), cds.Step(), interval)
+		}
 	}
 }
 
 // Reporting internal to Tgres: count
 func (r *Receiver) reportStatCount(name string, f float64) {
+	if r != nil && r.CollectStats && f != 0 {
+		r.collected.count(name, f)
+	}
 	if r != nil && r.ReportStats && f != 0 {
-		r.QueueSum(serde.Ident{"name": r.ReportStatsPrefix + "." + name}, f)
+		r.queuePacedMetric(&pacedMetric{kind: pacedSum, ident: serde.Ident{"name": r.ReportStatsPrefix + "." + name}, value: f})
 	}
 }
 
 // Reporting internal to Tgres: gauge
 func (r *Receiver) reportStatGauge(name string, f float64) {
+	if r != nil && r.CollectStats {
+		r.collected.gauge(name, f)
+	}
 	if r != nil && r.ReportStats {
-		r.QueueGauge(serde.Ident{"name": r.ReportStatsPrefix + "." + name}, f)
+		r.queuePacedMetric(&pacedMetric{kind: pacedGauge, ident: serde.Ident{"name": r.ReportStatsPrefix + "." + name}, value: f})
+	}
+}
+
+// collectedStats are the internal stats kept in memory.
+type collectedStats struct {
+	sync.Mutex
+	values map[string]float64
+	counts map[string]bool // names of the values which are counts
+}
+
+func (c *collectedStats) count(name string, f float64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]bool)
+	}
+	c.values[name] += f
+	c.counts[name] = true
+}
+
+func (c *collectedStats) gauge(name string, f float64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[name] = f
+}
+
+// InternalStats returns a copy of the internal stats collected so far
+// (see CollectStats) by name, without ReportStatsPrefix. A count is
+// the total since the receiver was created, a gauge is the last
+// value reported.
+func (r *Receiver) InternalStats() map[string]float64 {
+	r.collected.Lock()
+	defer r.collected.Unlock()
+	result := make(map[string]float64, len(r.collected.values))
+	for name, f := range r.collected.values {
+		result[name] = f
+	}
+	return result
+}
+
+// InternalStatCounts returns the names of the internal stats (see
+// InternalStats) which are counts, the others are gauges.
+func (r *Receiver) InternalStatCounts() map[string]bool {
+	r.collected.Lock()
+	defer r.collected.Unlock()
+	result := make(map[string]bool, len(r.collected.counts))
+	for name := range r.collected.counts {
+		result[name] = true
 	}
+	return result
+}
+
+// ListenerStats reports the counters of a protocol listener as
+// internal stats named "listener.<proto>.<counter>", so that e.g. a
+// parse error problem with one protocol can be told apart from a
+// slowdown of the whole receiver. It is safe for concurrent use.
+type ListenerStats struct {
+	r     *Receiver
+	proto string
+	conns int32
+}
+
+// ListenerStats returns a ListenerStats for the protocol proto,
+// e.g. "graphite_text". A Receiver keeps no track of these, every
+// listener should get its own.
+func (r *Receiver) ListenerStats(proto string) *ListenerStats {
+	return &ListenerStats{r: r, proto: proto}
+}
+
+// Proto returns the protocol of the listener, e.g. for WithSource.
+func (s *ListenerStats) Proto() string {
+	return s.proto
+}
+
+func (s *ListenerStats) statName(counter string) string {
+	return "listener." + s.proto + "." + counter
+}
+
+// ConnOpened increments the active connections gauge.
+func (s *ListenerStats) ConnOpened() {
+	s.r.reportStatGauge(s.statName("connections"), float64(atomic.AddInt32(&s.conns, 1)))
+}
+
+// ConnClosed decrements the active connections gauge.
+func (s *ListenerStats) ConnClosed() {
+	s.r.reportStatGauge(s.statName("connections"), float64(atomic.AddInt32(&s.conns, -1)))
+}
+
+// Connections returns the number of active connections.
+func (s *ListenerStats) Connections() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+// BytesRead counts n bytes read.
+func (s *ListenerStats) BytesRead(n int) {
+	s.r.reportStatCount(s.statName("bytes_read"), float64(n))
+}
+
+// ParseError counts a packet (or line) which could not be parsed.
+func (s *ListenerStats) ParseError() {
+	s.r.reportStatCount(s.statName("parse_errors"), 1)
+}
+
+// Rejected counts a connection (or packet) refused because of its
+// source address.
+func (s *ListenerStats) Rejected() {
+	s.r.reportStatCount(s.statName("rejected"), 1)
+}
+
+// Ignored counts a packet (or line) which was well formed but
+// carried no data, e.g. a syslog message without metrics.
+func (s *ListenerStats) Ignored() {
+	s.r.reportStatCount(s.statName("ignored"), 1)
+}
+
+// PointsAccepted counts n data points passed on to the receiver.
+func (s *ListenerStats) PointsAccepted(n int) {
+	s.r.reportStatCount(s.statName("points_accepted"), float64(n))
+}
+
+// internalQueuer queues data regardless of Pause, for receiver
+// internals which pass on data that has already been accepted.
+type internalQueuer struct{ r *Receiver }
+
+func (q internalQueuer) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	q.r.queueDataPoint(ident, ts, v)
+}
+
+func (q internalQueuer) QueueAggregatorCommand(agg *aggregator.Command) {
+	q.r.queueAggregatorCommand(agg)
 }
 
 type dataPointQueuer interface {
@@ -248,6 +2402,7 @@ type aggregatorCommandQueuer interface {
 type statReporter interface {
 	reportStatCount(string, float64)
 	reportStatGauge(string, float64)
+	reportDeadLetter(*incomingDP, DeadLetterReason, error)
 }
 
 type clusterer interface {
@@ -255,6 +2410,7 @@ type clusterer interface {
 	NumMembers() int
 	LoadDistData(func() ([]cluster.DistDatum, error)) error
 	NodesForDistDatum(cluster.DistDatum) []*cluster.Node
+	LeaseHolder(cluster.DistDatum) *cluster.Node
 	LocalNode() *cluster.Node
 	NotifyClusterChanges() chan bool
 	Transition(time.Duration) error
@@ -17,18 +17,25 @@ package receiver
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"log"
+	"math"
 	"net"
 	"os"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 // init sets debug
@@ -40,16 +47,38 @@ func Test_Receiver_init(t *testing.T) {
 
 func Test_Receiver_New(t *testing.T) {
 	db := &fakeSerde{}
-	r := New(db, nil)
-	if r.NWorkers != 4 || r.ReportStatsPrefix != "tgres" {
-		t.Errorf(`New: r.NWorkers != 4 (%d) || r.ReportStatsPrefix != "tgres" (%s)`, r.NWorkers, r.ReportStatsPrefix)
+	r, err := New(db, nil)
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	if r.NWorkers != DefaultNWorkers() || r.ReportStatsPrefix != "tgres" {
+		t.Errorf(`New: r.NWorkers != DefaultNWorkers() (%d) || r.ReportStatsPrefix != "tgres" (%s)`, r.NWorkers, r.ReportStatsPrefix)
+	}
+	if err := checkConfig(r); err != nil {
+		t.Errorf("New: the defaults should be a valid config: %v", err)
+	}
+
+	if _, err := New(nil, nil); err != ErrNoSerDe {
+		t.Errorf("New: expected ErrNoSerDe for a nil SerDe, got %v", err)
+	}
+}
+
+func Test_DefaultNWorkers(t *testing.T) {
+	save := runtime.GOMAXPROCS(64)
+	defer runtime.GOMAXPROCS(save)
+	if n := DefaultNWorkers(); n != MaxDefaultNWorkers {
+		t.Errorf("DefaultNWorkers: expected %d with 64 CPUs, got %d", MaxDefaultNWorkers, n)
+	}
+	runtime.GOMAXPROCS(2)
+	if n := DefaultNWorkers(); n != 2 {
+		t.Errorf("DefaultNWorkers: expected 2 with 2 CPUs, got %d", n)
 	}
 }
 
 func Test_Receiver_Start(t *testing.T) {
 	save := doStart
 	called := 0
-	doStart = func(_ *Receiver) { called++ }
+	doStart = func(_ *Receiver) error { called++; return nil }
 	(*Receiver)(nil).Start()
 	if called != 1 {
 		t.Errorf("Receiver.Start: called != 1")
@@ -78,6 +107,23 @@ func Test_Receiver_ClusterReady(t *testing.T) {
 	}
 }
 
+func Test_Receiver_AggregatorOwner(t *testing.T) {
+	r := &Receiver{}
+	if r.AggregatorOwner() != nil {
+		t.Errorf("AggregatorOwner: not clustered, expected nil")
+	}
+	c := &fakeCluster{}
+	r.cluster = c
+	if r.AggregatorOwner() != nil {
+		t.Errorf("AggregatorOwner: no nodes, expected nil")
+	}
+	node := &cluster.Node{Node: &memberlist.Node{Addr: net.ParseIP("10.10.10.10")}}
+	c.nodesForDd = []*cluster.Node{node}
+	if r.AggregatorOwner() != node {
+		t.Errorf("AggregatorOwner: expected node %v", node)
+	}
+}
+
 func Test_Receiver_SetCluster(t *testing.T) {
 	c := &fakeCluster{}
 	c.ln = &cluster.Node{Node: &memberlist.Node{Addr: net.ParseIP("10.10.10.10")}}
@@ -96,10 +142,10 @@ func Test_Receiver_SetCluster(t *testing.T) {
 }
 
 func Test_Receiver_QueueDataPoint(t *testing.T) {
-	r := &Receiver{dpCh: make(chan *IncomingDP)}
+	r := &Receiver{dpChs: directorChannels{make(chan *IncomingDP)}}
 	called := 0
 	go func() {
-		<-r.dpCh
+		<-r.dpChs[0]
 		called++
 	}()
 	r.QueueDataPoint("", time.Time{}, 0)
@@ -108,6 +154,143 @@ func Test_Receiver_QueueDataPoint(t *testing.T) {
 	}
 }
 
+func Test_Receiver_QueueCounterWrapped(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP)}}
+	var dp *incomingDP
+	done := make(chan bool)
+	go func() {
+		dp = <-r.dpChs[0]
+		done <- true
+	}()
+	r.QueueCounterWrapped(serde.Ident{"name": "foo"}, time.Unix(1000, 0), 123, 1<<32)
+	<-done
+	if dp.Value != 123 || dp.WrapAt != 1<<32 {
+		t.Errorf("QueueCounterWrapped: Value or WrapAt not set: %#v", dp)
+	}
+}
+
+func Test_Receiver_QueueSumCount(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP, 2)}}
+	foo := serde.Ident{"name": "foo", "host": "a"}
+	r.QueueSumCount(foo, time.Unix(1000, 0), 30, 3)
+	sum, count := <-r.dpChs[0], <-r.dpChs[0]
+	if !reflect.DeepEqual(sum.Ident, foo) || sum.Value != 30 || sum.SpecIdent != nil {
+		t.Errorf("QueueSumCount: unexpected sum data point: %#v", sum)
+	}
+	expect := serde.Ident{"name": "foo.count", "host": "a"}
+	if !reflect.DeepEqual(count.Ident, expect) || count.Value != 3 || !reflect.DeepEqual(count.SpecIdent, foo) {
+		t.Errorf("QueueSumCount: unexpected count data point: %#v", count)
+	}
+	if foo["name"] != "foo" {
+		t.Errorf("CountIdent: the original ident should not be modified")
+	}
+}
+
+func Test_Receiver_QueueIntDataPoint(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP)}}
+	var dp *incomingDP
+	done := make(chan bool)
+	go func() {
+		dp = <-r.dpChs[0]
+		done <- true
+	}()
+	big := int64(1<<53 + 1) // not representable as float64
+	r.QueueIntDataPoint(serde.Ident{"name": "foo"}, time.Unix(1000, 0), big)
+	<-done
+	if !dp.IsInt || dp.IntValue != big || dp.IntWrapAt != 0 {
+		t.Errorf("QueueIntDataPoint: IsInt or IntValue not set: %#v", dp)
+	}
+
+	go func() {
+		dp = <-r.dpChs[0]
+		done <- true
+	}()
+	r.QueueIntCounterWrapped(serde.Ident{"name": "foo"}, time.Unix(1000, 0), big, 1<<62)
+	<-done
+	if !dp.IsInt || dp.IntValue != big || dp.IntWrapAt != 1<<62 {
+		t.Errorf("QueueIntCounterWrapped: IntValue or IntWrapAt not set: %#v", dp)
+	}
+}
+
+func Test_Receiver_Pause(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP, 1)}}
+	foo := serde.Ident{"name": "foo"}
+
+	r.Pause()
+	r.Pause() // noop
+	if !r.Paused() {
+		t.Errorf("Pause: not paused")
+	}
+	if err := r.QueueDataPoint(foo, time.Unix(1000, 0), 1); err != ErrPaused {
+		t.Errorf("QueueDataPoint: expected ErrPaused, got %v", err)
+	}
+	if len(r.dpChs[0]) != 0 {
+		t.Errorf("QueueDataPoint: data point queued while paused")
+	}
+	r.Resume()
+	r.Resume() // noop
+	if err := r.QueueDataPoint(foo, time.Unix(1000, 0), 1); err != nil || len(r.dpChs[0]) != 1 {
+		t.Errorf("QueueDataPoint: expected a queued data point after Resume, got %v", err)
+	}
+	<-r.dpChs[0]
+
+	// with PauseBlocks, Queue* waits for Resume
+	r.PauseBlocks = true
+	r.Pause()
+	done := make(chan error)
+	go func() { done <- r.QueueDataPoint(foo, time.Unix(1000, 0), 1) }()
+	select {
+	case <-done:
+		t.Errorf("QueueDataPoint: did not block while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	r.Resume()
+	if err := <-done; err != nil || len(r.dpChs[0]) != 1 {
+		t.Errorf("QueueDataPoint: expected a queued data point after Resume, got %v", err)
+	}
+}
+
+func Test_Receiver_DisableAggregator(t *testing.T) {
+	// unbuffered, anything queued would block
+	r := &Receiver{aggCh: make(chan *aggregator.Command), pacedMetricCh: make(chan *pacedMetric), ReportStats: true}
+	foo := serde.Ident{"name": "foo"}
+
+	r.DisablePacedMetrics = true
+	if err := r.QueueSum(foo, 1); err != ErrPacedMetricsDisabled {
+		t.Errorf("QueueSum: expected ErrPacedMetricsDisabled, got %v", err)
+	}
+	if err := r.QueueGauge(foo, 1); err != ErrPacedMetricsDisabled {
+		t.Errorf("QueueGauge: expected ErrPacedMetricsDisabled, got %v", err)
+	}
+	r.reportStatCount("foo", 1) // dropped
+
+	r.DisablePacedMetrics, r.DisableAggregator = false, true
+	if err := r.QueueAggregatorCommand(nil); err != ErrAggregatorDisabled {
+		t.Errorf("QueueAggregatorCommand: expected ErrAggregatorDisabled, got %v", err)
+	}
+	if err := r.QueueSum(foo, 1); err != ErrPacedMetricsDisabled {
+		t.Errorf("QueueSum: with the aggregator disabled, expected ErrPacedMetricsDisabled, got %v", err)
+	}
+
+	started := 0
+	saveAW, savePMW := aggWorker, pacedMetricWorker
+	aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration time.Duration, statsNamePrefix string, scr statReporter, dpq *Receiver) {
+		started++
+	}
+	pacedMetricWorker = func(wc wController, pacedMetricCh chan *pacedMetric, acq aggregatorCommandQueuer, dpq dataPointQueuer, frequency time.Duration, sr statReporter) {
+		started++
+	}
+	var startWg sync.WaitGroup
+	startAggWorker(r, &startWg)
+	startPacedMetricWorker(r, &startWg)
+	startWg.Wait()
+	time.Sleep(5 * time.Millisecond)
+	if started != 0 {
+		t.Errorf("DisableAggregator: expected no goroutines to be started, got %d", started)
+	}
+	aggWorker, pacedMetricWorker = saveAW, savePMW
+}
+
 func Test_Receiver_QueueAggregatorCommand(t *testing.T) {
 	r := &Receiver{aggCh: make(chan *aggregator.Command)}
 	called := 0
@@ -121,6 +304,556 @@ func Test_Receiver_QueueAggregatorCommand(t *testing.T) {
 	}
 }
 
+func Test_Receiver_CurrentPDP(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+
+	foo := serde.Ident{"name": "foo"}
+	if _, _, ok := r.CurrentPDP(foo); ok {
+		t.Errorf("CurrentPDP: unknown DS should not be ok")
+	}
+
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+	if _, _, ok := r.CurrentPDP(foo); ok {
+		t.Errorf("CurrentPDP: DS without data should not be ok")
+	}
+
+	// DftDSSPec step is 10s
+	ds.ProcessDataPoint(100, time.Unix(1000, 0))
+	ds.ProcessDataPoint(100, time.Unix(1005, 0))
+	value, since, ok := r.CurrentPDP(foo)
+	if !ok || value != 100 || !since.Equal(time.Unix(1000, 0)) {
+		t.Errorf("CurrentPDP: expected 100, %v, true, got %v, %v, %v", time.Unix(1000, 0), value, since, ok)
+	}
+}
+
+func Test_Receiver_SnapshotTorn(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+	for i, name := range []string{"foo", "bar"} {
+		ds := serde.NewDbDataSource(int64(i+1), serde.Ident{"name": name}, rrd.NewDataSource(rrd.DSSpec{Step: 10 * time.Second}))
+		r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+	}
+	var buf bytes.Buffer
+	if err := r.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	full := buf.Bytes()
+
+	restored := func(data []byte) int {
+		r2 := &Receiver{dsc: newDsCache(nil, nil, nil)}
+		if err := r2.RestoreSnapshot(bytes.NewReader(data)); err != nil {
+			t.Fatalf("RestoreSnapshot: %v", err)
+		}
+		return len(r2.dsc.all())
+	}
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	if n := restored(full); n != 2 {
+		t.Errorf("RestoreSnapshot: expected 2 DSs, got %d", n)
+	}
+	// Without the end record and some of the last record
+	if n := restored(full[:len(full)-8-5]); n != 1 {
+		t.Errorf("RestoreSnapshot: expected 1 DS from a torn snapshot, got %d", n)
+	}
+	if !strings.Contains(logBuf.String(), "torn record") {
+		t.Errorf("RestoreSnapshot: expected the torn record to be logged, got %q", logBuf.String())
+	}
+	// Corrupt the last record
+	corrupt := append([]byte(nil), full...)
+	corrupt[len(corrupt)-8-5] ^= 0xff
+	if n := restored(corrupt); n != 1 {
+		t.Errorf("RestoreSnapshot: expected 1 DS from a corrupt snapshot, got %d", n)
+	}
+	if !strings.Contains(logBuf.String(), "checksum mismatch") {
+		t.Errorf("RestoreSnapshot: expected the checksum mismatch to be logged, got %q", logBuf.String())
+	}
+
+	// An earlier version snapshot without checksums
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(r.dsc.copyAll()); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if n := restored(buf.Bytes()); n != 2 {
+		t.Errorf("RestoreSnapshot: expected 2 DSs from an earlier version snapshot, got %d", n)
+	}
+}
+
+func Test_Receiver_Snapshot(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+
+	foo := serde.Ident{"name": "foo"}
+	rra, _ := serde.NewDbRoundRobinArchive(2, 10, rrd.RRASpec{Step: 10 * time.Second, Span: 100 * time.Second})
+	ds := serde.NewDbDataSource(1, foo, rrd.NewDataSource(rrd.DSSpec{Step: 10 * time.Second}))
+	ds.SetRRAs([]rrd.RoundRobinArchiver{rra})
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	ds.ProcessDataPoint(2, time.Unix(1025, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+
+	var buf bytes.Buffer
+	if err := r.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	r2 := &Receiver{dsc: newDsCache(nil, nil, nil)}
+	if err := r2.RestoreSnapshot(&buf); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	cds := r2.dsc.getByIdent(foo)
+	if cds == nil {
+		t.Fatalf("RestoreSnapshot: DS not restored")
+	}
+	if !reflect.DeepEqual(cds.DbDataSourcer, ds) {
+		t.Errorf("RestoreSnapshot: restored DS differs: %#v != %#v", cds.DbDataSourcer, ds)
+	}
+	if _, ok := cds.RRAs()[0].(serde.DbRoundRobinArchiver); !ok {
+		t.Errorf("RestoreSnapshot: RRA is not a serde.DbRoundRobinArchiver")
+	}
+
+	if err := r2.RestoreSnapshot(strings.NewReader("garbage")); err == nil {
+		t.Errorf("RestoreSnapshot: expected an error on garbage input")
+	}
+
+	// Compressed, the compression is detected on restore
+	r.SnapshotCompression = "gzip"
+	buf.Reset()
+	if err := r.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot (gzip): %v", err)
+	}
+	if b := buf.Bytes(); len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		t.Errorf("Snapshot (gzip): not gzip compressed")
+	}
+	r3 := &Receiver{dsc: newDsCache(nil, nil, nil)}
+	if err := r3.RestoreSnapshot(&buf); err != nil {
+		t.Fatalf("RestoreSnapshot (gzip): %v", err)
+	}
+	if cds := r3.dsc.getByIdent(foo); cds == nil || !reflect.DeepEqual(cds.DbDataSourcer, ds) {
+		t.Errorf("RestoreSnapshot (gzip): DS not restored correctly")
+	}
+
+	r.SnapshotCompression = "bogus"
+	if err := r.Snapshot(&buf); err == nil {
+		t.Errorf("Snapshot: expected an error on unknown compression")
+	}
+}
+
+func Test_Receiver_FlushAndEvict(t *testing.T) {
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	r := &Receiver{dsc: newDsCache(nil, nil, dsf), flusher: dsf}
+	byHost := func(host string) func(serde.Ident) bool {
+		return func(ident serde.Ident) bool { return ident["host"] == host }
+	}
+	if _, err := r.FlushAndEvict(byHost("a")); err == nil {
+		t.Errorf("FlushAndEvict: expected an error when not running")
+	}
+	r.workerChs = workerChannels{make(chan *incomingDpWithDs)}
+
+	for i, ident := range []serde.Ident{{"name": "foo", "host": "a"}, {"name": "bar", "host": "a"}, {"name": "foo", "host": "b"}} {
+		ds := serde.NewDbDataSource(int64(i+1), ident, rrd.NewDataSource(rrd.DSSpec{
+			Step: 10 * time.Second,
+			RRAs: []rrd.RRASpec{{Step: 10 * time.Second, Span: 10 * time.Minute}},
+		}))
+		ds.ProcessDataPoint(1, time.Unix(1000, 0))
+		r.dsc.insert(newCachedDs(ds, nil))
+	}
+
+	n, err := r.FlushAndEvict(byHost("a"))
+	if err != nil || n != 2 {
+		t.Errorf("FlushAndEvict: expected 2 DSs evicted, got %d (%v)", n, err)
+	}
+	if dsf.called != 2 {
+		t.Errorf("FlushAndEvict: expected 2 flushes, got %d", dsf.called)
+	}
+	if r.dsc.getByIdent(serde.Ident{"name": "foo", "host": "a"}) != nil || r.dsc.getByIdent(serde.Ident{"name": "foo", "host": "b"}) == nil {
+		t.Errorf("FlushAndEvict: expected only the DSs of host a to be evicted")
+	}
+
+	// Not evicted if it cannot be flushed
+	dsf.fdsReturn = false
+	if n, _ := r.FlushAndEvict(byHost("b")); n != 0 || r.dsc.getByIdent(serde.Ident{"name": "foo", "host": "b"}) == nil {
+		t.Errorf("FlushAndEvict: a DS which could not be flushed should stay cached, got %d evicted", n)
+	}
+}
+
+// blockingTracer holds up the first span until release is closed.
+type blockingTracer struct {
+	started, release chan bool
+}
+
+func (t *blockingTracer) StartSpan(context.Context, string, serde.Ident) Span {
+	if t.started != nil {
+		close(t.started)
+		t.started = nil
+		<-t.release
+	}
+	return noopSpan{}
+}
+
+func Test_Receiver_FlushAndEvict_periodicFlush(t *testing.T) {
+	// An unbuffered channel read only below stands for a slow database
+	f := &dsFlusher{db: &fakeSerde{}, sr: &fakeSr{}, flusherChs: flusherChannels{make(chan *dsFlushRequest)}}
+	r := &Receiver{dsc: newDsCache(nil, nil, f), flusher: f, workerChs: workerChannels{make(chan *incomingDpWithDs)}}
+	ds := serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	cds := newCachedDs(ds, nil)
+	cds.ProcessDataPoint(1, time.Unix(1000, 0))
+	r.dsc.insert(cds)
+
+	// A periodic flush copies the DS and is held up before queueing
+	// the copy, in the meantime the DS gets a newer point and is
+	// evicted.
+	tr := &blockingTracer{started: make(chan bool), release: make(chan bool)}
+	started := tr.started
+	cds.trace = &dpTrace{tracer: tr, ctx: context.Background()}
+	go f.flushCachedDs(cds)
+	<-started
+	cds.Lock()
+	cds.ProcessDataPoint(1, time.Unix(1010, 0))
+	cds.Unlock()
+
+	evicted := make(chan int)
+	go func() {
+		n, _ := r.FlushAndEvict(func(serde.Ident) bool { return true })
+		evicted <- n
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(tr.release)
+
+	// The later copy must not be queued (thus written) first
+	for _, lu := range []int64{1000, 1010} {
+		fr := <-f.flusherChs[0]
+		if !fr.ds.LastUpdate().Equal(time.Unix(lu, 0)) {
+			t.Errorf("FlushAndEvict: expected the copy as of %d queued, got %v", lu, fr.ds.LastUpdate().Unix())
+		}
+		if fr.resp != nil {
+			fr.resp <- true
+		}
+	}
+	if n := <-evicted; n != 1 {
+		t.Errorf("FlushAndEvict: expected 1 DS evicted, got %d", n)
+	}
+}
+
+func Test_Receiver_Recompute(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil), serde: &fakeSerde{}}
+
+	foo := serde.Ident{"name": "foo"}
+	if err := r.Recompute(foo, 1); err == nil {
+		t.Errorf("Recompute: expected an error when not running")
+	}
+
+	workerCh := make(chan *incomingDpWithDs)
+	r.workerChs = workerChannels{workerCh}
+	if err := r.Recompute(foo, 1); err == nil {
+		t.Errorf("Recompute: expected an error for an unknown DS")
+	}
+
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs: []rrd.RRASpec{
+			{Step: 10 * time.Second, Span: 10 * time.Minute},
+			{Step: time.Minute, Span: 10 * time.Minute},
+		},
+	}))
+	ds.ProcessDataPoint(1, time.Unix(5, 0))
+	ds.ProcessDataPoint(1, time.Unix(600, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+
+	if err := r.Recompute(foo, 0); err == nil {
+		t.Errorf("Recompute: expected an error when there is no higher resolution RRA")
+	}
+
+	saveSource, saveBatchSize := recomputeSource, recomputeBatchSize
+	defer func() { recomputeSource, recomputeBatchSize = saveSource, saveBatchSize }()
+	recomputeBatchSize = 4
+	var fetched []time.Time
+	recomputeSource = func(db serde.Fetcher, ds rrd.DataSourcer, from, to time.Time) ([]rrd.SlotValue, error) {
+		if len(ds.RRAs()) != 1 || ds.RRAs()[0].Step() != 10*time.Second {
+			t.Errorf("recomputeSource: expected only the 10s RRA, got %v", ds.RRAs())
+		}
+		fetched = append(fetched, to)
+		return nil, nil
+	}
+
+	// the worker fails the second batch
+	requests := 0
+	go func() {
+		for dpds := range workerCh {
+			requests++
+			if requests == 2 {
+				dpds.recompute.resp <- fmt.Errorf("fake error")
+			} else {
+				dpds.recompute.resp <- nil
+			}
+		}
+	}()
+
+	// RRA 1 begins at 60 and ends at 600, batches are 4 minutes
+	done, err := r.RecomputeFrom(foo, 1, time.Time{})
+	if err == nil || !done.Equal(time.Unix(300, 0)) {
+		t.Errorf("RecomputeFrom: expected an error and %v, got %v, %v", time.Unix(300, 0), err, done)
+	}
+	done, err = r.RecomputeFrom(foo, 1, done)
+	if err != nil || !done.Equal(time.Unix(600, 0)) {
+		t.Errorf("RecomputeFrom: expected %v, got %v, %v", time.Unix(600, 0), err, done)
+	}
+	expect := []time.Time{time.Unix(300, 0), time.Unix(540, 0), time.Unix(540, 0), time.Unix(600, 0)}
+	if !reflect.DeepEqual(fetched, expect) {
+		t.Errorf("RecomputeFrom: expected batches ending on %v, got %v", expect, fetched)
+	}
+	close(workerCh)
+}
+
+func Test_Receiver_SetDeadLetterHandler(t *testing.T) {
+	r := &Receiver{}
+	dp := &incomingDP{Ident: serde.Ident{"name": "foo"}, TimeStamp: time.Unix(1000, 0), Value: 1}
+
+	// no handler, nothing happens
+	r.reportDeadLetter(dp, DeadLetterNoSpec, nil)
+	(*Receiver)(nil).reportDeadLetter(dp, DeadLetterNoSpec, nil)
+
+	var got []*DeadLetter
+	r.SetDeadLetterHandler(func(dl *DeadLetter) { got = append(got, dl) })
+	err := fmt.Errorf("some error")
+	r.reportDeadLetter(dp, DeadLetterRejected, err)
+	expect := &DeadLetter{Ident: dp.Ident, TimeStamp: dp.TimeStamp, Value: 1, Reason: DeadLetterRejected, Err: err, dp: dp}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], expect) {
+		t.Errorf("reportDeadLetter: expected %v, got %v", expect, got)
+	}
+
+	if s := DeadLetterRejected.String(); s != "rejected" {
+		t.Errorf("DeadLetterReason.String(): expected rejected, got %q", s)
+	}
+	if s := DeadLetterReason(100).String(); s != "DeadLetterReason(100)" {
+		t.Errorf("DeadLetterReason.String(): unexpected %q", s)
+	}
+}
+
+func Test_Receiver_QueueDataPoints(t *testing.T) {
+	r := &Receiver{dpChs: newDirectorChannels(2, 10), BatchChunkSize: 2}
+	save := batchYield
+	defer func() { batchYield = save }()
+	yields := 0
+	batchYield = func() { yields++ }
+
+	var dps []DataPoint
+	for i := 0; i < 5; i++ {
+		dps = append(dps, DataPoint{Ident: serde.Ident{"name": fmt.Sprintf("foo%d", i)}, TimeStamp: time.Unix(1000, 0), Value: float64(i)})
+	}
+	if n, err := r.QueueDataPoints(dps); n != 5 || err != nil {
+		t.Errorf("QueueDataPoints: expected 5 queued, got %d, %v", n, err)
+	}
+	if yields != 2 {
+		t.Errorf("QueueDataPoints: expected 2 yields with chunks of 2, got %d", yields)
+	}
+	for _, dp := range dps {
+		ch := r.dpChs.forIdent(dp.Ident)
+		if got := <-ch; got.Ident.String() != dp.Ident.String() {
+			t.Errorf("QueueDataPoints: expected %v in its director channel, got %v", dp.Ident, got.Ident)
+		}
+	}
+
+	// a full channel
+	r.dpChs = newDirectorChannels(1, 3)
+	if n, err := r.QueueDataPoints(dps, WithMaxWait(0)); n != 3 || err != ErrQueueFull {
+		t.Errorf("QueueDataPoints: expected 3 queued and ErrQueueFull, got %d, %v", n, err)
+	}
+}
+
+func Test_Receiver_Reinject(t *testing.T) {
+	r := &Receiver{dpChs: directorChannels{make(chan *incomingDP, 2)}}
+	var got *DeadLetter
+	r.SetDeadLetterHandler(func(dl *DeadLetter) { got = dl })
+	r.reportDeadLetter(&incomingDP{Ident: serde.Ident{"name": "foo"}, TimeStamp: time.Unix(1000, 0), Value: 5, WrapAt: 100, Hops: 1}, DeadLetterTransit, nil)
+
+	got.Ident = serde.Ident{"name": "bar"} // corrected
+	if err := r.Reinject(got); err != nil {
+		t.Errorf("Reinject: unexpected error: %v", err)
+	}
+	dp := <-r.dpChs[0]
+	if dp.Ident["name"] != "bar" || dp.Value != 5 || dp.WrapAt != 100 || dp.Hops != 0 {
+		t.Errorf("Reinject: expected the corrected counter with no hops, got %+v", dp)
+	}
+
+	// not from the handler
+	r.Reinject(&DeadLetter{Ident: serde.Ident{"name": "baz"}, TimeStamp: time.Unix(1000, 0), Value: 1})
+	if dp := <-r.dpChs[0]; dp.Ident["name"] != "baz" || dp.Value != 1 || dp.WrapAt != 0 {
+		t.Errorf("Reinject: expected a plain data point, got %+v", dp)
+	}
+
+	r.Pause()
+	if err := r.Reinject(got); err != ErrPaused {
+		t.Errorf("Reinject: expected ErrPaused, got %v", err)
+	}
+}
+
+func Test_Receiver_OldestUnflushedAge(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+	if age := r.OldestUnflushedAge(); age != 0 {
+		t.Errorf("OldestUnflushedAge: expected 0 with nothing cached, got %v", age)
+	}
+
+	foo := serde.Ident{"name": "foo"}
+	cds := &cachedDs{DbDataSourcer: serde.NewDbDataSource(1, foo, rrd.NewDataSource(*DftDSSPec))}
+	r.dsc.insert(cds)
+	sr := &fakeSr{}
+	for i := 1; i <= 3; i++ {
+		workerProcessDP("test", cds, &incomingDP{Ident: foo, TimeStamp: time.Unix(int64(i*10), 0), Value: 1}, 0, sr)
+	}
+	first := cds.unflushedRT
+	if first.IsZero() || first.After(cds.lastDpRT) {
+		t.Errorf("workerProcessDP: expected the time of the first point, got %v", first)
+	}
+	if age := r.oldestUnflushedAge(first.Add(time.Minute)); age != time.Minute {
+		t.Errorf("OldestUnflushedAge: expected 1m, got %v", age)
+	}
+
+	// a periodic flush starts over
+	recent := map[int64]*cachedDs{1: cds}
+	workerPeriodicFlush("test", &fakeDsFlusher{fdsReturn: true}, recent, 0, 0, 0, 10, FlushAnyOrder, true)
+	if age := r.OldestUnflushedAge(); age != 0 {
+		t.Errorf("OldestUnflushedAge: expected 0 after a flush, got %v", age)
+	}
+
+	// so does MarkGap, which flushes as well
+	workerProcessDP("test", cds, &incomingDP{Ident: foo, TimeStamp: time.Unix(40, 0), Value: 1}, 0, sr)
+	if err := workerMarkGap(&fakeDsFlusher{fdsReturn: true}, cds, time.Unix(10, 0), time.Unix(30, 0)); err != nil {
+		t.Fatalf("workerMarkGap: %v", err)
+	}
+	if age := r.OldestUnflushedAge(); age != 0 {
+		t.Errorf("OldestUnflushedAge: expected 0 after MarkGap, got %v", age)
+	}
+}
+
+func Test_Receiver_SetStalenessHook(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+
+	// no hook, nothing happens
+	r.checkStaleness(time.Now())
+
+	type event struct {
+		ident    string
+		nowStale bool
+	}
+	var events []event
+	r.SetStalenessHook(time.Minute, func(ident serde.Ident, nowStale bool) {
+		events = append(events, event{ident.String(), nowStale})
+	})
+
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	r.dsc.insert(cds)
+
+	now := time.Now()
+	cds.lastDpRT = now
+	r.checkStaleness(now.Add(time.Second))
+	if len(events) != 0 {
+		t.Errorf("checkStaleness: active DS should not produce an event: %v", events)
+	}
+
+	r.checkStaleness(now.Add(2 * time.Minute))
+	r.checkStaleness(now.Add(3 * time.Minute))
+	if len(events) != 1 || events[0] != (event{foo.String(), true}) {
+		t.Errorf("checkStaleness: expected one stale event, got %v", events)
+	}
+
+	cds.lastDpRT = now.Add(3 * time.Minute)
+	r.checkStaleness(now.Add(3 * time.Minute))
+	if len(events) != 2 || events[1] != (event{foo.String(), false}) {
+		t.Errorf("checkStaleness: expected an active event, got %v", events)
+	}
+}
+
+func Test_Receiver_SetStepUpHook(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+
+	// no hook, nothing happens
+	r.checkStepUp(time.Now())
+
+	var intervals []time.Duration
+	r.SetStepUpHook(2, func(ident serde.Ident, step, interval time.Duration) {
+		intervals = append(intervals, interval)
+	})
+
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(rrd.DSSpec{Step: 10 * time.Second}))
+	cds := &cachedDs{DbDataSourcer: ds}
+	r.dsc.insert(cds)
+
+	now := time.Now()
+	r.checkStepUp(now) // first check only starts counting
+	for i := 1; i <= 3; i++ {
+		cds.stepUpDps = 10 // every 2s
+		r.checkStepUp(now.Add(time.Duration(i) * 20 * time.Second))
+	}
+	if len(intervals) != 1 || intervals[0] != 2*time.Second {
+		t.Errorf("checkStepUp: expected one proposal with an interval of 2s, got %v", intervals)
+	}
+
+	cds.stepUpDps = 1 // slowed down to every 20s
+	r.checkStepUp(now.Add(80 * time.Second))
+	for i := 5; i <= 6; i++ {
+		cds.stepUpDps = 10
+		r.checkStepUp(now.Add(time.Duration(i) * 20 * time.Second))
+	}
+	if len(intervals) != 2 {
+		t.Errorf("checkStepUp: expected another proposal after the rate dropped and rose again, got %v", intervals)
+	}
+}
+
+func Test_TimeStampAlignment(t *testing.T) {
+	step := 10 * time.Second
+	base := time.Unix(1000, 0)
+	ts := base.Add(3 * time.Second)
+	for _, c := range []struct {
+		a      TimeStampAlignment
+		ts     time.Time
+		expect time.Time
+	}{
+		{AlignNone, ts, ts},
+		{AlignFloor, ts, base},
+		{AlignRound, ts, base},
+		{AlignRound, base.Add(5 * time.Second), base.Add(step)},
+		{AlignCeil, ts, base.Add(step)},
+		{AlignCeil, base, base},
+	} {
+		if got := c.a.align(c.ts, step); !got.Equal(c.expect) {
+			t.Errorf("align(%d): expected %v, got %v", c.a, c.expect, got)
+		}
+	}
+	if got := AlignFloor.align(ts, 0); !got.Equal(ts) {
+		t.Errorf("align: zero step should not change the time stamp")
+	}
+
+	if a, err := ParseTimeStampAlignment("Floor"); err != nil || a != AlignFloor {
+		t.Errorf("ParseTimeStampAlignment: expected AlignFloor, got %v %v", a, err)
+	}
+	if a, err := ParseTimeStampAlignment(""); err != nil || a != AlignNone {
+		t.Errorf("ParseTimeStampAlignment: expected AlignNone, got %v %v", a, err)
+	}
+	if _, err := ParseTimeStampAlignment("bogus"); err == nil {
+		t.Errorf("ParseTimeStampAlignment: expected an error")
+	}
+}
+
+func Test_ParseFlushPriority(t *testing.T) {
+	for s, expect := range map[string]FlushPriority{
+		"":                   FlushAnyOrder,
+		"any":                FlushAnyOrder,
+		"Oldest-Dirty-First": FlushOldestDirtyFirst,
+		"most-points-first":  FlushMostPointsFirst,
+	} {
+		if p, err := ParseFlushPriority(s); err != nil || p != expect {
+			t.Errorf("ParseFlushPriority(%q): expected %v, got %v (%v)", s, expect, p, err)
+		}
+	}
+	if _, err := ParseFlushPriority("bogus"); err == nil {
+		t.Errorf("ParseFlushPriority: expected an error")
+	}
+}
+
 func Test_Receiver_reportStatCount(t *testing.T) {
 	// Also tests QueueSum and QueueGauge
 	r := &Receiver{ReportStats: true, ReportStatsPrefix: "foo", pacedMetricCh: make(chan *pacedMetric)}
@@ -144,11 +877,33 @@ func Test_Receiver_reportStatCount(t *testing.T) {
 	}
 }
 
+func Test_Receiver_ClusterDistribution(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(nil, nil, nil)}
+	if r.ClusterDistribution() != nil {
+		t.Errorf("ClusterDistribution: expected nil without a cluster")
+	}
+	for i, name := range []string{"foo", "bar"} {
+		ds := serde.NewDbDataSource(int64(i+1), serde.Ident{"name": name}, rrd.NewDataSource(*DftDSSPec))
+		r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+	}
+	clstr := &fakeCluster{}
+	r.cluster = clstr
+	if dist := r.ClusterDistribution(); len(dist) != 1 || len(dist[""]) != 2 {
+		t.Errorf("ClusterDistribution: expected 2 DSs without a node, got %v", dist)
+	}
+	clstr.nodesForDd = []*cluster.Node{&cluster.Node{Node: &memberlist.Node{Name: "a"}}, &cluster.Node{Node: &memberlist.Node{Name: "b"}}}
+	dist := r.ClusterDistribution()
+	if expect := []serde.Ident{{"name": "bar"}, {"name": "foo"}}; len(dist) != 1 || !reflect.DeepEqual(dist["a"], expect) {
+		t.Errorf("ClusterDistribution: expected %v on node a, got %v", expect, dist)
+	}
+}
+
 // fake cluster
 type fakeCluster struct {
 	n, nLeave, nShutdown, nReady int
 	nReg, nTrans                 int
 	nodesForDd                   []*cluster.Node
+	leaseHolder                  *cluster.Node
 	ln                           *cluster.Node
 	cChange                      chan bool
 	tErr                         bool
@@ -161,7 +916,13 @@ func (c *fakeCluster) RegisterMsgType() (chan *cluster.Msg, chan *cluster.Msg) {
 func (_ *fakeCluster) NumMembers() int                                          { return 0 }
 func (_ *fakeCluster) LoadDistData(f func() ([]cluster.DistDatum, error)) error { f(); return nil }
 func (c *fakeCluster) NodesForDistDatum(cluster.DistDatum) []*cluster.Node      { return c.nodesForDd }
-func (c *fakeCluster) LocalNode() *cluster.Node                                 { return c.ln }
+func (c *fakeCluster) LeaseHolder(cluster.DistDatum) *cluster.Node {
+	if c.leaseHolder == nil && len(c.nodesForDd) > 0 {
+		return c.nodesForDd[0]
+	}
+	return c.leaseHolder
+}
+func (c *fakeCluster) LocalNode() *cluster.Node { return c.ln }
 func (c *fakeCluster) NotifyClusterChanges() chan bool {
 	return c.cChange
 }
@@ -188,6 +949,40 @@ func (c *fakeCluster) Shutdown() error {
 	return nil
 }
 
+func Test_Receiver_ListenerStats(t *testing.T) {
+	r := &Receiver{ReportStats: true, ReportStatsPrefix: "foo", pacedMetricCh: make(chan *pacedMetric)}
+	names := make(chan string)
+	go func() {
+		for pm := range r.pacedMetricCh {
+			names <- pm.ident["name"]
+		}
+	}()
+
+	ls := r.ListenerStats("graphite_text")
+	expect := func(name string) {
+		if got := <-names; got != name {
+			t.Errorf("ListenerStats: expected %q, got %q", name, got)
+		}
+	}
+	go ls.ConnOpened()
+	expect("foo.listener.graphite_text.connections")
+	go ls.BytesRead(10)
+	expect("foo.listener.graphite_text.bytes_read")
+	go ls.ParseError()
+	expect("foo.listener.graphite_text.parse_errors")
+	go ls.PointsAccepted(1)
+	expect("foo.listener.graphite_text.points_accepted")
+	if ls.Connections() != 1 {
+		t.Errorf("ListenerStats: expected 1 connection, got %d", ls.Connections())
+	}
+	go ls.ConnClosed()
+	expect("foo.listener.graphite_text.connections")
+	if ls.Connections() != 0 {
+		t.Errorf("ListenerStats: expected 0 connections, got %d", ls.Connections())
+	}
+	close(r.pacedMetricCh)
+}
+
 // IncomingDP must be gob encodable
 func TestIncomingDP_gobEncodable(t *testing.T) {
 	now := time.Now()
@@ -214,3 +1009,512 @@ func TestIncomingDP_gobEncodable(t *testing.T) {
 		t.Errorf("dp1 != dp2 after gob encode/decode")
 	}
 }
+
+func Test_Receiver_DSMeta(t *testing.T) {
+	db := serde.NewMemSerDe()
+	ident := serde.Ident{"name": "foo"}
+	ds, err := db.FetchOrCreateDataSource(ident, &rrd.DSSpec{Step: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("FetchOrCreateDataSource: %v", err)
+	}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+
+	if err := r.SetDSMeta(ident, map[string]string{"unit": "ms"}); err == nil {
+		t.Errorf("SetDSMeta: expected an error for a DS not cached")
+	}
+	r.dsc.insert(newCachedDs(ds.(serde.DbDataSourcer), nil))
+
+	desc, err := r.DescribeDS(ident)
+	if err != nil || desc.Meta != nil || desc.Step != 10*time.Second {
+		t.Errorf("DescribeDS: expected step 10s and no meta, got %+v, %v", desc, err)
+	}
+	if err := r.SetDSMeta(ident, map[string]string{"unit": "ms"}); err != nil {
+		t.Errorf("SetDSMeta: unexpected error: %v", err)
+	}
+	desc, err = r.DescribeDS(ident)
+	if err != nil || desc.Meta["unit"] != "ms" {
+		t.Errorf("DescribeDS: expected unit ms, got %+v, %v", desc, err)
+	}
+}
+
+func Test_Receiver_QueueAnnotation(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(serde.NewMemSerDe(), nil, nil)}
+	foo, bar := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}
+	now := time.Now()
+
+	for _, a := range []serde.Annotation{
+		{Ident: foo, TimeStamp: now.Add(-time.Minute), Text: "deploy 1.2"},
+		{TimeStamp: now.Add(-2 * time.Minute), Text: "incident"},
+		{Ident: bar, TimeStamp: now, Text: "bar restarted"},
+		{Ident: foo, TimeStamp: now.Add(-time.Hour), Text: "too old"},
+	} {
+		if err := r.QueueAnnotation(a.Ident, a.TimeStamp, a.Text); err != nil {
+			t.Fatalf("QueueAnnotation: %v", err)
+		}
+	}
+
+	as, err := r.FetchAnnotations(foo, now.Add(-10*time.Minute), now)
+	if err != nil || len(as) != 2 || as[0].Text != "incident" || as[1].Text != "deploy 1.2" {
+		t.Errorf("FetchAnnotations: expected the global and the foo annotation, oldest first, got %v %v", as, err)
+	}
+	if as, _ = r.FetchAnnotations(nil, now.Add(-10*time.Minute), now); len(as) != 1 || as[0].Text != "incident" {
+		t.Errorf("FetchAnnotations: expected only the global annotation, got %v", as)
+	}
+
+	r.ReadOnly = true
+	if err := r.QueueAnnotation(foo, now, "read-only"); err != ErrReadOnly {
+		t.Errorf("QueueAnnotation: expected ErrReadOnly, got %v", err)
+	}
+
+	r = &Receiver{dsc: newDsCache(&fakeSerde{}, nil, nil)}
+	if err := r.QueueAnnotation(foo, now, "unsupported"); err == nil {
+		t.Errorf("QueueAnnotation: expected an error without an AnnotationStorer")
+	}
+}
+
+func Test_Receiver_Exists(t *testing.T) {
+	db := serde.NewMemSerDe()
+	foo, bar := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}
+	if _, err := db.FetchOrCreateDataSource(foo, &rrd.DSSpec{Step: 10 * time.Second}); err != nil {
+		t.Fatalf("FetchOrCreateDataSource: %v", err)
+	}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+
+	if !r.Exists(foo) {
+		t.Errorf("Exists: expected true for a DS in the SerDe")
+	}
+	if r.Exists(bar) {
+		t.Errorf("Exists: expected false for an unknown DS")
+	}
+	if r.Exists(bar) || len(r.dsc.all()) != 0 {
+		t.Errorf("Exists: nothing should be created or cached, %d DSs cached", len(r.dsc.all()))
+	}
+	r.dsc.requireTagKeys([]string{"name", "host"})
+	if r.Exists(foo) {
+		t.Errorf("Exists: expected false for an ident lacking a required tag key")
+	}
+
+	// Without a DataSourceExister only the cache is consulted
+	r = &Receiver{dsc: newDsCache(&fakeSerde{}, nil, nil)}
+	ds := serde.NewDbDataSource(1, bar, rrd.NewDataSource(rrd.DSSpec{Step: 10 * time.Second}))
+	r.dsc.insert(newCachedDs(ds, nil))
+	if !r.Exists(bar) || r.Exists(foo) {
+		t.Errorf("Exists: expected only the cached DS to exist")
+	}
+}
+
+func Test_Receiver_Subscribe(t *testing.T) {
+	db := serde.NewMemSerDe()
+	ident := serde.Ident{"name": "foo"}
+	ds, err := db.FetchOrCreateDataSource(ident, DftDSSPec)
+	if err != nil {
+		t.Fatalf("FetchOrCreateDataSource: %v", err)
+	}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+	if _, err := r.Subscribe(ident, 1); err == nil {
+		t.Errorf("Subscribe: expected an error for a DS not cached")
+	}
+	cds := newCachedDs(ds.(serde.DbDataSourcer), nil)
+	r.dsc.insert(cds)
+
+	sub1, _ := r.Subscribe(ident, 1)
+	sub2, _ := r.Subscribe(ident, 10)
+	sr := &fakeSr{}
+	for i := 1; i <= 3; i++ {
+		dp := &incomingDP{Ident: ident, TimeStamp: time.Unix(int64(i*10), 0), Value: float64(i)}
+		if !workerProcessDP("test", cds, dp, 0, sr) {
+			t.Fatalf("workerProcessDP: data point %d not applied", i)
+		}
+	}
+	if p := <-sub1.C; p.Value != 1 || !p.TimeStamp.Equal(time.Unix(10, 0)) {
+		t.Errorf("sub1: expected the first point, got %+v", p)
+	}
+	if sub1.Dropped() != 2 {
+		t.Errorf("sub1: expected 2 dropped, got %d", sub1.Dropped())
+	}
+	if len(sub2.C) != 3 || sub2.Dropped() != 0 {
+		t.Errorf("sub2: expected 3 points and none dropped, got %d, %d", len(sub2.C), sub2.Dropped())
+	}
+
+	sub1.Unsubscribe()
+	sub1.Unsubscribe()
+	if _, ok := <-sub1.C; ok {
+		t.Errorf("sub1: expected C to be closed")
+	}
+	if len(cds.subs) != 1 {
+		t.Errorf("expected 1 subscriber left, got %d", len(cds.subs))
+	}
+
+	r.dsc.endAllSubscriptions()
+	n := 0
+	for range sub2.C {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("sub2: expected 3 points before C is closed, got %d", n)
+	}
+	sub2.Unsubscribe()
+}
+
+func Test_Receiver_QueueGaugeEWMA(t *testing.T) {
+	r := &Receiver{pacedMetricCh: make(chan *pacedMetric, 1)}
+	foo := serde.Ident{"name": "foo"}
+	for _, alpha := range []float64{0, -1, 1.5} {
+		if err := r.QueueGaugeEWMA(foo, 1, alpha); err == nil {
+			t.Errorf("QueueGaugeEWMA: expected an error for alpha %v", alpha)
+		}
+	}
+	if err := r.QueueGaugeEWMA(foo, 1, 0.5); err != nil {
+		t.Errorf("QueueGaugeEWMA: unexpected error: %v", err)
+	}
+	if pm := <-r.pacedMetricCh; pm.kind != pacedGauge || pm.alpha != 0.5 {
+		t.Errorf("QueueGaugeEWMA: expected a gauge with alpha 0.5, got %+v", pm)
+	}
+}
+
+func Test_Receiver_CollectStats(t *testing.T) {
+	// unbuffered, anything reported would block
+	r := &Receiver{pacedMetricCh: make(chan *pacedMetric), CollectStats: true}
+	r.reportStatCount("foo", 1)
+	r.reportStatCount("foo", 2)
+	r.reportStatGauge("bar", 5)
+	r.reportStatGauge("bar", 7)
+	stats := r.InternalStats()
+	if len(stats) != 2 || stats["foo"] != 3 || stats["bar"] != 7 {
+		t.Errorf("InternalStats: expected foo 3 and bar 7, got %v", stats)
+	}
+	stats["foo"] = 0
+	if r.InternalStats()["foo"] != 3 {
+		t.Errorf("InternalStats: should return a copy")
+	}
+	if counts := r.InternalStatCounts(); len(counts) != 1 || !counts["foo"] {
+		t.Errorf("InternalStatCounts: expected only foo, got %v", counts)
+	}
+}
+
+func Test_Receiver_QueueMaxWait(t *testing.T) {
+	r := &Receiver{dpChs: newDirectorChannels(1, 1), aggCh: make(chan *aggregator.Command), pacedMetricCh: make(chan *pacedMetric)}
+	foo := serde.Ident{"name": "foo"}
+
+	if err := r.QueueDataPoint(foo, time.Unix(1000, 0), 1, WithMaxWait(0)); err != nil {
+		t.Errorf("QueueDataPoint: unexpected error with space in the channel: %v", err)
+	}
+	if err := r.QueueDataPoint(foo, time.Unix(1001, 0), 1, WithMaxWait(0)); err != ErrQueueFull {
+		t.Errorf("QueueDataPoint: expected ErrQueueFull without waiting, got %v", err)
+	}
+	start := time.Now()
+	if err := r.QueueCounterWrapped(foo, time.Unix(1001, 0), 1, 10, WithMaxWait(20*time.Millisecond)); err != ErrQueueFull {
+		t.Errorf("QueueCounterWrapped: expected ErrQueueFull after waiting, got %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("QueueCounterWrapped: expected to wait 20ms, waited %v", time.Since(start))
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-r.dpChs[0]
+	}()
+	if err := r.QueueDataPoint(foo, time.Unix(1002, 0), 1, WithMaxWait(time.Second)); err != nil {
+		t.Errorf("QueueDataPoint: expected to be queued once there is space, got %v", err)
+	}
+
+	if err := r.QueueAggregatorCommand(nil, WithMaxWait(0)); err != ErrQueueFull {
+		t.Errorf("QueueAggregatorCommand: expected ErrQueueFull, got %v", err)
+	}
+	if err := r.QueueGauge(foo, 1, WithMaxWait(time.Millisecond)); err != ErrQueueFull {
+		t.Errorf("QueueGauge: expected ErrQueueFull, got %v", err)
+	}
+}
+
+type traceKey struct{}
+
+type fakeTracer struct {
+	sync.Mutex
+	spans []string
+}
+
+type fakeSpan struct {
+	t    *fakeTracer
+	name string
+}
+
+func (s *fakeSpan) End() {
+	s.t.Lock()
+	s.t.spans = append(s.t.spans, s.name)
+	s.t.Unlock()
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string, ident serde.Ident) Span {
+	return &fakeSpan{t: t, name: fmt.Sprintf("%s:%s:%v", name, ident["name"], ctx.Value(traceKey{}))}
+}
+
+func Test_Receiver_Tracer(t *testing.T) {
+	ft := &fakeTracer{}
+	r := &Receiver{Tracer: ft, dpChs: newDirectorChannels(1, 10)}
+	foo := serde.Ident{"name": "foo"}
+	ctx := context.WithValue(context.Background(), traceKey{}, "abc")
+
+	r.QueueDataPoint(foo, time.Unix(1000, 0), 1, WithContext(ctx))
+	dp := <-r.dpChs[0]
+	if dp.trace == nil {
+		t.Fatalf("QueueDataPoint: the data point should be traced")
+	}
+
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(*DftDSSPec))
+	cds := newCachedDs(ds, nil)
+	workerProcessDP("test", cds, dp, AlignNone, &fakeSr{})
+	if cds.trace != dp.trace {
+		t.Errorf("workerProcessDP: the DS should keep the trace for the flush")
+	}
+
+	f := &dsFlusher{db: &fakeSerde{}, sr: &fakeSr{}, flusherChs: flusherChannels{make(chan *dsFlushRequest, 1)}}
+	f.flushCachedDs(cds)
+	fr := <-f.flusherChs[0]
+	if fr.span == nil || cds.trace != nil {
+		t.Fatalf("flushCachedDs: expected a flush span and the trace cleared")
+	}
+	fr.span.End()
+
+	exp := []string{"enqueue:foo:abc", "apply:foo:abc", "flush:foo:abc"}
+	if !reflect.DeepEqual(ft.spans, exp) {
+		t.Errorf("expected spans %v, got %v", exp, ft.spans)
+	}
+
+	// Without a tracer nothing is traced
+	r.Tracer = nil
+	r.QueueDataPoint(foo, time.Unix(1010, 0), 1, WithContext(ctx))
+	if dp = <-r.dpChs[0]; dp.trace != nil {
+		t.Errorf("QueueDataPoint: without a tracer the data point should not be traced")
+	}
+}
+
+func Test_Receiver_FetchRRA(t *testing.T) {
+	foo := serde.Ident{"name": "foo"}
+	r := &Receiver{serde: serde.NewMemSerDe(), dsc: newDsCache(nil, nil, nil)}
+	if _, err := r.FetchRRA(foo, 0, time.Time{}, time.Time{}); err == nil {
+		t.Errorf("FetchRRA: expected an error for a DS not cached")
+	}
+
+	ds := serde.NewDbDataSource(0, foo, rrd.NewDataSource(rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 10 * time.Minute},
+			{Function: rrd.MAX, Step: time.Minute, Span: 10 * time.Minute},
+		},
+	}))
+	ds.ProcessDataPoint(1, time.Unix(60, 0))
+	ds.ProcessDataPoint(5, time.Unix(120, 0))
+	ds.ProcessDataPoint(3, time.Unix(180, 0))
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds})
+
+	desc, err := r.DescribeDS(foo)
+	if err != nil || len(desc.RRAs) != 2 || desc.RRAs[1].Function != rrd.MAX || desc.RRAs[1].Step != time.Minute {
+		t.Fatalf("DescribeDS: unexpected RRAs %+v (%v)", desc, err)
+	}
+
+	saveSource := recomputeSource
+	defer func() { recomputeSource = saveSource }()
+	recomputeSource = func(db serde.Fetcher, ds rrd.DataSourcer, from, to time.Time) ([]rrd.SlotValue, error) {
+		if len(ds.RRAs()) != 1 || ds.RRAs()[0].Step() != time.Minute {
+			t.Errorf("recomputeSource: expected only the 1m RRA, got %v", ds.RRAs())
+		}
+		// saved earlier, the cached 120 slot takes precedence
+		var result []rrd.SlotValue
+		for _, sv := range []rrd.SlotValue{{End: time.Unix(60, 0), Value: 7}, {End: time.Unix(120, 0), Value: 9}} {
+			if sv.End.After(from) && !sv.End.After(to) {
+				result = append(result, sv)
+			}
+		}
+		return result, nil
+	}
+
+	slots, err := r.FetchRRA(foo, 1, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("FetchRRA: unexpected error: %v", err)
+	}
+	exp := []rrd.SlotValue{{End: time.Unix(60, 0), Value: 7}, {End: time.Unix(120, 0), Value: 5}, {End: time.Unix(180, 0), Value: 3}}
+	if !reflect.DeepEqual(slots, exp) {
+		t.Errorf("FetchRRA: expected %v, got %v", exp, slots)
+	}
+
+	slots, _ = r.FetchRRA(foo, 1, time.Unix(60, 0), time.Unix(120, 0))
+	if len(slots) != 1 || !slots[0].End.Equal(time.Unix(120, 0)) {
+		t.Errorf("FetchRRA: expected only the 120 slot, got %v", slots)
+	}
+	if _, err := r.FetchRRA(foo, 2, time.Time{}, time.Time{}); err == nil {
+		t.Errorf("FetchRRA: expected an error for an invalid RRA index")
+	}
+}
+
+func Test_Receiver_RenameDS(t *testing.T) {
+	db := serde.NewMemSerDe()
+	foo, bar, baz := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}, serde.Ident{"name": "baz"}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+	for _, ident := range []serde.Ident{foo, baz} {
+		ds, _ := db.FetchOrCreateDataSource(ident, DftDSSPec)
+		r.dsc.insert(newCachedDs(ds.(serde.DbDataSourcer), nil))
+	}
+	cds := r.dsc.getByIdent(foo)
+	cds.ProcessDataPoint(1, time.Unix(1000, 0))
+
+	if err := r.RenameDS(foo, baz); err == nil {
+		t.Errorf("RenameDS: expected an error for an ident which is taken")
+	}
+	if err := r.RenameDS(bar, serde.Ident{"name": "qux"}); err == nil {
+		t.Errorf("RenameDS: expected an error for a DS not cached")
+	}
+	if err := r.RenameDS(foo, bar); err != nil {
+		t.Fatalf("RenameDS: unexpected error: %v", err)
+	}
+	if r.dsc.getByIdent(foo) != nil || r.dsc.getByIdent(bar) != cds {
+		t.Errorf("RenameDS: the cache should have the DS under the new ident only")
+	}
+	if cds.Ident().String() != bar.String() || cds.LastUpdate().IsZero() {
+		t.Errorf("RenameDS: the DS should keep its data under the new ident, got %v", cds.Ident())
+	}
+	if ds, _ := db.FetchOrCreateDataSource(bar, DftDSSPec); ds.(serde.DbDataSourcer).Id() != cds.Id() {
+		t.Errorf("RenameDS: the SerDe should have the DS under the new ident")
+	}
+}
+
+func Test_Receiver_Catalog(t *testing.T) {
+	src := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour},
+			rrd.RRASpec{Function: rrd.MAX, Step: time.Minute, Span: 24 * time.Hour, Xff: 0.5},
+		},
+	}
+	for _, name := range []string{"foo", "bar"} {
+		src.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+	}
+
+	var buf bytes.Buffer
+	r := &Receiver{serde: src}
+	if n, err := r.ExportCatalog(&buf); n != 2 || err != nil {
+		t.Fatalf("ExportCatalog: expected 2 DSs and no error, got %d %v", n, err)
+	}
+	catalog := buf.String()
+	if lines := strings.Split(strings.TrimSpace(catalog), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"bar"`) {
+		t.Errorf("ExportCatalog: expected one line per DS sorted by ident, got %q", catalog)
+	}
+
+	dst := serde.NewMemSerDe()
+	r = &Receiver{serde: dst}
+	if n, err := r.ImportCatalog(strings.NewReader(catalog)); n != 2 || err != nil {
+		t.Fatalf("ImportCatalog: expected 2 DSs and no error, got %d %v", n, err)
+	}
+	buf.Reset()
+	r.ExportCatalog(&buf)
+	if buf.String() != catalog {
+		t.Errorf("ImportCatalog: exporting the imported DSs should write the same catalog, got %q, expected %q", buf.String(), catalog)
+	}
+
+	bad := catalog + `{"ident":{"name":"baz"},"step_ms":10000,"rras":[{"cf":"AVG","step_ms":10000,"span_ms":60000}]}` + "\n"
+	if _, err := (&Receiver{serde: serde.NewMemSerDe()}).ImportCatalog(strings.NewReader(bad)); err == nil {
+		t.Errorf("ImportCatalog: expected an error for an invalid consolidation")
+	}
+}
+
+func Test_Receiver_RepairLastUpdate(t *testing.T) {
+	db := serde.NewMemSerDe()
+	foo := serde.Ident{"name": "foo"}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+	if _, err := r.RepairLastUpdate(foo); err == nil {
+		t.Errorf("RepairLastUpdate: expected an error for an unknown data source")
+	}
+
+	ds, _ := db.FetchOrCreateDataSource(foo, DftDSSPec)
+	cds := newCachedDs(ds.(serde.DbDataSourcer), nil)
+	r.dsc.insert(cds)
+	for ts := int64(1000); ts <= 1100; ts += 10 {
+		cds.ProcessDataPoint(1, time.Unix(ts, 0))
+	}
+	cds.ProcessDataPoint(1, time.Unix(99999, 0)) // the corruption
+
+	saveSource := recomputeSource
+	defer func() { recomputeSource = saveSource }()
+	recomputeSource = func(db serde.Fetcher, ds rrd.DataSourcer, from, to time.Time) ([]rrd.SlotValue, error) {
+		if len(ds.RRAs()) != 1 || ds.RRAs()[0].Step() != 10*time.Second {
+			t.Errorf("recomputeSource: expected only the finest RRA, got %v", ds.RRAs())
+		}
+		return []rrd.SlotValue{{End: time.Unix(1090, 0), Value: 1}, {End: time.Unix(1100, 0), Value: 1}, {End: time.Unix(1110, 0), Value: math.NaN()}}, nil
+	}
+
+	lu, err := r.RepairLastUpdate(foo)
+	if err != nil || !lu.Equal(time.Unix(1100, 0)) {
+		t.Fatalf("RepairLastUpdate: expected 1100, got %v (%v)", lu, err)
+	}
+	if !cds.LastUpdate().Equal(lu) || cds.PointCount() != 0 {
+		t.Errorf("RepairLastUpdate: expected the cached DS reloaded with no points, got %v %d", cds.LastUpdate(), cds.PointCount())
+	}
+	if stored, _ := db.FetchDataSourceById(cds.Id()); !stored.LastUpdate().Equal(lu) {
+		t.Errorf("RepairLastUpdate: expected the last update rewritten in the SerDe, got %v", stored.LastUpdate())
+	}
+	if err := cds.ProcessDataPoint(1, time.Unix(1110, 0)); err != nil {
+		t.Errorf("RepairLastUpdate: a point after the repaired last update should be accepted: %v", err)
+	}
+}
+
+func Test_Receiver_RebalanceWorker(t *testing.T) {
+	db := serde.NewMemSerDe()
+	foo := serde.Ident{"name": "foo"}
+	ds, _ := db.FetchOrCreateDataSource(foo, DftDSSPec)
+	r := &Receiver{dsc: newDsCache(db, nil, nil), workerChs: workerChannels{make(chan *incomingDpWithDs, 1024), make(chan *incomingDpWithDs, 1024)}}
+	cds := newCachedDs(ds.(serde.DbDataSourcer), nil)
+	r.dsc.insert(cds)
+	const n = 2000
+	sub, _ := r.Subscribe(foo, n)
+
+	var wg sync.WaitGroup
+	for i, ch := range r.workerChs {
+		wc := &wrkCtl{wg: &wg, startWg: &sync.WaitGroup{}, id: fmt.Sprintf("worker_%d", i)}
+		wc.startWg.Add(1)
+		go worker(wc, &fakeDsFlusher{fdsReturn: true}, ch, 0, 0, 10, time.Hour, time.Millisecond, AlignNone, FlushAnyOrder, nil, nil, &fakeSr{})
+		wc.startWg.Wait()
+	}
+	from := cds.workerIndex(2)
+
+	// Feed points while the DS moves; if the old worker applied one
+	// after the new one, it would be rejected as out of order.
+	started, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 1; i <= n; i++ {
+			r.workerChs.queue(&incomingDP{Ident: foo, TimeStamp: time.Unix(int64(1000+i*10), 0), Value: float64(i)}, cds)
+			if i == n/4 {
+				close(started)
+			}
+		}
+		close(done)
+	}()
+	<-started
+	if moved, err := r.RebalanceWorker(from); err != nil || moved != 1 {
+		t.Errorf("RebalanceWorker: expected 1 DS moved, got %d (%v)", moved, err)
+	}
+	<-done
+	for _, ch := range r.workerChs {
+		close(ch)
+	}
+	wg.Wait()
+
+	if cds.workerIndex(2) == from {
+		t.Errorf("RebalanceWorker: expected the DS to move off worker %d", from)
+	}
+	sub.Unsubscribe()
+	var last float64
+	count := 0
+	for p := range sub.C {
+		if p.Value != last+1 {
+			t.Errorf("RebalanceWorker: expected point %v, got %v", last+1, p.Value)
+			break
+		}
+		last = p.Value
+		count++
+	}
+	if count != n {
+		t.Errorf("RebalanceWorker: expected %d points applied, got %d", n, count)
+	}
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package receivertest provides utilities for testing code which
+// uses a receiver.Receiver, e.g. a front end, without a database: a
+// SerDe which keeps the data sources in memory and records the
+// flushes, a Receiver set up to flush quickly, and a way to wait for
+// the queued data points to be processed. The Receiver is the real
+// one, running its own goroutines in real time, only the time stamps
+// of the data points are up to the test.
+package receivertest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// SerDe is an in-memory serde.SerDe which records every flush.
+type SerDe struct {
+	db serde.Fetcher
+
+	mu      sync.Mutex
+	flushes int
+	flushed map[string]rrd.DataSourcer // by ident, last flushed
+}
+
+// NewSerDe returns an empty SerDe.
+func NewSerDe() *SerDe {
+	return &SerDe{
+		db:      serde.NewMemSerDe().Fetcher(),
+		flushed: make(map[string]rrd.DataSourcer),
+	}
+}
+
+func (s *SerDe) Fetcher() serde.Fetcher { return s.db }
+func (s *SerDe) Flusher() serde.Flusher { return s }
+
+// FlushDataSource records a copy of ds.
+func (s *SerDe) FlushDataSource(ds rrd.DataSourcer) error {
+	dbds, ok := ds.(serde.DbDataSourcer)
+	if !ok {
+		return fmt.Errorf("FlushDataSource: ds must be a serde.DbDataSourcer")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	s.flushed[dbds.Ident().String()] = ds.Copy()
+	return nil
+}
+
+// Flushes returns the number of flushes so far.
+func (s *SerDe) Flushes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushes
+}
+
+// LastFlushed returns a copy of the DS identified by ident as it was
+// last flushed, nil if it never was. Note that what is flushed are
+// the RRA slots updated since the previous flush.
+func (s *SerDe) LastFlushed(ident serde.Ident) rrd.DataSourcer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushed[ident.String()]
+}
+
+// NewReceiver returns a Receiver (not yet started) using a new SerDe,
+// with a single worker and flusher and small cache durations, so that
+// data points are flushed soon after they are processed. A nil finder
+// means receiver.DftDSSPec for every ident.
+func NewReceiver(finder receiver.MatchingDSSpecFinder) (*receiver.Receiver, *SerDe) {
+	sd := NewSerDe()
+	r, _ := receiver.New(sd, finder) // cannot fail, sd is not nil
+	r.NWorkers = 1
+	r.MinCacheDuration = 10 * time.Millisecond
+	r.MaxCacheDuration = 50 * time.Millisecond
+	return r, sd
+}
+
+// WaitForLastUpdate waits up to timeout for the DS identified by
+// ident to be cached by r with a last update not before ts, i.e.
+// until the data points queued up to ts have been processed, and
+// returns a copy of it.
+func WaitForLastUpdate(r *receiver.Receiver, ident serde.Ident, ts time.Time, timeout time.Duration) (serde.DbDataSourcer, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ds := r.CachedDataSource(ident)
+		if ds != nil && !ds.LastUpdate().Before(ts) {
+			return ds, nil
+		}
+		if time.Now().After(deadline) {
+			return ds, fmt.Errorf("WaitForLastUpdate: %v not updated to %v within %v", ident, ts, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receivertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_NewReceiver(t *testing.T) {
+	r, sd := NewReceiver(nil)
+	r.DisableAggregator = true
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+
+	foo := serde.Ident{"name": "foo"}
+	for i := int64(0); i <= 10; i++ {
+		r.QueueDataPoint(foo, time.Unix(1000+i*10, 0), float64(i))
+	}
+	ds, err := WaitForLastUpdate(r, foo, time.Unix(1100, 0), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Ident().String() != foo.String() {
+		t.Errorf("WaitForLastUpdate: expected %v, got %v", foo, ds.Ident())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sd.LastFlushed(foo) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sd.Flushes() == 0 || sd.LastFlushed(foo) == nil {
+		t.Errorf("SerDe: expected foo to be flushed")
+	}
+}
+
+func Test_NewReceiver_directors(t *testing.T) {
+	r, _ := NewReceiver(nil)
+	r.NDirectors = 2
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+
+	idents := []serde.Ident{{"name": "foo"}, {"name": "bar"}, {"name": "baz"}}
+	for i := int64(0); i <= 10; i++ {
+		for _, ident := range idents {
+			r.QueueDataPoint(ident, time.Unix(1000+i*10, 0), float64(i))
+		}
+	}
+	for _, ident := range idents {
+		if _, err := WaitForLastUpdate(r, ident, time.Unix(1100, 0), 5*time.Second); err != nil {
+			t.Error(err)
+		}
+	}
+}
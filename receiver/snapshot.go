@@ -0,0 +1,100 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// snapshotMagic begins a snapshot (once decompressed) which is made
+// of checksummed records, one per DS. A snapshot without it is a
+// single gob encoded slice of DSs, as written by earlier versions.
+var snapshotMagic = []byte("TGSNAP1\n")
+
+// maxSnapshotRecord is the largest record length believed, anything
+// larger is a corrupt length.
+const maxSnapshotRecord = 1 << 28
+
+// writeSnapshotRecord writes ds as a record: the length and the
+// CRC-32 (IEEE) of the data, 4 bytes big endian each, followed by the
+// data, which is the gob encoded DS. A nil ds writes the end record,
+// which has a length of 0.
+func writeSnapshotRecord(w io.Writer, ds serde.DbDataSourcer) error {
+	var data bytes.Buffer
+	if ds != nil {
+		if err := gob.NewEncoder(&data).Encode(&ds); err != nil {
+			return err
+		}
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(data.Len()))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(data.Bytes()))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
+
+// readSnapshot reads the DSs of a (decompressed) snapshot. A torn or
+// corrupt record, as left by a crash in the middle of writing the
+// snapshot, ends the snapshot: the DSs before it are returned along
+// with a non-nil torn describing the problem. So does a snapshot
+// missing its end record. An error is returned only if the snapshot
+// cannot be read at all.
+func readSnapshot(r io.Reader) (dss []serde.DbDataSourcer, torn, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(snapshotMagic)); !bytes.Equal(magic, snapshotMagic) {
+		// An earlier version snapshot, without checksums
+		err = gob.NewDecoder(br).Decode(&dss)
+		return dss, nil, err
+	}
+	br.Discard(len(snapshotMagic))
+
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return dss, fmt.Errorf("missing end of snapshot after %d data sources", len(dss)), nil
+		}
+		n, sum := binary.BigEndian.Uint32(hdr[0:4]), binary.BigEndian.Uint32(hdr[4:8])
+		if n == 0 {
+			return dss, nil, nil
+		}
+		if n > maxSnapshotRecord {
+			return dss, fmt.Errorf("corrupt record length %d after %d data sources", n, len(dss)), nil
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return dss, fmt.Errorf("torn record after %d data sources", len(dss)), nil
+		}
+		if crc32.ChecksumIEEE(data) != sum {
+			return dss, fmt.Errorf("checksum mismatch after %d data sources", len(dss)), nil
+		}
+		var ds serde.DbDataSourcer
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ds); err != nil {
+			return dss, fmt.Errorf("undecodable record after %d data sources: %v", len(dss), err), nil
+		}
+		dss = append(dss, ds)
+	}
+}
@@ -0,0 +1,171 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// dsSpiller moves the cached points of cold DSs to files in a
+// directory, see Receiver.SpillDir. A spill file is a snapshot of
+// just the one DS, named after its id.
+type dsSpiller struct {
+	dir string
+}
+
+// newDsSpiller returns a spiller for dir, which is created if need
+// be. Spill files left over from a previous run are removed, the
+// points in them are as lost as those which were cached in memory.
+func newDsSpiller(dir string) (*dsSpiller, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		log.Printf("dsSpiller: removing stale spill file %s.", path)
+		os.Remove(path)
+	}
+	return &dsSpiller{dir: dir}, nil
+}
+
+func (s *dsSpiller) path(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.spill", id))
+}
+
+// candidates returns the DSs with cached points in the order they
+// should be spilled, which is least recently accessed first.
+func (s *dsSpiller) candidates(cdsss ...map[int64]*cachedDs) []*cachedDs {
+	var result []*cachedDs
+	for _, cdss := range cdsss {
+		for _, cds := range cdss {
+			if cds.PointCount() > 0 {
+				result = append(result, cds)
+			}
+		}
+	}
+	sort.Sort(dsByLastAccess(result))
+	return result
+}
+
+type dsByLastAccess []*cachedDs
+
+func (a dsByLastAccess) Len() int           { return len(a) }
+func (a dsByLastAccess) Less(i, j int) bool { return a[i].lastDpRT.Before(a[j].lastDpRT) }
+func (a dsByLastAccess) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// spill writes the RRAs of the DS to its spill file and clears them,
+// it returns the number of points moved out of memory.
+func (s *dsSpiller) spill(cds *cachedDs) (int, error) {
+	cds.Lock()
+	defer cds.Unlock()
+	n := cds.PointCount()
+	if n == 0 || cds.spiller != nil {
+		return 0, nil
+	}
+	f, err := os.Create(s.path(cds.Id()))
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(snapshotMagic)
+	if err = writeSnapshotRecord(w, cds.DbDataSourcer); err == nil {
+		if err = writeSnapshotRecord(w, nil); err == nil {
+			err = w.Flush()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	cds.ClearRRAs(false)
+	cds.spiller, cds.spilledPoints = s, n
+	return n, nil
+}
+
+// unspill loads the RRAs of a spilled DS back from its spill file,
+// it does nothing if the DS is not spilled. It must be called with
+// the DS locked, before anything reads or changes its RRAs. Nothing
+// is applied to a spilled DS, so the RRAs are as they were when
+// spilled, except that late points (see rrd.DSSpec.LateGrace) are no
+// longer merged into slots closed before then. If the file cannot be
+// read, the spilled points are lost, the error says so.
+func (cds *cachedDs) unspill() error {
+	if cds.spiller == nil {
+		return nil
+	}
+	path := cds.spiller.path(cds.Id())
+	cds.spiller, cds.spilledPoints = nil, 0
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unspill: %v, %v points lost", err, cds.Ident())
+	}
+	defer f.Close()
+	dss, torn, err := readSnapshot(f)
+	if err == nil && torn != nil {
+		err = torn
+	}
+	if err == nil && (len(dss) != 1 || len(dss[0].RRAs()) != len(cds.RRAs())) {
+		err = fmt.Errorf("spill file %s does not match the DS", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unspill: %v, %v points lost", err, cds.Ident())
+	}
+	cds.SetRRAs(dss[0].RRAs())
+	return nil
+}
+
+// unspillLogged is unspill for when there is nothing to be done
+// about the error other than to log it.
+func (cds *cachedDs) unspillLogged() {
+	if err := cds.unspill(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// workerSpill spills the least recently accessed of the DSs until
+// the budget is no longer exceeded, it returns the number of points
+// moved out of memory and whether the budget is still exceeded.
+func workerSpill(ident string, budget *cacheBudget, sr statReporter, cdsss ...map[int64]*cachedDs) (int, bool) {
+	total := 0
+	for _, cds := range budget.spiller.candidates(cdsss...) {
+		n, err := budget.spiller.spill(cds)
+		if err != nil {
+			log.Printf("%s: unable to spill %v: %v", ident, cds.Ident(), err)
+			sr.reportStatCount("receiver.cache.spill_errors", 1)
+			continue
+		}
+		total += n
+		sr.reportStatCount("receiver.cache.spilled", 1)
+		sr.reportStatCount("receiver.cache.spilled_points", float64(n))
+		if !budget.add(-n) {
+			return total, false
+		}
+	}
+	return total, true
+}
@@ -19,21 +19,36 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
 )
 
 type wrkCtl struct {
 	wg, startWg *sync.WaitGroup
 	id          string
+	count       *int32 // number of running goroutines, can be nil
 }
 
 func (w *wrkCtl) ident() string { return w.id }
-func (w *wrkCtl) onEnter()      { w.wg.Add(1) }
-func (w *wrkCtl) onExit()       { w.wg.Done() }
 func (w *wrkCtl) onStarted()    { w.startWg.Done() }
 
+func (w *wrkCtl) onEnter() {
+	w.wg.Add(1)
+	if w.count != nil {
+		atomic.AddInt32(w.count, 1)
+	}
+}
+
+func (w *wrkCtl) onExit() {
+	if w.count != nil {
+		atomic.AddInt32(w.count, -1)
+	}
+	w.wg.Done()
+}
+
 type wController interface {
 	ident() string
 	onEnter()
@@ -48,14 +63,149 @@ var startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) {
 	startPacedMetricWorker(r, startWg)
 }
 
-var doStart = func(r *Receiver) {
+// nFlushers returns the number of flushers to start.
+func (r *Receiver) nFlushers() int {
+	if r.NFlushers > 0 {
+		return r.NFlushers
+	}
+	return r.NWorkers
+}
+
+// A ConfigError is returned by Start when a field of the Receiver
+// has an invalid value.
+type ConfigError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Receiver: invalid %s (%v): %s", e.Field, e.Value, e.Reason)
+}
+
+// checkConfig returns a *ConfigError for the first invalid field of
+// the Receiver.
+var checkConfig = func(r *Receiver) error {
+	switch {
+	case r.NWorkers <= 0:
+		return &ConfigError{"NWorkers", r.NWorkers, "must be greater than 0"}
+	case r.NDirectors < 0:
+		return &ConfigError{"NDirectors", r.NDirectors, "must not be negative"}
+	case r.NFlushers < 0:
+		return &ConfigError{"NFlushers", r.NFlushers, "must not be negative"}
+	case r.MaxFlushBurst < 0:
+		return &ConfigError{"MaxFlushBurst", r.MaxFlushBurst, "must not be negative"}
+	case r.MaxCachedPoints < 0:
+		return &ConfigError{"MaxCachedPoints", r.MaxCachedPoints, "must not be negative"}
+	case r.MaxCacheDuration < r.MinCacheDuration:
+		return &ConfigError{"MaxCacheDuration", r.MaxCacheDuration, "must not be less than MinCacheDuration"}
+	case r.StatFlushDuration <= 0:
+		return &ConfigError{"StatFlushDuration", r.StatFlushDuration, "must be greater than 0"}
+	}
+	return nil
+}
+
+// checkSerDe returns an error if the SerDe cannot reach its
+// storage.
+var checkSerDe = func(r *Receiver) error {
+	if p, ok := r.serde.(serde.Pinger); ok {
+		if err := p.Ping(); err != nil {
+			return fmt.Errorf("Receiver: database unreachable: %v", err)
+		}
+	}
+	return nil
+}
+
+// connPoolSizer is implemented by SerDes whose database connection
+// pool size can be set.
+type connPoolSizer interface {
+	SetMaxOpenConns(n int)
+}
+
+var checkFlushConnections = func(r *Receiver) error {
+	if r.MaxFlushConnections <= 0 {
+		return nil
+	}
+	if n := r.nFlushers(); n > r.MaxFlushConnections {
+		return fmt.Errorf("Receiver: number of flushers (%d) exceeds MaxFlushConnections (%d)", n, r.MaxFlushConnections)
+	}
+	if ps, ok := r.serde.(connPoolSizer); ok {
+		ps.SetMaxOpenConns(r.MaxFlushConnections)
+	}
+	return nil
+}
+
+// checkSchemaVersion returns an error if the schema of the SerDe
+// storage is not the one this version of Tgres expects, which could
+// otherwise lead to misbehaving or corrupting the data.
+var checkSchemaVersion = func(r *Receiver) error {
+	sv, ok := r.serde.(serde.SchemaVersioner)
+	if !ok {
+		return nil
+	}
+	version, err := sv.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("Receiver: cannot determine the database schema version: %v", err)
+	}
+	if version != serde.SchemaVersion {
+		return fmt.Errorf("Receiver: database schema version is %d, expected %d, refusing to start", version, serde.SchemaVersion)
+	}
+	return nil
+}
+
+var doStart = func(r *Receiver) error {
+	if err := checkConfig(r); err != nil {
+		return err
+	}
+	if err := checkSerDe(r); err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(r); err != nil {
+		return err
+	}
+	if err := checkFlushConnections(r); err != nil {
+		return err
+	}
+
+	r.dsc.bounds = newValueBounds(r.MinValue, r.MaxValue)
+	r.dsc.setFlushJitter(r.FlushJitter, r.FlushJitterSeed)
+	r.dsc.newDSHook = r.newDSHook
 	log.Printf("Receiver: Caching data sources...")
 	r.dsc.preLoad()
 	log.Printf("Receiver: Cached %d data sources.", len(r.dsc.byIdent))
+	r.dsc.limitCreateRate(r.MaxNewDSPerSecond)
+	r.dsc.limitConcurrentCreates(r.MaxConcurrentCreates)
+	r.dsc.limitRRASlots(r.MaxRRASlots)
+	if r.FetchTimeout > 0 {
+		r.dsc.setFetchTimeout(r.FetchTimeout)
+	}
+	r.dsc.allowTagKeys(r.TagKeyAllowlist, r.StripDisallowedTagKeys)
+	r.dsc.requireTagKeys(r.RequiredTagKeys)
+	if r.ClusterFailurePolicy == ClusterFallbackLocal {
+		r.dsc.health = &clusterHealth{downAfter: r.ClusterDownAfter}
+	}
+	r.dsc.fwdWindow = r.ForwardAccumulateWindow
+	r.dsc.typePolicy = r.TypeConflictPolicy
+	r.dsc.skewTolerance, r.dsc.skewPolicy = r.SkewTolerance, r.SkewPolicy
+
+	if r.ReadOnly {
+		log.Printf("Receiver: Read-only, not starting workers, flushers or director.")
+		log.Printf("Receiver: Ready.")
+		return nil
+	}
 
 	log.Printf("Receiver: starting...")
 
+	// The workers read dpChs too (aggWorker, pacedMetricWorker), so
+	// it must be sized before any of them starts.
+	if r.NDirectors > len(r.dpChs) {
+		r.dpChs = r.dpChs.resize(r.NDirectors)
+	}
+
 	var startWg sync.WaitGroup
+	if r.dsc.fetchTimeout > 0 {
+		r.dsc.startFetchers(&r.fetcherWg, &startWg, &r.goroutines)
+	}
 	startAllWorkers(r, &startWg)
 
 	// Wait for workers/flushers to start correctly
@@ -63,22 +213,28 @@ var doStart = func(r *Receiver) {
 	log.Printf("Receiver: All workers running, starting director.")
 
 	startWg.Add(1)
-	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director"}, r.dpCh, r.cluster, r, r.dsc, r.workerChs)
+	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director", count: &r.goroutines}, r.dpChs, r.cluster, r, r.dsc, r.workerChs)
 	startWg.Wait()
 
 	log.Printf("Receiver: Ready.")
+	return nil
 }
 
 var stopDirector = func(r *Receiver) {
-	log.Printf("Closing director channel...")
-	close(r.dpCh)
+	log.Printf("Closing director channels...")
+	r.dpChs.close()
 	r.directorWg.Wait()
 	log.Printf("Director finished.")
 }
 
 var doStop = func(r *Receiver, clstr clusterer) {
-	stopDirector(r)
 	stopAllWorkers(r)
+	if r.dsc != nil {
+		r.dsc.endAllSubscriptions()
+	}
+	if clstr == nil {
+		return
+	}
 	log.Printf("Leaving cluster...")
 	clstr.Leave(1 * time.Second)
 	clstr.Shutdown()
@@ -122,22 +278,62 @@ var stopPacedMetricWorker = func(pacedMetricCh chan *pacedMetric, pacedMetricWg
 }
 
 var stopAllWorkers = func(r *Receiver) {
-	// Order matters here
-	stopPacedMetricWorker(r.pacedMetricCh, &r.pacedMetricWg)
-	stopAggWorker(r.aggCh, &r.aggWg)
+	if r.ReadOnly { // nothing was started
+		return
+	}
+	// Order matters here. The aggregator is stopped before the
+	// director so that the data points of its last flush are
+	// processed rather than lost.
+	if r.pacedMetricsEnabled() {
+		if r.coalescer != nil {
+			close(r.coalescerDone)
+			r.coalescerWg.Wait()
+		}
+		stopPacedMetricWorker(r.pacedMetricCh, &r.pacedMetricWg)
+	}
+	if r.aggregatorEnabled() {
+		stopAggWorker(r.aggCh, &r.aggWg)
+	}
+	stopDirector(r)
+	if r.dsc != nil && r.dsc.fetchTimeout > 0 { // the director was their only client
+		r.dsc.stopFetchers(&r.fetcherWg)
+	}
 	stopWorkers(r.workerChs, &r.workerWg)
 	stopFlushers(r.flusher.channels(), &r.flusherWg)
+	// The flushers were the only users of the serde Flusher
+	if fs, ok := r.flusher.flusher().(serde.FlushStopper); ok {
+		fs.Stop()
+	}
 }
 
 var startWorkers = func(r *Receiver, startWg *sync.WaitGroup) {
 
 	r.workerChs = make([]chan *incomingDpWithDs, r.NWorkers)
 
+	var budget *cacheBudget
+	if r.MaxTotalCachedPoints > 0 {
+		budget = &cacheBudget{max: r.MaxTotalCachedPoints, hook: r.memoryPressureHook}
+		if r.SpillDir != "" {
+			spiller, err := newDsSpiller(r.SpillDir)
+			if err != nil {
+				log.Printf("Unable to spill to %s, will flush early instead: %v", r.SpillDir, err)
+			} else {
+				log.Printf("Spilling cold DSs to %s.", r.SpillDir)
+				budget.spiller, r.dsc.spiller = spiller, spiller
+			}
+		}
+	}
+
+	var onPanic *workerPanicHandler
+	if r.WorkerPanicPolicy == WorkerPanicRestart {
+		onPanic = &workerPanicHandler{dsc: r.dsc}
+	}
+
 	log.Printf("Starting %d workers...", r.NWorkers)
 	startWg.Add(r.NWorkers)
 	for i := 0; i < r.NWorkers; i++ {
 		r.workerChs[i] = make(chan *incomingDpWithDs, 1024)
-		go worker(&wrkCtl{wg: &r.flusherWg, startWg: startWg, id: fmt.Sprintf("worker_%d", i)}, r.flusher, r.workerChs[i], r.MinCacheDuration, r.MaxCacheDuration, r.MaxCachedPoints, time.Second, r)
+		go worker(&wrkCtl{wg: &r.flusherWg, startWg: startWg, id: fmt.Sprintf("worker_%d", i), count: &r.goroutines}, r.flusher, r.workerChs[i], r.MinCacheDuration, r.MaxCacheDuration, r.MaxCachedPoints, time.Second, r.ReorderWindow, r.TimeStampAlignment, r.FlushPriority, budget, onPanic, r)
 
 	}
 }
@@ -147,19 +343,34 @@ var startFlushers = func(r *Receiver, startWg *sync.WaitGroup) {
 		return
 	}
 
-	log.Printf("Starting %d flushers...", r.NWorkers)
-	startWg.Add(r.NWorkers)
-	r.flusher.start(r.NWorkers, &r.flusherWg, startWg, r.MaxFlushRatePerSecond)
+	n := r.nFlushers()
+	log.Printf("Starting %d flushers...", n)
+	startWg.Add(n)
+	r.flusher.start(n, &r.flusherWg, startWg, r.MaxFlushRatePerSecond, r.MaxFlushBurst)
 }
 
 var startAggWorker = func(r *Receiver, startWg *sync.WaitGroup) {
+	if !r.aggregatorEnabled() {
+		log.Printf("Aggregator disabled, not starting aggWorker.")
+		return
+	}
 	log.Printf("Starting aggWorker...")
 	startWg.Add(1)
-	go aggWorker(&wrkCtl{wg: &r.aggWg, startWg: startWg, id: "aggWorker"}, r.aggCh, r.cluster, r.StatFlushDuration, r.StatsNamePrefix, r, r)
+	go aggWorker(&wrkCtl{wg: &r.aggWg, startWg: startWg, id: "aggWorker", count: &r.goroutines}, r.aggCh, r.cluster, r.StatFlushDuration, r.StatsNamePrefix, r, r)
 }
 
 var startPacedMetricWorker = func(r *Receiver, startWg *sync.WaitGroup) {
+	if !r.pacedMetricsEnabled() {
+		log.Printf("Paced metrics disabled, not starting pacedMetricWorker.")
+		return
+	}
 	log.Printf("Starting pacedMetricWorker...")
 	startWg.Add(1)
-	go pacedMetricWorker(&wrkCtl{wg: &r.pacedMetricWg, startWg: startWg, id: "pacedMetricWorker"}, r.pacedMetricCh, r, r, time.Second, r)
+	go pacedMetricWorker(&wrkCtl{wg: &r.pacedMetricWg, startWg: startWg, id: "pacedMetricWorker", count: &r.goroutines}, r.pacedMetricCh, internalQueuer{r}, internalQueuer{r}, time.Second, r)
+	if r.PacedSumCoalesce > 0 {
+		log.Printf("Coalescing paced sums every %v.", r.PacedSumCoalesce)
+		r.coalescer, r.coalescerDone = newPacedSumCoalescer(), make(chan bool)
+		startWg.Add(1)
+		go pacedSumCoalescerWorker(&wrkCtl{wg: &r.coalescerWg, startWg: startWg, id: "pacedSumCoalescer", count: &r.goroutines}, r.coalescer, r.pacedMetricCh, r.PacedSumCoalesce, r.coalescerDone)
+	}
 }
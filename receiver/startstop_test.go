@@ -16,11 +16,13 @@
 package receiver
 
 import (
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
 )
 
 func Test_startstop_wrkCtl(t *testing.T) {
@@ -28,6 +30,17 @@ func Test_startstop_wrkCtl(t *testing.T) {
 	if wc.ident() != "foo" {
 		t.Errorf(`wc.ident() != "foo"`)
 	}
+
+	r := &Receiver{}
+	wc = &wrkCtl{wg: &sync.WaitGroup{}, id: "foo", count: &r.goroutines}
+	wc.onEnter()
+	if r.Goroutines() != 1 {
+		t.Errorf("onEnter: Goroutines() != 1: %d", r.Goroutines())
+	}
+	wc.onExit()
+	if r.Goroutines() != 0 {
+		t.Errorf("onExit: Goroutines() != 0: %d", r.Goroutines())
+	}
 }
 
 func Test_startstop_startAllWorkers(t *testing.T) {
@@ -54,18 +67,18 @@ func Test_startstop_doStart(t *testing.T) {
 	fl := &dsFlusher{db: db, sr: sr}
 	dsc := newDsCache(db, df, fl)
 
-	r := &Receiver{dpCh: make(chan *IncomingDP), dsc: dsc}
+	r := &Receiver{NWorkers: 1, StatFlushDuration: time.Second, dpChs: directorChannels{make(chan *IncomingDP)}, dsc: dsc}
 
 	saveDisp := director
 	saveSaw := startAllWorkers
 	called := 0
 	stopped := false
-	director = func(wc wController, dpCh chan *IncomingDP, clstr clusterer, scr statReporter, dss *dsCache, workerChs workerChannels) {
+	director = func(wc wController, dpChs directorChannels, clstr clusterer, scr statReporter, dss *dsCache, workerChs workerChannels) {
 		wc.onEnter()
 		defer wc.onExit()
 		called++
 		wc.onStarted()
-		if _, ok := <-dpCh; !ok {
+		if _, ok := <-dpChs[0]; !ok {
 			stopped = true
 		}
 	}
@@ -100,6 +113,168 @@ func Test_startstop_doStart(t *testing.T) {
 	startAllWorkers = saveSaw
 }
 
+func Test_startstop_doStart_ReadOnly(t *testing.T) {
+	db := &fakeSerde{}
+	df := &SimpleDSFinder{DftDSSPec}
+	dsc := newDsCache(db, df, &dsFlusher{db: db, sr: &fakeSr{}})
+
+	// unbuffered, anything queued would block
+	r := &Receiver{NWorkers: 1, StatFlushDuration: time.Second, dsc: dsc, ReadOnly: true, ReportStats: true,
+		dpChs: directorChannels{make(chan *IncomingDP)}, pacedMetricCh: make(chan *pacedMetric)}
+
+	saveDisp, saveSaw := director, startAllWorkers
+	called := 0
+	director = func(wc wController, dpChs directorChannels, clstr clusterer, scr statReporter, dss *dsCache, workerChs workerChannels) {
+		called++
+	}
+	startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) { called++ }
+	if err := doStart(r); err != nil {
+		t.Errorf("doStart: read-only: %v", err)
+	}
+	if called != 0 {
+		t.Errorf("doStart: read-only: expected nothing to be started")
+	}
+	director, startAllWorkers = saveDisp, saveSaw
+
+	foo := serde.Ident{"name": "foo"}
+	if err := r.QueueDataPoint(foo, time.Now(), 1); err != ErrReadOnly {
+		t.Errorf("QueueDataPoint: read-only: expected ErrReadOnly, got %v", err)
+	}
+	if err := r.QueueSum(foo, 1); err != ErrReadOnly {
+		t.Errorf("QueueSum: read-only: expected ErrReadOnly, got %v", err)
+	}
+	if _, err := r.RepairLastUpdate(foo); err != ErrReadOnly {
+		t.Errorf("RepairLastUpdate: read-only: expected ErrReadOnly, got %v", err)
+	}
+	r.reportStatCount("foo", 1) // dropped
+
+	stopAllWorkers(r) // nothing to stop, must not panic
+}
+
+type fakePoolSerde struct {
+	fakeSerde
+	maxOpenConns int
+}
+
+func (f *fakePoolSerde) SetMaxOpenConns(n int) { f.maxOpenConns = n }
+
+func Test_startstop_checkFlushConnections(t *testing.T) {
+	db := &fakePoolSerde{}
+	r := &Receiver{NWorkers: 4, StatFlushDuration: time.Second, serde: db}
+
+	// no limit
+	if err := checkFlushConnections(r); err != nil || db.maxOpenConns != 0 {
+		t.Errorf("checkFlushConnections: no limit: err %v, maxOpenConns %d", err, db.maxOpenConns)
+	}
+
+	r.MaxFlushConnections = 4
+	if err := checkFlushConnections(r); err != nil || db.maxOpenConns != 4 {
+		t.Errorf("checkFlushConnections: err %v, maxOpenConns %d (expected 4)", err, db.maxOpenConns)
+	}
+
+	r.NFlushers = 5
+	if err := checkFlushConnections(r); err == nil {
+		t.Errorf("checkFlushConnections: NFlushers > MaxFlushConnections should be an error")
+	}
+
+	// a misconfigured receiver does not start
+	saveSaw := startAllWorkers
+	calledSAW := 0
+	startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) { calledSAW++ }
+	if err := doStart(r); err == nil || calledSAW != 0 {
+		t.Errorf("doStart: expected an error and no workers started, got err %v, calledSAW %d", err, calledSAW)
+	}
+	startAllWorkers = saveSaw
+}
+
+type fakeVersionedSerde struct {
+	fakeSerde
+	version int
+	err     error
+}
+
+func (f *fakeVersionedSerde) SchemaVersion() (int, error) { return f.version, f.err }
+
+func Test_startstop_checkSchemaVersion(t *testing.T) {
+	r := &Receiver{NWorkers: 1, StatFlushDuration: time.Second, serde: &fakeSerde{}}
+	if err := checkSchemaVersion(r); err != nil {
+		t.Errorf("checkSchemaVersion: a SerDe without a schema should pass: %v", err)
+	}
+
+	db := &fakeVersionedSerde{version: serde.SchemaVersion}
+	r.serde = db
+	if err := checkSchemaVersion(r); err != nil {
+		t.Errorf("checkSchemaVersion: unexpected error: %v", err)
+	}
+	db.version = serde.SchemaVersion - 1
+	if err := checkSchemaVersion(r); err == nil {
+		t.Errorf("checkSchemaVersion: expected an error for an older schema")
+	}
+	db.version, db.err = serde.SchemaVersion, fmt.Errorf("some error")
+	if err := checkSchemaVersion(r); err == nil {
+		t.Errorf("checkSchemaVersion: expected an error when the version cannot be read")
+	}
+
+	// with a wrong version the receiver does not start
+	db.err = nil
+	db.version = serde.SchemaVersion + 1
+	saveSaw := startAllWorkers
+	calledSAW := 0
+	startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) { calledSAW++ }
+	if err := doStart(r); err == nil || calledSAW != 0 {
+		t.Errorf("doStart: expected an error and no workers started, got err %v, calledSAW %d", err, calledSAW)
+	}
+	startAllWorkers = saveSaw
+}
+
+func Test_startstop_checkConfig(t *testing.T) {
+	r := &Receiver{NWorkers: 1, StatFlushDuration: time.Second}
+	if err := checkConfig(r); err != nil {
+		t.Errorf("checkConfig: unexpected error: %v", err)
+	}
+
+	r.NWorkers = 0
+	err := checkConfig(r)
+	if ce, ok := err.(*ConfigError); !ok || ce.Field != "NWorkers" {
+		t.Errorf("checkConfig: expected a ConfigError for NWorkers, got %v", err)
+	}
+	r.NWorkers = 1
+
+	r.MinCacheDuration = time.Minute
+	err = checkConfig(r)
+	if ce, ok := err.(*ConfigError); !ok || ce.Field != "MaxCacheDuration" {
+		t.Errorf("checkConfig: expected a ConfigError for MaxCacheDuration, got %v", err)
+	}
+
+	// an invalid config does not start
+	saveSaw := startAllWorkers
+	calledSAW := 0
+	startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) { calledSAW++ }
+	if err := doStart(r); err == nil || calledSAW != 0 {
+		t.Errorf("doStart: expected an error and no workers started, got err %v, calledSAW %d", err, calledSAW)
+	}
+	startAllWorkers = saveSaw
+}
+
+type fakePingSerde struct {
+	fakeSerde
+	err error
+}
+
+func (f *fakePingSerde) Ping() error { return f.err }
+
+func Test_startstop_checkSerDe(t *testing.T) {
+	db := &fakePingSerde{}
+	r := &Receiver{serde: db}
+	if err := checkSerDe(r); err != nil {
+		t.Errorf("checkSerDe: unexpected error: %v", err)
+	}
+	db.err = fmt.Errorf("connection refused")
+	if err := checkSerDe(r); err == nil {
+		t.Errorf("checkSerDe: expected an error for an unreachable database")
+	}
+}
+
 func Test_startstop_Receiver_doStop(t *testing.T) {
 	f1, f2 := stopDirector, stopAllWorkers
 	called, calledSAW := 0, 0
@@ -241,24 +416,30 @@ func Test_startstop_stopAggWorker(t *testing.T) {
 
 func Test_startstop_stopAllWorkers(t *testing.T) {
 	// Save
-	f1, f2, f3, f4 := stopWorkers, stopFlushers, stopAggWorker, stopPacedMetricWorker
+	f1, f2, f3, f4, f5 := stopWorkers, stopFlushers, stopAggWorker, stopPacedMetricWorker, stopDirector
 	called := 0
+	stopDirector = func(_ *Receiver) { called++ }
 	stopWorkers = func(workerChs []chan *incomingDpWithDs, workerWg *sync.WaitGroup) { called++ }
 	stopFlushers = func(flusherChs []chan *dsFlushRequest, flusherWg *sync.WaitGroup) { called++ }
 	stopAggWorker = func(aggCh chan *aggregator.Command, aggWg *sync.WaitGroup) { called++ }
 	stopPacedMetricWorker = func(pacedMetricCh chan *pacedMetric, pacedMetricWg *sync.WaitGroup) { called++ }
 	stopAllWorkers(&Receiver{flusher: &fakeDsFlusher{}})
-	if called != 4 {
-		t.Errorf("stopAllWorkers: called != 4")
+	if called != 5 {
+		t.Errorf("stopAllWorkers: called != 5")
+	}
+	db := &fakeDroppingFlusher{}
+	stopAllWorkers(&Receiver{flusher: &dsFlusher{db: db}})
+	if !db.stopped {
+		t.Errorf("stopAllWorkers: the serde Flusher was not stopped")
 	}
 	// Restore
-	stopWorkers, stopFlushers, stopAggWorker, stopPacedMetricWorker = f1, f2, f3, f4
+	stopWorkers, stopFlushers, stopAggWorker, stopPacedMetricWorker, stopDirector = f1, f2, f3, f4, f5
 }
 
 func Test_startstop_startWorkers(t *testing.T) {
 	nWorkers := 0
 	saveWorker := worker
-	worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incomingDpWithDs, minCacheDur, maxCacheDur time.Duration, maxPoints int, flushInt time.Duration, sr statReporter) {
+	worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incomingDpWithDs, minCacheDur, maxCacheDur time.Duration, maxPoints int, flushInt, reorderWin time.Duration, align TimeStampAlignment, prio FlushPriority, budget *cacheBudget, onPanic *workerPanicHandler, sr statReporter) {
 		wc.onEnter()
 		defer wc.onExit()
 		nWorkers++
@@ -350,3 +531,27 @@ func Test_startstop_startPacedMetricWorker(t *testing.T) {
 	}
 	pacedMetricWorker = savePMW
 }
+
+func Test_startstop_startPacedMetricWorker_coalescer(t *testing.T) {
+	savePMW := pacedMetricWorker
+	pacedMetricWorker = func(wc wController, pacedMetricCh chan *pacedMetric, acq aggregatorCommandQueuer, dpq dataPointQueuer, frequency time.Duration, sr statReporter) {
+		wc.onEnter()
+		defer wc.onExit()
+		wc.onStarted()
+	}
+	var startWg sync.WaitGroup
+	r := &Receiver{PacedSumCoalesce: time.Hour, pacedMetricCh: make(chan *pacedMetric, 1)}
+	startPacedMetricWorker(r, &startWg)
+	startWg.Wait()
+	r.pacedMetricWg.Wait()
+
+	if n := r.Goroutines(); n != 1 {
+		t.Errorf("startPacedMetricWorker: expected the coalescer to be counted, got %d goroutines", n)
+	}
+	close(r.coalescerDone)
+	r.coalescerWg.Wait()
+	if n := r.Goroutines(); n != 0 {
+		t.Errorf("startPacedMetricWorker: expected 0 goroutines after the coalescer stopped, got %d", n)
+	}
+	pacedMetricWorker = savePMW
+}
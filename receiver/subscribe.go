@@ -0,0 +1,128 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// A SubscribedPoint is a data point as it was applied to a DS, i.e.
+// with the time stamp aligned and, for a counter, the value being
+// the rate.
+type SubscribedPoint struct {
+	TimeStamp time.Time
+	Value     float64
+}
+
+// A Subscription delivers the data points applied to a DS, see
+// Receiver.Subscribe.
+type Subscription struct {
+	// C is where the points are delivered. It is closed by
+	// Unsubscribe, once the receiver stops or once the DS is no
+	// longer handled by this node (in a cluster).
+	C <-chan SubscribedPoint
+
+	c       chan SubscribedPoint
+	cds     *cachedDs
+	closed  bool  // guarded by cds
+	dropped int64 // atomic
+}
+
+// Subscribe returns a Subscription to the data points applied to the
+// DS identified by ident, with a channel buffer of size points (at
+// least 1). A DS can have any number of subscribers. The worker never
+// waits for a subscriber, a point which does not fit in the buffer
+// is dropped (see Dropped), thus a slow or abandoned subscriber
+// cannot hold up the receiver, but it should still call Unsubscribe
+// when done. The DS must be cached (in a cluster, handled) by this
+// node.
+func (r *Receiver) Subscribe(ident serde.Ident, size int) (*Subscription, error) {
+	cds := r.dsc.getByIdent(ident)
+	if cds == nil {
+		return nil, fmt.Errorf("Subscribe: unknown data source: %v", ident)
+	}
+	if size < 1 {
+		size = 1
+	}
+	c := make(chan SubscribedPoint, size)
+	sub := &Subscription{C: c, c: c, cds: cds}
+	cds.Lock()
+	cds.subs = append(cds.subs, sub)
+	cds.Unlock()
+	return sub, nil
+}
+
+// Unsubscribe stops the delivery of points and closes C. It is safe
+// to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.cds.Lock()
+	defer s.cds.Unlock()
+	for i, sub := range s.cds.subs {
+		if sub == s {
+			s.cds.subs = append(s.cds.subs[:i], s.cds.subs[i+1:]...)
+			break
+		}
+	}
+	s.close()
+}
+
+// Dropped returns the number of points which were dropped because
+// the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// close must be called with the DS locked.
+func (s *Subscription) close() {
+	if !s.closed {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+// publish sends the point to all the subscribers without blocking,
+// it must be called with the DS locked.
+func (cds *cachedDs) publish(ts time.Time, value float64) {
+	for _, sub := range cds.subs {
+		select {
+		case sub.c <- SubscribedPoint{TimeStamp: ts, Value: value}:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// endSubscriptions closes all the subscriptions, it must be called
+// with the DS locked.
+func (cds *cachedDs) endSubscriptions() {
+	for _, sub := range cds.subs {
+		sub.close()
+	}
+	cds.subs = nil
+}
+
+// endAllSubscriptions closes the subscriptions of all the cached DSs.
+func (d *dsCache) endAllSubscriptions() {
+	for _, cds := range d.all() {
+		cds.Lock()
+		cds.endSubscriptions()
+		cds.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// A Tracer creates the spans which trace a data point through the
+// receiver, see Receiver.Tracer. It is meant to adapt a tracing
+// library such as OpenTelemetry, which Tgres does not depend on.
+type Tracer interface {
+	// StartSpan starts a span named name, a child of whatever span
+	// ctx carries, with ident (of the DS) as an attribute.
+	StartSpan(ctx context.Context, name string, ident serde.Ident) Span
+}
+
+// A Span is what a Tracer returns. End is called once the stage it
+// traces is done, possibly by another goroutine.
+type Span interface {
+	End()
+}
+
+// The stages traced, in order. All the spans are children of the
+// context passed to WithContext.
+const (
+	SpanEnqueue = "enqueue" // the Queue* call, including any wait for the receiver channel
+	SpanRoute   = "route"   // the director, including fetching or creating the DS
+	SpanApply   = "apply"   // the worker applying the point to the DS
+	SpanFlush   = "flush"   // queuing and saving the DS, the parent being the last point applied
+)
+
+// WithContext makes ctx the parent of the spans tracing the data
+// point, when the receiver has a Tracer.
+func WithContext(ctx context.Context) QueueOption {
+	return func(o *queueOptions) {
+		o.ctx = ctx
+	}
+}
+
+// dpTrace is how a data point is being traced.
+type dpTrace struct {
+	tracer Tracer
+	ctx    context.Context
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span for the stage if the trace is not nil.
+func (t *dpTrace) startSpan(name string, ident serde.Ident) Span {
+	if t == nil {
+		return noopSpan{}
+	}
+	return t.tracer.StartSpan(t.ctx, name, ident)
+}
+
+// newDpTrace returns the trace of a data point queued with o, nil
+// if there is no tracer.
+func newDpTrace(o queueOptions) *dpTrace {
+	if o.tracer == nil {
+		return nil
+	}
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &dpTrace{tracer: o.tracer, ctx: ctx}
+}
@@ -18,34 +18,183 @@ package receiver
 import (
 	"fmt"
 	"log"
+	"runtime"
+	"sort"
+	"sync/atomic"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
 )
 
 type workerChannels []chan *incomingDpWithDs
 
+// send sends msg to the worker responsible for the DS. The DS route
+// lock is held while sending, so that the DS cannot move to another
+// worker until msg is in the channel, see Receiver.RebalanceWorker.
+func (w workerChannels) send(cds *cachedDs, msg *incomingDpWithDs) {
+	cds.route.RLock()
+	defer cds.route.RUnlock()
+	w[cds.workerIndex(len(w))] <- msg
+}
+
 func (w workerChannels) queue(dp *incomingDP, cds *cachedDs) {
-	w[cds.Id()%int64(len(w))] <- &incomingDpWithDs{dp, cds}
+	w.send(cds, &incomingDpWithDs{dp: dp, cds: cds})
+}
+
+// queueGap sends a MarkGap request to the worker responsible for
+// the DS and waits for the result.
+func (w workerChannels) queueGap(cds *cachedDs, from, to time.Time) error {
+	gap := &gapRequest{from: from, to: to, resp: make(chan error, 1)}
+	w.send(cds, &incomingDpWithDs{cds: cds, gap: gap})
+	return <-gap.resp
+}
+
+// queueRecompute sends a recompute request to the worker responsible
+// for the DS and waits for the result.
+func (w workerChannels) queueRecompute(cds *cachedDs, rraIndex int, src []rrd.SlotValue, srcStep time.Duration) error {
+	rc := &recomputeRequest{rraIndex: rraIndex, src: src, srcStep: srcStep, resp: make(chan error, 1)}
+	w.send(cds, &incomingDpWithDs{cds: cds, recompute: rc})
+	return <-rc.resp
+}
+
+// queueTouch sends a Touch request to the worker responsible for the
+// DS.
+func (w workerChannels) queueTouch(cds *cachedDs, ts time.Time) {
+	w.send(cds, &incomingDpWithDs{cds: cds, touch: &ts})
+}
+
+// queueFlush sends a flush request to the worker responsible for the
+// DS, see AggDirect.
+func (w workerChannels) queueFlush(cds *cachedDs) {
+	w.send(cds, &incomingDpWithDs{cds: cds, flush: true})
 }
 
 type incomingDpWithDs struct {
-	dp  *incomingDP
+	dp        *incomingDP
+	cds       *cachedDs
+	gap       *gapRequest       // If not nil, this is a gap request and dp is nil
+	recompute *recomputeRequest // If not nil, this is a recompute request and dp is nil
+	touch     *time.Time        // If not nil, this is a touch request and dp is nil
+	drain     *drainRequest     // If not nil, this is a drain request and dp and cds are nil
+	flush     bool              // If true, this is a flush request and dp is nil
+}
+
+// drainRequest tells a worker to apply the held points of DSs moving
+// to other workers and flush them, see Receiver.RebalanceWorker. The
+// response is the number of DSs drained, unflushed are those which
+// could not be flushed (rate limited).
+type drainRequest struct {
+	moves     []dsMove
+	unflushed []*cachedDs
+	resp      chan int
+}
+
+// A dsMove is a DS and the index of the worker it is moving to.
+type dsMove struct {
 	cds *cachedDs
+	to  int
+}
+
+type gapRequest struct {
+	from, to time.Time
+	resp     chan error
+}
+
+type recomputeRequest struct {
+	rraIndex int
+	src      []rrd.SlotValue
+	srcStep  time.Duration
+	resp     chan error
+}
+
+// workerMarkGap flushes whatever data the DS has, then sets the RRA
+// slots from-to to NaN and flushes again, thereby saving only the gap.
+var workerMarkGap = func(dsf dsFlusherBlocking, cds *cachedDs, from, to time.Time) error {
+	if !dsf.enabled() {
+		return fmt.Errorf("flushing is not supported")
+	}
+	cds.Lock()
+	defer cds.Unlock()
+	cds.unspillLogged()
+	if cds.PointCount() > 0 && !dsf.flushDs(cds.DbDataSourcer, true) {
+		return fmt.Errorf("unable to flush data source (rate limited), try again later")
+	}
+	cds.unflushedRT = time.Time{} // the gap is flushed or cleared below
+	cds.MarkGap(from, to)
+	if cds.PointCount() > 0 && !dsf.flushDs(cds.DbDataSourcer, true) {
+		cds.ClearRRAs(false) // do not let the NaNs get flushed as regular data later
+		return fmt.Errorf("unable to flush data source (rate limited), try again later")
+	}
+	return nil
+}
+
+// workerRecompute flushes whatever data the DS has, then replaces the
+// slots of the RRA covered by the request with values consolidated
+// from the source slots and flushes again, thereby saving only those.
+var workerRecompute = func(dsf dsFlusherBlocking, cds *cachedDs, rc *recomputeRequest) error {
+	if !dsf.enabled() {
+		return fmt.Errorf("flushing is not supported")
+	}
+	cds.Lock()
+	defer cds.Unlock()
+	cds.unspillLogged()
+	if cds.PointCount() > 0 && !dsf.flushDs(cds.DbDataSourcer, true) {
+		return fmt.Errorf("unable to flush data source (rate limited), try again later")
+	}
+	cds.unflushedRT = time.Time{} // the recomputed slots are flushed or cleared below
+	if err := cds.RecomputeRRA(rc.rraIndex, rc.src, rc.srcStep); err != nil {
+		return err
+	}
+	if cds.PointCount() > 0 && !dsf.flushDs(cds.DbDataSourcer, true) {
+		cds.ClearRRAs(false) // do not let the recomputed slots get flushed as regular data later
+		return fmt.Errorf("unable to flush data source (rate limited), try again later")
+	}
+	return nil
+}
+
+// workerTouch advances the last update of the DS to ts, aligned like
+// a data point would be. It returns false if there was nothing to
+// do, i.e. ts is not after the last update.
+func workerTouch(cds *cachedDs, ts time.Time, align TimeStampAlignment) bool {
+	ts = align.align(ts, cds.Step())
+	cds.Lock()
+	defer cds.Unlock()
+	cds.unspillLogged()
+	if !ts.After(cds.LastUpdate()) {
+		return false
+	}
+	cds.Touch(ts)
+	if cds.unflushedRT.IsZero() {
+		cds.unflushedRT = time.Now()
+	}
+	return true
 }
 
-var workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[int64]*cachedDs, minCacheDur, maxCacheDur time.Duration, maxPoints, maxFlushes int) map[int64]*cachedDs {
+// If early is true, every DS with cached points is due, regardless
+// of the cache parameters (see MaxTotalCachedPoints).
+var workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[int64]*cachedDs, minCacheDur, maxCacheDur time.Duration, maxPoints, maxFlushes int, prio FlushPriority, early bool) map[int64]*cachedDs {
+	var due []int64
+	for id, cds := range recent {
+		if early && cds.PointCount() > 0 || cds.shouldBeFlushed(maxPoints, minCacheDur, maxCacheDur) {
+			due = append(due, id)
+		}
+	}
+	if prio != FlushAnyOrder {
+		sort.Sort(&dsFlushOrder{due, recent, prio})
+	}
+
 	leftover := make(map[int64]*cachedDs)
 	n := 0
-	for id, cds := range recent {
-		if cds.shouldBeFlushed(maxPoints, minCacheDur, maxCacheDur) {
-			if debug {
-				log.Printf("%s: Requesting (periodic) flush of ds id: %d", ident, id)
-			}
-			if !dsf.flushDs(cds.DbDataSourcer, false) {
-				leftover[id] = cds
-			}
-			cds.lastFlushRT = time.Now()
-			delete(recent, id)
+	for _, id := range due {
+		cds := recent[id]
+		if debug {
+			log.Printf("%s: Requesting (periodic) flush of ds id: %d", ident, id)
 		}
+		if !dsf.flushCachedDs(cds) {
+			leftover[id] = cds
+		}
+		cds.setLastFlushRT(time.Now())
+		delete(recent, id)
 		n++
 		if n > maxFlushes {
 			break
@@ -54,6 +203,57 @@ var workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[i
 	return leftover
 }
 
+// dsFlushOrder sorts DS ids by FlushPriority.
+type dsFlushOrder struct {
+	ids  []int64
+	cdss map[int64]*cachedDs
+	prio FlushPriority
+}
+
+func (o *dsFlushOrder) Len() int      { return len(o.ids) }
+func (o *dsFlushOrder) Swap(i, j int) { o.ids[i], o.ids[j] = o.ids[j], o.ids[i] }
+func (o *dsFlushOrder) Less(i, j int) bool {
+	a, b := o.cdss[o.ids[i]], o.cdss[o.ids[j]]
+	if o.prio == FlushMostPointsFirst {
+		return a.PointCount() > b.PointCount()
+	}
+	return a.lastFlushRT.Before(b.lastFlushRT)
+}
+
+// cacheBudget keeps track of the number of points cached by all the
+// workers, see MaxTotalCachedPoints.
+type cacheBudget struct {
+	max      int
+	points   int64 // atomic
+	pressure int32 // atomic, 1 while over budget
+	hook     func(cachedPoints, budget int)
+	spiller  *dsSpiller // if not nil, spill rather than flush early
+}
+
+// add adds delta (which can be negative) to the number of cached
+// points and tells whether it is now over budget. The hook is called
+// when it goes over budget.
+func (b *cacheBudget) add(delta int) bool {
+	points := int(atomic.AddInt64(&b.points, int64(delta)))
+	if points <= b.max {
+		atomic.StoreInt32(&b.pressure, 0)
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&b.pressure, 0, 1) && b.hook != nil {
+		b.hook(points, b.max)
+	}
+	return true
+}
+
+// cachedPoints returns the number of points cached in the DSs.
+func cachedPoints(cdss map[int64]*cachedDs) int {
+	n := 0
+	for _, cds := range cdss {
+		n += cds.PointCount()
+	}
+	return n
+}
+
 func reportWorkerChannelFillPercent(workerCh chan *incomingDpWithDs, sr statReporter, ident string, nap time.Duration) {
 	fillStatName := fmt.Sprintf("receiver.workers.%s.channel.fill_percent", ident)
 	lenStatName := fmt.Sprintf("receiver.workers.%s.channel.len", ident)
@@ -69,16 +269,188 @@ func reportWorkerChannelFillPercent(workerCh chan *incomingDpWithDs, sr statRepo
 	}
 }
 
+// workerProcessDP applies an incoming data point to the DS, with its
+// time stamp aligned to the DS step as per align. It returns false if
+// the point was not applied.
+func workerProcessDP(ident string, cds *cachedDs, dp *incomingDP, align TimeStampAlignment, sr statReporter) bool {
+	defer dp.trace.startSpan(SpanApply, cds.Ident()).End()
+	value, ts := dp.Value, align.align(dp.TimeStamp, cds.Step())
+	if dp.IsInt && dp.IntWrapAt != 0 {
+		var ok bool
+		if value, ok = cds.counterRateInt(dp.IntValue, dp.IntWrapAt, ts); !ok {
+			return false
+		}
+	} else if dp.WrapAt != 0 {
+		var ok bool
+		if value, ok = cds.counterRate(value, dp.WrapAt, ts); !ok {
+			return false
+		}
+	}
+	if cds.outOfBoundsValue(value) {
+		sr.reportStatCount("receiver.datapoints.out_of_bounds", 1)
+		sr.reportDeadLetter(dp, DeadLetterOutOfBounds, fmt.Errorf("value %v out of bounds", value))
+		return false
+	}
+	if cds.sampling != nil && !cds.sampling.Accumulate(value, ts) {
+		return false
+	}
+	if wait := cds.lockTimed(); wait >= time.Millisecond {
+		sr.reportStatCount("receiver.worker.ds_lock.waits", 1)
+		sr.reportStatCount("receiver.worker.ds_lock.wait_ms", float64(wait)/float64(time.Millisecond))
+	}
+	if cds.spiller != nil {
+		if err := cds.unspill(); err != nil {
+			log.Printf("%s: %v", ident, err)
+		}
+		sr.reportStatCount("receiver.cache.unspilled", 1)
+	}
+	late := ts.Before(cds.LastUpdate())
+	err := func() error {
+		defer cds.Unlock() // even if it panics, see Receiver.WorkerPanicPolicy
+		err := cds.ProcessDataPoint(value, ts)
+		cds.lastDpRT = time.Now()
+		cds.stepUpDps++
+		if err == nil {
+			if cds.unflushedRT.IsZero() {
+				cds.unflushedRT = cds.lastDpRT
+			}
+			if dp.trace != nil {
+				cds.trace = dp.trace
+			}
+			if dp.Exemplar != nil {
+				cds.SetExemplar(rrd.Exemplar{Labels: dp.Exemplar, Value: dp.Value, TimeStamp: dp.TimeStamp})
+			}
+			cds.publish(ts, value)
+		}
+		return err
+	}()
+	if err == rrd.ErrTooLate {
+		sr.reportStatCount("receiver.datapoints.late_dropped", 1)
+		sr.reportDeadLetter(dp, DeadLetterLate, err)
+		return false
+	}
+	if err != nil {
+		log.Printf("%s: ds.ProcessDataPoint [%v] error: %v", ident, cds.Ident(), err)
+		sr.reportDeadLetter(dp, DeadLetterRejected, err)
+		return false
+	}
+	if late {
+		sr.reportStatCount("receiver.datapoints.late_merged", 1)
+	}
+	return true
+}
+
+// workerPanicHandler recovers a worker from a panic, see
+// Receiver.WorkerPanicPolicy. A nil *workerPanicHandler lets the
+// panic crash the process.
+type workerPanicHandler struct {
+	dsc *dsCache
+}
+
+// recovered logs and counts the panic p of the worker, which was
+// working on msg (nil if unknown). The DS of msg is reloaded from the
+// database and returned, and the request, if msg is one, fails.
+func (h *workerPanicHandler) recovered(ident string, p interface{}, msg *incomingDpWithDs, sr statReporter) *cachedDs {
+	stack := make([]byte, 8192)
+	stack = stack[:runtime.Stack(stack, false)]
+	log.Printf("%s: recovered from panic: %v\n%s", ident, p, stack)
+	sr.reportStatCount("receiver.worker.panics", 1)
+	if msg == nil {
+		return nil
+	}
+	err := fmt.Errorf("worker panic: %v", p)
+	switch {
+	case msg.gap != nil:
+		msg.gap.resp <- err
+	case msg.recompute != nil:
+		msg.recompute.resp <- err
+	case msg.drain != nil:
+		msg.drain.resp <- 0
+	}
+	if msg.cds == nil {
+		return nil
+	}
+	cds, err := h.dsc.reload(msg.cds)
+	if err != nil {
+		log.Printf("%s: unable to reload %v after panic: %v", ident, msg.cds.Ident(), err)
+		sr.reportStatCount("receiver.worker.panic_reload_errors", 1)
+		return nil
+	}
+	log.Printf("%s: reloaded %v from the database after panic.", ident, msg.cds.Ident())
+	return cds
+}
+
 var worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incomingDpWithDs,
-	minCacheDur, maxCacheDur time.Duration, maxPoints int, flushInt time.Duration, sr statReporter) {
+	minCacheDur, maxCacheDur time.Duration, maxPoints int, flushInt, reorderWin time.Duration, align TimeStampAlignment, prio FlushPriority, budget *cacheBudget, onPanic *workerPanicHandler, sr statReporter) {
 	wc.onEnter()
 	defer wc.onExit()
 
 	var (
 		recent       = make(map[int64]*cachedDs)
 		leftover     map[int64]*cachedDs
+		holding      = make(map[int64]*cachedDs) // DSs with held (not yet applied) points
+		reloaded     map[int64]*cachedDs         // DSs reloaded after a panic, by id
 		flushEnabled = dsf.enabled()
+		cached       int // our share of the budget
 	)
+	defer func() {
+		if budget != nil {
+			budget.add(-cached)
+		}
+	}()
+
+	process := func(cds *cachedDs, dps []*incomingDP) {
+		for _, dp := range dps {
+			if workerProcessDP(wc.ident(), cds, dp, align, sr) && flushEnabled {
+				recent[cds.Id()] = cds
+			}
+		}
+	}
+
+	release := func(cds *cachedDs, window time.Duration) {
+		process(cds, cds.release(window, time.Now()))
+		if len(cds.held) == 0 {
+			delete(holding, cds.Id())
+		}
+	}
+
+	// drain applies the held points of the moving DSs and flushes
+	// them. The DSs do not move until the response, and no points
+	// can be routed to them meanwhile, thus once drain returns this
+	// worker is done with them.
+	drain := func(dr *drainRequest) int {
+		for _, m := range dr.moves {
+			id := m.cds.Id()
+			if _, ok := holding[id]; ok {
+				release(m.cds, 0)
+			}
+			delete(recent, id)
+			delete(leftover, id)
+			if flushEnabled && m.cds.unflushedPoints() > 0 && !dsf.flushCachedDs(m.cds) {
+				dr.unflushed = append(dr.unflushed, m.cds)
+			}
+		}
+		return len(dr.moves)
+	}
+
+	// flush applies the held points of the DS and flushes it. If it
+	// cannot be flushed (rate limited), the periodic flush will.
+	flush := func(cds *cachedDs) {
+		id := cds.Id()
+		if _, ok := holding[id]; ok {
+			release(cds, 0)
+		}
+		if !flushEnabled || cds.unflushedPoints() == 0 {
+			return
+		}
+		if dsf.flushCachedDs(cds) {
+			cds.setLastFlushRT(time.Now())
+			delete(recent, id)
+			delete(leftover, id)
+		} else {
+			recent[id] = cds
+		}
+	}
 
 	periodicFlushTicker := time.NewTicker(flushInt)
 
@@ -88,29 +460,102 @@ var worker = func(wc wController, dsf dsFlusherBlocking, workerCh chan *incoming
 	wc.onStarted()
 
 	maxFlushes := cap(workerCh) / 2
-	for {
-		select {
-		case <-periodicFlushTicker.C:
-			if flushEnabled {
-				if len(leftover) > 0 {
-					leftover = workerPeriodicFlush(wc.ident(), dsf, leftover, minCacheDur, maxCacheDur, maxPoints, maxFlushes)
-				} else {
-					leftover = workerPeriodicFlush(wc.ident(), dsf, recent, minCacheDur, maxCacheDur, maxPoints, maxFlushes)
+
+	// run is the worker loop, msg is what it is working on. It
+	// returns false once the channel is closed, or, if there is a
+	// panic handler, true after recovering from a panic, so that it
+	// is run again.
+	var msg *incomingDpWithDs
+	run := func() (restart bool) {
+		if onPanic != nil {
+			defer func() {
+				if p := recover(); p != nil {
+					if cds := onPanic.recovered(wc.ident(), p, msg, sr); cds != nil {
+						// Messages already queued refer to the old DS
+						if reloaded == nil {
+							reloaded = make(map[int64]*cachedDs)
+						}
+						id := cds.Id()
+						reloaded[id] = cds
+						delete(recent, id)
+						delete(leftover, id)
+						delete(holding, id)
+					}
+					restart = true
+				}
+			}()
+		}
+		for {
+			select {
+			case <-periodicFlushTicker.C:
+				msg = nil
+				for _, cds := range holding {
+					release(cds, reorderWin)
 				}
-			}
-		case dpds, ok := <-workerCh:
-			if !ok {
-				return
-			}
-			cds := dpds.cds
-			if err := cds.ProcessDataPoint(dpds.dp.Value, dpds.dp.TimeStamp); err == nil {
 				if flushEnabled {
-					recent[cds.Id()] = cds
+					var early bool
+					if budget != nil {
+						n := cachedPoints(recent) + cachedPoints(leftover)
+						early = budget.add(n - cached)
+						cached = n
+						if early && budget.spiller != nil {
+							var spilled int
+							spilled, early = workerSpill(wc.ident(), budget, sr, recent, leftover)
+							cached -= spilled
+						}
+					}
+					if len(leftover) > 0 {
+						leftover = workerPeriodicFlush(wc.ident(), dsf, leftover, minCacheDur, maxCacheDur, maxPoints, maxFlushes, prio, early)
+					} else {
+						leftover = workerPeriodicFlush(wc.ident(), dsf, recent, minCacheDur, maxCacheDur, maxPoints, maxFlushes, prio, early)
+					}
+				}
+			case dpds, ok := <-workerCh:
+				if !ok {
+					for _, cds := range holding {
+						release(cds, 0)
+					}
+					return false
+				}
+				msg = dpds
+				if reloaded != nil && dpds.cds != nil {
+					if cds := reloaded[dpds.cds.Id()]; cds != nil {
+						dpds.cds = cds
+					}
+				}
+				if dpds.gap != nil {
+					dpds.gap.resp <- workerMarkGap(dsf, dpds.cds, dpds.gap.from, dpds.gap.to)
+					continue
+				}
+				if dpds.recompute != nil {
+					dpds.recompute.resp <- workerRecompute(dsf, dpds.cds, dpds.recompute)
+					continue
+				}
+				if dpds.touch != nil {
+					if workerTouch(dpds.cds, *dpds.touch, align) && flushEnabled {
+						recent[dpds.cds.Id()] = dpds.cds
+					}
+					continue
+				}
+				if dpds.drain != nil {
+					dpds.drain.resp <- drain(dpds.drain)
+					continue
+				}
+				if dpds.flush {
+					flush(dpds.cds)
+					continue
+				}
+				if reorderWin > 0 {
+					dpds.cds.hold(dpds.dp, time.Now())
+					holding[dpds.cds.Id()] = dpds.cds
+					release(dpds.cds, reorderWin)
+				} else {
+					process(dpds.cds, []*incomingDP{dpds.dp})
 				}
-			} else {
-				log.Printf("%s: ds.ProcessDataPoint [%v] error: %v", wc.ident(), cds.Ident(), err)
 			}
-		}
 
+		}
+	}
+	for run() {
 	}
 }
@@ -16,6 +16,7 @@
 package receiver
 
 import (
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -76,7 +77,7 @@ func Test_workerPeriodicFlush(t *testing.T) {
 	recent[7] = rds
 	dsc.insert(rds)
 
-	workerPeriodicFlush("workerperiodic2", f, recent, 0, 10*time.Millisecond, 10, 1)
+	workerPeriodicFlush("workerperiodic2", f, recent, 0, 10*time.Millisecond, 10, 1, FlushAnyOrder, false)
 
 	if f.called > 0 {
 		t.Errorf("workerPeriodicFlush: no flush should have happened")
@@ -101,7 +102,7 @@ func Test_workerPeriodicFlush(t *testing.T) {
 	recent[7] = rds
 	debug = true
 
-	leftover := workerPeriodicFlush("workerperiodic3", f, recent, 0, 10*time.Millisecond, 0, 1)
+	leftover := workerPeriodicFlush("workerperiodic3", f, recent, 0, 10*time.Millisecond, 0, 1, FlushAnyOrder, false)
 	if f.called == 0 {
 		t.Errorf("workerPeriodicFlush: should have called flushDs")
 	}
@@ -117,7 +118,7 @@ func Test_workerPeriodicFlush(t *testing.T) {
 	recent[7] = rds
 	ds.ProcessDataPoint(123, time.Unix(4000, 0))
 	ds.ProcessDataPoint(123, time.Unix(5000, 0))
-	leftover = workerPeriodicFlush("workerperiodic4", f, recent, 0, 10*time.Millisecond, 0, 0)
+	leftover = workerPeriodicFlush("workerperiodic4", f, recent, 0, 10*time.Millisecond, 0, 0, FlushAnyOrder, false)
 	if f.called == 0 {
 		t.Errorf("workerPeriodicFlush: should have called flushDs")
 	}
@@ -130,6 +131,151 @@ func Test_workerPeriodicFlush(t *testing.T) {
 
 }
 
+func Test_workerPeriodicFlushPriority(t *testing.T) {
+	now := time.Now()
+	newCds := func(id int64, points int, lastFlush time.Time) *cachedDs {
+		ds := serde.NewDbDataSource(id, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+		for i := 0; i <= points; i++ {
+			ds.ProcessDataPoint(1, time.Unix(int64(1000+i*10), 0))
+		}
+		return &cachedDs{DbDataSourcer: ds, lastFlushRT: lastFlush}
+	}
+
+	for _, c := range []struct {
+		prio   FlushPriority
+		expect int64
+	}{
+		{FlushOldestDirtyFirst, 1},
+		{FlushMostPointsFirst, 2},
+	} {
+		recent := map[int64]*cachedDs{
+			1: newCds(1, 1, now.Add(-time.Hour)),
+			2: newCds(2, 10, now.Add(-time.Minute)),
+			3: newCds(3, 5, now.Add(-2*time.Minute)),
+		}
+		dsf := &fakeDsFlusher{fdsReturn: true}
+		// maxFlushes 0 means one flush
+		workerPeriodicFlush("workerperiodic", dsf, recent, 0, time.Millisecond, 0, 0, c.prio, false)
+		if dsf.called != 1 || len(recent) != 2 || recent[c.expect] != nil {
+			t.Errorf("workerPeriodicFlush: with priority %v expected DS %d to be flushed, recent: %v", c.prio, c.expect, recent)
+		}
+	}
+}
+
+func Test_workerPeriodicFlushEarly(t *testing.T) {
+	ds := serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	ds.ProcessDataPoint(1, time.Unix(1010, 0))
+	recent := map[int64]*cachedDs{1: {DbDataSourcer: ds, lastFlushRT: time.Now()}}
+
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	workerPeriodicFlush("workerperiodic", dsf, recent, time.Hour, time.Hour, 100, 10, FlushAnyOrder, false)
+	if dsf.called != 0 {
+		t.Errorf("workerPeriodicFlush: nothing should be due yet")
+	}
+	workerPeriodicFlush("workerperiodic", dsf, recent, time.Hour, time.Hour, 100, 10, FlushAnyOrder, true)
+	if dsf.called != 1 || len(recent) != 0 {
+		t.Errorf("workerPeriodicFlush: with early, the DS should have been flushed")
+	}
+}
+
+func Test_cacheBudget(t *testing.T) {
+	var calls [][2]int
+	b := &cacheBudget{max: 10, hook: func(points, budget int) { calls = append(calls, [2]int{points, budget}) }}
+
+	if b.add(10) {
+		t.Errorf("cacheBudget: 10 is not over a budget of 10")
+	}
+	if !b.add(5) || !b.add(1) {
+		t.Errorf("cacheBudget: 15 and 16 are over a budget of 10")
+	}
+	if len(calls) != 1 || calls[0] != [2]int{15, 10} {
+		t.Errorf("cacheBudget: expected the hook to be called once with 15, 10, got %v", calls)
+	}
+	if b.add(-8) {
+		t.Errorf("cacheBudget: 8 is not over a budget of 10")
+	}
+	b.add(5)
+	if len(calls) != 2 {
+		t.Errorf("cacheBudget: expected the hook to be called again after going over budget again, got %v", calls)
+	}
+}
+
+func Test_worker_workerMarkGap(t *testing.T) {
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	ds.ProcessDataPoint(100, time.Unix(1000, 0))
+	ds.ProcessDataPoint(100, time.Unix(1100, 0))
+
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	if err := workerMarkGap(dsf, cds, time.Unix(1000, 0), time.Unix(1100, 0)); err != nil {
+		t.Errorf("workerMarkGap: unexpected error: %v", err)
+	}
+	if dsf.called != 2 {
+		t.Errorf("workerMarkGap: expected 2 flushes, got %d", dsf.called)
+	}
+
+	ds.ClearRRAs(false) // as if flushed
+	dsf = &fakeDsFlusher{fdsReturn: false}
+	if err := workerMarkGap(dsf, cds, time.Unix(1000, 0), time.Unix(1100, 0)); err == nil {
+		t.Errorf("workerMarkGap: expected an error when flush fails")
+	}
+	if cds.PointCount() != 0 {
+		t.Errorf("workerMarkGap: NaNs should not remain in the RRAs after a failed flush")
+	}
+}
+
+func Test_worker_workerTouch(t *testing.T) {
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	ds.ProcessDataPoint(100, time.Unix(1000, 0))
+
+	if !workerTouch(cds, time.Unix(1015, 0), AlignFloor) {
+		t.Errorf("workerTouch: expected true")
+	}
+	if !cds.LastUpdate().Equal(time.Unix(1010, 0)) {
+		t.Errorf("workerTouch: expected last update aligned to 1010, got %v", cds.LastUpdate())
+	}
+	if cds.unflushedRT.IsZero() {
+		t.Errorf("workerTouch: unflushedRT should be set")
+	}
+	if workerTouch(cds, time.Unix(1005, 0), AlignNone) {
+		t.Errorf("workerTouch: expected false for a time stamp before the last update")
+	}
+}
+
+func Test_worker_workerRecompute(t *testing.T) {
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds}
+	ds.ProcessDataPoint(100, time.Unix(1000, 0))
+	ds.ProcessDataPoint(100, time.Unix(1100, 0))
+	src := []rrd.SlotValue{{End: time.Unix(1010, 0), Value: 1}, {End: time.Unix(1020, 0), Value: 2}}
+
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	rc := &recomputeRequest{rraIndex: 0, src: src, srcStep: 10 * time.Second}
+	if err := workerRecompute(dsf, cds, rc); err != nil {
+		t.Errorf("workerRecompute: unexpected error: %v", err)
+	}
+	if dsf.called != 2 {
+		t.Errorf("workerRecompute: expected 2 flushes, got %d", dsf.called)
+	}
+
+	rc.rraIndex = 100
+	if err := workerRecompute(dsf, cds, rc); err == nil {
+		t.Errorf("workerRecompute: expected an error for an invalid RRA index")
+	}
+
+	ds.ClearRRAs(false) // as if flushed
+	dsf = &fakeDsFlusher{fdsReturn: false}
+	rc.rraIndex = 0
+	if err := workerRecompute(dsf, cds, rc); err == nil {
+		t.Errorf("workerRecompute: expected an error when flush fails")
+	}
+	if cds.PointCount() != 0 {
+		t.Errorf("workerRecompute: recomputed slots should not remain in the RRAs after a failed flush")
+	}
+}
+
 func Test_worker_theWorker(t *testing.T) {
 
 	// fake logger
@@ -148,7 +294,7 @@ func Test_worker_theWorker(t *testing.T) {
 	saveFn1 := workerPeriodicFlush
 
 	wpfCalled := 0
-	workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[int64]*cachedDs, minCacheDur, maxCacheDur time.Duration, maxPoints, maxFlushes int) map[int64]*cachedDs {
+	workerPeriodicFlush = func(ident string, dsf dsFlusherBlocking, recent map[int64]*cachedDs, minCacheDur, maxCacheDur time.Duration, maxPoints, maxFlushes int, prio FlushPriority, early bool) map[int64]*cachedDs {
 		wpfCalled++
 		return map[int64]*cachedDs{1: nil, 2: nil}
 	}
@@ -156,7 +302,7 @@ func Test_worker_theWorker(t *testing.T) {
 	sr := &fakeSr{}
 
 	wc.startWg.Add(1)
-	go worker(wc, dsf, workerCh, 0, 0, 10, 10*time.Millisecond, sr)
+	go worker(wc, dsf, workerCh, 0, 0, 10, 10*time.Millisecond, 0, AlignNone, FlushAnyOrder, nil, nil, sr)
 	wc.startWg.Wait()
 
 	if !strings.Contains(string(fl.last), ident) {
@@ -181,9 +327,9 @@ func Test_worker_theWorker(t *testing.T) {
 
 	// send some points
 	dp := &IncomingDP{Name: "foo", TimeStamp: time.Unix(2000, 0), Value: 123}
-	workerCh <- &incomingDpWithDs{dp, rds}
+	workerCh <- &incomingDpWithDs{dp: dp, cds: rds}
 	dp = &IncomingDP{Name: "foo", TimeStamp: time.Unix(3000, 0), Value: 123}
-	workerCh <- &incomingDpWithDs{dp, rds}
+	workerCh <- &incomingDpWithDs{dp: dp, cds: rds}
 
 	pc := ds.PointCount()
 	if pc == 0 {
@@ -197,7 +343,7 @@ func Test_worker_theWorker(t *testing.T) {
 
 	// trigger an error
 	dp = &IncomingDP{Name: "foo", TimeStamp: time.Unix(5000, 0), Value: math.Inf(-1)}
-	workerCh <- &incomingDpWithDs{dp, rds}
+	workerCh <- &incomingDpWithDs{dp: dp, cds: rds}
 
 	close(workerCh)
 	wc.wg.Wait()
@@ -210,6 +356,54 @@ func Test_worker_theWorker(t *testing.T) {
 	workerPeriodicFlush = saveFn1
 }
 
+// panickyDs panics on every data point.
+type panickyDs struct {
+	serde.DbDataSourcer
+}
+
+func (*panickyDs) ProcessDataPoint(value float64, ts time.Time) error { panic("bad math") }
+
+func Test_worker_panic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db := serde.NewMemSerDe()
+	foo := serde.Ident{"name": "foo"}
+	ds, _ := db.FetchOrCreateDataSource(foo, &rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 30 * time.Second}},
+	})
+	cds := &cachedDs{DbDataSourcer: &panickyDs{ds.(serde.DbDataSourcer)}}
+	dsc := newDsCache(db, nil, nil)
+	dsc.insert(cds)
+
+	wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+	dsf := &fakeDsFlusher{fdsReturn: true}
+	workerCh := make(chan *incomingDpWithDs)
+	sr := &fakeSr{}
+
+	wc.startWg.Add(1)
+	go worker(wc, dsf, workerCh, 0, 0, 10, time.Hour, 0, AlignNone, FlushAnyOrder, nil, &workerPanicHandler{dsc: dsc}, sr)
+	wc.startWg.Wait()
+
+	workerCh <- &incomingDpWithDs{dp: &incomingDP{Ident: foo, TimeStamp: time.Unix(2000, 0), Value: 1}, cds: cds}
+	// the DS was reloaded, this one is applied
+	workerCh <- &incomingDpWithDs{dp: &incomingDP{Ident: foo, TimeStamp: time.Unix(2010, 0), Value: 1}, cds: cds}
+	close(workerCh)
+	wc.wg.Wait()
+
+	if _, ok := cds.DbDataSourcer.(*panickyDs); !ok {
+		t.Errorf("worker panic: the old DS should be left alone")
+	}
+	cds = dsc.getByIdent(foo)
+	if _, ok := cds.DbDataSourcer.(*panickyDs); ok {
+		t.Errorf("worker panic: the DS should have been reloaded")
+	}
+	if !cds.LastUpdate().Equal(time.Unix(2010, 0)) {
+		t.Errorf("worker panic: the worker should carry on after the panic, last update %v", cds.LastUpdate())
+	}
+}
+
 func Test_worker_reportWorkerChannelFillPercent(t *testing.T) {
 	workerCh := make(chan *incomingDpWithDs, 10)
 	sr := &fakeSr{}
@@ -219,3 +413,116 @@ func Test_worker_reportWorkerChannelFillPercent(t *testing.T) {
 		t.Errorf("reportWorkerChannelFillPercent: statReporter should have been called a bunch of times")
 	}
 }
+
+func Test_worker_workerProcessDPOutOfBounds(t *testing.T) {
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	spec := *DftDSSPec
+	spec.MinValue, spec.MaxValue = 0, 100
+	cds := newCachedDs(ds, &spec)
+	sr := &fakeSr{}
+
+	if workerProcessDP("test", cds, &incomingDP{TimeStamp: time.Unix(1000, 0), Value: 1e300}, AlignNone, sr) {
+		t.Errorf("workerProcessDP: a value above the bounds should not be applied")
+	}
+	if workerProcessDP("test", cds, &incomingDP{TimeStamp: time.Unix(1000, 0), Value: -1}, AlignNone, sr) {
+		t.Errorf("workerProcessDP: a value below the bounds should not be applied")
+	}
+	if !workerProcessDP("test", cds, &incomingDP{TimeStamp: time.Unix(1000, 0), Value: 100}, AlignNone, sr) {
+		t.Errorf("workerProcessDP: a value within the bounds should be applied")
+	}
+	if cds.outOfBounds != 2 {
+		t.Errorf("outOfBounds: expected 2, got %d", cds.outOfBounds)
+	}
+	if len(sr.deadLetters) != 2 || sr.deadLetters[0] != DeadLetterOutOfBounds {
+		t.Errorf("expected 2 out_of_bounds dead letters, got %v", sr.deadLetters)
+	}
+
+	// Without a spec, the cache wide bounds apply
+	d := newDsCache(nil, nil, nil)
+	d.bounds = newValueBounds(math.Inf(-1), 10)
+	cds = newCachedDs(serde.NewDbDataSource(1, serde.Ident{"name": "bar"}, rrd.NewDataSource(*DftDSSPec)), nil)
+	d.insert(cds)
+	if !cds.outOfBoundsValue(11) || cds.outOfBoundsValue(-1e300) {
+		t.Errorf("outOfBoundsValue: expected only 11 to be out of bounds")
+	}
+}
+
+func Test_worker_workerProcessDPExemplar(t *testing.T) {
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, rrd.NewDataSource(*DftDSSPec))
+	cds := newCachedDs(ds, nil)
+	sr := &fakeSr{}
+
+	workerProcessDP("test", cds, &incomingDP{TimeStamp: time.Unix(1000, 0), Value: 1}, AlignNone, sr)
+	if n := len(cds.RRAs()[0].Exemplars()); n != 0 {
+		t.Errorf("workerProcessDP: expected no exemplars, got %d", n)
+	}
+	ts := time.Unix(1003, 500)
+	dp := &incomingDP{TimeStamp: ts, Value: 2, Exemplar: map[string]string{"trace_id": "abc"}}
+	if !workerProcessDP("test", cds, dp, AlignNone, sr) {
+		t.Fatalf("workerProcessDP: the exemplar should be applied")
+	}
+	for _, rra := range cds.RRAs() {
+		ex := rra.Exemplars()
+		if len(ex) != 1 {
+			t.Fatalf("workerProcessDP: expected 1 exemplar, got %v", ex)
+		}
+		for _, e := range ex {
+			if e.Labels["trace_id"] != "abc" || e.Value != 2 || !e.TimeStamp.Equal(ts) {
+				t.Errorf("workerProcessDP: unexpected exemplar %v", e)
+			}
+		}
+	}
+}
+
+func Test_workerSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spiller, err := newDsSpiller(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := &fakeSr{}
+	recent := make(map[int64]*cachedDs)
+	for id, name := range []string{"cold", "hot"} {
+		cds := newCachedDs(serde.NewDbDataSource(int64(id), serde.Ident{"name": name}, rrd.NewDataSource(*DftDSSPec)), nil)
+		for i := 0; i < 10; i++ {
+			workerProcessDP("test", cds, &incomingDP{TimeStamp: time.Unix(1000+int64(i)*10, 0), Value: float64(i)}, AlignNone, sr)
+		}
+		recent[cds.Id()] = cds
+	}
+	cold, hot := recent[0], recent[1]
+	cold.lastDpRT = hot.lastDpRT.Add(-time.Minute)
+	n, before := cold.PointCount(), cold.Copy()
+
+	budget := &cacheBudget{max: hot.PointCount(), spiller: spiller}
+	budget.add(n + hot.PointCount())
+	spilled, over := workerSpill("test", budget, sr, recent)
+	if spilled != n || over {
+		t.Errorf("workerSpill: expected the cold DS to be spilled to get within budget, got %d %v", spilled, over)
+	}
+	if cold.PointCount() != 0 || cold.unflushedPoints() != n || hot.spiller != nil {
+		t.Errorf("workerSpill: expected the cold DS only to be spilled, with %d unflushed points", n)
+	}
+	if _, err := os.Stat(spiller.path(cold.Id())); err != nil {
+		t.Errorf("workerSpill: expected a spill file: %v", err)
+	}
+
+	workerProcessDP("test", cold, &incomingDP{TimeStamp: time.Unix(1100, 0), Value: 10}, AlignNone, sr)
+	if cold.spiller != nil || cold.PointCount() < n {
+		t.Errorf("workerProcessDP: expected the spilled DS to be loaded back, got %d points", cold.PointCount())
+	}
+	for i, rra := range before.RRAs() {
+		for slot, v := range rra.DPs() {
+			if cold.RRAs()[i].DPs()[slot] != v {
+				t.Errorf("workerProcessDP: RRA %d slot %d: expected %v, got %v", i, slot, v, cold.RRAs()[i].DPs()[slot])
+			}
+		}
+	}
+	if _, err := os.Stat(spiller.path(cold.Id())); !os.IsNotExist(err) {
+		t.Errorf("workerProcessDP: expected the spill file to be removed")
+	}
+}
@@ -16,11 +16,17 @@
 package rrd
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math"
 	"time"
 )
 
+func init() {
+	gob.Register(&DataSource{})
+}
+
 // DataSource describes a time series and its parameters, RRA and
 // intermediate state (PDP).
 type DataSource struct {
@@ -29,6 +35,9 @@ type DataSource struct {
 	heartbeat  time.Duration        // Heartbeat is inactivity period longer than this causes NaN values. 0 -> no heartbeat.
 	lastUpdate time.Time            // Last time we received an update (series time - can be in the past or future)
 	rras       []RoundRobinArchiver // Array of Round Robin Archives
+	lateGrace  time.Duration        // How late a data point can be and still be merged, see SetLateGrace
+	onChange   bool                 // Flush changed slots only, see SetFlushOnChange
+	epsilon    float64              // Difference below which a slot is unchanged
 }
 
 // DataSourcer is a DataSource as an interface.
@@ -43,7 +52,16 @@ type DataSourcer interface {
 	BestRRA(start, end time.Time, points int64) RoundRobinArchiver
 	PointCount() int
 	ClearRRAs(clearLU bool)
+	MarkGap(from, to time.Time)
+	RecomputeRRA(n int, src []SlotValue, srcStep time.Duration) error
+	MergeRRA(n int, src []SlotValue, sum bool) error
+	SetLateGrace(grace time.Duration)
+	SetFlushOnChange(onChange bool, epsilon float64)
+	FlushOnChange() (bool, float64)
 	ProcessDataPoint(value float64, ts time.Time) error
+	SetExemplar(e Exemplar)
+	Touch(ts time.Time)
+	SetLastUpdate(ts time.Time)
 }
 
 // NewDataSource returns a new DataSource in accordance with the passed
@@ -63,6 +81,8 @@ func NewDataSource(spec DSSpec) *DataSource {
 		rra := NewRoundRobinArchive(rspec)
 		result.rras = append(result.rras, rra)
 	}
+	result.SetLateGrace(spec.LateGrace)
+	result.SetFlushOnChange(spec.FlushOnChange, spec.FlushEpsilon)
 
 	return result
 }
@@ -82,7 +102,12 @@ func (ds *DataSource) LastUpdate() time.Time { return ds.lastUpdate }
 func (ds *DataSource) RRAs() []RoundRobinArchiver { return ds.rras }
 
 // SetRRAs provides a way to set the RRAs (which may contain data)
-func (ds *DataSource) SetRRAs(rras []RoundRobinArchiver) { ds.rras = rras }
+func (ds *DataSource) SetRRAs(rras []RoundRobinArchiver) {
+	ds.rras = rras
+	if ds.lateGrace > 0 {
+		ds.SetLateGrace(ds.lateGrace)
+	}
+}
 
 // Returns a complete copy of this Data Source
 func (ds *DataSource) Copy() DataSourcer {
@@ -92,6 +117,9 @@ func (ds *DataSource) Copy() DataSourcer {
 		heartbeat:  ds.heartbeat,
 		lastUpdate: ds.lastUpdate,
 		rras:       make([]RoundRobinArchiver, len(ds.rras)),
+		lateGrace:  ds.lateGrace,
+		onChange:   ds.onChange,
+		epsilon:    ds.epsilon,
 	}
 	for n, rra := range ds.rras {
 		newDs.rras[n] = rra.Copy()
@@ -99,6 +127,46 @@ func (ds *DataSource) Copy() DataSourcer {
 	return newDs
 }
 
+// GobEncode encodes the complete state of the DS, including its
+// RRAs. The RRA types must be registered with gob.Register().
+func (ds *DataSource) GobEncode() ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(enc.Encode(ds.value))
+	check(enc.Encode(ds.duration))
+	check(enc.Encode(ds.step))
+	check(enc.Encode(ds.heartbeat))
+	check(enc.Encode(ds.lastUpdate))
+	check(enc.Encode(ds.rras))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ds *DataSource) GobDecode(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(dec.Decode(&ds.value))
+	check(dec.Decode(&ds.duration))
+	check(dec.Decode(&ds.step))
+	check(dec.Decode(&ds.heartbeat))
+	check(dec.Decode(&ds.lastUpdate))
+	check(dec.Decode(&ds.rras))
+	return err
+}
+
 // BestRRA examines the RRAs and returns the one that best matches the
 // given start, end and resolution (as number of points).
 func (ds *DataSource) BestRRA(start, end time.Time, points int64) RoundRobinArchiver {
@@ -270,6 +338,9 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 	}
 
 	if ts.Before(ds.lastUpdate) {
+		if ds.lateGrace > 0 {
+			return ds.processLate(value, ts)
+		}
 		return fmt.Errorf("Data point time stamp %v is not greater than data source last update time %v", ts, ds.lastUpdate)
 	}
 
@@ -287,6 +358,57 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 	return nil
 }
 
+// Touch advances the last update to ts without contributing a value:
+// the time since the last update counts as unknown, as if the DS had
+// not been updated, but a data point after ts only covers the time
+// since ts, thus it is not deemed to be beyond the heartbeat, as it
+// would be had the DS been quiet. Unlike ProcessDataPoint, touching a
+// never-before-updated DS sets the last update, which lets its first
+// data point count. A ts which is not after the last update is
+// ignored.
+func (ds *DataSource) Touch(ts time.Time) {
+	if !ts.After(ds.lastUpdate) {
+		return
+	}
+	if !ds.lastUpdate.IsZero() {
+		ds.updateRange(ds.lastUpdate, ts, math.NaN())
+	}
+	ds.lastUpdate = ts
+}
+
+// SetLastUpdate sets the last update to ts and discards the PDP,
+// unlike Touch it can move the last update back. It is a repair
+// tool, for a DS whose last update is known to be wrong, the RRAs
+// are not changed.
+func (ds *DataSource) SetLastUpdate(ts time.Time) {
+	ds.lastUpdate = ts
+	ds.Reset()
+}
+
+// ErrTooLate is returned by ProcessDataPoint for a data point older
+// than the last update by more than the late grace.
+var ErrTooLate = fmt.Errorf("data point is older than the last update by more than the late grace period")
+
+// processLate merges a data point older than the last update into
+// the RRAs, weighted as one step of the DS. Unlike a point in order,
+// it does not cover the interval since the previous point, there
+// being none.
+func (ds *DataSource) processLate(value float64, ts time.Time) error {
+	if ds.lastUpdate.Sub(ts) > ds.lateGrace {
+		return ErrTooLate
+	}
+	merged := false
+	for _, rra := range ds.rras {
+		if rra.mergeLate(value, ts, ds.step) {
+			merged = true
+		}
+	}
+	if !merged {
+		return ErrTooLate
+	}
+	return nil
+}
+
 func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	// for each of this DS's RRAs
 	for _, rra := range ds.rras {
@@ -311,6 +433,81 @@ func (ds *DataSource) ClearRRAs(clearLU bool) {
 	}
 }
 
+// MarkGap sets the RRA slots between from and to to NaN, e.g. to
+// denote a maintenance window which should show up as a gap rather
+// than whatever data arrived during it. Slots after the last update
+// of an RRA are not affected. It is meant to be called immediately
+// after flushing the DS, so that only the gap is saved on the next
+// flush.
+func (ds *DataSource) MarkGap(from, to time.Time) {
+	for _, rra := range ds.rras {
+		rra.markGap(from, to)
+	}
+}
+
+// RecomputeRRA replaces the slots of the n-th RRA covered by src
+// with values consolidated from src, which are the slots of a higher
+// resolution RRA whose step is srcStep, e.g. as read back from the
+// database. This is useful when an RRA was added or its consolidation
+// function changed. Like MarkGap, slots after the last update of the
+// RRA are not affected and it is meant to be called immediately after
+// flushing the DS.
+func (ds *DataSource) RecomputeRRA(n int, src []SlotValue, srcStep time.Duration) error {
+	if n < 0 || n >= len(ds.rras) {
+		return fmt.Errorf("RecomputeRRA: no RRA at index %d", n)
+	}
+	rra := ds.rras[n]
+	if srcStep <= 0 || rra.Step()%srcStep != 0 {
+		return fmt.Errorf("RecomputeRRA: source step %v does not divide RRA step %v", srcStep, rra.Step())
+	}
+	rra.recompute(src, srcStep)
+	return nil
+}
+
+// MergeRRA combines src, the slots of an RRA of the same step as the
+// n-th RRA, e.g. of another DS as read back from the database, with
+// the slots of the n-th RRA. Slots known in both are added if sum is
+// true, otherwise the value already in the RRA is kept. It is meant
+// for merging duplicate DSs, the RRA should first be populated with
+// its own data from the database by merging that.
+func (ds *DataSource) MergeRRA(n int, src []SlotValue, sum bool) error {
+	if n < 0 || n >= len(ds.rras) {
+		return fmt.Errorf("MergeRRA: no RRA at index %d", n)
+	}
+	ds.rras[n].merge(src, sum)
+	return nil
+}
+
+// SetLateGrace sets how much older than the last update a data point
+// can be and still be merged into the slot it belongs to, even if
+// that slot is already closed (the slot is then saved again on the
+// next flush). Zero, the default, rejects all such points. The RRAs
+// retain the state of the slots closed within grace, which is not
+// persisted, so after a restart only slots closed since then accept
+// late points.
+func (ds *DataSource) SetLateGrace(grace time.Duration) {
+	ds.lateGrace = grace
+	for _, rra := range ds.rras {
+		rra.setGrace(grace)
+	}
+}
+
+// SetFlushOnChange sets whether a flush of this DS should only write
+// the slots whose value differs from what was last written by more
+// than epsilon, which reduces the write volume of series that rarely
+// change. It is up to the SerDe to honor it, one which does not know
+// what it last wrote (e.g. after a restart) writes the slot. The
+// postgres SerDe remembers only the last value written to each RRA and
+// a bit per slot of whether it holds it, so a series which alternates
+// between values gains little.
+func (ds *DataSource) SetFlushOnChange(onChange bool, epsilon float64) {
+	ds.onChange, ds.epsilon = onChange, math.Abs(epsilon)
+}
+
+// FlushOnChange returns the flush on change setting and epsilon, see
+// SetFlushOnChange.
+func (ds *DataSource) FlushOnChange() (bool, float64) { return ds.onChange, ds.epsilon }
+
 // DSSpec describes a DataSource. DSSpec is a schema that is used to
 // create the DataSource, as an argument to NewDataSource(). DSSpec is
 // used in configuration describing how a DataSource must be created
@@ -324,4 +521,79 @@ type DSSpec struct {
 	LastUpdate time.Time
 	Value      float64
 	Duration   time.Duration
+
+	// If not nil, NewSampling is called to create the
+	// SamplingStrategy of a DS. Nil means all data points are
+	// accumulated.
+	NewSampling func() SamplingStrategy
+
+	// If not zero, these override the cache parameters of the same
+	// name of the receiver (github.com/tgres/tgres/receiver) for the
+	// DS, e.g. to flush a latency sensitive series more often.
+	MinCacheDuration time.Duration
+	MaxCacheDuration time.Duration
+	MaxCachedPoints  int
+
+	// If not zero, data points up to this much older than the last
+	// update are merged into the RRAs, see DataSource.SetLateGrace.
+	LateGrace time.Duration
+
+	// If true, a flush only writes the slots whose value changed by
+	// more than FlushEpsilon, see DataSource.SetFlushOnChange.
+	FlushOnChange bool
+	FlushEpsilon  float64
+
+	// If not zero, the unit of time the values of the DS are a rate
+	// per, e.g. time.Second. It is recorded in the DS metadata when
+	// the receiver creates (or loads) the DS, so that whoever reads
+	// the data can tell, see NormalizeRate.
+	RateUnit time.Duration
+
+	// If MinValue is less than MaxValue, the receiver rejects data
+	// points with a value (for a counter, the rate) outside of
+	// [MinValue, MaxValue] instead of accumulating them, as a guard
+	// against a faulty source. Either can be infinite for a bound on
+	// one side only.
+	MinValue, MaxValue float64
+}
+
+// NormalizeRate converts value, a rate per from, to a rate per to.
+// E.g. with to being the step of an RRA, the result is the amount per
+// slot. It returns value unchanged if either unit is not positive.
+func NormalizeRate(value float64, from, to time.Duration) float64 {
+	if from <= 0 || to <= 0 || from == to {
+		return value
+	}
+	return value * float64(to) / float64(from)
+}
+
+// SamplingStrategy decides whether an incoming data point is
+// accumulated into a DS or skipped. This bounds the CPU spent on
+// extremely high rate series at the expense of accuracy: a skipped
+// point's interval is covered by the next accumulated one. Each DS
+// has its own SamplingStrategy, which need not be safe for
+// concurrent use.
+type SamplingStrategy interface {
+	Accumulate(value float64, ts time.Time) bool
+}
+
+type systematicSampling struct {
+	every, n int
+}
+
+// SystematicSampling returns a function suitable for
+// DSSpec.NewSampling which accumulates every n-th data point.
+func SystematicSampling(n int) func() SamplingStrategy {
+	return func() SamplingStrategy {
+		return &systematicSampling{every: n}
+	}
+}
+
+func (s *systematicSampling) Accumulate(float64, time.Time) bool {
+	s.n++
+	if s.n >= s.every {
+		s.n = 0
+		return true
+	}
+	return false
 }
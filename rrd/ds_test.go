@@ -258,6 +258,48 @@ func Test_DataSource_ProcessDataPoint(t *testing.T) {
 	}
 }
 
+func Test_DataSource_Touch(t *testing.T) {
+	ds := &DataSource{step: 10 * time.Second, heartbeat: 30 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 100},
+	})
+
+	// Touching a new DS lets the first point count
+	ds.Touch(time.Unix(100, 0))
+	if !ds.lastUpdate.Equal(time.Unix(100, 0)) {
+		t.Errorf("Touch: lastUpdate not set on a new DS: %v", ds.lastUpdate)
+	}
+	ds.ProcessDataPoint(5, time.Unix(110, 0))
+
+	// A quiet period longer than the heartbeat, touched along the way
+	for ts := int64(120); ts <= 200; ts += 20 {
+		ds.Touch(time.Unix(ts, 0))
+	}
+	if !ds.lastUpdate.Equal(time.Unix(200, 0)) {
+		t.Errorf("Touch: lastUpdate not advanced: %v", ds.lastUpdate)
+	}
+	// The point after is within the heartbeat of the touch
+	ds.ProcessDataPoint(7, time.Unix(210, 0))
+
+	dps := ds.rras[0].DPs()
+	slot := func(end int64) int64 { return SlotIndex(time.Unix(end, 0), 10*time.Second, 100) }
+	if v, ok := dps[slot(110)]; !ok || v != 5 {
+		t.Errorf("Touch: expected 5 at 110, got %v", v)
+	}
+	if v, ok := dps[slot(150)]; ok && v != 0 && !math.IsNaN(v) {
+		t.Errorf("Touch: expected no value for the touched period, got %v", v)
+	}
+	if v, ok := dps[slot(210)]; !ok || v != 7 {
+		t.Errorf("Touch: expected 7 at 210 (not beyond the heartbeat), got %v", v)
+	}
+
+	// The past is ignored
+	ds.Touch(time.Unix(150, 0))
+	if !ds.lastUpdate.Equal(time.Unix(210, 0)) {
+		t.Errorf("Touch: a touch before lastUpdate should be ignored")
+	}
+}
+
 func Test_DataSource_ClearRRAs(t *testing.T) {
 
 	ds := &DataSource{step: 10 * time.Second}
@@ -288,6 +330,200 @@ func Test_DataSource_ClearRRAs(t *testing.T) {
 	}
 }
 
+func Test_DataSource_MarkGap(t *testing.T) {
+
+	latest := time.Unix(1000, 0)
+	ds := &DataSource{step: 10 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 10, latest: latest},
+		&RoundRobinArchive{step: 10 * time.Second, size: 10}, // never updated
+	})
+
+	// 945 - 1015 overlaps the slots ending on 950 - 1000, 1010 is after latest
+	ds.MarkGap(time.Unix(945, 0), time.Unix(1015, 0))
+	rra := ds.rras[0]
+	if rra.PointCount() != 6 {
+		t.Errorf("MarkGap: expected 6 points, got %d", rra.PointCount())
+	}
+	for n, v := range rra.DPs() {
+		if !math.IsNaN(v) {
+			t.Errorf("MarkGap: slot %d is not NaN: %v", n, v)
+		}
+	}
+	if rra.Start() != 5 || rra.End() != 0 || !rra.Latest().Equal(latest) {
+		t.Errorf("MarkGap: expected start 5, end 0, latest %v, got %d, %d, %v", latest, rra.Start(), rra.End(), rra.Latest())
+	}
+	if ds.rras[1].PointCount() != 0 {
+		t.Errorf("MarkGap: never updated RRA should not be affected")
+	}
+}
+
+func Test_DataSource_RecomputeRRA(t *testing.T) {
+
+	ds := &DataSource{step: 10 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 10, latest: time.Unix(1000, 0)},
+		&RoundRobinArchive{step: 60 * time.Second, size: 10, latest: time.Unix(960, 0), cf: MAX},
+	})
+
+	// 900 belongs to the slot ending on 900, 910 - 960 to the one
+	// ending on 960, 1020 is after latest
+	src := []SlotValue{{time.Unix(900, 0), 7}, {time.Unix(1020, 0), 100}}
+	for i := int64(1); i <= 6; i++ {
+		src = append(src, SlotValue{time.Unix(900+i*10, 0), float64(i)})
+	}
+	if err := ds.RecomputeRRA(1, src, 10*time.Second); err != nil {
+		t.Errorf("RecomputeRRA: unexpected error: %v", err)
+	}
+	rra := ds.rras[1]
+	if rra.PointCount() != 2 {
+		t.Errorf("RecomputeRRA: expected 2 points, got %d", rra.PointCount())
+	}
+	if v := rra.DPs()[SlotIndex(time.Unix(900, 0), rra.Step(), rra.Size())]; v != 7 {
+		t.Errorf("RecomputeRRA: expected 7 in slot ending on 900, got %v", v)
+	}
+	if v := rra.DPs()[SlotIndex(time.Unix(960, 0), rra.Step(), rra.Size())]; v != 6 {
+		t.Errorf("RecomputeRRA: expected max of 6 in slot ending on 960, got %v", v)
+	}
+	if rra.Start() != 5 || rra.End() != 6 || !rra.Latest().Equal(time.Unix(960, 0)) {
+		t.Errorf("RecomputeRRA: expected start 5, end 6, latest 960, got %d, %d, %v", rra.Start(), rra.End(), rra.Latest())
+	}
+	if ds.rras[0].PointCount() != 0 {
+		t.Errorf("RecomputeRRA: other RRAs should not be affected")
+	}
+
+	if err := ds.RecomputeRRA(2, src, 10*time.Second); err == nil {
+		t.Errorf("RecomputeRRA: expected an error for an invalid RRA index")
+	}
+	if err := ds.RecomputeRRA(1, src, 7*time.Second); err == nil {
+		t.Errorf("RecomputeRRA: expected an error when source step does not divide RRA step")
+	}
+}
+
+func Test_DataSource_MergeRRA(t *testing.T) {
+
+	ds := &DataSource{step: 10 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 10, latest: time.Unix(1000, 0)},
+	})
+	rra := ds.rras[0]
+	slot := func(ts int64) float64 { return rra.DPs()[SlotIndex(time.Unix(ts, 0), rra.Step(), rra.Size())] }
+
+	// 1010 is after latest
+	own := []SlotValue{{time.Unix(920, 0), 1}, {time.Unix(930, 0), 2}, {time.Unix(1010, 0), 100}}
+	if err := ds.MergeRRA(0, own, true); err != nil {
+		t.Errorf("MergeRRA: unexpected error: %v", err)
+	}
+	dup := []SlotValue{{time.Unix(930, 0), 3}, {time.Unix(940, 0), 4}, {time.Unix(950, 0), math.NaN()}}
+	if err := ds.MergeRRA(0, dup, true); err != nil {
+		t.Errorf("MergeRRA: unexpected error: %v", err)
+	}
+	if rra.PointCount() != 9 || rra.Start() != 2 || rra.End() != 0 {
+		t.Errorf("MergeRRA: expected all 9 slots after 910 to be set, start 2, end 0, got %d, %d, %d", rra.PointCount(), rra.Start(), rra.End())
+	}
+	if v := slot(920); v != 1 {
+		t.Errorf("MergeRRA: expected 1 in slot ending on 920, got %v", v)
+	}
+	if v := slot(930); v != 5 {
+		t.Errorf("MergeRRA: expected sum of 5 in slot ending on 930, got %v", v)
+	}
+	if v := slot(940); v != 4 {
+		t.Errorf("MergeRRA: expected 4 in slot ending on 940, got %v", v)
+	}
+	if v := slot(950); !math.IsNaN(v) {
+		t.Errorf("MergeRRA: expected NaN in slot ending on 950, got %v", v)
+	}
+
+	if err := ds.MergeRRA(0, []SlotValue{{time.Unix(940, 0), 10}}, false); err != nil {
+		t.Errorf("MergeRRA: unexpected error: %v", err)
+	}
+	if v := slot(940); v != 4 {
+		t.Errorf("MergeRRA: without sum, expected existing 4 in slot ending on 940, got %v", v)
+	}
+
+	if err := ds.MergeRRA(1, own, true); err == nil {
+		t.Errorf("MergeRRA: expected an error for an invalid RRA index")
+	}
+}
+
+func Test_DataSource_LateGrace(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{
+		Step:      10 * time.Second,
+		RRAs:      []RRASpec{{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Xff: 0.5}},
+		LateGrace: 30 * time.Second,
+	})
+	for _, ts := range []int64{1000, 1010, 1020} {
+		if err := ds.ProcessDataPoint(1, time.Unix(ts, 0)); err != nil {
+			t.Errorf("ProcessDataPoint: unexpected error: %v", err)
+		}
+	}
+	ds.ClearRRAs(false) // as if flushed
+	rra := ds.rras[0]
+	slot := func(ts int64) float64 { return rra.DPs()[SlotIndex(time.Unix(ts, 0), rra.Step(), rra.Size())] }
+
+	if err := ds.ProcessDataPoint(4, time.Unix(1005, 0)); err != nil {
+		t.Errorf("LateGrace: unexpected error for a point within grace: %v", err)
+	}
+	if rra.PointCount() != 2 {
+		t.Errorf("LateGrace: expected the slots ending on 1010 and 1020 to be set again, got %d slots", rra.PointCount())
+	}
+	if v := slot(1010); v != 2.5 {
+		t.Errorf("LateGrace: expected 2.5 in slot ending on 1010, got %v", v)
+	}
+	if v := slot(1020); v != 1 {
+		t.Errorf("LateGrace: expected 1 in slot ending on 1020, got %v", v)
+	}
+	if !ds.LastUpdate().Equal(time.Unix(1020, 0)) {
+		t.Errorf("LateGrace: last update should not change, got %v", ds.LastUpdate())
+	}
+
+	if err := ds.ProcessDataPoint(1, time.Unix(980, 0)); err != ErrTooLate {
+		t.Errorf("LateGrace: expected ErrTooLate beyond grace, got %v", err)
+	}
+	// Within grace, but the slot ending on 1000 was never closed
+	if err := ds.ProcessDataPoint(1, time.Unix(995, 0)); err != ErrTooLate {
+		t.Errorf("LateGrace: expected ErrTooLate for a slot not retained, got %v", err)
+	}
+
+	ds.SetLateGrace(0)
+	if err := ds.ProcessDataPoint(1, time.Unix(1015, 0)); err == nil || err == ErrTooLate {
+		t.Errorf("LateGrace: without grace, expected the usual error, got %v", err)
+	}
+}
+
+func Test_DataSource_FlushOnChange(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{
+		Step:          10 * time.Second,
+		RRAs:          []RRASpec{{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Xff: 0.5}},
+		FlushOnChange: true,
+		FlushEpsilon:  -0.5,
+	})
+	if on, eps := ds.FlushOnChange(); !on || eps != 0.5 {
+		t.Errorf("FlushOnChange: expected true and 0.5, got %v and %v", on, eps)
+	}
+	if on, eps := ds.Copy().FlushOnChange(); !on || eps != 0.5 {
+		t.Errorf("FlushOnChange: Copy expected true and 0.5, got %v and %v", on, eps)
+	}
+	ds.SetFlushOnChange(false, 0)
+	if on, _ := ds.FlushOnChange(); on {
+		t.Errorf("FlushOnChange: expected false after SetFlushOnChange(false)")
+	}
+}
+
+func Test_NormalizeRate(t *testing.T) {
+	if v := NormalizeRate(2, time.Second, time.Minute); v != 120 {
+		t.Errorf("NormalizeRate: 2/s should be 120/m, got %v", v)
+	}
+	if v := NormalizeRate(120, time.Minute, 10*time.Second); v != 20 {
+		t.Errorf("NormalizeRate: 120/m should be 20 per 10s, got %v", v)
+	}
+	if v := NormalizeRate(3, 0, time.Minute); v != 3 {
+		t.Errorf("NormalizeRate: an unknown unit should leave the value unchanged, got %v", v)
+	}
+}
+
 func Test_DataSource_Copy(t *testing.T) {
 
 	ds := &DataSource{
@@ -308,3 +544,72 @@ func Test_DataSource_Copy(t *testing.T) {
 		t.Errorf("Copy: !reflect.DeepEqual(ds, cpy)")
 	}
 }
+
+func Test_DataSource_SetExemplar(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []RRASpec{
+			{Function: WMEAN, Step: 10 * time.Second, Span: 100 * time.Second},
+			{Function: MAX, Step: 60 * time.Second, Span: 600 * time.Second},
+		},
+	})
+	ds.ProcessDataPoint(1, time.Unix(1000, 0))
+	ex := func(trace string, v float64, ts int64) Exemplar {
+		return Exemplar{Labels: map[string]string{"trace_id": trace}, Value: v, TimeStamp: time.Unix(ts, 0)}
+	}
+	for _, e := range []Exemplar{ex("a", 2, 1003), ex("b", 3, 1007), ex("c", 4, 1010)} {
+		ds.ProcessDataPoint(e.Value, e.TimeStamp)
+		ds.SetExemplar(e)
+	}
+
+	rra := ds.rras[0]
+	exemplar := func(rra RoundRobinArchiver, end int64) Exemplar {
+		return rra.Exemplars()[SlotIndex(time.Unix(end, 0), rra.Step(), rra.Size())]
+	}
+	// 1010 is on a boundary, it belongs to the same slot as 1007
+	if e := exemplar(rra, 1010); len(rra.Exemplars()) != 1 || e.Labels["trace_id"] != "c" || e.Value != 4 {
+		t.Errorf("SetExemplar: expected only the latest exemplar c in the slot ending on 1010, got %v", rra.Exemplars())
+	}
+	if e := exemplar(ds.rras[1], 1020); e.Labels["trace_id"] != "c" {
+		t.Errorf("SetExemplar: expected exemplar c in the slot ending on 1020 of the second RRA, got %v", e)
+	}
+
+	cpy := ds.Copy()
+	if !reflect.DeepEqual(cpy.RRAs()[0].Exemplars(), rra.Exemplars()) {
+		t.Errorf("Copy: expected the exemplars copied")
+	}
+
+	// Only the exemplars of the ended slots are cleared
+	ds.ClearRRAs(false)
+	if len(rra.Exemplars()) != 0 || len(ds.rras[1].Exemplars()) != 1 {
+		t.Errorf("ClearRRAs: expected the exemplar cleared from the ended slot only, got %v and %v", rra.Exemplars(), ds.rras[1].Exemplars())
+	}
+
+	// Exemplars survive gob
+	b, err := ds.rras[1].(*RoundRobinArchive).GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode: %v", err)
+	}
+	dec := &RoundRobinArchive{}
+	if err := dec.GobDecode(b); err != nil || !reflect.DeepEqual(dec.Exemplars(), ds.rras[1].Exemplars()) {
+		t.Errorf("GobDecode: expected the exemplars back, got %v (%v)", dec.Exemplars(), err)
+	}
+}
+
+func Test_DataSource_SetLastUpdate(t *testing.T) {
+	ds := &DataSource{step: 10 * time.Second, heartbeat: 30 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 100},
+	})
+	ds.ProcessDataPoint(5, time.Unix(100, 0))
+	ds.ProcessDataPoint(5, time.Unix(105, 0))
+
+	ds.SetLastUpdate(time.Unix(90, 0))
+	if !ds.lastUpdate.Equal(time.Unix(90, 0)) || ds.duration != 0 {
+		t.Errorf("SetLastUpdate: expected the last update moved back and no PDP, got %v %v", ds.lastUpdate, ds.duration)
+	}
+	if err := ds.ProcessDataPoint(7, time.Unix(100, 0)); err != nil {
+		t.Errorf("SetLastUpdate: a point after the new last update should be accepted: %v", err)
+	}
+}
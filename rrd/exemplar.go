@@ -0,0 +1,60 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import "time"
+
+// An Exemplar is a sample singled out by whoever sent it, e.g. one
+// belonging to a trace, whose Labels would then contain the trace
+// id. Unlike the ident of a DS the labels vary from sample to
+// sample, and unlike the consolidated value of a slot the Value and
+// TimeStamp are exactly those of the sample.
+type Exemplar struct {
+	Labels    map[string]string
+	Value     float64
+	TimeStamp time.Time
+}
+
+// slotEnd returns the end of the slot of the given step which ts
+// falls into. A time stamp on a step boundary ends a slot, as a data
+// point covers the time up to its time stamp.
+func slotEnd(ts time.Time, step time.Duration) time.Time {
+	end := ts.Truncate(step)
+	if end.Before(ts) {
+		end = end.Add(step)
+	}
+	return end
+}
+
+// setExemplar makes e the exemplar of the slot its time stamp falls
+// into, replacing any earlier one.
+func (rra *RoundRobinArchive) setExemplar(e Exemplar) {
+	if rra.exemplars == nil {
+		rra.exemplars = make(map[int64]Exemplar)
+	}
+	rra.exemplars[SlotIndex(slotEnd(e.TimeStamp, rra.step), rra.step, rra.size)] = e
+}
+
+// SetExemplar records e as the latest exemplar of the slot its time
+// stamp falls into, in every RRA. It is meant to be called along
+// with ProcessDataPoint for the same sample. The exemplars are
+// flushed (see RoundRobinArchive.Exemplars) with the slots once they
+// end.
+func (ds *DataSource) SetExemplar(e Exemplar) {
+	for _, rra := range ds.rras {
+		rra.setExemplar(e)
+	}
+}
@@ -16,26 +16,60 @@
 package rrd
 
 import (
+	"bytes"
+	"encoding/gob"
+	"io"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+func init() {
+	gob.Register(&RoundRobinArchive{})
+}
+
 type Consolidation int
 
 const (
-	WMEAN Consolidation = iota // Time-weighted average
-	MAX                        // Max
-	MIN                        // Min
-	LAST                       // Last
+	WMEAN      Consolidation = iota // Time-weighted average
+	MAX                             // Max
+	MIN                             // Min
+	LAST                            // Last
+	PERCENTILE                      // Percentile, see RRASpec.Percentile
 )
 
+// PercentileName returns the name of the PERCENTILE consolidation of
+// the percentile pct, e.g. "P99" or "P99.9", which is how it is
+// configured and stored.
+func PercentileName(pct float64) string {
+	return "P" + strconv.FormatFloat(pct, 'f', -1, 64)
+}
+
+// ParsePercentileName returns the percentile of a name returned by
+// PercentileName (case insensitive), ok is false if s is not one or
+// the percentile is not between 0 and 100.
+func ParsePercentileName(s string) (pct float64, ok bool) {
+	if len(s) < 2 || strings.ToUpper(s[:1]) != "P" {
+		return 0, false
+	}
+	pct, err := strconv.ParseFloat(s[1:], 64)
+	if err != nil || pct < 0 || pct > 100 {
+		return 0, false
+	}
+	return pct, true
+}
+
 // A Round Robin Archive and all its parameters.
 type RoundRobinArchive struct {
 	Pdp
 	// Consolidation function (CF). How data points from a
 	// higher-resolution RRA are aggregated into a lower-resolution
-	// one. Must be WMEAN, MAX, MIN, LAST.
+	// one. Must be WMEAN, MAX, MIN, LAST or PERCENTILE.
 	cf Consolidation
+	// The percentile of a PERCENTILE RRA.
+	pct float64
 	// The RRA step
 	step time.Duration
 	// Number of data points in the RRA.
@@ -70,6 +104,82 @@ type RoundRobinArchive struct {
 	// possible for end to be less than start, which means the RRD
 	// wraps around.
 	end int64
+
+	// Slots closed within grace of latest, most recent last, so
+	// that late data points can still be merged into them, see
+	// DataSource.SetLateGrace. Unlike dps, these are not cleared
+	// when the RRA is flushed.
+	grace  time.Duration
+	closed []closedSlot
+
+	// The latest exemplar of each slot, by slot index, see
+	// DataSource.SetExemplar. Those of slots which have ended are
+	// cleared along with dps.
+	exemplars map[int64]Exemplar
+
+	// The values consolidated into the current slot of a
+	// PERCENTILE RRA, the PDP is their percentile.
+	samples pctSamples
+}
+
+// closedSlot is the PDP of a slot as it was when the slot ended.
+type closedSlot struct {
+	end     time.Time
+	pdp     Pdp
+	samples pctSamples // PERCENTILE only
+}
+
+// pctSample is a value consolidated into the slot of a PERCENTILE RRA,
+// weighted by its duration.
+type pctSample struct {
+	value    float64
+	duration time.Duration
+}
+
+// pctSamples are kept sorted by value, see insert.
+type pctSamples []pctSample
+
+func (s pctSamples) Len() int           { return len(s) }
+func (s pctSamples) Less(i, j int) bool { return s[i].value < s[j].value }
+func (s pctSamples) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// insert adds smp after the samples of the same or lesser value, so
+// that inserting n samples is O(n²) moves at worst rather than the
+// O(n² log n) of sorting them for every one.
+func (s *pctSamples) insert(smp pctSample) {
+	i := sort.Search(len(*s), func(i int) bool { return (*s)[i].value > smp.value })
+	*s = append(*s, pctSample{})
+	copy((*s)[i+1:], (*s)[i:])
+	(*s)[i] = smp
+}
+
+func (s pctSamples) copy() pctSamples {
+	if s == nil {
+		return nil
+	}
+	return append(pctSamples(nil), s...)
+}
+
+// percentile returns the pct percentile of the (sorted) samples
+// weighted by duration, i.e. the smallest value such that the
+// samples up to it make up at least pct percent of their total
+// duration, which is also returned.
+func (s pctSamples) percentile(pct float64) (float64, time.Duration) {
+	if len(s) == 0 {
+		return math.NaN(), 0
+	}
+	var total time.Duration
+	for _, smp := range s {
+		total += smp.duration
+	}
+	threshold := float64(total) * pct / 100
+	var sum time.Duration
+	for _, smp := range s {
+		if sum += smp.duration; float64(sum) >= threshold {
+			return smp.value, total
+		}
+	}
+	return s[len(s)-1].value, total
 }
 
 // RoundRobinArchive as an interface
@@ -77,19 +187,29 @@ type RoundRobinArchiver interface {
 	Pdper
 	Latest() time.Time
 	Step() time.Duration
+	Consolidation() Consolidation
+	Xff() float32
+	Percentile() float64
 	Size() int64
 	Start() int64
 	End() int64
 	PointCount() int
 	DPs() map[int64]float64
+	Exemplars() map[int64]Exemplar
 	Copy() RoundRobinArchiver
 	Begins(now time.Time) time.Time
 
 	// A side benifit from these being unexported is that you can only
 	// satisfy this interface by including this implementation
 	clear()
+	markGap(from, to time.Time)
+	recompute(src []SlotValue, srcStep time.Duration)
+	merge(src []SlotValue, sum bool)
+	setGrace(grace time.Duration)
+	mergeLate(value float64, ts time.Time, duration time.Duration) bool
 	includes(t time.Time) bool
 	update(periodBegin, periodEnd time.Time, value float64, duration time.Duration)
+	setExemplar(e Exemplar)
 }
 
 // Latest returns the time on which the last slot ends.
@@ -98,6 +218,15 @@ func (rra *RoundRobinArchive) Latest() time.Time { return rra.latest }
 // Step of this RRA
 func (rra *RoundRobinArchive) Step() time.Duration { return rra.step }
 
+// Consolidation function of this RRA
+func (rra *RoundRobinArchive) Consolidation() Consolidation { return rra.cf }
+
+// X-Files Factor of this RRA
+func (rra *RoundRobinArchive) Xff() float32 { return rra.xff }
+
+// Percentile of a PERCENTILE RRA.
+func (rra *RoundRobinArchive) Percentile() float64 { return rra.pct }
+
 // Number of data points in this RRA
 func (rra *RoundRobinArchive) Size() int64 { return rra.size }
 
@@ -112,9 +241,15 @@ func (rra *RoundRobinArchive) End() int64 { return rra.end }
 // a slice to be more space-efficient for sparse series.
 func (rra *RoundRobinArchive) DPs() map[int64]float64 { return rra.dps }
 
+// Exemplars returns the latest exemplar of the slots which have one,
+// by slot index like DPs.
+func (rra *RoundRobinArchive) Exemplars() map[int64]Exemplar { return rra.exemplars }
+
 // Returns a new RRA in accordance with the provided RRASpec.
 func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 	return &RoundRobinArchive{
+		cf:     spec.Function,
+		pct:    spec.Percentile,
 		step:   spec.Step,
 		size:   spec.Span.Nanoseconds() / spec.Step.Nanoseconds(),
 		xff:    spec.Xff,
@@ -130,22 +265,128 @@ func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 // Returns a complete copy of the RRA.
 func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 	new_rra := &RoundRobinArchive{
-		Pdp:    Pdp{value: rra.value, duration: rra.duration},
-		cf:     rra.cf,
-		step:   rra.step,
-		size:   rra.size,
-		latest: rra.latest,
-		xff:    rra.xff,
-		start:  rra.start,
-		end:    rra.end,
-		dps:    make(map[int64]float64, len(rra.dps)),
+		Pdp:     Pdp{value: rra.value, duration: rra.duration},
+		cf:      rra.cf,
+		pct:     rra.pct,
+		step:    rra.step,
+		size:    rra.size,
+		latest:  rra.latest,
+		xff:     rra.xff,
+		start:   rra.start,
+		end:     rra.end,
+		dps:     make(map[int64]float64, len(rra.dps)),
+		grace:   rra.grace,
+		samples: rra.samples.copy(),
+	}
+	if rra.closed != nil {
+		new_rra.closed = append([]closedSlot(nil), rra.closed...)
+		for i := range new_rra.closed {
+			new_rra.closed[i].samples = new_rra.closed[i].samples.copy()
+		}
 	}
 	for k, v := range rra.dps {
 		new_rra.dps[k] = v
 	}
+	if rra.exemplars != nil {
+		new_rra.exemplars = make(map[int64]Exemplar, len(rra.exemplars))
+		for k, e := range rra.exemplars {
+			new_rra.exemplars[k] = e
+		}
+	}
 	return new_rra
 }
 
+// GobEncode encodes the complete state of the RRA, including its
+// data points.
+func (rra *RoundRobinArchive) GobEncode() ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	dps := rra.dps
+	if dps == nil {
+		dps = map[int64]float64{}
+	}
+	check(enc.Encode(rra.value))
+	check(enc.Encode(rra.duration))
+	check(enc.Encode(rra.cf))
+	check(enc.Encode(rra.step))
+	check(enc.Encode(rra.size))
+	check(enc.Encode(rra.latest))
+	check(enc.Encode(rra.xff))
+	check(enc.Encode(dps))
+	check(enc.Encode(rra.start))
+	check(enc.Encode(rra.end))
+	if len(rra.exemplars) > 0 || rra.cf == PERCENTILE {
+		exemplars := rra.exemplars
+		if exemplars == nil {
+			exemplars = map[int64]Exemplar{}
+		}
+		check(enc.Encode(exemplars))
+	}
+	if rra.cf == PERCENTILE {
+		values := make([]float64, len(rra.samples))
+		durations := make([]time.Duration, len(rra.samples))
+		for i, smp := range rra.samples {
+			values[i], durations[i] = smp.value, smp.duration
+		}
+		check(enc.Encode(rra.pct))
+		check(enc.Encode(values))
+		check(enc.Encode(durations))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (rra *RoundRobinArchive) GobDecode(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(dec.Decode(&rra.value))
+	check(dec.Decode(&rra.duration))
+	check(dec.Decode(&rra.cf))
+	check(dec.Decode(&rra.step))
+	check(dec.Decode(&rra.size))
+	check(dec.Decode(&rra.latest))
+	check(dec.Decode(&rra.xff))
+	check(dec.Decode(&rra.dps))
+	check(dec.Decode(&rra.start))
+	check(dec.Decode(&rra.end))
+	if err == nil { // earlier versions did not encode exemplars
+		if er := dec.Decode(&rra.exemplars); er != io.EOF {
+			check(er)
+		}
+	}
+	if err == nil && rra.cf == PERCENTILE {
+		var (
+			values    []float64
+			durations []time.Duration
+		)
+		check(dec.Decode(&rra.pct))
+		check(dec.Decode(&values))
+		check(dec.Decode(&durations))
+		rra.samples = nil
+		for i := 0; i < len(values) && i < len(durations); i++ {
+			rra.samples = append(rra.samples, pctSample{values[i], durations[i]})
+		}
+		sort.Stable(rra.samples) // from a node which did not keep them sorted
+	}
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+	return err
+}
+
 // Begins returns the timestamp of the beginning of this RRA assuming
 // that that the argument "now" is within it. This will be a time
 // approximately but not exactly the RRA length ago, because it is
@@ -193,16 +434,7 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 			currentEnd = periodEnd
 		}
 
-		switch rra.cf {
-		case WMEAN:
-			rra.AddValue(value, duration)
-		case MAX:
-			rra.AddValueMax(value, duration)
-		case MIN:
-			rra.AddValueMin(value, duration)
-		case LAST:
-			rra.AddValueLast(value, duration)
-		}
+		rra.consolidate(&rra.Pdp, &rra.samples, value, duration)
 
 		// if end of slot, move PDP into its place in dps.
 		if currentEnd.Equal(endOfSlot) {
@@ -217,6 +449,10 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 // movePdpToDps moves the PDP into its proper slot in the dps map and
 // resets the PDP.
 func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
+	if rra.grace > 0 {
+		rra.retainClosed(endOfSlot)
+	}
+
 	// Check XFF
 	known := float64(rra.duration) / float64(rra.step)
 	if known < float64(rra.xff) {
@@ -239,14 +475,240 @@ func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
 	rra.end = slotN
 
 	rra.Reset()
+	rra.samples = nil
+}
+
+// retainClosed adds the PDP of the slot ending at endOfSlot to the
+// closed slots and forgets those no longer within grace.
+func (rra *RoundRobinArchive) retainClosed(endOfSlot time.Time) {
+	rra.closed = append(rra.closed, closedSlot{end: endOfSlot, pdp: rra.Pdp, samples: rra.samples})
+	oldest := endOfSlot.Add(-rra.grace - rra.step)
+	n := 0
+	for n < len(rra.closed) && !rra.closed[n].end.After(oldest) {
+		n++
+	}
+	if n > 0 {
+		rra.closed = append(rra.closed[:0], rra.closed[n:]...)
+	}
+}
+
+func (rra *RoundRobinArchive) setGrace(grace time.Duration) {
+	rra.grace = grace
+	if grace == 0 {
+		rra.closed = nil
+	}
+}
+
+// mergeLate consolidates a data point with a time stamp before the
+// last update, weighted as duration, into the slot which contains
+// ts. If that slot is closed, the slots from it to latest are
+// (re)written from the closed slots, so that they get flushed
+// again. It returns false if the slot was closed too long ago.
+func (rra *RoundRobinArchive) mergeLate(value float64, ts time.Time, duration time.Duration) bool {
+	if rra.latest.IsZero() || ts.After(rra.latest) { // the slot is not closed yet
+		rra.consolidate(&rra.Pdp, &rra.samples, value, duration)
+		return true
+	}
+
+	endOfSlot := ts.Truncate(rra.step)
+	if endOfSlot.Before(ts) {
+		endOfSlot = endOfSlot.Add(rra.step)
+	}
+	i := 0
+	for i < len(rra.closed) && !rra.closed[i].end.Equal(endOfSlot) {
+		i++
+	}
+	if i == len(rra.closed) {
+		return false
+	}
+	rra.consolidate(&rra.closed[i].pdp, &rra.closed[i].samples, value, duration)
+
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+	// Unless dps already has older slots, it now begins at slot i.
+	if len(rra.dps) == 0 || !SlotTime(rra.start, rra.latest, rra.step, rra.size).Before(endOfSlot) {
+		rra.start = SlotIndex(endOfSlot, rra.step, rra.size)
+	}
+	for _, cs := range rra.closed[i:] {
+		v := cs.pdp.value
+		if known := float64(cs.pdp.duration) / float64(rra.step); known < float64(rra.xff) {
+			v = math.NaN()
+		}
+		rra.dps[SlotIndex(cs.end, rra.step, rra.size)] = v
+	}
+	rra.end = SlotIndex(rra.latest, rra.step, rra.size)
+	return true
+}
+
+// markGap sets all the slots overlapping the from-to range to NaN.
+// Only slots that are already within the RRA (i.e. not after Latest)
+// are affected, Latest does not change. This is meant to be done on
+// an empty (just flushed) RRA, so that start and end only cover the
+// gap.
+func (rra *RoundRobinArchive) markGap(from, to time.Time) {
+	if rra.latest.IsZero() || rra.size == 0 {
+		return
+	}
+	if begin := rra.Begins(rra.latest); from.Before(begin) {
+		from = begin
+	}
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+	for endOfSlot := from.Truncate(rra.step).Add(rra.step); endOfSlot.Add(-rra.step).Before(to) && !endOfSlot.After(rra.latest); endOfSlot = endOfSlot.Add(rra.step) {
+		slotN := SlotIndex(endOfSlot, rra.step, rra.size)
+		if len(rra.dps) == 0 {
+			rra.start = slotN
+		}
+		rra.dps[slotN] = math.NaN()
+		rra.end = slotN
+	}
+}
+
+// A SlotValue is the value of an RRA slot ending at End.
+type SlotValue struct {
+	End   time.Time
+	Value float64
+}
+
+// recompute replaces the slots covered by src with values
+// consolidated from src using the consolidation function of this
+// RRA. The src slots are of a higher resolution RRA whose step is
+// srcStep, which must divide the step of this RRA. As with markGap,
+// only slots that are already within the RRA are affected, Latest
+// does not change, and it is meant to be done on an empty (just
+// flushed) RRA.
+func (rra *RoundRobinArchive) recompute(src []SlotValue, srcStep time.Duration) {
+	if rra.latest.IsZero() || rra.size == 0 {
+		return
+	}
+	begin := rra.Begins(rra.latest)
+	pdps := make(map[int64]*Pdp)
+	samples := make(map[int64]*pctSamples)
+	for _, sv := range src {
+		endOfSlot := sv.End.Truncate(rra.step)
+		if endOfSlot.Before(sv.End) {
+			endOfSlot = endOfSlot.Add(rra.step)
+		}
+		if !endOfSlot.After(begin) || endOfSlot.After(rra.latest) {
+			continue
+		}
+		key := endOfSlot.UnixNano()
+		if pdps[key] == nil {
+			pdps[key], samples[key] = &Pdp{}, &pctSamples{}
+		}
+		rra.consolidate(pdps[key], samples[key], sv.Value, srcStep)
+	}
+
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+	for endOfSlot := begin.Add(rra.step); len(pdps) > 0 && !endOfSlot.After(rra.latest); endOfSlot = endOfSlot.Add(rra.step) {
+		pdp := pdps[endOfSlot.UnixNano()]
+		if pdp == nil {
+			continue
+		}
+		delete(pdps, endOfSlot.UnixNano())
+		if known := float64(pdp.duration) / float64(rra.step); known < float64(rra.xff) {
+			pdp.SetValue(math.NaN(), 0)
+		}
+		slotN := SlotIndex(endOfSlot, rra.step, rra.size)
+		if len(rra.dps) == 0 {
+			rra.start = slotN
+		}
+		rra.dps[slotN] = pdp.Value()
+		rra.end = slotN
+	}
+}
+
+// merge combines src, which are slots of the same step as this
+// RRA, with the slots this RRA already has: where only one of them
+// has a value that value is used, where both do, they are added if
+// sum is true, otherwise the existing value is kept. Afterwards every
+// slot between Begins(Latest) and Latest is set, unknown ones to NaN,
+// so that the whole RRA gets flushed. Slots after Latest are ignored.
+func (rra *RoundRobinArchive) merge(src []SlotValue, sum bool) {
+	if rra.latest.IsZero() || rra.size == 0 {
+		return
+	}
+	vals := make(map[int64]float64, len(src))
+	for _, sv := range src {
+		if !math.IsNaN(sv.Value) {
+			vals[sv.End.UnixNano()] = sv.Value
+		}
+	}
+
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+	begin := rra.Begins(rra.latest)
+	rra.start = SlotIndex(begin.Add(rra.step), rra.step, rra.size)
+	for endOfSlot := begin.Add(rra.step); !endOfSlot.After(rra.latest); endOfSlot = endOfSlot.Add(rra.step) {
+		slotN := SlotIndex(endOfSlot, rra.step, rra.size)
+		existing, ok := rra.dps[slotN]
+		if !ok {
+			existing = math.NaN()
+		}
+		if v, ok := vals[endOfSlot.UnixNano()]; ok {
+			if math.IsNaN(existing) {
+				existing = v
+			} else if sum {
+				existing += v
+			}
+		}
+		rra.dps[slotN] = existing
+		rra.end = slotN
+	}
+}
+
+// consolidate adds value to the PDP p of a slot using the
+// consolidation function of the RRA. Unless the RRA is a PERCENTILE
+// one, samples is ignored, otherwise it has the values of the slot
+// so far, to which value is added, and p becomes their percentile. A
+// slot which has a value (e.g. as loaded from the database) but no
+// samples starts out with its value as the only sample.
+func (rra *RoundRobinArchive) consolidate(p *Pdp, samples *pctSamples, value float64, duration time.Duration) {
+	if rra.cf != PERCENTILE {
+		consolidate(p, rra.cf, value, duration)
+		return
+	}
+	if math.IsNaN(value) || duration <= 0 {
+		return
+	}
+	if len(*samples) == 0 && p.duration > 0 && !math.IsNaN(p.value) {
+		*samples = append(*samples, pctSample{p.value, p.duration})
+	}
+	samples.insert(pctSample{value, duration})
+	p.SetValue(samples.percentile(rra.pct))
+}
+
+// consolidate adds value to the PDP using the consolidation function cf.
+func consolidate(p *Pdp, cf Consolidation, value float64, duration time.Duration) {
+	switch cf {
+	case WMEAN:
+		p.AddValue(value, duration)
+	case MAX:
+		p.AddValueMax(value, duration)
+	case MIN:
+		p.AddValueMin(value, duration)
+	case LAST:
+		p.AddValueLast(value, duration)
+	}
 }
 
-// clears the data in dps
+// clears the data in dps, and the exemplars of the slots which have
+// ended
 func (rra *RoundRobinArchive) clear() {
 	if len(rra.dps) > 0 {
 		rra.dps = make(map[int64]float64)
 	}
 	rra.start, rra.end = 0, 0
+	for n, e := range rra.exemplars {
+		if !slotEnd(e.TimeStamp, rra.step).After(rra.latest) {
+			delete(rra.exemplars, n)
+		}
+	}
 }
 
 // Given a slot timestamp, RRA step and size, return the slot's index
@@ -277,6 +739,16 @@ type RRASpec struct {
 	Span     time.Duration // duration of the whole series (should be multiple of step)
 	Xff      float32
 
+	// Percentile (between 0 and 100) of a PERCENTILE RRA: a slot is
+	// the percentile of the values (of the DS step, weighted by
+	// duration) within it, e.g. 99 for p99 latencies. Unlike the
+	// other functions, this requires keeping all the values of the
+	// current slot, i.e. as many as there are DS steps in the RRA
+	// step. They are not stored in the database, thus when the DS is
+	// loaded from it, the value of the current slot so far counts as
+	// a single value for its duration.
+	Percentile float64
+
 	// These can be used to fill the initial value
 	Latest   time.Time
 	Value    float64
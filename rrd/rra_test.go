@@ -17,7 +17,9 @@ package rrd
 
 import (
 	"math"
+	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 )
@@ -108,6 +110,23 @@ func Test_RoundRobinArchive(t *testing.T) {
 	}
 }
 
+func Test_NewRoundRobinArchive_function(t *testing.T) {
+	for _, cf := range []Consolidation{WMEAN, MAX, MIN, LAST, PERCENTILE} {
+		rra := NewRoundRobinArchive(RRASpec{Function: cf, Step: time.Second, Span: 10 * time.Second})
+		if rra.Consolidation() != cf {
+			t.Errorf("NewRoundRobinArchive: expected consolidation %v, got %v", cf, rra.Consolidation())
+		}
+	}
+
+	// MAX, not the default WMEAN, is what the slot ends up with
+	rra := NewRoundRobinArchive(RRASpec{Function: MAX, Step: 10 * time.Second, Span: 100 * time.Second})
+	rra.consolidate(&rra.Pdp, &rra.samples, 1, 5*time.Second)
+	rra.consolidate(&rra.Pdp, &rra.samples, 3, 5*time.Second)
+	if rra.value != 3 {
+		t.Errorf("NewRoundRobinArchive: expected the MAX of 1 and 3 to be 3, got %v", rra.value)
+	}
+}
+
 func Test_RoundRobinArchive_update(t *testing.T) {
 
 	// All the possibilities we want to test. Value is 50 unless noted.
@@ -330,3 +349,80 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 	}
 
 }
+
+func Test_RoundRobinArchive_Percentile(t *testing.T) {
+
+	if pct, ok := ParsePercentileName(PercentileName(99.9)); !ok || pct != 99.9 {
+		t.Errorf("ParsePercentileName: expected 99.9, got %v (%v)", pct, ok)
+	}
+	for _, s := range []string{"P", "P101", "Pxx", "WMEAN"} {
+		if _, ok := ParsePercentileName(s); ok {
+			t.Errorf("ParsePercentileName: %q should not parse", s)
+		}
+	}
+
+	ds := NewDataSource(DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []RRASpec{{Function: PERCENTILE, Percentile: 90, Step: 100 * time.Second, Span: 1000 * time.Second}},
+	})
+	ds.ProcessDataPoint(0, time.Unix(1000, 0))
+	for i := int64(1); i <= 10; i++ {
+		if err := ds.ProcessDataPoint(float64(i), time.Unix(1000+i*10, 0)); err != nil {
+			t.Errorf("ProcessDataPoint: unexpected error: %v", err)
+		}
+	}
+	rra := ds.rras[0].(*RoundRobinArchive)
+	if rra.Percentile() != 90 {
+		t.Errorf("Percentile: expected 90, got %v", rra.Percentile())
+	}
+	if v := rra.DPs()[SlotIndex(time.Unix(1100, 0), rra.Step(), rra.Size())]; v != 9 {
+		t.Errorf("PERCENTILE: expected 9 in slot ending on 1100, got %v", v)
+	}
+	if len(rra.samples) != 0 {
+		t.Errorf("PERCENTILE: samples of a closed slot should be reset, got %v", rra.samples)
+	}
+
+	// An open slot, its samples must survive Copy and gob
+	ds.ProcessDataPoint(100, time.Unix(1110, 0))
+	ds.ProcessDataPoint(1, time.Unix(1120, 0))
+	if v := rra.Value(); v != 100 {
+		t.Errorf("PERCENTILE: expected 100 as the open slot value, got %v", v)
+	}
+	if cp := rra.Copy().(*RoundRobinArchive); !reflect.DeepEqual(cp.samples, rra.samples) || cp.pct != rra.pct {
+		t.Errorf("Copy: expected samples %v, got %v", rra.samples, cp.samples)
+	}
+	b, err := rra.GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode: %v", err)
+	}
+	dec := &RoundRobinArchive{}
+	if err := dec.GobDecode(b); err != nil || !reflect.DeepEqual(dec.samples, rra.samples) || dec.pct != rra.pct {
+		t.Errorf("GobDecode: expected samples %v, got %v (%v)", rra.samples, dec.samples, err)
+	}
+}
+
+func Test_pctSamples_insert(t *testing.T) {
+	var s pctSamples
+	for _, v := range []float64{5, 1, 3, 5, 2, 4} {
+		s.insert(pctSample{v, time.Second})
+	}
+	if !sort.IsSorted(s) {
+		t.Errorf("insert: expected the samples sorted, got %v", s)
+	}
+	if v, total := s.percentile(50); v != 3 || total != 6*time.Second {
+		t.Errorf("percentile: expected 3 of 6s, got %v of %v", v, total)
+	}
+}
+
+func BenchmarkRoundRobinArchive_percentile(b *testing.B) {
+	// A slot of 1000 DS steps
+	ds := NewDataSource(DSSpec{
+		Step: time.Second,
+		RRAs: []RRASpec{{Function: PERCENTILE, Percentile: 99, Step: 1000 * time.Second, Span: 10000 * time.Second}},
+	})
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ds.ProcessDataPoint(rnd.Float64(), time.Unix(int64(i), 0))
+	}
+}
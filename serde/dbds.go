@@ -17,12 +17,17 @@ package serde
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
 	"sort"
 
 	"github.com/tgres/tgres/rrd"
 )
 
+func init() {
+	gob.Register(&DbDataSource{})
+}
+
 type DbDataSource struct {
 	rrd.DataSourcer
 	ident Ident
@@ -38,6 +43,10 @@ type DbDataSourcer interface {
 func (ds *DbDataSource) Ident() Ident { return ds.ident }
 func (ds *DbDataSource) Id() int64    { return ds.id }
 
+// SetIdent changes the ident of the DS, which is only meant for once
+// it has been changed in the database, see DataSourceRenamer.
+func (ds *DbDataSource) SetIdent(ident Ident) { ds.ident = ident }
+
 func NewDbDataSource(id int64, ident Ident, ds rrd.DataSourcer) *DbDataSource {
 	return &DbDataSource{
 		DataSourcer: ds,
@@ -58,6 +67,40 @@ func (ds *DbDataSource) Copy() rrd.DataSourcer {
 	return result
 }
 
+// GobEncode encodes the complete state of the DS. This is used by
+// the receiver cache snapshots, it is not a storage format.
+func (ds *DbDataSource) GobEncode() ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(enc.Encode(ds.id))
+	check(enc.Encode(ds.ident))
+	check(enc.Encode(&ds.DataSourcer))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ds *DbDataSource) GobDecode(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(dec.Decode(&ds.id))
+	check(dec.Decode(&ds.ident))
+	check(dec.Decode(&ds.DataSourcer))
+	return err
+}
+
 type Ident map[string]string
 
 func (it Ident) String() string {
@@ -17,13 +17,19 @@ package serde
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
 )
 
+func init() {
+	gob.Register(&DbRoundRobinArchive{})
+}
+
 type DbRoundRobinArchiver interface {
 	rrd.RoundRobinArchiver
 	Id() int64
@@ -73,11 +79,19 @@ func (rra *DbRoundRobinArchive) SlotRow(slot int64) int64 {
 
 // DPsAsPGString returns data points as a PostgreSQL-compatible array string
 func (rra *DbRoundRobinArchive) DPsAsPGString(start, end int64) string {
+	return dpsAsPGString(rra.DPs(), start, end, "NaN")
+}
+
+// dpsAsPGString is DPsAsPGString with NaN written as nan, e.g. "NULL".
+func dpsAsPGString(dps map[int64]float64, start, end int64, nan string) string {
 	var b bytes.Buffer
 	b.WriteString("{")
-	dps := rra.DPs()
 	for i := start; i <= end; i++ {
-		b.WriteString(strconv.FormatFloat(dps[int64(i)], 'f', -1, 64))
+		if v := dps[int64(i)]; math.IsNaN(v) {
+			b.WriteString(nan)
+		} else {
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		}
 		if i != end {
 			b.WriteString(",")
 		}
@@ -93,3 +107,35 @@ func (rra *DbRoundRobinArchive) Copy() rrd.RoundRobinArchiver {
 		width:              rra.width,
 	}
 }
+
+func (rra *DbRoundRobinArchive) GobEncode() ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(enc.Encode(rra.id))
+	check(enc.Encode(rra.width))
+	check(enc.Encode(&rra.RoundRobinArchiver))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (rra *DbRoundRobinArchive) GobDecode(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	var err error
+	check := func(er error) {
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	check(dec.Decode(&rra.id))
+	check(dec.Decode(&rra.width))
+	check(dec.Decode(&rra.RoundRobinArchiver))
+	return err
+}
@@ -15,6 +15,12 @@
 
 package serde
 
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
 // // SlotRow()
 // var slot int64
 // rra.width, slot = 10, 20
@@ -31,3 +37,37 @@ package serde
 // if rra.DpsAsPGString(1, 2) != expect {
 // 	t.Errorf("DpsAsPGString() didn't return %q", expect)
 // }
+
+func Test_dpsAsPGString(t *testing.T) {
+	dps := map[int64]float64{1: 123.45, 2: math.NaN(), 3: 0}
+	for _, c := range []struct {
+		nan, expect string
+	}{
+		{"NaN", "{123.45,NaN,0}"},
+		{"NULL", "{123.45,NULL,0}"},
+		{strconv.FormatFloat(-9999, 'f', -1, 64), "{123.45,-9999,0}"}, // a sentinel
+	} {
+		if s := dpsAsPGString(dps, 1, 3, c.nan); s != c.expect {
+			t.Errorf("dpsAsPGString: with %q expected %q, got %q", c.nan, c.expect, s)
+		}
+	}
+}
+
+func Test_ParseNaNRepresentation(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		expect NaNRepresentation
+		err    bool
+	}{
+		{"", NaNAsNaN, false},
+		{"nan", NaNAsNaN, false},
+		{"NULL", NaNAsNull, false},
+		{"Sentinel", NaNAsSentinel, false},
+		{"zero", NaNAsNaN, true},
+	} {
+		rep, err := ParseNaNRepresentation(c.s)
+		if rep != c.expect || (err != nil) != c.err {
+			t.Errorf("ParseNaNRepresentation: %q: expected %v (error: %v), got %v (%v)", c.s, c.expect, c.err, rep, err)
+		}
+	}
+}
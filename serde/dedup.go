@@ -0,0 +1,173 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// DataSourceDeleter is implemented by a Fetcher which can delete
+// a DS along with all of its data.
+type DataSourceDeleter interface {
+	DeleteDataSource(id int64) error
+}
+
+// FindDuplicateDataSources groups the DSs whose idents are the same
+// once normalized, e.g. those created before tag order was
+// normalized. A nil normalize compares the idents as they are, which
+// is insensitive to the order of tags. Only groups of more than one
+// DS are returned, each sorted by id.
+func FindDuplicateDataSources(dss []rrd.DataSourcer, normalize func(Ident) Ident) [][]DbDataSourcer {
+	groups := make(map[string][]DbDataSourcer)
+	var keys []string
+	for _, ds := range dss {
+		dbds, ok := ds.(DbDataSourcer)
+		if !ok {
+			continue
+		}
+		ident := dbds.Ident()
+		if normalize != nil {
+			ident = normalize(ident)
+		}
+		key := ident.String()
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], dbds)
+	}
+
+	sort.Strings(keys)
+	var result [][]DbDataSourcer
+	for _, key := range keys {
+		if group := groups[key]; len(group) > 1 {
+			sort.Sort(dbdsById(group))
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+type dbdsById []DbDataSourcer
+
+func (d dbdsById) Len() int           { return len(d) }
+func (d dbdsById) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dbdsById) Less(i, j int) bool { return d[i].Id() < d[j].Id() }
+
+// MergeDataSources merges the data of a group of duplicate DSs (as
+// returned by FindDuplicateDataSources) into the most recently
+// updated one, flushes it and deletes the others, returning the one
+// kept. An RRA of a duplicate is merged into the RRA of the kept DS
+// of the same step and size, if there is one. Slots known in both
+// are added if sum is true, which is right for counters whose
+// updates were split among the duplicates, otherwise the value of
+// the kept DS wins. Slots newer than the last update of the kept DS
+// are lost. This does not coordinate with a running Receiver and is
+// meant to be used as a one-time repair while Tgres is not running.
+func MergeDataSources(sd SerDe, group []DbDataSourcer, sum bool) (DbDataSourcer, error) {
+	if len(group) < 2 {
+		return nil, fmt.Errorf("MergeDataSources: need at least two data sources")
+	}
+	db, flusher := sd.Fetcher(), sd.Flusher()
+	deleter, ok := db.(DataSourceDeleter)
+	if !ok || flusher == nil {
+		return nil, fmt.Errorf("MergeDataSources: this SerDe cannot flush and delete data sources")
+	}
+
+	keep := group[0]
+	for _, ds := range group[1:] {
+		if ds.LastUpdate().After(keep.LastUpdate()) {
+			keep = ds
+		}
+	}
+	// The kept DS goes first so that its own data is loaded before
+	// anything is merged into it.
+	merged := []DbDataSourcer{keep}
+	for _, ds := range group {
+		if ds != keep {
+			merged = append(merged, ds)
+		}
+	}
+
+	keepRRAs := keep.RRAs()
+	for _, ds := range merged {
+		for _, rra := range ds.RRAs() {
+			n := matchingRRA(keepRRAs, rra)
+			if n < 0 {
+				log.Printf("MergeDataSources: %v: no RRA matching step %v size %d in %v, skipping", ds.Ident(), rra.Step(), rra.Size(), keep.Ident())
+				continue
+			}
+			src, err := fetchRRASlots(db, ds, rra)
+			if err != nil {
+				return nil, fmt.Errorf("MergeDataSources: %v: %v", ds.Ident(), err)
+			}
+			if err := keep.MergeRRA(n, src, sum); err != nil {
+				return nil, fmt.Errorf("MergeDataSources: %v", err)
+			}
+		}
+	}
+
+	if err := flusher.FlushDataSource(keep); err != nil {
+		return nil, fmt.Errorf("MergeDataSources: flushing %v: %v", keep.Ident(), err)
+	}
+	keep.ClearRRAs(false)
+
+	for _, ds := range merged[1:] {
+		if err := deleter.DeleteDataSource(ds.Id()); err != nil {
+			return keep, fmt.Errorf("MergeDataSources: deleting %v: %v", ds.Ident(), err)
+		}
+	}
+	return keep, nil
+}
+
+// matchingRRA returns the index of the RRA in rras which has the same
+// step and size as rra, or -1.
+func matchingRRA(rras []rrd.RoundRobinArchiver, rra rrd.RoundRobinArchiver) int {
+	for n, r := range rras {
+		if r.Step() == rra.Step() && r.Size() == rra.Size() {
+			return n
+		}
+	}
+	return -1
+}
+
+// fetchRRASlots returns the slots of rra of ds as stored in the
+// database.
+func fetchRRASlots(db Fetcher, ds DbDataSourcer, rra rrd.RoundRobinArchiver) ([]rrd.SlotValue, error) {
+	if rra.Latest().IsZero() {
+		return nil, nil
+	}
+	// With rra as the only RRA, it is what gets fetched.
+	cp := ds.Copy().(DbDataSourcer)
+	cp.SetRRAs([]rrd.RoundRobinArchiver{rra})
+	from, to := rra.Begins(rra.Latest()), rra.Latest()
+	ser, err := db.FetchSeries(cp, from, to, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ser.Close()
+	var result []rrd.SlotValue
+	for ser.Next() {
+		if t, v := ser.CurrentTime(), ser.CurrentValue(); t.After(from) && !t.After(to) && !math.IsNaN(v) {
+			result = append(result, rrd.SlotValue{End: t, Value: v})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,151 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+func lowerIdent(ident Ident) Ident {
+	result := make(Ident, len(ident))
+	for k, v := range ident {
+		result[k] = strings.ToLower(v)
+	}
+	return result
+}
+
+// mergeSerDe is a memSerDe which can flush, the slots in the
+// "database" being those of stored rather than of the DSs.
+type mergeSerDe struct {
+	*memSerDe
+	stored  map[int64]rrd.RoundRobinArchiver // by DS id
+	flushed map[int64]float64                // slots of the flushed RRA by end time
+}
+
+func (m *mergeSerDe) Fetcher() Fetcher { return m }
+func (m *mergeSerDe) Flusher() Flusher { return m }
+
+func (m *mergeSerDe) FlushDataSource(ds rrd.DataSourcer) error {
+	rra := ds.RRAs()[0]
+	m.flushed = make(map[int64]float64)
+	for n, v := range rra.DPs() {
+		m.flushed[rrd.SlotTime(n, rra.Latest(), rra.Step(), rra.Size()).Unix()] = v
+	}
+	return nil
+}
+
+func (m *mergeSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return series.NewRRASeries(m.stored[ds.(DbDataSourcer).Id()]), nil
+}
+
+// newMergeSerDe returns a mergeSerDe with a DS per ident, id being the
+// position in idents plus one, updated on lastUpdate and with the
+// slots given stored.
+func newMergeSerDe(idents []Ident, lastUpdate []int64, slots [][]rrd.SlotValue) *mergeSerDe {
+	m := &mergeSerDe{memSerDe: NewMemSerDe(), stored: make(map[int64]rrd.RoundRobinArchiver)}
+	for i, ident := range idents {
+		spec := rrd.DSSpec{
+			Step:       10 * time.Second,
+			LastUpdate: time.Unix(lastUpdate[i], 0),
+			RRAs: []rrd.RRASpec{
+				rrd.RRASpec{Function: rrd.WMEAN,
+					Step:   10 * time.Second,
+					Span:   100 * time.Second,
+					Latest: time.Unix(1030, 0),
+				},
+			},
+		}
+		stored := rrd.NewDataSource(spec)
+		stored.MergeRRA(0, slots[i], false)
+		id := int64(i + 1)
+		m.stored[id] = stored.RRAs()[0]
+		// As fetched, the RRAs of the DS are empty
+		ds := NewDbDataSource(id, ident, rrd.NewDataSource(spec))
+		m.byId[id], m.byIdent[ident.String()] = ds, ds
+	}
+	return m
+}
+
+func Test_FindDuplicateDataSources(t *testing.T) {
+	dss := []rrd.DataSourcer{
+		NewDbDataSource(3, Ident{"name": "foo", "host": "A"}, rrd.NewDataSource(rrd.DSSpec{Step: time.Second})),
+		NewDbDataSource(1, Ident{"name": "foo", "host": "a"}, rrd.NewDataSource(rrd.DSSpec{Step: time.Second})),
+		NewDbDataSource(2, Ident{"name": "foo", "host": "b"}, rrd.NewDataSource(rrd.DSSpec{Step: time.Second})),
+		rrd.NewDataSource(rrd.DSSpec{Step: time.Second}), // not a DbDataSourcer
+	}
+	if groups := FindDuplicateDataSources(dss, nil); len(groups) != 0 {
+		t.Errorf("FindDuplicateDataSources: expected no duplicates without normalize, got %v", groups)
+	}
+	groups := FindDuplicateDataSources(dss, lowerIdent)
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][0].Id() != 1 || groups[0][1].Id() != 3 {
+		t.Errorf("FindDuplicateDataSources: expected the DSs 1 and 3 to be duplicates, got %v", groups)
+	}
+}
+
+func Test_MergeDataSources(t *testing.T) {
+	idents := []Ident{{"name": "foo", "host": "a"}, {"name": "foo", "host": "A"}}
+	// The second is updated last and is thus kept
+	lastUpdate := []int64{1020, 1030}
+	slots := [][]rrd.SlotValue{
+		{{End: time.Unix(1010, 0), Value: 1}, {End: time.Unix(1020, 0), Value: 2}},
+		{{End: time.Unix(1020, 0), Value: 8}, {End: time.Unix(1030, 0), Value: 8}},
+	}
+	for _, c := range []struct {
+		sum    bool
+		expect map[int64]float64
+	}{
+		{true, map[int64]float64{1010: 1, 1020: 10, 1030: 8}},
+		{false, map[int64]float64{1010: 1, 1020: 8, 1030: 8}},
+	} {
+		m := newMergeSerDe(idents, lastUpdate, slots)
+		dss, _ := m.FetchDataSources()
+		groups := FindDuplicateDataSources(dss, lowerIdent)
+		if len(groups) != 1 {
+			t.Fatalf("MergeDataSources: expected one group of duplicates, got %v", groups)
+		}
+		keep, err := MergeDataSources(m, groups[0], c.sum)
+		if err != nil {
+			t.Fatalf("MergeDataSources: unexpected error: %v", err)
+		}
+		if keep.Id() != 2 {
+			t.Errorf("MergeDataSources: expected the last updated DS 2 to be kept, got %d", keep.Id())
+		}
+		for ts, v := range c.expect {
+			if m.flushed[ts] != v {
+				t.Errorf("MergeDataSources: sum %v: expected %v in the slot ending on %d, got %v", c.sum, v, ts, m.flushed[ts])
+			}
+		}
+		// The duplicate is gone
+		if dss, _ := m.FetchDataSources(); len(dss) != 1 || dss[0].(DbDataSourcer).Id() != 2 {
+			t.Errorf("MergeDataSources: expected only DS 2 to remain, got %v", dss)
+		} else if groups := FindDuplicateDataSources(dss, lowerIdent); len(groups) != 0 {
+			t.Errorf("MergeDataSources: expected no duplicates after merging, got %v", groups)
+		}
+	}
+
+	m := newMergeSerDe(idents, lastUpdate, slots)
+	if _, err := MergeDataSources(m, []DbDataSourcer{m.byId[1]}, true); err == nil {
+		t.Errorf("MergeDataSources: expected an error for a single DS")
+	}
+	if _, err := MergeDataSources(m.memSerDe, []DbDataSourcer{m.byId[1], m.byId[2]}, true); err == nil {
+		t.Errorf("MergeDataSources: expected an error for a SerDe which cannot flush")
+	}
+}
@@ -0,0 +1,74 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"sort"
+	"strings"
+)
+
+// IdentToPath maps an ident to a Graphite metric path. Implementations
+// can assume that the ident has a "name" tag.
+type IdentToPath func(ident Ident) string
+
+// GraphitePath is the IdentToPath used by everything which exports to
+// Graphite, e.g. NewWhisperFlusher. It must be set (if at all) before
+// anything is exported.
+var GraphitePath IdentToPath = NameAndTagValuesPath
+
+// NameAndTagValuesPath is the default GraphitePath. It is the name
+// followed by the values of the other tags sorted by tag key, e.g.
+// {"name": "cpu", "host": "a", "dc": "b"} becomes cpu.b.a, thus the
+// path of an ident with only a name is the name.
+func NameAndTagValuesPath(ident Ident) string {
+	keys := make([]string, 0, len(ident))
+	for k := range ident {
+		if k != "name" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	parts := []string{ident["name"]}
+	for _, k := range keys {
+		parts = append(parts, pathPart(ident[k], "."))
+	}
+	return strings.Join(parts, ".")
+}
+
+// TagsPath returns an IdentToPath which joins the name and the values
+// of tags, in that order, with sep, which defaults to a dot. Tags the
+// ident does not have are left out, as are all the others. Occurrences
+// of sep in the tag values are replaced with an underscore.
+func TagsPath(tags []string, sep string) IdentToPath {
+	if sep == "" {
+		sep = "."
+	}
+	tags = append([]string(nil), tags...)
+	return func(ident Ident) string {
+		parts := []string{ident["name"]}
+		for _, k := range tags {
+			if v := ident[k]; v != "" {
+				parts = append(parts, pathPart(v, sep))
+			}
+		}
+		return strings.Join(parts, sep)
+	}
+}
+
+// pathPart makes a tag value usable as (a part of) a path element.
+func pathPart(value, sep string) string {
+	return strings.Replace(value, sep, "_", -1)
+}
@@ -0,0 +1,130 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kisielk/whisper-go/whisper"
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_NameAndTagValuesPath(t *testing.T) {
+	for _, c := range []struct {
+		ident  Ident
+		expect string
+	}{
+		{Ident{"name": "foo.bar"}, "foo.bar"},
+		{Ident{"name": "cpu", "host": "a", "dc": "b"}, "cpu.b.a"},
+		{Ident{"name": "cpu", "host": "a.example.com"}, "cpu.a_example_com"},
+	} {
+		if path := NameAndTagValuesPath(c.ident); path != c.expect {
+			t.Errorf("NameAndTagValuesPath: %v: expected %q, got %q", c.ident, c.expect, path)
+		}
+	}
+}
+
+func Test_TagsPath(t *testing.T) {
+	ident := Ident{"name": "cpu", "host": "a.example.com", "dc": "b", "env": "prod"}
+	for _, c := range []struct {
+		tags        []string
+		sep, expect string
+	}{
+		{nil, "", "cpu"},
+		{[]string{"host", "dc"}, "", "cpu.a_example_com.b"},
+		{[]string{"dc", "rack", "host"}, "", "cpu.b.a_example_com"},
+		{[]string{"dc", "host"}, "/", "cpu/b/a.example.com"},
+	} {
+		if path := TagsPath(c.tags, c.sep)(ident); path != c.expect {
+			t.Errorf("TagsPath: %v %q: expected %q, got %q", c.tags, c.sep, c.expect, path)
+		}
+	}
+
+	// The tags are copied
+	tags := []string{"dc"}
+	toPath := TagsPath(tags, "")
+	tags[0] = "host"
+	if path := toPath(ident); path != "cpu.b" {
+		t.Errorf("TagsPath: expected changing tags to change nothing, got %q", path)
+	}
+}
+
+func Test_pathPart(t *testing.T) {
+	if part := pathPart("a.b/c", "."); part != "a_b/c" {
+		t.Errorf("pathPart: expected %q, got %q", "a_b/c", part)
+	}
+	if part := pathPart("a.b/c", "/"); part != "a.b_c" {
+		t.Errorf("pathPart: expected %q, got %q", "a.b_c", part)
+	}
+}
+
+func Test_whisperFlusher_GraphitePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-whisper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(p IdentToPath) { GraphitePath = p }(GraphitePath)
+	GraphitePath = TagsPath([]string{"host"}, "")
+
+	// Whisper ignores points older than its retention
+	latest := time.Now().Truncate(10 * time.Second).Add(-20 * time.Second)
+
+	ds := NewDbDataSource(1, Ident{"name": "cpu", "host": "a", "dc": "b"}, rrd.NewDataSource(rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN,
+				Step:   10 * time.Second,
+				Span:   100 * time.Second,
+				Latest: latest,
+			},
+		},
+	}))
+	ds.ProcessDataPoint(5, latest.Add(5*time.Second))
+	ds.ProcessDataPoint(5, latest.Add(10*time.Second))
+	if err := NewWhisperFlusher(dir).FlushDataSource(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read back from where GraphitePath says it is
+	fd, err := os.Open(filepath.Join(dir, "cpu", "a.wsp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	w, err := whisper.OpenWhisper(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := w.DumpArchive(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range points {
+		if p.Timestamp == uint32(latest.Unix()) {
+			found = p.Value == 5
+		}
+	}
+	if !found {
+		t.Errorf("whisperFlusher: expected 5 at %d, got %v", latest.Unix(), points)
+	}
+}
@@ -17,6 +17,7 @@ package serde
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +29,8 @@ type memSerDe struct {
 	*sync.RWMutex
 	byIdent map[string]*DbDataSource
 	byId    map[int64]*DbDataSource
+	meta    map[int64]map[string]string
+	annots  []Annotation // in the order stored
 	lastId  int64
 }
 
@@ -89,6 +92,114 @@ func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 	return result, nil
 }
 
+func (m *memSerDe) DeleteDataSource(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	ds, ok := m.byId[id]
+	if !ok {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	delete(m.byIdent, ds.Ident().String())
+	delete(m.byId, id)
+	delete(m.meta, id)
+	return nil
+}
+
+func (m *memSerDe) RenameDataSource(id int64, ident Ident) error {
+	m.Lock()
+	defer m.Unlock()
+	ds, ok := m.byId[id]
+	if !ok {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	if _, ok := m.byIdent[ident.String()]; ok {
+		return fmt.Errorf("a data source with ident %v already exists", ident)
+	}
+	delete(m.byIdent, ds.Ident().String())
+	ds.SetIdent(ident)
+	m.byIdent[ident.String()] = ds
+	return nil
+}
+
+func (m *memSerDe) SetDataSourceLastUpdate(id int64, lastUpdate time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	ds, ok := m.byId[id]
+	if !ok {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	ds.SetLastUpdate(lastUpdate)
+	return nil
+}
+
+func (m *memSerDe) SetDataSourceMeta(id int64, meta map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.byId[id]; !ok {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	if m.meta == nil {
+		m.meta = make(map[int64]map[string]string)
+	}
+	cp := make(map[string]string, len(meta))
+	for k, v := range meta {
+		cp[k] = v
+	}
+	m.meta[id] = cp
+	return nil
+}
+
+func (m *memSerDe) FetchDataSourceMeta(id int64) (map[string]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	meta, ok := m.meta[id]
+	if !ok {
+		return nil, nil
+	}
+	cp := make(map[string]string, len(meta))
+	for k, v := range meta {
+		cp[k] = v
+	}
+	return cp, nil
+}
+
+func (m *memSerDe) StoreAnnotation(a Annotation) error {
+	m.Lock()
+	defer m.Unlock()
+	m.annots = append(m.annots, a)
+	return nil
+}
+
+func (m *memSerDe) FetchAnnotations(ident Ident, from, to time.Time) ([]Annotation, error) {
+	m.RLock()
+	defer m.RUnlock()
+	key := ident.String()
+	var result []Annotation
+	for _, a := range m.annots {
+		if a.TimeStamp.Before(from) || a.TimeStamp.After(to) {
+			continue
+		}
+		if len(a.Ident) == 0 || a.Ident.String() == key {
+			result = append(result, a)
+		}
+	}
+	sort.Stable(annotationsByTime(result))
+	return result, nil
+}
+
+type annotationsByTime []Annotation
+
+func (a annotationsByTime) Len() int           { return len(a) }
+func (a annotationsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a annotationsByTime) Less(i, j int) bool { return a[i].TimeStamp.Before(a[j].TimeStamp) }
+
+func (m *memSerDe) DataSourceExists(ident Ident) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.byIdent[ident.String()]
+	return ok, nil
+}
+
 func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
 	m.Lock()
 	defer m.Unlock()
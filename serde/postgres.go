@@ -44,16 +44,19 @@ package serde
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/series"
 )
@@ -65,9 +68,63 @@ func init() {
 }
 
 type pgSerDe struct {
-	dbConn                                         *sql.DB
-	sql1, sql2, sql3, sql4, sql5, sql6, sql7, sql8 *sql.Stmt
-	prefix                                         string
+	dbConn                                               *sql.DB
+	sql1, sql2, sql3, sql4, sql5, sql6, sql7, sql8, sql9 *sql.Stmt
+	prefix                                               string
+
+	skipNaN     bool                    // see SetSkipNaNWrites
+	rraParallel int                     // see SetRRAFlushParallelism
+	nanRep      NaNRepresentation       // see SetNaNRepresentation
+	nanSentinel float64                 // only with NaNAsSentinel
+	nanMu       sync.Mutex              // guards nanSlots and written
+	nanSlots    map[int64][]uint64      // by RRA id, bits of slots known to be NaN in the db
+	written     map[int64]*writtenSlots // by RRA id, slots last written, for flush on change
+}
+
+// writtenSlots is what is known of the slots of an RRA as last
+// written to the db: a slot whose bit is set in known holds value.
+// Rather than a copy of every slot, only the one value is kept, at a
+// cost of a bit per slot, which is all a series which rarely changes
+// needs: a slot written with a value different by more than epsilon
+// becomes the new value and the other slots are forgotten, as they
+// must then be rewritten anyway.
+type writtenSlots struct {
+	known []uint64
+	value float64
+}
+
+// unchanged returns true if slot is known to be v in the db, give or
+// take epsilon.
+func (w *writtenSlots) unchanged(slot int64, v, epsilon float64) bool {
+	if w.known[slot/64]&(1<<uint(slot%64)) == 0 {
+		return false
+	}
+	return w.near(v, epsilon)
+}
+
+func (w *writtenSlots) near(v, epsilon float64) bool {
+	if math.IsNaN(w.value) || math.IsNaN(v) {
+		return math.IsNaN(w.value) && math.IsNaN(v)
+	}
+	return v == w.value || math.Abs(v-w.value) <= epsilon
+}
+
+// mark records that slot was written as v.
+func (w *writtenSlots) mark(slot int64, v, epsilon float64) {
+	bit := uint64(1) << uint(slot%64)
+	if w.near(v, 0) {
+		w.known[slot/64] |= bit
+		return
+	}
+	if w.near(v, epsilon) { // slot is not quite value
+		w.known[slot/64] &^= bit
+		return
+	}
+	for i := range w.known {
+		w.known[i] = 0
+	}
+	w.value = v
+	w.known[slot/64] |= bit
 }
 
 func sqlOpen(a, b string) (*sql.DB, error) {
@@ -92,6 +149,80 @@ func InitDb(connect_string, prefix string) (*pgSerDe, error) {
 	}
 }
 
+// SetMaxOpenConns sets the maximum number of open connections to
+// the database.
+func (p *pgSerDe) SetMaxOpenConns(n int) { p.dbConn.SetMaxOpenConns(n) }
+
+// SetNaNRepresentation sets how the slots of unknown value are
+// written to the ts table, NaN (the default), NULL or the sentinel
+// value. Either way they read back as NaN: the series query treats
+// NULL as unknown, and the sentinel as NULL. Slots already written
+// keep their representation, NaN in particular still reads as NaN,
+// though for a consolidated (grouped) point a NaN slot makes it NaN,
+// whereas NULL slots are left out of the average. The value columns
+// of the ds and rra tables always hold NaN as NaN. It must be called
+// before any flushing.
+func (p *pgSerDe) SetNaNRepresentation(rep NaNRepresentation, sentinel float64) {
+	p.nanRep, p.nanSentinel = rep, sentinel
+}
+
+// dpsAsPGString is rra.DPsAsPGString as per the NaN representation.
+func (p *pgSerDe) dpsAsPGString(rra DbRoundRobinArchiver, start, end int64) string {
+	switch p.nanRep {
+	case NaNAsNull:
+		return dpsAsPGString(rra.DPs(), start, end, "NULL")
+	case NaNAsSentinel:
+		return dpsAsPGString(rra.DPs(), start, end, strconv.FormatFloat(p.nanSentinel, 'f', -1, 64))
+	}
+	return rra.DPsAsPGString(start, end)
+}
+
+// nanSentinelParam is the parameter of the series query which is
+// read as NULL, the sentinel with NaNAsSentinel, NULL otherwise
+// (NULLIF then changes nothing).
+func (p *pgSerDe) nanSentinelParam() sql.NullFloat64 {
+	return sql.NullFloat64{Float64: p.nanSentinel, Valid: p.nanRep == NaNAsSentinel}
+}
+
+// SetSkipNaNWrites arranges for flushes to not write NaN slots which
+// are already NaN in the database, which reduces the write volume of
+// sparse series. Since a slot is reused once the RRA wraps around,
+// NaN cannot simply be skipped: the slots known to be NaN in the
+// database are tracked in memory (one bit per slot of every RRA
+// flushed) and forgotten whenever the RRAs of a DS are loaded, thus
+// the first flush of a slot after startup always writes it. The last
+// update of the DS and RRAs is saved as usual. It must be called
+// before any flushing.
+func (p *pgSerDe) SetSkipNaNWrites(skip bool) {
+	p.skipNaN = skip
+	if skip && p.nanSlots == nil {
+		p.nanSlots = make(map[int64][]uint64)
+	}
+}
+
+// SetRRAFlushParallelism arranges for FlushDataSource to write up to
+// n RRAs of a DS at once rather than one after the other, which
+// speeds up flushing DSs with many RRAs when the database is slow.
+// The RRAs are independent of each other, but every one of them
+// being written uses a database connection of its own, so a flusher
+// may use up to n connections. The DS itself is saved once all of
+// its RRAs are. Zero or one means one RRA at a time. It must be
+// called before any flushing.
+func (p *pgSerDe) SetRRAFlushParallelism(n int) { p.rraParallel = n }
+
+// Ping verifies that the database is reachable.
+func (p *pgSerDe) Ping() error { return p.dbConn.Ping() }
+
+// SchemaVersion returns the version of the schema of the database.
+func (p *pgSerDe) SchemaVersion() (int, error) {
+	var version int
+	sql := fmt.Sprintf("SELECT MAX(version) FROM %[1]sschema_version", p.prefix)
+	if err := p.dbConn.QueryRow(sql).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
 func (p *pgSerDe) Fetcher() Fetcher         { return p }
 func (p *pgSerDe) Flusher() Flusher         { return p }
 func (p *pgSerDe) DbAddresser() DbAddresser { return p }
@@ -160,7 +291,7 @@ func (p *pgSerDe) prepareSqlStatements() error {
 	if p.sql2, err = p.dbConn.Prepare(fmt.Sprintf("UPDATE %[1]srra rra SET value = $1, duration_ms = $2, latest = $3 WHERE id = $4", p.prefix)); err != nil {
 		return err
 	}
-	if p.sql3, err = p.dbConn.Prepare(fmt.Sprintf("SELECT max(tg) mt, avg(r) ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
+	if p.sql3, err = p.dbConn.Prepare(fmt.Sprintf("SELECT max(tg) mt, avg(NULLIF(r, $9)) ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
 		"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
 		" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
 		p.prefix)); err != nil {
@@ -189,6 +320,10 @@ func (p *pgSerDe) prepareSqlStatements() error {
 		p.prefix)); err != nil {
 		return err
 	}
+	if p.sql9, err = p.dbConn.Prepare(fmt.Sprintf("INSERT INTO %[1]sexemplar AS e (rra_id, n, t, value, labels) VALUES ($1, $2, $3, $4, $5) "+
+		"ON CONFLICT (rra_id, n) DO UPDATE SET t = $3, value = $4, labels = $5", p.prefix)); err != nil {
+		return err
+	}
 	// // TODO This is WRONG, a "ident ->>" is NOT searchable using index, it must be ident @> '{"name":$1}'
 	// if p.sql9, err = p.dbConn.Prepare(fmt.Sprintf("SELECT id, ident, step_ms, heartbeat_ms, lastupdate, value, duration_ms FROM %[1]sds AS ds WHERE ident ->> 'name' = $1",
 	// 	p.prefix)); err != nil {
@@ -232,6 +367,29 @@ func (p *pgSerDe) createTablesIfNotExist() error {
        dp DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_idx_ts_rra_id_n ON %[1]sts (rra_id, n);
+
+       CREATE TABLE IF NOT EXISTS %[1]sexemplar (
+       rra_id INT NOT NULL REFERENCES %[1]srra(id) ON DELETE CASCADE,
+       n INT NOT NULL,
+       t TIMESTAMPTZ NOT NULL,
+       value DOUBLE PRECISION NOT NULL,
+       labels JSONB NOT NULL DEFAULT '{}',
+       PRIMARY KEY (rra_id, n));
+
+       CREATE TABLE IF NOT EXISTS %[1]sannotation (
+       id SERIAL NOT NULL PRIMARY KEY,
+       ident JSONB NOT NULL DEFAULT '{}',
+       t TIMESTAMPTZ NOT NULL,
+       text TEXT NOT NULL);
+
+       CREATE INDEX IF NOT EXISTS %[1]sidx_annotation_t ON %[1]sannotation (t);
+
+       CREATE TABLE IF NOT EXISTS %[1]sds_meta (
+       ds_id INT NOT NULL PRIMARY KEY REFERENCES %[1]sds(id) ON DELETE CASCADE,
+       meta JSONB NOT NULL DEFAULT '{}');
+
+       CREATE TABLE IF NOT EXISTS %[1]sschema_version (
+       version INT NOT NULL);
     `
 	if rows, err := p.dbConn.Query(fmt.Sprintf(create_sql, p.prefix)); err != nil {
 		log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
@@ -239,6 +397,14 @@ func (p *pgSerDe) createTablesIfNotExist() error {
 	} else {
 		rows.Close()
 	}
+	// A database without a version predates versioning, which
+	// began with version 1, and the above brought it up to date.
+	version_sql := `INSERT INTO %[1]sschema_version (version)
+       SELECT $1 WHERE NOT EXISTS (SELECT 1 FROM %[1]sschema_version)`
+	if _, err := p.dbConn.Exec(fmt.Sprintf(version_sql, p.prefix), SchemaVersion); err != nil {
+		log.Printf("ERROR: setting the schema version failed: %v", err)
+		return err
+	}
 	create_sql = `
        CREATE VIEW %[1]stv AS
        SELECT ds.id ds_id, rra.id rra_id, latest - interval '1 millisecond' * ds.step_ms * rra.steps_per_row *
@@ -376,7 +542,11 @@ func roundRobinArchiveFromRow(rows *sql.Rows, dsStep time.Duration) (*DbRoundRob
 	case "LAST":
 		spec.Function = rrd.LAST
 	default:
-		return nil, fmt.Errorf("roundRoundRobinArchiveFromRow(): Invalid cf: %q (valid funcs: wmean, min, max, last)", cf)
+		var ok bool
+		if spec.Percentile, ok = rrd.ParsePercentileName(cf); !ok {
+			return nil, fmt.Errorf("roundRoundRobinArchiveFromRow(): Invalid cf: %q (valid funcs: wmean, min, max, last, p<percentile>)", cf)
+		}
+		spec.Function = rrd.PERCENTILE
 	}
 
 	rra, err := NewDbRoundRobinArchive(id, width, spec)
@@ -558,6 +728,7 @@ func (p *pgSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinArc
 	var rras []rrd.RoundRobinArchiver
 	for rows.Next() {
 		if rra, err := roundRobinArchiveFromRow(rows, ds.Step()); err == nil {
+			p.forgetSlots(rra.Id())
 			rras = append(rras, rra)
 		} else {
 			log.Printf("fetchRoundRobinArchives(): error: %v", err)
@@ -568,23 +739,20 @@ func (p *pgSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinArc
 	return rras, nil
 }
 
-func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver) error {
+// flushRoundRobinArchive writes the slots of rra. If onChange is true,
+// slots known to be in the db with the same value (give or take
+// epsilon) are not written.
+func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver, onChange bool, epsilon float64) error {
 	var n int64
 	rraSize, rraWidth := rra.Size(), rra.Width()
 	rraStart, rraEnd := rra.Start(), rra.End()
 	if int64(rra.PointCount()) == rraSize { // The whole thing
 		for n = 0; n < rra.SlotRow(rraSize); n++ {
-			end := rraWidth - 1
+			start, end := int64(0), rraWidth-1
 			if n == rraSize/rraWidth {
 				end = (rraSize - 1) % rraWidth
 			}
-			dps := rra.DPsAsPGString(n*rraWidth, n*rraWidth+rraWidth-1)
-			if rows, err := p.sql1.Query(1, end+1, dps, rra.Id(), n); err == nil {
-				if debug {
-					log.Printf("flushRoundRobinArchive(1): rra.Id: %d rraStart: %d rra.End: %d params: s: %d e: %d len: %d n: %d", rra.Id(), rraStart, rraEnd, 1, end+1, len(dps), n)
-				}
-				rows.Close()
-			} else {
+			if err := p.flushRow(rra, onChange, epsilon, n, start, end); err != nil {
 				return err
 			}
 		}
@@ -597,13 +765,7 @@ func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver) error {
 			if n == rraEnd/rraWidth {
 				end = rraEnd % rraWidth
 			}
-			dps := rra.DPsAsPGString(n*rraWidth+start, n*rraWidth+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id(), n); err == nil {
-				if debug {
-					log.Printf("flushRoundRobinArchive(2): rra.Id: %d rraStart: %d rra.End: %d params: s: %d e: %d len: %d n: %d", rra.Id(), rraStart, rraEnd, start+1, end+1, len(dps), n)
-				}
-				rows.Close()
-			} else {
+			if err := p.flushRow(rra, onChange, epsilon, n, start, end); err != nil {
 				return err
 			}
 		}
@@ -614,13 +776,7 @@ func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver) error {
 			if n == rraEnd/rraWidth {
 				end = rraEnd % rraWidth
 			}
-			dps := rra.DPsAsPGString(n*rraWidth+start, n*rraWidth+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id(), n); err == nil {
-				if debug {
-					log.Printf("flushRoundRobinArchive(3): rra.Id: %d rraStart: %d rra.End: %d params: s: %d e: %d len: %d n: %d", rra.Id, rraStart, rraEnd, start+1, end+1, len(dps), n)
-				}
-				rows.Close()
-			} else {
+			if err := p.flushRow(rra, onChange, epsilon, n, start, end); err != nil {
 				return err
 			}
 		}
@@ -634,13 +790,7 @@ func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver) error {
 			if n == rraSize/rraWidth {
 				end = (rraSize - 1) % rraWidth
 			}
-			dps := rra.DPsAsPGString(n*rraWidth+start, n*rraWidth+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id(), n); err == nil {
-				if debug {
-					log.Printf("flushRoundRobinArchive(4): rra.Id: %d rraStart: %d rra.End: %d params: s: %d e: %d len: %d n: %d", rra.Id(), rraStart, rraEnd, start+1, end+1, len(dps), n)
-				}
-				rows.Close()
-			} else {
+			if err := p.flushRow(rra, onChange, epsilon, n, start, end); err != nil {
 				return err
 			}
 		}
@@ -655,12 +805,125 @@ func (p *pgSerDe) flushRoundRobinArchive(rra DbRoundRobinArchiver) error {
 	return nil
 }
 
+// flushRow writes the slots start to end of row n of rra, less those
+// which trimKnown finds need not be written if p.skipNaN or onChange.
+func (p *pgSerDe) flushRow(rra DbRoundRobinArchiver, onChange bool, epsilon float64, n, start, end int64) error {
+	if p.skipNaN || onChange {
+		var write bool
+		if start, end, write = p.trimKnown(rra, onChange, epsilon, n, start, end); !write {
+			return nil
+		}
+	}
+	dps := p.dpsAsPGString(rra, n*rra.Width()+start, n*rra.Width()+end)
+	rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id(), n)
+	if err != nil {
+		return err
+	}
+	if debug {
+		log.Printf("flushRoundRobinArchive(): rra.Id: %d rraStart: %d rra.End: %d params: s: %d e: %d len: %d n: %d", rra.Id(), rra.Start(), rra.End(), start+1, end+1, len(dps), n)
+	}
+	rows.Close()
+	p.markNaNSlots(rra, n, start, end)
+	if onChange {
+		p.markWrittenSlots(rra, epsilon, n, start, end)
+	}
+	return nil
+}
+
+// trimKnown narrows the slots start to end of row n of rra down to
+// those which need to be written, i.e. excluding slots at either end
+// known to be NaN in the database or, if onChange is true, known to
+// be unchanged in the database. It returns false if there is nothing
+// to write.
+func (p *pgSerDe) trimKnown(rra DbRoundRobinArchiver, onChange bool, epsilon float64, n, start, end int64) (int64, int64, bool) {
+	p.nanMu.Lock()
+	defer p.nanMu.Unlock()
+	bits := p.nanSlots[rra.Id()]
+	var ws *writtenSlots
+	if onChange {
+		ws = p.written[rra.Id()]
+	}
+	if bits == nil && ws == nil {
+		return start, end, true
+	}
+	dps, base := rra.DPs(), n*rra.Width()
+	known := func(i int64) bool {
+		slot := base + i
+		v := dps[slot]
+		if bits != nil && math.IsNaN(v) && bits[slot/64]&(1<<uint(slot%64)) != 0 {
+			return true
+		}
+		return ws != nil && ws.unchanged(slot, v, epsilon)
+	}
+	for start <= end && known(start) {
+		start++
+	}
+	for end >= start && known(end) {
+		end--
+	}
+	return start, end, start <= end
+}
+
+// markNaNSlots records which of the slots start to end of row n of
+// rra, just written, are NaN in the database.
+func (p *pgSerDe) markNaNSlots(rra DbRoundRobinArchiver, n, start, end int64) {
+	if !p.skipNaN {
+		return
+	}
+	p.nanMu.Lock()
+	defer p.nanMu.Unlock()
+	bits := p.nanSlots[rra.Id()]
+	if bits == nil {
+		bits = make([]uint64, (rra.Size()+63)/64)
+		p.nanSlots[rra.Id()] = bits
+	}
+	dps, base := rra.DPs(), n*rra.Width()
+	for i := start; i <= end; i++ {
+		slot := base + i
+		if math.IsNaN(dps[slot]) {
+			bits[slot/64] |= 1 << uint(slot%64)
+		} else {
+			bits[slot/64] &^= 1 << uint(slot%64)
+		}
+	}
+}
+
+// markWrittenSlots records the values of the slots start to end of
+// row n of rra, just written.
+func (p *pgSerDe) markWrittenSlots(rra DbRoundRobinArchiver, epsilon float64, n, start, end int64) {
+	p.nanMu.Lock()
+	defer p.nanMu.Unlock()
+	if p.written == nil {
+		p.written = make(map[int64]*writtenSlots)
+	}
+	ws := p.written[rra.Id()]
+	if ws == nil {
+		ws = &writtenSlots{known: make([]uint64, (rra.Size()+63)/64)}
+		p.written[rra.Id()] = ws
+	}
+	dps, base := rra.DPs(), n*rra.Width()
+	for i := start; i <= end; i++ {
+		slot := base + i
+		ws.mark(slot, dps[slot], epsilon)
+	}
+}
+
+// forgetSlots forgets what is known about the slots of the RRA in the
+// db, once it is loaded the db is the authority.
+func (p *pgSerDe) forgetSlots(rraId int64) {
+	p.nanMu.Lock()
+	delete(p.nanSlots, rraId)
+	delete(p.written, rraId)
+	p.nanMu.Unlock()
+}
+
 func (p *pgSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 	dbds, ok := ds.(DbDataSourcer)
 	if !ok {
 		return fmt.Errorf("ds must be a DbDataSourcer to flush.")
 	}
 
+	var drras []DbRoundRobinArchiver
 	for _, rra := range ds.RRAs() {
 		// If this is not a DbRoundRobinArchive, we cannot flush
 		drra, ok := rra.(DbRoundRobinArchiver)
@@ -668,12 +931,13 @@ func (p *pgSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 			return fmt.Errorf("rra must be a DbRoundRobinArchiver to flush.")
 		}
 		if drra.PointCount() > 0 {
-			if err := p.flushRoundRobinArchive(drra); err != nil {
-				log.Printf("FlushDataSource(): error flushing RRA, probable data loss: %v", err)
-				return err
-			}
+			drras = append(drras, drra)
 		}
 	}
+	onChange, epsilon := ds.FlushOnChange()
+	if err := p.flushRRAs(drras, onChange, epsilon); err != nil {
+		return pgTransient(err)
+	}
 
 	if debug {
 		log.Printf("FlushDataSource(): Id %d: LastUpdate: %v, Value: %v, Duration: %v", dbds.Id(), ds.LastUpdate(), ds.Value(), ds.Duration())
@@ -682,7 +946,7 @@ func (p *pgSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 	if rows, err := p.sql7.Query(ds.LastUpdate(), ds.Value(), durationMs, dbds.Id()); err != nil {
 		// TODO Check number of rows updated - what if this DS does not exist in the DB?
 		log.Printf("FlushDataSource(): database error: %v flushing data source %#v", err, ds)
-		return err
+		return pgTransient(err)
 	} else {
 		rows.Close()
 	}
@@ -690,6 +954,255 @@ func (p *pgSerDe) FlushDataSource(ds rrd.DataSourcer) error {
 	return nil
 }
 
+// flushRRAs writes the slots and exemplars of the RRAs, as many at
+// once as per SetRRAFlushParallelism. It returns the first error,
+// by then the other RRAs may or may not have been written.
+func (p *pgSerDe) flushRRAs(rras []DbRoundRobinArchiver, onChange bool, epsilon float64) error {
+	flush := func(rra DbRoundRobinArchiver) error {
+		if err := p.flushRoundRobinArchive(rra, onChange, epsilon); err != nil {
+			log.Printf("FlushDataSource(): error flushing RRA, probable data loss: %v", err)
+			return err
+		}
+		if err := p.flushExemplars(rra); err != nil {
+			log.Printf("FlushDataSource(): error flushing exemplars: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	if p.rraParallel <= 1 || len(rras) < 2 {
+		for _, rra := range rras {
+			if err := flush(rra); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(rras))
+	sem := make(chan bool, p.rraParallel)
+	for i, rra := range rras {
+		wg.Add(1)
+		sem <- true
+		go func(i int, rra DbRoundRobinArchiver) {
+			defer wg.Done()
+			errs[i] = flush(rra)
+			<-sem
+		}(i, rra)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushExemplars saves the exemplars of the slots being flushed, one
+// row per slot. A slot which has no exemplar this time around keeps
+// the one of the previous time around, which FetchExemplars leaves
+// out by its time stamp.
+func (p *pgSerDe) flushExemplars(rra DbRoundRobinArchiver) error {
+	dps := rra.DPs()
+	for n, e := range rra.Exemplars() {
+		if _, ok := dps[n]; !ok { // the slot has not ended
+			continue
+		}
+		labels := e.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labelsJson, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+		if _, err := p.sql9.Exec(rra.Id(), n, e.TimeStamp, e.Value, labelsJson); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchExemplars returns the exemplars of the RRA whose time stamps
+// are within from and to (inclusive), oldest first.
+func (p *pgSerDe) FetchExemplars(rraId int64, from, to time.Time) ([]rrd.Exemplar, error) {
+	rows, err := p.dbConn.Query(fmt.Sprintf("SELECT t, value, labels FROM %[1]sexemplar WHERE rra_id = $1 AND t >= $2 AND t <= $3 ORDER BY t", p.prefix), rraId, from, to)
+	if err != nil {
+		log.Printf("FetchExemplars(): database error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []rrd.Exemplar
+	for rows.Next() {
+		var (
+			e          rrd.Exemplar
+			labelsJson []byte
+		)
+		if err := rows.Scan(&e.TimeStamp, &e.Value, &labelsJson); err != nil {
+			log.Printf("FetchExemplars(): error scanning row: %v", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(labelsJson, &e.Labels); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// StoreAnnotation saves the annotation, a global one has an empty
+// ident ('{}').
+func (p *pgSerDe) StoreAnnotation(a Annotation) error {
+	if _, err := p.dbConn.Exec(fmt.Sprintf("INSERT INTO %[1]sannotation (ident, t, text) VALUES ($1, $2, $3)", p.prefix), a.Ident.String(), a.TimeStamp, a.Text); err != nil {
+		log.Printf("StoreAnnotation(): database error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchAnnotations returns the annotations of the ident and the
+// global ones whose time stamps are within from and to (inclusive),
+// oldest first.
+func (p *pgSerDe) FetchAnnotations(ident Ident, from, to time.Time) ([]Annotation, error) {
+	rows, err := p.dbConn.Query(fmt.Sprintf("SELECT ident, t, text FROM %[1]sannotation WHERE (ident = $1 OR ident = '{}') AND t >= $2 AND t <= $3 ORDER BY t", p.prefix), ident.String(), from, to)
+	if err != nil {
+		log.Printf("FetchAnnotations(): database error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Annotation
+	for rows.Next() {
+		var (
+			a         Annotation
+			identJson []byte
+		)
+		if err := rows.Scan(&identJson, &a.TimeStamp, &a.Text); err != nil {
+			log.Printf("FetchAnnotations(): error scanning row: %v", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(identJson, &a.Ident); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// pgTransient returns err as a TransientError if it is one of the
+// errors to expect during a failover or restart of the database: a
+// lost connection, the database being read only (e.g. a standby) or
+// shutting down, or a transaction rolled back. Otherwise err is
+// returned as is.
+func pgTransient(err error) error {
+	if err == driver.ErrBadConn {
+		return &TransientError{err}
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"25", // invalid transaction state, e.g. read only
+			"40", // transaction rollback
+			"53", // insufficient resources
+			"57": // operator intervention, e.g. shutting down
+			return &TransientError{err}
+		}
+	}
+	return err
+}
+
+// DeleteDataSource deletes the DS, its RRAs and their data points
+// go along by way of ON DELETE CASCADE.
+func (p *pgSerDe) DeleteDataSource(id int64) error {
+	if _, err := p.dbConn.Exec(fmt.Sprintf("DELETE FROM %[1]sds WHERE id = $1", p.prefix), id); err != nil {
+		log.Printf("DeleteDataSource(): database error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DataSourceExists looks the ident up using the unique index on it,
+// nothing is created.
+func (p *pgSerDe) DataSourceExists(ident Ident) (bool, error) {
+	var exists bool
+	if err := p.dbConn.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %[1]sds WHERE ident = $1)", p.prefix), ident.String()).Scan(&exists); err != nil {
+		log.Printf("DataSourceExists(): database error: %v", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// RenameDataSource changes the ident of the DS, relying on the unique
+// index on ident to reject one which is already taken.
+func (p *pgSerDe) RenameDataSource(id int64, ident Ident) error {
+	res, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]sds SET ident = $1 WHERE id = $2", p.prefix), ident.String(), id)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+			return fmt.Errorf("a data source with ident %v already exists", ident)
+		}
+		log.Printf("RenameDataSource(): database error: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	return nil
+}
+
+// SetDataSourceLastUpdate sets the last update of the DS, the PDP
+// being discarded.
+func (p *pgSerDe) SetDataSourceLastUpdate(id int64, lastUpdate time.Time) error {
+	res, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]sds SET lastupdate = $1, value = 0, duration_ms = 0 WHERE id = $2", p.prefix), lastUpdate, id)
+	if err != nil {
+		log.Printf("SetDataSourceLastUpdate(): database error: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no data source with id %d", id)
+	}
+	return nil
+}
+
+// SetDataSourceMeta replaces the metadata of the DS, which is kept
+// in a separate table so that it is not loaded with every DS.
+func (p *pgSerDe) SetDataSourceMeta(id int64, meta map[string]string) error {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := p.dbConn.Exec(fmt.Sprintf("INSERT INTO %[1]sds_meta AS m (ds_id, meta) VALUES ($1, $2) "+
+		"ON CONFLICT (ds_id) DO UPDATE SET meta = $2", p.prefix), id, metaJson); err != nil {
+		log.Printf("SetDataSourceMeta(): database error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchDataSourceMeta returns the metadata of the DS, nil if there is
+// none.
+func (p *pgSerDe) FetchDataSourceMeta(id int64) (map[string]string, error) {
+	var metaJson []byte
+	err := p.dbConn.QueryRow(fmt.Sprintf("SELECT meta FROM %[1]sds_meta WHERE ds_id = $1", p.prefix), id).Scan(&metaJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("FetchDataSourceMeta(): database error: %v", err)
+		return nil, err
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(metaJson, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
 // FetchOrCreateDataSource loads or returns an existing DS. This is
 // done by using upserts first on the ds table, then for each
 // RRA. This method also attempt to create the TS empty rows with ON
@@ -731,6 +1244,8 @@ func (p *pgSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.
 			cf = "MAX"
 		case rrd.LAST:
 			cf = "LAST"
+		case rrd.PERCENTILE:
+			cf = rrd.PercentileName(rraSpec.Percentile)
 		}
 		rraRows, err := p.sql5.Query(ds.Id(), cf, steps, size, rraSpec.Xff)
 		if err != nil {
@@ -743,6 +1258,7 @@ func (p *pgSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.
 			log.Printf("FetchOrCreateDataSource(): error2: %v", err)
 			return nil, err
 		}
+		p.forgetSlots(rra.Id())
 		rras = append(rras, rra)
 
 		// sql1 UPSERT obsoletes the need for this
@@ -0,0 +1,108 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_pgSerDe_trimKnown(t *testing.T) {
+	nan := math.NaN()
+	type row struct {
+		start, end int64
+		write      bool
+	}
+	// Two rows of 4 slots, db is what was written before, dps is
+	// what is being flushed now.
+	for _, c := range []struct {
+		name    string
+		db, dps []float64
+		expect  [2]row
+	}{
+		{"all NaN",
+			[]float64{nan, nan, nan, nan, nan, nan, nan, nan},
+			[]float64{nan, nan, nan, nan, nan, nan, nan, nan},
+			[2]row{{write: false}, {write: false}}},
+		{"leading NaN",
+			[]float64{nan, nan, 1, 1, 1, 1, 1, 1},
+			[]float64{nan, nan, 2, 2, 2, 2, 2, 2},
+			[2]row{{2, 3, true}, {0, 3, true}}},
+		{"trailing NaN",
+			[]float64{1, 1, 1, 1, 1, 1, nan, nan},
+			[]float64{2, 2, 2, 2, 2, 2, nan, nan},
+			[2]row{{0, 3, true}, {0, 1, true}}},
+		{"NaN crossing a row boundary",
+			[]float64{1, 1, nan, nan, nan, nan, 1, 1},
+			[]float64{2, 2, nan, nan, nan, nan, 2, 2},
+			[2]row{{0, 1, true}, {2, 3, true}}},
+		{"NaN in the middle is written",
+			[]float64{1, nan, nan, 1, 1, 1, 1, 1},
+			[]float64{2, nan, nan, 2, 2, 2, 2, 2},
+			[2]row{{0, 3, true}, {0, 3, true}}},
+		{"NaN not yet in the db is written",
+			[]float64{1, 1, 1, 1, 1, 1, 1, 1},
+			[]float64{nan, 2, 2, 2, 2, 2, 2, nan},
+			[2]row{{0, 3, true}, {0, 3, true}}},
+		{"no longer NaN is written",
+			[]float64{nan, nan, nan, nan, nan, nan, nan, nan},
+			[]float64{nan, nan, 2, nan, nan, nan, nan, nan},
+			[2]row{{2, 2, true}, {write: false}}},
+	} {
+		rra, err := NewDbRoundRobinArchive(1, 4, rrd.RRASpec{Function: rrd.WMEAN, Step: time.Second, Span: 8 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &pgSerDe{skipNaN: true, nanSlots: make(map[int64][]uint64)}
+		for i, v := range c.db {
+			rra.DPs()[int64(i)] = v
+		}
+		p.markNaNSlots(rra, 0, 0, 3)
+		p.markNaNSlots(rra, 1, 0, 3)
+		for i, v := range c.dps {
+			rra.DPs()[int64(i)] = v
+		}
+		for n, expect := range c.expect {
+			start, end, write := p.trimKnown(rra, false, 0, int64(n), 0, 3)
+			if write != expect.write || write && (start != expect.start || end != expect.end) {
+				t.Errorf("trimKnown: %s: row %d: expected %v, got {%d %d %v}", c.name, n, expect, start, end, write)
+			}
+		}
+	}
+}
+
+func Test_writtenSlots(t *testing.T) {
+	nan := math.NaN()
+	ws := &writtenSlots{known: make([]uint64, 2), value: nan}
+	ws.mark(70, 1, 0.5)
+	ws.mark(3, 1, 0.5)
+	if !ws.unchanged(70, 1.2, 0.5) || !ws.unchanged(3, 1, 0.5) || ws.unchanged(4, 1, 0.5) {
+		t.Errorf("writtenSlots: expected slots 3 and 70 to be 1, got %v", ws)
+	}
+	// Written within epsilon, the slot is no longer exactly value
+	ws.mark(3, 1.2, 0.5)
+	if ws.unchanged(3, 1.2, 0.5) || !ws.unchanged(70, 1, 0.5) {
+		t.Errorf("writtenSlots: expected only slot 70 to be known, got %v", ws)
+	}
+	// A new value forgets all others
+	ws.mark(4, nan, 0.5)
+	if ws.unchanged(70, 1, 0.5) || !ws.unchanged(4, nan, 0.5) || ws.unchanged(4, 1, 0.5) {
+		t.Errorf("writtenSlots: expected only slot 4 to be known as NaN, got %v", ws)
+	}
+}
@@ -0,0 +1,157 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"golang.org/x/time/rate"
+)
+
+// DefaultFlushBacklog is the number of flushes a rate limited Flusher
+// queues unless told otherwise, see NewRateLimitedFlusher.
+const DefaultFlushBacklog = 65536
+
+// rateLimitedFlushRetry is how long a rate limited Flusher waits
+// before retrying a flush which failed with a transient error.
+var rateLimitedFlushRetry = time.Second
+
+// rateLimitedFlusher is a Flusher which passes flushes on to another
+// at a limited rate, see NewRateLimitedFlusher.
+type rateLimitedFlusher struct {
+	flusher Flusher
+	limiter *rate.Limiter // nil means no limit
+	queue   chan rrd.DataSourcer
+	dropped int64 // atomic
+	lagging int32 // atomic, 1 while flushes are being dropped
+	ctx     context.Context
+	stop    context.CancelFunc
+	done    chan bool // closed when run returns
+}
+
+// NewRateLimitedFlusher returns a Flusher which flushes to f at no
+// more than perSecond DSs per second (no limit if 0 or less),
+// independently of any other Flusher and of the receiver
+// MaxFlushRatePerSecond, which limits the flushes of the receiver as
+// a whole. It is meant for the backends of NewMultiFlusher which
+// cannot sustain the write rate of the primary one: FlushDataSource
+// queues a copy of the DS and returns right away, and a goroutine
+// passes the queued flushes on to f in order, thus a slow backend
+// lags behind rather than holds up the others. Up to backlog flushes
+// (DefaultFlushBacklog if 0 or less) are queued, beyond that a
+// backend lagging too far behind does not get the flushes, which are
+// counted (see Dropped, which the receiver reports as the
+// serde.flushes_dropped stat) and logged. A flush which fails with a
+// transient error (see IsTransient) is retried until it succeeds,
+// holding up those behind it, other errors are logged and lose the
+// flush. The goroutine runs until Stop (which the receiver calls once
+// its flushers are stopped), flushes still queued then are dropped.
+func NewRateLimitedFlusher(f Flusher, perSecond, backlog int) *rateLimitedFlusher {
+	if backlog <= 0 {
+		backlog = DefaultFlushBacklog
+	}
+	rf := &rateLimitedFlusher{flusher: f, queue: make(chan rrd.DataSourcer, backlog), done: make(chan bool)}
+	if perSecond > 0 {
+		rf.limiter = rate.NewLimiter(rate.Limit(perSecond), perSecond)
+	}
+	rf.ctx, rf.stop = context.WithCancel(context.Background())
+	go rf.run()
+	return rf
+}
+
+func (rf *rateLimitedFlusher) FlushDataSource(ds rrd.DataSourcer) error {
+	if rf.ctx.Err() != nil { // stopped
+		atomic.AddInt64(&rf.dropped, 1)
+		return nil
+	}
+	select {
+	case rf.queue <- ds.Copy():
+	default:
+		atomic.AddInt64(&rf.dropped, 1)
+		if atomic.CompareAndSwapInt32(&rf.lagging, 0, 1) {
+			log.Printf("rateLimitedFlusher: backlog of %d flushes is full, dropping flushes until it catches up.", cap(rf.queue))
+		}
+	}
+	return nil
+}
+
+// Stop stops the goroutine passing the flushes on, once the flush in
+// progress (if any) is done. The flushes still queued are dropped,
+// as are those of any later FlushDataSource. It is safe to call more
+// than once.
+func (rf *rateLimitedFlusher) Stop() {
+	rf.stop()
+	<-rf.done
+	if n := len(rf.queue); n > 0 {
+		atomic.AddInt64(&rf.dropped, int64(n))
+		log.Printf("rateLimitedFlusher: stopped, dropping %d queued flushes.", n)
+		for len(rf.queue) > 0 {
+			<-rf.queue
+		}
+	}
+}
+
+// Backlog returns the number of flushes queued.
+func (rf *rateLimitedFlusher) Backlog() int {
+	return len(rf.queue)
+}
+
+// Dropped returns the number of flushes dropped because the backlog
+// was full or the Flusher was stopped.
+func (rf *rateLimitedFlusher) Dropped() int64 {
+	return atomic.LoadInt64(&rf.dropped)
+}
+
+func (rf *rateLimitedFlusher) run() {
+	defer close(rf.done)
+	for rf.ctx.Err() == nil {
+		var ds rrd.DataSourcer
+		select {
+		case <-rf.ctx.Done():
+			return
+		case ds = <-rf.queue:
+		}
+		if rf.limiter != nil {
+			if err := rf.limiter.Wait(rf.ctx); err != nil { // stopped
+				atomic.AddInt64(&rf.dropped, 1)
+				return
+			}
+		}
+		for {
+			err := rf.flusher.FlushDataSource(ds)
+			if err == nil {
+				break
+			}
+			if !IsTransient(err) {
+				log.Printf("rateLimitedFlusher: error flushing data source %v: %v", ds, err)
+				break
+			}
+			select {
+			case <-rf.ctx.Done():
+				atomic.AddInt64(&rf.dropped, 1)
+				return
+			case <-time.After(rateLimitedFlushRetry):
+			}
+		}
+		if len(rf.queue) == 0 && atomic.CompareAndSwapInt32(&rf.lagging, 1, 0) {
+			log.Printf("rateLimitedFlusher: caught up, %d flushes dropped so far.", atomic.LoadInt64(&rf.dropped))
+		}
+	}
+}
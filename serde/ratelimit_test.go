@@ -0,0 +1,114 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+type fakeFlusher struct {
+	sync.Mutex
+	flushed int
+	block   chan bool // if not nil, FlushDataSource waits for it
+}
+
+func (f *fakeFlusher) FlushDataSource(ds rrd.DataSourcer) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.flushed++
+	return nil
+}
+
+func (f *fakeFlusher) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.flushed
+}
+
+func newTestDS() rrd.DataSourcer {
+	return NewDbDataSource(1, Ident{"name": "foo"}, rrd.NewDataSource(rrd.DSSpec{Step: time.Second}))
+}
+
+func Test_rateLimitedFlusher_limit(t *testing.T) {
+	f := &fakeFlusher{}
+	// A burst of 10, then 10 per second
+	rf := NewRateLimitedFlusher(f, 10, 0)
+	defer rf.Stop()
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		rf.FlushDataSource(newTestDS())
+	}
+	for i := 0; i < 1000 && f.count() < 15; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := f.count(); n != 15 {
+		t.Fatalf("rateLimitedFlusher: expected 15 flushes, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("rateLimitedFlusher: 5 flushes past the burst should take about 500ms, took %v", elapsed)
+	}
+	if rf.Dropped() != 0 {
+		t.Errorf("rateLimitedFlusher: expected none dropped, got %d", rf.Dropped())
+	}
+}
+
+func Test_rateLimitedFlusher_dropped(t *testing.T) {
+	f := &fakeFlusher{block: make(chan bool)}
+	rf := NewRateLimitedFlusher(f, 0, 2)
+	// The first one is taken by the goroutine, which waits for
+	// block, the next two fill the backlog.
+	rf.FlushDataSource(newTestDS())
+	for i := 0; i < 100 && rf.Backlog() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		rf.FlushDataSource(newTestDS())
+	}
+	if rf.Backlog() != 2 || rf.Dropped() != 3 {
+		t.Errorf("rateLimitedFlusher: expected 2 queued and 3 dropped, got %d and %d", rf.Backlog(), rf.Dropped())
+	}
+	var m FlushDropper = NewMultiFlusher(&fakeFlusher{}, rf).(FlushDropper)
+	if m.Dropped() != 3 {
+		t.Errorf("multiFlusher: expected 3 dropped, got %d", m.Dropped())
+	}
+
+	// Stop waits for the flush in progress and drops the queued ones
+	stopped := make(chan bool)
+	go func() {
+		rf.Stop()
+		close(stopped)
+	}()
+	for i := 0; i < 100 && rf.ctx.Err() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	f.block <- true
+	<-stopped
+	if f.count() != 1 || rf.Backlog() != 0 || rf.Dropped() != 5 {
+		t.Errorf("Stop: expected 1 flushed, 0 queued and 5 dropped, got %d, %d and %d", f.count(), rf.Backlog(), rf.Dropped())
+	}
+	rf.FlushDataSource(newTestDS())
+	if rf.Dropped() != 6 {
+		t.Errorf("Stop: expected a flush after Stop to be dropped, got %d dropped", rf.Dropped())
+	}
+	rf.Stop() // again is fine
+}
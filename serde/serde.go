@@ -18,6 +18,8 @@
 package serde
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
@@ -51,10 +53,171 @@ type Fetcher interface {
 	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
 }
 
+// DataSourceExister is implemented by a Fetcher which can tell
+// whether a DS exists without creating it, which
+// FetchOrCreateDataSource would.
+type DataSourceExister interface {
+	// DataSourceExists returns whether there is a DS with the ident.
+	DataSourceExists(ident Ident) (bool, error)
+}
+
+// DataSourceMetaStorer is implemented by a Fetcher which can store
+// descriptive metadata of a DS (e.g. unit, description), which is
+// not part of its ident.
+type DataSourceMetaStorer interface {
+	// SetDataSourceMeta replaces the metadata of the DS.
+	SetDataSourceMeta(id int64, meta map[string]string) error
+	// FetchDataSourceMeta returns the metadata of the DS, nil if
+	// there is none.
+	FetchDataSourceMeta(id int64) (map[string]string, error)
+}
+
+// DataSourceRenamer is implemented by a Fetcher which can change the
+// ident of a DS, keeping its data.
+type DataSourceRenamer interface {
+	// RenameDataSource changes the ident of the DS, it fails if
+	// there already is a DS with the new ident.
+	RenameDataSource(id int64, ident Ident) error
+}
+
+// DataSourceLastUpdateSetter is implemented by a Fetcher which can
+// overwrite the last update of a DS, e.g. to repair it.
+type DataSourceLastUpdateSetter interface {
+	// SetDataSourceLastUpdate sets the last update of the DS and
+	// discards its PDP, leaving its RRAs as they are.
+	SetDataSourceLastUpdate(id int64, lastUpdate time.Time) error
+}
+
+// ExemplarFetcher is implemented by a Fetcher which saves the
+// exemplars of the RRA slots it flushes, see rrd.Exemplar.
+type ExemplarFetcher interface {
+	// FetchExemplars returns the exemplars of the RRA whose time
+	// stamps are within from and to, oldest first.
+	FetchExemplars(rraId int64, from, to time.Time) ([]rrd.Exemplar, error)
+}
+
+// An Annotation is a time stamped text event, e.g. a deploy marker,
+// which belongs to the series identified by Ident, or to no series in
+// particular (a global one) if Ident is empty.
+type Annotation struct {
+	Ident     Ident
+	TimeStamp time.Time
+	Text      string
+}
+
+// AnnotationStorer is implemented by a Fetcher which can store
+// annotations, apart from the data of the DSs.
+type AnnotationStorer interface {
+	// StoreAnnotation saves the annotation.
+	StoreAnnotation(a Annotation) error
+	// FetchAnnotations returns the annotations of the ident, along
+	// with the global ones, whose time stamps are within from and
+	// to, oldest first. With an empty ident only the global ones
+	// are returned.
+	FetchAnnotations(ident Ident, from, to time.Time) ([]Annotation, error)
+}
+
+// MetaRateUnit is the DS metadata key of the unit of time the values
+// of the DS are a rate per (rrd.DSSpec.RateUnit), as a duration
+// string, e.g. "1s" for per second.
+const MetaRateUnit = "rate_unit"
+
+// RateUnit returns the rate unit recorded in meta, false if there is
+// none or it is not a valid duration.
+func RateUnit(meta map[string]string) (time.Duration, bool) {
+	d, err := time.ParseDuration(meta[MetaRateUnit])
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// MetaKind is the DS metadata key of the kind of data points the DS
+// receives, "counter" or "gauge", see
+// receiver.Receiver.TypeConflictPolicy.
+const MetaKind = "kind"
+
 type Flusher interface {
 	FlushDataSource(ds rrd.DataSourcer) error
 }
 
+// A TransientError is an error which is expected to go away by
+// itself shortly, e.g. a write failing because the database is read
+// only during a failover. The receiver holds on to the data of a DS
+// which failed to flush with such an error and keeps retrying,
+// whereas other flush errors lose the data.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string   { return e.Err.Error() }
+func (e *TransientError) Temporary() bool { return true }
+
+// IsTransient tells whether err is transient, i.e. it has a
+// Temporary method which returns true, as a TransientError (or a
+// temporary net.Error) does.
+func IsTransient(err error) bool {
+	te, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && te.Temporary()
+}
+
+// SchemaVersion is the version of the database schema this version of
+// Tgres expects. It is incremented whenever the schema changes in a
+// way that older versions could not work with.
+const SchemaVersion = 1
+
+// SchemaVersioner is implemented by a SerDe whose storage has a
+// schema, the receiver refuses to start if it is not SchemaVersion.
+type SchemaVersioner interface {
+	SchemaVersion() (int, error)
+}
+
+// Pinger is implemented by a SerDe whose storage can become
+// unreachable, the receiver refuses to start if Ping fails.
+type Pinger interface {
+	Ping() error
+}
+
+// NaNRepresentation is how a SerDe stores the slots whose value is
+// unknown (NaN), for a storage which does not keep NaN as such.
+type NaNRepresentation int
+
+const (
+	NaNAsNaN      NaNRepresentation = iota // the float NaN (default)
+	NaNAsNull                              // NULL
+	NaNAsSentinel                          // a sentinel value, e.g. -1e308
+)
+
+// ParseNaNRepresentation converts "nan", "null" or "sentinel" (case
+// insensitive) to a NaNRepresentation. Empty string is the same as
+// "nan".
+func ParseNaNRepresentation(s string) (NaNRepresentation, error) {
+	switch strings.ToLower(s) {
+	case "", "nan":
+		return NaNAsNaN, nil
+	case "null":
+		return NaNAsNull, nil
+	case "sentinel":
+		return NaNAsSentinel, nil
+	}
+	return NaNAsNaN, fmt.Errorf("Invalid NaN representation: %q (valid: nan, null, sentinel)", s)
+}
+
+// NaNRepresenter is implemented by a SerDe whose representation of
+// unknown slots is configurable. Slots are written as rep, sentinel
+// being the value of NaNAsSentinel, and read back as NaN, thus the
+// same representation must be used by everything sharing the
+// storage. Only the current sentinel reads back as NaN: slots written
+// with another sentinel, or with NaNAsSentinel before switching to
+// another representation, read back as that (real) value, and a real
+// value equal to the sentinel reads back as NaN. It must be called
+// before any flushing.
+type NaNRepresenter interface {
+	SetNaNRepresentation(rep NaNRepresentation, sentinel float64)
+}
+
 type SerDe interface {
 	Fetcher() Fetcher
 	Flusher() Flusher
@@ -69,3 +232,127 @@ type DbSerDe interface {
 	SerDe
 	DbAddresser() DbAddresser
 }
+
+// A FlushDropper is a Flusher which can drop flushes rather than
+// pass them on, e.g. one returned by NewRateLimitedFlusher. Dropped
+// returns how many it has dropped so far.
+type FlushDropper interface {
+	Dropped() int64
+}
+
+// A FlushStopper is a Flusher which runs goroutines of its own, e.g.
+// one returned by NewRateLimitedFlusher. Stop stops them, the Flusher
+// must not be used afterwards.
+type FlushStopper interface {
+	Stop()
+}
+
+// multiFlusher is a Flusher which flushes to several Flushers.
+type multiFlusher []Flusher
+
+// NewMultiFlusher returns a Flusher which flushes a DS to every one
+// of the given Flushers. All of them are attempted, the first error
+// encountered is returned.
+func NewMultiFlusher(flushers ...Flusher) Flusher {
+	return multiFlusher(flushers)
+}
+
+func (m multiFlusher) FlushDataSource(ds rrd.DataSourcer) error {
+	var result error
+	for _, f := range m {
+		if err := f.FlushDataSource(ds); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Dropped returns the sum of Dropped of the Flushers which are
+// FlushDroppers.
+func (m multiFlusher) Dropped() int64 {
+	var n int64
+	for _, f := range m {
+		if fd, ok := f.(FlushDropper); ok {
+			n += fd.Dropped()
+		}
+	}
+	return n
+}
+
+// Stop stops the Flushers which are FlushStoppers.
+func (m multiFlusher) Stop() {
+	for _, f := range m {
+		if fs, ok := f.(FlushStopper); ok {
+			fs.Stop()
+		}
+	}
+}
+
+// flusherSerDe is a SerDe with its Flusher replaced.
+type flusherSerDe struct {
+	SerDe
+	flusher Flusher
+}
+
+// WithFlusher returns a SerDe which is sd, except that its Flusher()
+// returns f.
+func WithFlusher(sd SerDe, f Flusher) SerDe {
+	return &flusherSerDe{SerDe: sd, flusher: f}
+}
+
+func (s *flusherSerDe) Flusher() Flusher { return s.flusher }
+
+// SetMaxOpenConns passes n on to the underlying SerDe, if it supports
+// it.
+func (s *flusherSerDe) SetMaxOpenConns(n int) {
+	if ps, ok := s.SerDe.(interface {
+		SetMaxOpenConns(int)
+	}); ok {
+		ps.SetMaxOpenConns(n)
+	}
+}
+
+// SchemaVersion returns the schema version of the underlying SerDe,
+// SchemaVersion if it has none.
+func (s *flusherSerDe) SchemaVersion() (int, error) {
+	if sv, ok := s.SerDe.(SchemaVersioner); ok {
+		return sv.SchemaVersion()
+	}
+	return SchemaVersion, nil
+}
+
+// Ping pings the underlying SerDe, if it supports it.
+func (s *flusherSerDe) Ping() error {
+	if p, ok := s.SerDe.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// SetRRAFlushParallelism passes n on to the underlying SerDe, if it
+// supports it.
+func (s *flusherSerDe) SetRRAFlushParallelism(n int) {
+	if ps, ok := s.SerDe.(interface {
+		SetRRAFlushParallelism(int)
+	}); ok {
+		ps.SetRRAFlushParallelism(n)
+	}
+}
+
+// SetNaNRepresentation passes rep and sentinel on to the underlying
+// SerDe, if it supports it.
+func (s *flusherSerDe) SetNaNRepresentation(rep NaNRepresentation, sentinel float64) {
+	if ps, ok := s.SerDe.(NaNRepresenter); ok {
+		ps.SetNaNRepresentation(rep, sentinel)
+	}
+}
+
+// SetSkipNaNWrites passes skip on to the underlying SerDe, if it
+// supports it.
+func (s *flusherSerDe) SetSkipNaNWrites(skip bool) {
+	if ps, ok := s.SerDe.(interface {
+		SetSkipNaNWrites(bool)
+	}); ok {
+		ps.SetSkipNaNWrites(skip)
+	}
+}
@@ -0,0 +1,145 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kisielk/whisper-go/whisper"
+	"github.com/tgres/tgres/rrd"
+)
+
+// whisperFlusher is a Flusher which writes data points to Graphite
+// whisper files.
+type whisperFlusher struct {
+	dir string
+}
+
+// NewWhisperFlusher returns a Flusher which writes flushed data to
+// whisper files in dir so that it can be read by Graphite. The file
+// path is derived from the GraphitePath of the DS ident, e.g. a DS
+// named foo.bar (without other tags) is written to dir/foo/bar.wsp.
+// Missing files are created with an archive per RRA. Only the points
+// of the highest resolution RRA are written, whisper aggregates them
+// into the lower resolution archives by itself.
+func NewWhisperFlusher(dir string) *whisperFlusher {
+	return &whisperFlusher{dir: dir}
+}
+
+func (f *whisperFlusher) FlushDataSource(ds rrd.DataSourcer) error {
+	dbds, ok := ds.(DbDataSourcer)
+	if !ok {
+		return fmt.Errorf("ds must be a DbDataSourcer to flush.")
+	}
+
+	rras := whisperSortedRRAs(ds.RRAs())
+	if len(rras) == 0 || rras[0].PointCount() == 0 {
+		return nil
+	}
+
+	path, err := whisperPath(f.dir, dbds.Ident())
+	if err != nil {
+		return err
+	}
+
+	w, err := whisperOpenOrCreate(path, rras)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	return w.UpdateMany(whisperPoints(rras[0]))
+}
+
+// whisperPath returns the whisper file path for a DS ident.
+func whisperPath(dir string, ident Ident) (string, error) {
+	if ident["name"] == "" {
+		return "", fmt.Errorf("whisperPath: ident without name tag")
+	}
+	name := GraphitePath(ident)
+	parts := strings.Split(strings.Replace(name, string(filepath.Separator), "_", -1), ".")
+	return filepath.Join(dir, filepath.Join(parts...)) + ".wsp", nil
+}
+
+// whisperSortedRRAs returns the RRAs sorted by step, highest
+// resolution first, which is the order whisper expects its archives in.
+func whisperSortedRRAs(rras []rrd.RoundRobinArchiver) []rrd.RoundRobinArchiver {
+	result := make(rrasByStep, len(rras))
+	copy(result, rras)
+	sort.Stable(result)
+	return result
+}
+
+type rrasByStep []rrd.RoundRobinArchiver
+
+func (r rrasByStep) Len() int           { return len(r) }
+func (r rrasByStep) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rrasByStep) Less(i, j int) bool { return r[i].Step() < r[j].Step() }
+
+// whisperArchives maps (sorted) RRAs to whisper archives. Whisper
+// precision is in seconds, therefore an RRA step must be a whole
+// number of seconds.
+func whisperArchives(rras []rrd.RoundRobinArchiver) ([]whisper.ArchiveInfo, error) {
+	result := make([]whisper.ArchiveInfo, 0, len(rras))
+	for _, rra := range rras {
+		if rra.Step() < time.Second || rra.Step()%time.Second != 0 {
+			return nil, fmt.Errorf("whisperArchives: RRA step (%v) must be whole seconds", rra.Step())
+		}
+		result = append(result, whisper.NewArchiveInfo(uint32(rra.Step()/time.Second), uint32(rra.Size())))
+	}
+	return result, nil
+}
+
+// whisperPoints returns the data points of an RRA as whisper
+// points. Whisper time stamps mark the beginning of a slot, whereas
+// ours mark the end. NaNs are skipped, whisper has no notion of them.
+func whisperPoints(rra rrd.RoundRobinArchiver) []whisper.Point {
+	result := make([]whisper.Point, 0, len(rra.DPs()))
+	for n, v := range rra.DPs() {
+		if math.IsNaN(v) {
+			continue
+		}
+		slotEnd := rrd.SlotTime(n, rra.Latest(), rra.Step(), rra.Size())
+		result = append(result, whisper.NewPoint(slotEnd.Add(-rra.Step()), v))
+	}
+	return result
+}
+
+func whisperOpenOrCreate(path string, rras []rrd.RoundRobinArchiver) (*whisper.Whisper, error) {
+	if _, err := os.Stat(path); err == nil {
+		return whisper.Open(path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	archives, err := whisperArchives(rras)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return whisper.Create(path, archives, whisper.CreateOptions{
+		XFilesFactor:      0.5,
+		AggregationMethod: whisper.AggregationAverage,
+	})
+}